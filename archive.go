@@ -0,0 +1,713 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveFormatZip   = "zip"
+	archiveFormatTar   = "tar"
+	archiveFormatTarGz = "tar.gz"
+)
+
+// ErrArchiveWriteOnly is returned when reading content from an ArchiveBackend created in writer mode
+var ErrArchiveWriteOnly = errors.New("archive is opened for writing")
+
+type (
+	// archiveEntry is a regular file of the archive
+	archiveEntry struct {
+		path         string
+		size         int64
+		lastModified time.Time
+		// zip entries are opened through the central directory
+		zipFile *zip.File
+		// tar entries are located by the offset of their data in the uncompressed stream
+		offset int64
+	}
+
+	// archiveIndex holds every regular file of the archive, sorted by path
+	archiveIndex struct {
+		format  string
+		file    *os.File
+		zip     *zip.Reader
+		entries []archiveEntry
+		byPath  map[string]int
+	}
+
+	// archiveWriter builds a new archive from PutObject calls
+	archiveWriter struct {
+		sync.Mutex
+		format  string
+		file    *os.File
+		gzip    *gzip.Writer
+		zip     *zip.Writer
+		tar     *tar.Writer
+		entries map[string]time.Time
+	}
+
+	// archiveCountingReader keeps track of the position in a tar stream
+	archiveCountingReader struct {
+		io.Reader
+		n int64
+	}
+
+	// archiveEntryReader reads an entry whose data is not seekable
+	archiveEntryReader struct {
+		io.Reader
+		closers []io.Closer
+	}
+
+	// archiveSectionReader reads an entry stored as is in the archive file
+	archiveSectionReader struct {
+		*io.SectionReader
+	}
+)
+
+func (r *archiveCountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *archiveEntryReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (r archiveSectionReader) Close() error {
+	return nil
+}
+
+type archiveListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []Metadata
+	isDir           map[string]bool
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &archiveListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+		isDir:  l.isDir,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the index is in memory, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, m := range entries {
+		if l.isDir[m.Path] {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *archiveListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// ArchiveBackend is a storage backend for a single .zip, .tar or .tar.gz file
+// It is read-only, unless it was created with NewArchiveWriterBackend to build a new archive
+type ArchiveBackend struct {
+	Path   string
+	Prefix string
+	index  *archiveIndex
+	writer *archiveWriter
+}
+
+// NewArchiveBackend creates a new instance of ArchiveBackend reading the archive at path
+// The format is detected from the content of the file; zip archives are read through their
+// central directory, tar archives are scanned once to locate every entry
+func NewArchiveBackend(path string, prefix string) *ArchiveBackend {
+	index, err := openArchiveIndex(path)
+	if err != nil {
+		panic("Failed to open archive: " + err.Error())
+	}
+
+	b := &ArchiveBackend{
+		Path:   path,
+		Prefix: cleanPrefix(prefix),
+		index:  index,
+	}
+	return b
+}
+
+// NewArchiveWriterBackend creates a new instance of ArchiveBackend writing a new archive at path
+// The format is chosen from the extension of path (.zip, .tar, .tar.gz or .tgz); objects can only be
+// added with PutObject and PutObjectStream, and the archive is complete once Close is called
+func NewArchiveWriterBackend(path string, prefix string) *ArchiveBackend {
+	format := archiveFormatFromName(path)
+	if format == "" {
+		panic("Failed to create archive: unknown archive extension " + path)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		panic("Failed to create archive: " + err.Error())
+	}
+
+	writer := &archiveWriter{
+		format:  format,
+		file:    file,
+		entries: map[string]time.Time{},
+	}
+	switch format {
+	case archiveFormatZip:
+		writer.zip = zip.NewWriter(file)
+	case archiveFormatTarGz:
+		writer.gzip = gzip.NewWriter(file)
+		writer.tar = tar.NewWriter(writer.gzip)
+	default:
+		writer.tar = tar.NewWriter(file)
+	}
+
+	b := &ArchiveBackend{
+		Path:   path,
+		Prefix: cleanPrefix(prefix),
+		writer: writer,
+	}
+	return b
+}
+
+func archiveFormatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return archiveFormatZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveFormatTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return archiveFormatTar
+	}
+	return ""
+}
+
+// archiveEntryPath normalizes the name of an entry, returning false for entries that are not below the archive root
+func archiveEntryPath(name string) (string, bool) {
+	name = pathutil.Clean("/" + strings.TrimPrefix(name, "./"))
+	name = strings.TrimPrefix(name, "/")
+	return name, name != "" && name != "."
+}
+
+func openArchiveIndex(path string) (*archiveIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &archiveIndex{
+		file:   file,
+		byPath: map[string]int{},
+	}
+
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		index.format = archiveFormatZip
+		err = index.readZip()
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		index.format = archiveFormatTarGz
+		err = index.readTar()
+	default:
+		index.format = archiveFormatTar
+		err = index.readTar()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	sort.Slice(index.entries, func(i, j int) bool {
+		return index.entries[i].path < index.entries[j].path
+	})
+	for i, e := range index.entries {
+		index.byPath[e.path] = i
+	}
+	return index, nil
+}
+
+func (index *archiveIndex) add(entry archiveEntry) {
+	if i, ok := index.byPath[entry.path]; ok {
+		// the last entry with a name wins, as when extracting
+		index.entries[i] = entry
+		return
+	}
+	index.byPath[entry.path] = len(index.entries)
+	index.entries = append(index.entries, entry)
+}
+
+func (index *archiveIndex) readZip() error {
+	info, err := index.file.Stat()
+	if err != nil {
+		return err
+	}
+	index.zip, err = zip.NewReader(index.file, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, f := range index.zip.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		path, ok := archiveEntryPath(f.Name)
+		if !ok {
+			continue
+		}
+		index.add(archiveEntry{
+			path:         path,
+			size:         int64(f.UncompressedSize64),
+			lastModified: f.Modified,
+			zipFile:      f,
+		})
+	}
+	return nil
+}
+
+// readTar scans the tar stream once, recording where the data of every regular file starts
+func (index *archiveIndex) readTar() error {
+	stream, closer, err := index.tarStream()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	counter := &archiveCountingReader{Reader: stream}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		path, ok := archiveEntryPath(header.Name)
+		if !ok {
+			continue
+		}
+		// the tar reader has consumed the header blocks only, the data starts here
+		index.add(archiveEntry{
+			path:         path,
+			size:         header.Size,
+			lastModified: header.ModTime,
+			offset:       counter.n,
+		})
+	}
+}
+
+// tarStream opens the uncompressed tar stream from its beginning
+func (index *archiveIndex) tarStream() (io.Reader, io.Closer, error) {
+	file, err := os.Open(index.file.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+	if index.format != archiveFormatTarGz {
+		return bufio.NewReader(file), file, nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return gz, &archiveEntryReader{closers: []io.Closer{gz, file}}, nil
+}
+
+// open returns a reader of the content of an entry
+// Entries stored without compression are seekable; a tar.gz entry is reached by decompressing the stream up to it
+func (index *archiveIndex) open(entry archiveEntry) (io.ReadCloser, error) {
+	switch index.format {
+	case archiveFormatZip:
+		if entry.zipFile.Method == zip.Store {
+			offset, err := entry.zipFile.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			return archiveSectionReader{io.NewSectionReader(index.file, offset, entry.size)}, nil
+		}
+		return entry.zipFile.Open()
+	case archiveFormatTar:
+		return archiveSectionReader{io.NewSectionReader(index.file, entry.offset, entry.size)}, nil
+	}
+
+	stream, closer, err := index.tarStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, stream, entry.offset); err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return &archiveEntryReader{
+		Reader:  io.LimitReader(stream, entry.size),
+		closers: []io.Closer{closer},
+	}, nil
+}
+
+// Close releases the archive file; in writer mode, it completes the archive
+func (b ArchiveBackend) Close() error {
+	if b.writer != nil {
+		return b.writer.close()
+	}
+	return b.index.file.Close()
+}
+
+func (w *archiveWriter) close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	var err error
+	if w.zip != nil {
+		err = w.zip.Close()
+	} else {
+		err = w.tar.Close()
+		if w.gzip != nil && err == nil {
+			err = w.gzip.Close()
+		}
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *archiveWriter) put(path string, content []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, ok := w.entries[path]; ok {
+		return fmt.Errorf("%s: %w", path, ErrNewPathNotEmpty)
+	}
+
+	now := time.Now()
+	if w.zip != nil {
+		f, err := w.zip.CreateHeader(&zip.FileHeader{
+			Name:     path,
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(content); err != nil {
+			return err
+		}
+	} else {
+		err := w.tar.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path,
+			Size:     int64(len(content)),
+			Mode:     0644,
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.tar.Write(content); err != nil {
+			return err
+		}
+	}
+	w.entries[path] = now
+	return nil
+}
+
+// metadata returns every object of the archive, at prefix
+func (b ArchiveBackend) metadata() []Metadata {
+	var objects []Metadata
+	if b.writer != nil {
+		b.writer.Lock()
+		for path, lastModified := range b.writer.entries {
+			objects = append(objects, Metadata{Path: path, LastModified: lastModified})
+		}
+		b.writer.Unlock()
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i].Path < objects[j].Path
+		})
+	} else {
+		for _, e := range b.index.entries {
+			objects = append(objects, Metadata{Path: e.path, LastModified: e.lastModified})
+		}
+	}
+	return objects
+}
+
+// children lists the direct children of the directory at prefix, directories take the time of their newest object
+func (b ArchiveBackend) children(prefix string) ([]Metadata, map[string]bool) {
+	dir := cleanPrefix(pathutil.Join(b.Prefix, prefix))
+	if dir != "" {
+		dir += "/"
+	}
+
+	var children []Metadata
+	isDir := map[string]bool{}
+	position := map[string]int{}
+	for _, m := range b.metadata() {
+		if !strings.HasPrefix(m.Path, dir) {
+			continue
+		}
+		name := strings.TrimPrefix(m.Path, dir)
+		childPath := pathutil.Join(prefix, name)
+		if i := strings.Index(name, "/"); i >= 0 {
+			childPath = pathutil.Join(prefix, name[:i])
+			isDir[childPath] = true
+		}
+		if p, ok := position[childPath]; ok {
+			if m.LastModified.After(children[p].LastModified) {
+				children[p].LastModified = m.LastModified
+			}
+			continue
+		}
+		position[childPath] = len(children)
+		children = append(children, Metadata{Path: childPath, LastModified: m.LastModified})
+	}
+	return children, isDir
+}
+
+// ListObjects lists all objects in the archive, at prefix
+func (b ArchiveBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	children, isDir := b.children(prefix)
+	for _, m := range children {
+		if isDir[m.Path] {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         removePrefixFromObjectPath(cleanPrefix(prefix), m.Path),
+				LastModified: m.LastModified,
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+// Directories are implied by the paths of the entries, their modification time is the one of their newest object
+func (b ArchiveBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if b.index != nil {
+		if _, ok := b.index.byPath[cleanPrefix(pathutil.Join(b.Prefix, prefix))]; ok && cleanPrefix(prefix) != "" {
+			return nil, ErrPrefixIsAnObject
+		}
+	}
+
+	children, isDir := b.children(prefix)
+	output := &archiveListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		entries: children,
+		isDir:   isDir,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject is not supported, entries of an archive cannot be moved
+func (b ArchiveBackend) RenamePrefixOrObject(path, newPath string) error {
+	if b.writer != nil {
+		return ErrNotImplemented
+	}
+	return ErrReadOnly
+}
+
+// GetObject retrieves an object from the archive, at prefix
+func (b ArchiveBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject adds an object to an archive created with NewArchiveWriterBackend, at prefix
+// Every path can only be written once
+func (b ArchiveBackend) PutObject(path string, content []byte) error {
+	if b.writer == nil {
+		return ErrReadOnly
+	}
+	entryPath, ok := archiveEntryPath(pathutil.Join(b.Prefix, path))
+	if !ok {
+		return fmt.Errorf("invalid archive entry path %q", path)
+	}
+	return b.writer.put(entryPath, content)
+}
+
+// DeleteObject is not supported, entries of an archive cannot be removed
+func (b ArchiveBackend) DeleteObject(path string) error {
+	if b.writer != nil {
+		return ErrNotImplemented
+	}
+	return ErrReadOnly
+}
+
+// GetObjectStream retrieves an object stream from the archive, at prefix
+func (b ArchiveBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	if b.writer != nil {
+		return object, ErrArchiveWriteOnly
+	}
+
+	i, ok := b.index.byPath[cleanPrefix(pathutil.Join(b.Prefix, path))]
+	if !ok {
+		return object, ErrObjectNotFound
+	}
+	entry := b.index.entries[i]
+
+	content, err := b.index.open(entry)
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = entry.lastModified
+	object.Content = content
+	return object, nil
+}
+
+// PutObjectStream adds an object stream to an archive created with NewArchiveWriterBackend, at prefix
+// tar headers need the size of the content, so the stream is read into memory first
+func (b ArchiveBackend) PutObjectStream(path string, content io.Reader) error {
+	if b.writer == nil {
+		return ErrReadOnly
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return b.PutObject(path, data)
+}
+
+func (b ArchiveBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer obj.Content.Close()
+
+	name := pathutil.Base(obj.Path)
+	if seeker, ok := obj.Content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, obj.LastModified, seeker)
+		return
+	}
+
+	// compressed entries are streamed without range support
+	entry := b.index.entries[b.index.byPath[cleanPrefix(pathutil.Join(b.Prefix, path))]]
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.size, 10))
+	w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, obj.Content)
+}
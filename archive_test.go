@@ -0,0 +1,232 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var archiveTestEntries = []struct {
+	name    string
+	content string
+}{
+	{"./bundle/index.yaml", "apiVersion: v1"},
+	{"./bundle/charts/a-0.1.0.tgz", "a"},
+	{"./bundle/charts/b-0.1.0.tgz", strings.Repeat("b", 1000)},
+	{"./bundle/charts/sub/c-0.1.0.tgz", "c"},
+	{"./bundle/charts/d-0.1.0.tgz", "d"},
+}
+
+type ArchiveTestSuite struct {
+	suite.Suite
+	TempDirectory   string
+	ArchiveBackends map[string]*ArchiveBackend
+}
+
+func (suite *ArchiveTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-archive/%s", timestamp)
+	suite.Nil(os.MkdirAll(suite.TempDirectory, 0777))
+
+	modTime := time.Date(2021, 3, 4, 12, 45, 0, 0, time.UTC)
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for i, e := range archiveTestEntries {
+		// alternate compressed and stored entries
+		method := zip.Deflate
+		if i%2 == 0 {
+			method = zip.Store
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: method, Modified: modTime})
+		suite.Nil(err)
+		f.Write([]byte(e.content))
+	}
+	zw.Close()
+	suite.Nil(ioutil.WriteFile(suite.TempDirectory+"/bundle.zip", zipBuf.Bytes(), 0644))
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./bundle/", Mode: 0755, ModTime: modTime})
+	for _, e := range archiveTestEntries {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: e.name, Size: int64(len(e.content)), Mode: 0644, ModTime: modTime})
+		tw.Write([]byte(e.content))
+	}
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "./bundle/link", Linkname: "index.yaml", ModTime: modTime})
+	tw.Close()
+	suite.Nil(ioutil.WriteFile(suite.TempDirectory+"/bundle.tar", tarBuf.Bytes(), 0644))
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	// the format is detected from the content, not from the name
+	suite.Nil(ioutil.WriteFile(suite.TempDirectory+"/bundle.bin", gzBuf.Bytes(), 0644))
+
+	suite.ArchiveBackends = map[string]*ArchiveBackend{
+		"zip":    NewArchiveBackend(suite.TempDirectory+"/bundle.zip", "bundle"),
+		"tar":    NewArchiveBackend(suite.TempDirectory+"/bundle.tar", "bundle"),
+		"tar.gz": NewArchiveBackend(suite.TempDirectory+"/bundle.bin", "bundle"),
+	}
+}
+
+func (suite *ArchiveTestSuite) TearDownSuite() {
+	for _, backend := range suite.ArchiveBackends {
+		backend.Close()
+	}
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *ArchiveTestSuite) TestGetObject() {
+	for format, backend := range suite.ArchiveBackends {
+		for _, e := range archiveTestEntries {
+			path := strings.TrimPrefix(e.name, "./bundle/")
+			object, err := backend.GetObject(path)
+			suite.Nil(err, "no error getting %s from %s", path, format)
+			suite.Equal(e.content, string(object.Content), "content of %s from %s", path, format)
+			suite.Equal(2021, object.LastModified.Year(), "modification time of %s from %s", path, format)
+		}
+
+		_, err := backend.GetObject("missing.yaml")
+		suite.ErrorIs(err, ErrObjectNotFound, "missing object in %s", format)
+		_, err = backend.GetObject("link")
+		suite.ErrorIs(err, ErrObjectNotFound, "only regular files are objects in %s", format)
+	}
+}
+
+func (suite *ArchiveTestSuite) TestReadOnly() {
+	for format, backend := range suite.ArchiveBackends {
+		suite.ErrorIs(backend.PutObject("new.txt", []byte("x")), ErrReadOnly, format)
+		suite.ErrorIs(backend.PutObjectStream("new.txt", bytes.NewReader(nil)), ErrReadOnly, format)
+		suite.ErrorIs(backend.DeleteObject("index.yaml"), ErrReadOnly, format)
+		suite.ErrorIs(backend.RenamePrefixOrObject("charts", "moved"), ErrReadOnly, format)
+	}
+}
+
+func (suite *ArchiveTestSuite) TestListObjects() {
+	for format, backend := range suite.ArchiveBackends {
+		objects, err := backend.ListObjects("charts")
+		suite.Nil(err, "no error listing objects in %s", format)
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.Path)
+		}
+		suite.Equal([]string{"a-0.1.0.tgz", "b-0.1.0.tgz", "d-0.1.0.tgz"}, names, "objects of %s at depth 1", format)
+	}
+}
+
+func (suite *ArchiveTestSuite) TestListObjectsFromDirectory() {
+	for format, backend := range suite.ArchiveBackends {
+		_, err := backend.ListObjectsFromDirectory("index.yaml", 0)
+		suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object in %s", format)
+
+		var files, directories []string
+		output, err := backend.ListObjectsFromDirectory("charts", 2)
+		for {
+			suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+			for _, d := range output.GetDirectories() {
+				directories = append(directories, d.Path)
+				suite.False(d.LastModified.IsZero(), "directories take the time of their objects")
+			}
+			for _, f := range output.GetFiles() {
+				files = append(files, f.Path)
+			}
+			if err == io.EOF {
+				break
+			}
+			suite.Nil(err, "no error listing page of %s", format)
+			output, err = output.NextPage()
+		}
+		suite.Equal([]string{"charts/sub"}, directories, "directories of %s", format)
+		suite.Equal([]string{"charts/a-0.1.0.tgz", "charts/b-0.1.0.tgz", "charts/d-0.1.0.tgz"}, files, "files of %s", format)
+	}
+}
+
+func (suite *ArchiveTestSuite) TestHandleHttpFileDownload() {
+	for format, backend := range suite.ArchiveBackends {
+		for _, path := range []string{"index.yaml", "charts/b-0.1.0.tgz"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/"+path, nil)
+			backend.HandleHttpFileDownload(w, r, path)
+			suite.Equal(http.StatusOK, w.Code, "%s is served from %s", path, format)
+			object, _ := backend.GetObject(path)
+			suite.Equal(object.Content, w.Body.Bytes())
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+		backend.HandleHttpFileDownload(w, r, "missing.txt")
+		suite.Equal(http.StatusNotFound, w.Code)
+	}
+
+	// stored entries support range requests
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	suite.ArchiveBackends["tar"].HandleHttpFileDownload(w, r, "index.yaml")
+	suite.Equal(http.StatusPartialContent, w.Code)
+	suite.Equal("apiVersion", w.Body.String())
+}
+
+func (suite *ArchiveTestSuite) TestWriter() {
+	for _, name := range []string{"out.zip", "out.tar", "out.tgz"} {
+		path := suite.TempDirectory + "/" + name
+		writer := NewArchiveWriterBackend(path, "bundle")
+		suite.Nil(writer.PutObject("index.yaml", []byte("apiVersion: v1")), name)
+		suite.Nil(writer.PutObjectStream("charts/a-0.1.0.tgz", strings.NewReader("a")), name)
+		suite.ErrorIs(writer.PutObject("index.yaml", []byte("again")), ErrNewPathNotEmpty, "entries are written once in %s", name)
+
+		objects, err := writer.ListObjects("charts")
+		suite.Nil(err)
+		suite.Len(objects, 1, "written objects are listed in %s", name)
+		_, err = writer.GetObject("index.yaml")
+		suite.ErrorIs(err, ErrArchiveWriteOnly, "content cannot be read back from %s", name)
+		suite.ErrorIs(writer.DeleteObject("index.yaml"), ErrNotImplemented)
+		suite.Nil(writer.Close(), "no error completing %s", name)
+
+		reader := NewArchiveBackend(path, "bundle")
+		object, err := reader.GetObject("charts/a-0.1.0.tgz")
+		suite.Nil(err, "written archive %s can be read", name)
+		suite.Equal([]byte("a"), object.Content)
+		suite.Nil(reader.Close())
+	}
+
+	suite.Panics(func() {
+		NewArchiveWriterBackend(suite.TempDirectory+"/out.zip", "")
+	}, "existing archives are not overwritten")
+	suite.Panics(func() {
+		NewArchiveWriterBackend(suite.TempDirectory+"/out.rar", "")
+	}, "unknown extensions are rejected")
+}
+
+func TestArchiveStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(ArchiveTestSuite))
+}
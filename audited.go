@@ -0,0 +1,364 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// AuditStarted is the result of the event recorded before a mutation, by the AuditedBackend failing closed
+	AuditStarted = "started"
+	// AuditSucceeded is the result of a mutation which succeeded
+	AuditSucceeded = "succeeded"
+	// AuditFailed is the result of a mutation which failed
+	AuditFailed = "failed"
+)
+
+// actorKey is the key of the actor in a context
+type actorKey struct{}
+
+type (
+	// AuditEvent is the record of a mutation made through an AuditedBackend
+	AuditEvent struct {
+		Time time.Time `json:"time"`
+		// Actor is who made the mutation, see WithActor
+		Actor     string `json:"actor,omitempty"`
+		Operation string `json:"operation"`
+		Path      string `json:"path"`
+		NewPath   string `json:"new_path,omitempty"`
+		// Size and Digest describe the content written by PutObject and PutObjectStream
+		Size   int64  `json:"size,omitempty"`
+		Digest string `json:"digest,omitempty"`
+		// Result is AuditStarted, AuditSucceeded or AuditFailed
+		Result string `json:"result"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	// AuditSink records the events of an AuditedBackend
+	AuditSink interface {
+		Record(event AuditEvent) error
+	}
+
+	// AuditedBackend is a Backend wrapper recording every mutation of the wrapped backend in an AuditSink
+	// Reads are not recorded
+	AuditedBackend struct {
+		Backend Backend
+		Sink    AuditSink
+		// Context holds the actor of the mutations, see WithContext and WithActor
+		Context context.Context
+		// FailClosed refuses the mutations which cannot be recorded: an event is recorded before every mutation,
+		// which is not made if the sink fails, and the failure to record its result is returned even though it was made;
+		// otherwise the mutations are made whatever the sink does, and its errors are passed to OnSinkError
+		FailClosed bool
+		// OnSinkError is called with the errors of the sink when failing open, e.g. to log them
+		OnSinkError func(error)
+	}
+
+	// JSONLinesAuditSink is an AuditSink appending the events to a local file, one JSON document per line
+	JSONLinesAuditSink struct {
+		Path  string
+		mutex *sync.Mutex
+		file  *os.File
+	}
+
+	// SlogAuditSink is an AuditSink logging the events with a slog.Logger
+	SlogAuditSink struct {
+		Logger *slog.Logger
+		Level  slog.Level
+	}
+
+	// BackendAuditSink is an AuditSink storing every event as its own JSON object in a Backend, under Prefix
+	// The objects are named after the time of the events, so that they are listed in order
+	BackendAuditSink struct {
+		Backend Backend
+		Prefix  string
+	}
+
+	// auditedReader hashes and counts the content of a stream
+	auditedReader struct {
+		io.Reader
+		hash hash.Hash
+		size int64
+	}
+)
+
+// WithActor returns a copy of ctx holding actor, who is recorded in the events of the mutations made with it
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor held by ctx, if any
+func ActorFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	actor, ok := ctx.Value(actorKey{}).(string)
+	return actor, ok
+}
+
+// NewAuditedBackend creates a new instance of AuditedBackend, recording the mutations in sink
+func NewAuditedBackend(backend Backend, sink AuditSink, failClosed bool) *AuditedBackend {
+	return &AuditedBackend{
+		Backend:    backend,
+		Sink:       sink,
+		Context:    context.Background(),
+		FailClosed: failClosed,
+	}
+}
+
+// NewJSONLinesAuditSink creates a new instance of JSONLinesAuditSink, appending to the file at path
+func NewJSONLinesAuditSink(path string) *JSONLinesAuditSink {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		panic("Failed to create audit log directory: " + err.Error())
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		panic("Failed to open audit log: " + err.Error())
+	}
+	return &JSONLinesAuditSink{
+		Path:  path,
+		mutex: &sync.Mutex{},
+		file:  file,
+	}
+}
+
+// Record appends an event to the file, and syncs it to disk
+func (s JSONLinesAuditSink) Record(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the file
+func (s JSONLinesAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// NewSlogAuditSink creates a new instance of SlogAuditSink, logging the events at the info level
+func NewSlogAuditSink(logger *slog.Logger) *SlogAuditSink {
+	return &SlogAuditSink{
+		Logger: logger,
+		Level:  slog.LevelInfo,
+	}
+}
+
+// Record logs an event, with its fields as attributes
+func (s SlogAuditSink) Record(event AuditEvent) error {
+	attrs := []slog.Attr{
+		slog.Time("time", event.Time),
+		slog.String("operation", event.Operation),
+		slog.String("path", event.Path),
+		slog.String("result", event.Result),
+	}
+	if event.Actor != "" {
+		attrs = append(attrs, slog.String("actor", event.Actor))
+	}
+	if event.NewPath != "" {
+		attrs = append(attrs, slog.String("new_path", event.NewPath))
+	}
+	if event.Digest != "" {
+		attrs = append(attrs, slog.Int64("size", event.Size), slog.String("digest", event.Digest))
+	}
+	if event.Error != "" {
+		attrs = append(attrs, slog.String("error", event.Error))
+	}
+	s.Logger.LogAttrs(context.Background(), s.Level, "storage audit", attrs...)
+	return nil
+}
+
+// NewBackendAuditSink creates a new instance of BackendAuditSink, storing the events in backend under prefix
+// The backend must not be the one audited, whose mutations would be recorded endlessly
+func NewBackendAuditSink(backend Backend, prefix string) *BackendAuditSink {
+	return &BackendAuditSink{
+		Backend: backend,
+		Prefix:  cleanPrefix(prefix),
+	}
+}
+
+// Record stores an event as a new object, never overwriting the previous ones
+func (s BackendAuditSink) Record(event AuditEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", event.Time.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix))
+	return s.Backend.PutObject(pathutil.Join(s.Prefix, name), content)
+}
+
+func (r *auditedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+func auditDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// WithContext returns a copy of the backend recording the actor of ctx
+// The wrapped backend makes its requests with ctx too when it implements ContextBackend
+func (b AuditedBackend) WithContext(ctx context.Context) *AuditedBackend {
+	b.Context = ctx
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// record sends an event to the sink, and returns its error when failing closed
+func (b AuditedBackend) record(event AuditEvent) error {
+	event.Time = time.Now().UTC()
+	event.Actor, _ = ActorFromContext(b.Context)
+	err := b.Sink.Record(event)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("failed to record audit event: %w", err)
+	if b.FailClosed {
+		return err
+	}
+	if b.OnSinkError != nil {
+		b.OnSinkError(err)
+	}
+	return nil
+}
+
+// audit makes a mutation, recording it around
+func (b AuditedBackend) audit(event AuditEvent, mutation func() error, completed func(*AuditEvent)) error {
+	if b.FailClosed {
+		started := event
+		started.Result = AuditStarted
+		if err := b.record(started); err != nil {
+			return err
+		}
+	}
+	err := mutation()
+	if completed != nil {
+		completed(&event)
+	}
+	event.Result = AuditSucceeded
+	if err != nil {
+		event.Result = AuditFailed
+		event.Error = err.Error()
+	}
+	if recordErr := b.record(event); recordErr != nil && err == nil {
+		return recordErr
+	}
+	return err
+}
+
+// BackendContext returns the Context of the backend
+func (b AuditedBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext is WithContext returning a Backend, see ContextBackend
+func (b AuditedBackend) WithBackendContext(ctx context.Context) Backend {
+	return b.WithContext(ctx)
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b AuditedBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend
+func (b AuditedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b AuditedBackend) GetObject(path string) (Object, error) {
+	return b.Backend.GetObject(path)
+}
+
+// PutObject uploads an object to the wrapped backend, recording its size and digest
+func (b AuditedBackend) PutObject(path string, content []byte) error {
+	digest := sha256.Sum256(content)
+	event := AuditEvent{
+		Operation: "PutObject",
+		Path:      path,
+		Size:      int64(len(content)),
+		Digest:    "sha256:" + hex.EncodeToString(digest[:]),
+	}
+	return b.audit(event, func() error {
+		return b.Backend.PutObject(path, content)
+	}, nil)
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b AuditedBackend) DeleteObject(path string) error {
+	return b.audit(AuditEvent{Operation: "DeleteObject", Path: path}, func() error {
+		return b.Backend.DeleteObject(path)
+	}, nil)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+func (b AuditedBackend) RenamePrefixOrObject(path, newPath string) error {
+	return b.audit(AuditEvent{Operation: "RenamePrefixOrObject", Path: path, NewPath: newPath}, func() error {
+		return b.Backend.RenamePrefixOrObject(path, newPath)
+	}, nil)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+func (b AuditedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	return getObjectStream(b.Backend, path)
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend, recording the size and digest of what it read
+// Only the result event has them, as they are known once the stream is read
+func (b AuditedBackend) PutObjectStream(path string, content io.Reader) error {
+	reader := &auditedReader{Reader: content, hash: sha256.New()}
+	return b.audit(AuditEvent{Operation: "PutObjectStream", Path: path}, func() error {
+		return putObjectStream(b.Backend, path, reader)
+	}, func(event *AuditEvent) {
+		event.Size = reader.size
+		event.Digest = auditDigest(reader.hash)
+	})
+}
+
+func (b AuditedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	handleHttpFileDownload(b.Backend, w, r, path)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var errAuditSinkDown = errors.New("sink down")
+
+// auditedMemorySink keeps the events in memory, and fails while failing is set
+type auditedMemorySink struct {
+	events  []AuditEvent
+	failing bool
+}
+
+func (s *auditedMemorySink) Record(event AuditEvent) error {
+	if s.failing {
+		return errAuditSinkDown
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+type AuditedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	Sink          *auditedMemorySink
+	Audited       *AuditedBackend
+}
+
+func (suite *AuditedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-audited/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(filepath.Join(suite.TempDirectory, "storage"))
+	suite.Sink = &auditedMemorySink{}
+	suite.Audited = NewAuditedBackend(suite.Local, suite.Sink, false)
+}
+
+func (suite *AuditedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *AuditedTestSuite) TestEvents() {
+	audited := suite.Audited.WithContext(WithActor(context.Background(), "alice"))
+	suite.Nil(audited.PutObject("a.txt", []byte("content")))
+	suite.Nil(audited.PutObjectStream("b.txt", strings.NewReader("content")))
+	suite.Nil(audited.RenamePrefixOrObject("b.txt", "c.txt"))
+	suite.Equal(ErrNewPathNotEmpty, audited.RenamePrefixOrObject("a.txt", "c.txt"))
+	suite.Nil(suite.Audited.DeleteObject("c.txt"))
+	_, err := audited.GetObject("a.txt")
+	suite.Nil(err)
+
+	events := suite.Sink.events
+	suite.Len(events, 5, "reads are not recorded")
+	digest := "sha256:ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	suite.Equal(AuditEvent{Time: events[0].Time, Actor: "alice", Operation: "PutObject", Path: "a.txt",
+		Size: 7, Digest: digest, Result: AuditSucceeded}, events[0])
+	suite.WithinDuration(time.Now(), events[0].Time, time.Minute)
+	suite.Equal(int64(7), events[1].Size, "streams are measured as they are read")
+	suite.Equal(digest, events[1].Digest)
+	suite.Equal("c.txt", events[2].NewPath)
+	suite.Equal(AuditFailed, events[3].Result, "failures are recorded")
+	suite.Equal(ErrNewPathNotEmpty.Error(), events[3].Error)
+	suite.Equal("DeleteObject", events[4].Operation)
+	suite.Equal("", events[4].Actor, "the actor comes from the context")
+}
+
+func (suite *AuditedTestSuite) TestFailOpen() {
+	var sinkErrors []error
+	suite.Audited.OnSinkError = func(err error) {
+		sinkErrors = append(sinkErrors, err)
+	}
+	suite.Sink.failing = true
+	suite.Nil(suite.Audited.PutObject("open.txt", []byte("open")), "mutations are made whatever the sink does")
+	_, err := suite.Local.GetObject("open.txt")
+	suite.Nil(err)
+	suite.Len(sinkErrors, 1)
+	suite.ErrorIs(sinkErrors[0], errAuditSinkDown)
+}
+
+func (suite *AuditedTestSuite) TestFailClosed() {
+	suite.Audited.FailClosed = true
+	suite.Nil(suite.Audited.PutObject("closed.txt", []byte("closed")))
+	suite.Len(suite.Sink.events, 2)
+	suite.Equal(AuditStarted, suite.Sink.events[0].Result, "mutations are recorded before being made")
+	suite.Equal(AuditSucceeded, suite.Sink.events[1].Result)
+
+	suite.Sink.failing = true
+	err := suite.Audited.DeleteObject("closed.txt")
+	suite.ErrorIs(err, errAuditSinkDown, "mutations which cannot be recorded are refused")
+	_, err = suite.Local.GetObject("closed.txt")
+	suite.Nil(err, "the refused mutation was not made")
+}
+
+func (suite *AuditedTestSuite) TestJSONLinesAuditSink() {
+	path := filepath.Join(suite.TempDirectory, "audit", "audit.jsonl")
+	sink := NewJSONLinesAuditSink(path)
+	suite.Audited.Sink = sink
+	suite.Nil(suite.Audited.PutObject("a.txt", []byte("a")))
+	suite.Nil(suite.Audited.DeleteObject("a.txt"))
+	suite.Nil(sink.Close())
+
+	sink = NewJSONLinesAuditSink(path)
+	suite.Audited.Sink = sink
+	suite.Nil(suite.Audited.PutObject("b.txt", []byte("b")))
+	suite.Nil(sink.Close())
+
+	file, err := os.Open(path)
+	suite.Nil(err)
+	defer file.Close()
+	var operations []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		suite.Nil(json.Unmarshal(scanner.Bytes(), &event))
+		operations = append(operations, event.Operation+" "+event.Path)
+	}
+	suite.Equal([]string{"PutObject a.txt", "DeleteObject a.txt", "PutObject b.txt"}, operations, "events are appended")
+}
+
+func (suite *AuditedTestSuite) TestSlogAuditSink() {
+	var buf bytes.Buffer
+	suite.Audited.Sink = NewSlogAuditSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+	suite.Nil(suite.Audited.WithContext(WithActor(context.Background(), "bob")).RenamePrefixOrObject("a.txt", "b.txt"))
+
+	var record map[string]interface{}
+	suite.Nil(json.Unmarshal(buf.Bytes(), &record))
+	suite.Equal("storage audit", record["msg"])
+	suite.Equal("INFO", record["level"])
+	suite.Equal("bob", record["actor"])
+	suite.Equal("RenamePrefixOrObject", record["operation"])
+	suite.Equal("b.txt", record["new_path"])
+	suite.Equal(AuditSucceeded, record["result"])
+}
+
+func (suite *AuditedTestSuite) TestBackendAuditSink() {
+	audit := NewLocalFilesystemBackend(filepath.Join(suite.TempDirectory, "audit"))
+	suite.Audited.Sink = NewBackendAuditSink(audit, "/events/")
+	suite.Nil(suite.Audited.PutObject("a.txt", []byte("a")))
+	suite.Nil(suite.Audited.PutObject("a.txt", []byte("b")))
+
+	objects, err := audit.ListObjects("events")
+	suite.Nil(err)
+	suite.Len(objects, 2, "every event is its own object")
+	var digests []string
+	for _, o := range objects {
+		object, err := audit.GetObject("events/" + o.Path)
+		suite.Nil(err)
+		var event AuditEvent
+		suite.Nil(json.Unmarshal(object.Content, &event))
+		digests = append(digests, event.Digest)
+	}
+	suite.NotEqual(digests[0], digests[1])
+}
+
+func (suite *AuditedTestSuite) TestActorFromContext() {
+	_, ok := ActorFromContext(context.Background())
+	suite.False(ok)
+	actor, ok := ActorFromContext(WithActor(context.Background(), "carol"))
+	suite.True(ok)
+	suite.Equal("carol", actor)
+}
+
+func TestAuditedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditedTestSuite))
+}
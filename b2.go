@@ -0,0 +1,1015 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	pathutil "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultB2Endpoint = "https://api.backblazeb2.com"
+
+	// b2_list_file_names returns at most 1000 names per transaction class B call
+	b2MaxFileCount = 1000
+	// the largest file b2_upload_file and b2_copy_file accept in a single request
+	b2MaxSimpleFileSize = 5 * 1000 * 1000 * 1000
+)
+
+type (
+	// b2Error is the error body of the B2 API
+	b2Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	b2File struct {
+		FileID          string            `json:"fileId"`
+		FileName        string            `json:"fileName"`
+		Action          string            `json:"action"`
+		ContentLength   int64             `json:"contentLength"`
+		ContentType     string            `json:"contentType"`
+		UploadTimestamp int64             `json:"uploadTimestamp"`
+		FileInfo        map[string]string `json:"fileInfo"`
+	}
+
+	b2ListFilesResponse struct {
+		Files        []b2File `json:"files"`
+		NextFileName *string  `json:"nextFileName"`
+		NextFileID   *string  `json:"nextFileId"`
+	}
+
+	b2UploadURL struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+
+	// b2Session is the state of an authorized account, shared by the copies of a backend
+	b2Session struct {
+		sync.Mutex
+		accountID   string
+		token       string
+		apiURL      string
+		downloadURL string
+		bucketID    string
+		partSize    int64
+		uploadURLs  []b2UploadURL
+	}
+)
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("b2: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// b2IsNotFound reports whether err is a not_found error of the B2 API
+func b2IsNotFound(err error) bool {
+	var b2err *b2Error
+	return errors.As(err, &b2err) && b2err.Status == http.StatusNotFound
+}
+
+// b2LastModified prefers the modification time recorded at upload over the upload time itself
+func b2LastModified(f b2File) time.Time {
+	if millis, err := strconv.ParseInt(f.FileInfo["src_last_modified_millis"], 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond))
+	}
+	return time.Unix(0, f.UploadTimestamp*int64(time.Millisecond))
+}
+
+// b2EscapeName percent-encodes a file name for headers and download URLs, keeping the slashes
+func b2EscapeName(name string) string {
+	return (&url.URL{Path: name}).EscapedPath()
+}
+
+type b2ListObjectsFromDirectoryOutput struct {
+	backend         *B2Backend
+	prefix          string
+	limit           int
+	startFileName   string
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &b2ListObjectsFromDirectoryOutput{
+		backend: l.backend,
+		prefix:  l.prefix,
+		limit:   l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	prefix := l.backend.key(l.prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	maxFileCount := l.limit
+	if maxFileCount <= 0 || maxFileCount > b2MaxFileCount {
+		maxFileCount = b2MaxFileCount
+	}
+
+	bucketID, err := l.backend.bucketID()
+	if err != nil {
+		return nil, err
+	}
+	var resp b2ListFilesResponse
+	err = l.backend.call("b2_list_file_names", map[string]interface{}{
+		"bucketId":      bucketID,
+		"prefix":        prefix,
+		"delimiter":     "/",
+		"startFileName": l.startFileName,
+		"maxFileCount":  maxFileCount,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range resp.Files {
+		name := strings.TrimSuffix(strings.TrimPrefix(f.FileName, prefix), "/")
+		switch f.Action {
+		case "folder":
+			r.directoriesRead = append(r.directoriesRead, Metadata{
+				Path: pathutil.Join(l.prefix, name),
+			})
+		case "upload":
+			r.filesRead = append(r.filesRead, Metadata{
+				Path:         pathutil.Join(l.prefix, name),
+				LastModified: b2LastModified(f),
+			})
+		}
+	}
+
+	if resp.NextFileName != nil {
+		r.startFileName = *resp.NextFileName
+	}
+	r.isEOF = resp.NextFileName == nil
+
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *b2ListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// B2Backend is a storage backend for Backblaze B2, on the native B2 API
+type B2Backend struct {
+	Bucket         string
+	Prefix         string
+	Endpoint       string
+	Client         *http.Client
+	ApplicationKey string
+	KeyID          string
+	// PartSize is the size of the parts of large files, the recommended part size of the account is used if zero
+	PartSize int64
+	// HideOnDelete hides deleted files instead of deleting all their versions, so that lifecycle rules decide when they are removed
+	HideOnDelete bool
+	session      *b2Session
+}
+
+// B2FileVersion is a version of a file, as returned by ListObjectVersions
+type B2FileVersion struct {
+	Metadata
+	ID     string
+	Hidden bool
+}
+
+// NewB2Backend creates a new instance of B2Backend
+// Credentials are taken from B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY, the account is authorized on first use
+// endpoint defaults to https://api.backblazeb2.com
+func NewB2Backend(bucket string, prefix string, endpoint string) *B2Backend {
+	if endpoint == "" {
+		endpoint = defaultB2Endpoint
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		panic("Failed to parse B2 endpoint: " + err.Error())
+	}
+
+	b := &B2Backend{
+		Bucket:         bucket,
+		Prefix:         cleanPrefix(prefix),
+		Endpoint:       strings.TrimSuffix(endpoint, "/"),
+		Client:         http.DefaultClient,
+		KeyID:          os.Getenv("B2_APPLICATION_KEY_ID"),
+		ApplicationKey: os.Getenv("B2_APPLICATION_KEY"),
+		session:        &b2Session{},
+	}
+	return b
+}
+
+func (b B2Backend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+// authorize calls b2_authorize_account, and finds the bucket id unless the key is restricted to the bucket
+// token is the expired token that triggered a refresh, so that concurrent refreshes only authorize once
+func (b B2Backend) authorize(token string) error {
+	b.session.Lock()
+	defer b.session.Unlock()
+	if b.session.token != token {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, b.Endpoint+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.KeyID, b.ApplicationKey)
+	var auth struct {
+		AccountID           string `json:"accountId"`
+		AuthorizationToken  string `json:"authorizationToken"`
+		APIURL              string `json:"apiUrl"`
+		DownloadURL         string `json:"downloadUrl"`
+		RecommendedPartSize int64  `json:"recommendedPartSize"`
+		Allowed             struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+	if err := b.decode(req, &auth); err != nil {
+		return err
+	}
+
+	b.session.accountID = auth.AccountID
+	b.session.token = auth.AuthorizationToken
+	b.session.apiURL = auth.APIURL
+	b.session.downloadURL = auth.DownloadURL
+	b.session.partSize = auth.RecommendedPartSize
+	b.session.uploadURLs = nil
+
+	if auth.Allowed.BucketID != "" && auth.Allowed.BucketName == b.Bucket {
+		b.session.bucketID = auth.Allowed.BucketID
+		return nil
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	err = b.post(b.session.apiURL, b.session.token, "b2_list_buckets", map[string]string{
+		"accountId":  b.session.accountID,
+		"bucketName": b.Bucket,
+	}, &buckets)
+	if err != nil {
+		return err
+	}
+	if len(buckets.Buckets) == 0 {
+		return fmt.Errorf("b2: bucket %s not found", b.Bucket)
+	}
+	b.session.bucketID = buckets.Buckets[0].BucketID
+	return nil
+}
+
+// decode sends a request and decodes its JSON response, or its B2 error
+func (b B2Backend) decode(req *http.Request, response interface{}) error {
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return b2ResponseError(resp)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func b2ResponseError(resp *http.Response) error {
+	b2err := &b2Error{}
+	if err := json.NewDecoder(resp.Body).Decode(b2err); err != nil || b2err.Status == 0 {
+		b2err.Status = resp.StatusCode
+		b2err.Message = resp.Status
+	}
+	return b2err
+}
+
+func (b B2Backend) post(apiURL string, token string, operation string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL+"/b2api/v2/"+operation, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	return b.decode(req, response)
+}
+
+// credentials returns the current session, authorizing the account if needed
+func (b B2Backend) credentials() (apiURL string, token string, err error) {
+	b.session.Lock()
+	apiURL, token = b.session.apiURL, b.session.token
+	b.session.Unlock()
+	if token == "" {
+		if err := b.authorize(""); err != nil {
+			return "", "", err
+		}
+		return b.credentials()
+	}
+	return apiURL, token, nil
+}
+
+// retry runs fn with the current token, and once more with a new one if the token expired
+func (b B2Backend) retry(fn func(token string) error) error {
+	_, token, err := b.credentials()
+	if err != nil {
+		return err
+	}
+	err = fn(token)
+	var b2err *b2Error
+	if errors.As(err, &b2err) && b2err.Status == http.StatusUnauthorized && (b2err.Code == "expired_auth_token" || b2err.Code == "bad_auth_token") {
+		if err := b.authorize(token); err != nil {
+			return err
+		}
+		_, token, err = b.credentials()
+		if err != nil {
+			return err
+		}
+		return fn(token)
+	}
+	return err
+}
+
+// call runs an operation of the B2 API, refreshing the authorization token when it expired
+func (b B2Backend) call(operation string, request interface{}, response interface{}) error {
+	return b.retry(func(token string) error {
+		b.session.Lock()
+		apiURL := b.session.apiURL
+		b.session.Unlock()
+		return b.post(apiURL, token, operation, request, response)
+	})
+}
+
+// bucketID returns the id of the bucket, authorizing the account if needed
+func (b B2Backend) bucketID() (string, error) {
+	if _, _, err := b.credentials(); err != nil {
+		return "", err
+	}
+	b.session.Lock()
+	defer b.session.Unlock()
+	return b.session.bucketID, nil
+}
+
+// listFileNames lists the latest visible version of the files starting with prefix, at any depth
+func (b B2Backend) listFileNames(prefix string, delimiter string, fn func(b2File) error) error {
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return err
+	}
+	startFileName := ""
+	for {
+		var resp b2ListFilesResponse
+		err := b.call("b2_list_file_names", map[string]interface{}{
+			"bucketId":      bucketID,
+			"prefix":        prefix,
+			"delimiter":     delimiter,
+			"startFileName": startFileName,
+			"maxFileCount":  b2MaxFileCount,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		for _, f := range resp.Files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		if resp.NextFileName == nil {
+			return nil
+		}
+		startFileName = *resp.NextFileName
+	}
+}
+
+// file returns the latest visible version of a file
+func (b B2Backend) file(path string) (b2File, error) {
+	name := b.key(path)
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return b2File{}, err
+	}
+	var resp b2ListFilesResponse
+	err = b.call("b2_list_file_names", map[string]interface{}{
+		"bucketId":      bucketID,
+		"prefix":        name,
+		"startFileName": name,
+		"maxFileCount":  1,
+	}, &resp)
+	if err != nil {
+		return b2File{}, err
+	}
+	if len(resp.Files) == 0 || resp.Files[0].FileName != name || resp.Files[0].Action != "upload" {
+		return b2File{}, ErrObjectNotFound
+	}
+	return resp.Files[0], nil
+}
+
+// ListObjects lists all objects in B2 bucket, at prefix
+func (b B2Backend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	prefix = b.key(prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+	err := b.listFileNames(prefix, "/", func(f b2File) error {
+		if f.Action != "upload" {
+			return nil
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         strings.TrimPrefix(f.FileName, prefix),
+				LastModified: b2LastModified(f),
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+		return nil
+	})
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b B2Backend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if cleanPrefix(prefix) != "" {
+		_, err := b.file(prefix)
+		if err == nil {
+			return nil, ErrPrefixIsAnObject
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	} else if _, err := b.bucketID(); err != nil {
+		return nil, err
+	}
+
+	output := &b2ListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+	}
+	return output.NextPage()
+}
+
+// ListObjectVersions lists every version of a file, newest first, including hide markers
+func (b B2Backend) ListObjectVersions(path string) ([]B2FileVersion, error) {
+	var versions []B2FileVersion
+
+	files, err := b.fileVersions(b.key(path))
+	for _, f := range files {
+		versions = append(versions, B2FileVersion{
+			Metadata: Metadata{
+				Path:         path,
+				LastModified: b2LastModified(f),
+			},
+			ID:     f.FileID,
+			Hidden: f.Action == "hide",
+		})
+	}
+	return versions, err
+}
+
+func (b B2Backend) fileVersions(name string) ([]b2File, error) {
+	var files []b2File
+
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return files, err
+	}
+	startFileName, startFileID := name, ""
+	for {
+		request := map[string]interface{}{
+			"bucketId":      bucketID,
+			"prefix":        name,
+			"startFileName": startFileName,
+			"maxFileCount":  b2MaxFileCount,
+		}
+		if startFileID != "" {
+			request["startFileId"] = startFileID
+		}
+		var resp b2ListFilesResponse
+		if err := b.call("b2_list_file_versions", request, &resp); err != nil {
+			return files, err
+		}
+		for _, f := range resp.Files {
+			if f.FileName != name {
+				return files, nil
+			}
+			files = append(files, f)
+		}
+		if resp.NextFileName == nil || *resp.NextFileName != name || resp.NextFileID == nil {
+			return files, nil
+		}
+		startFileName, startFileID = *resp.NextFileName, *resp.NextFileID
+	}
+}
+
+// RenamePrefixOrObject copies an object, or every object under a prefix, to newPath with b2_copy_file, then deletes the originals
+// Files larger than the part size are copied part by part with b2_copy_part
+// The copy is done server side, but the whole move is not atomic
+func (b B2Backend) RenamePrefixOrObject(path, newPath string) error {
+	// check if newPath is already occupied
+	if _, err := b.file(newPath); err == nil {
+		return ErrNewPathNotEmpty
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	occupied := false
+	err := b.listFileNames(b.key(newPath)+"/", "/", func(f b2File) error {
+		occupied = true
+		return io.EOF
+	})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if occupied {
+		return ErrNewPathNotEmpty
+	}
+
+	var files []b2File
+	if f, err := b.file(path); err == nil {
+		files = append(files, f)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	} else {
+		err := b.listFileNames(b.key(path)+"/", "", func(f b2File) error {
+			if f.Action == "upload" {
+				files = append(files, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// ignore if the source does not exist
+	for _, f := range files {
+		newName := b.key(newPath) + strings.TrimPrefix(f.FileName, b.key(path))
+		if err := b.copyFile(f, newName); err != nil {
+			return err
+		}
+		if err := b.deleteFile(f.FileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file to name, with b2_copy_file up to the part size and with b2_copy_part above
+func (b B2Backend) copyFile(f b2File, name string) error {
+	partSize := b.partSize()
+	if f.ContentLength <= partSize {
+		return b.call("b2_copy_file", map[string]string{
+			"sourceFileId":      f.FileID,
+			"fileName":          name,
+			"metadataDirective": "COPY",
+		}, nil)
+	}
+
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return err
+	}
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
+	fileInfo := f.FileInfo
+	if fileInfo == nil {
+		fileInfo = map[string]string{}
+	}
+	var large struct {
+		FileID string `json:"fileId"`
+	}
+	err = b.call("b2_start_large_file", map[string]interface{}{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": contentType,
+		"fileInfo":    fileInfo,
+	}, &large)
+	if err != nil {
+		return err
+	}
+
+	var sums []string
+	err = func() error {
+		for number, start := 1, int64(0); start < f.ContentLength; number, start = number+1, start+partSize {
+			end := start + partSize
+			if end > f.ContentLength {
+				end = f.ContentLength
+			}
+			var part struct {
+				ContentSha1 string `json:"contentSha1"`
+			}
+			err := b.call("b2_copy_part", map[string]interface{}{
+				"sourceFileId": f.FileID,
+				"largeFileId":  large.FileID,
+				"partNumber":   number,
+				"range":        fmt.Sprintf("bytes=%d-%d", start, end-1),
+			}, &part)
+			if err != nil {
+				return err
+			}
+			sums = append(sums, part.ContentSha1)
+		}
+		return b.call("b2_finish_large_file", map[string]interface{}{
+			"fileId":        large.FileID,
+			"partSha1Array": sums,
+		}, nil)
+	}()
+	if err != nil {
+		// do not leave the copied parts behind
+		b.call("b2_cancel_large_file", map[string]string{"fileId": large.FileID}, nil)
+		return err
+	}
+	return nil
+}
+
+// GetObject retrieves an object from B2 bucket, at prefix
+func (b B2Backend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// GetObjectVersion retrieves a given version of an object, hidden versions included
+func (b B2Backend) GetObjectVersion(path string, fileID string) (Object, error) {
+	var object Object
+	object.Path = path
+
+	resp, err := b.download(http.MethodGet, "/b2api/v2/b2_download_file_by_id?fileId="+url.QueryEscape(fileID), nil)
+	if err != nil {
+		return object, err
+	}
+	defer resp.Body.Close()
+
+	object.LastModified = b2DownloadLastModified(resp.Header)
+	object.Content, err = ioutil.ReadAll(resp.Body)
+	return object, err
+}
+
+// PutObject uploads an object to B2 bucket, at prefix
+func (b B2Backend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from B2 bucket, at prefix
+// When HideOnDelete is set the file is hidden and its versions are kept, otherwise every version is deleted
+func (b B2Backend) DeleteObject(path string) error {
+	return b.deleteFile(b.key(path))
+}
+
+func (b B2Backend) deleteFile(name string) error {
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return err
+	}
+
+	if b.HideOnDelete {
+		err := b.call("b2_hide_file", map[string]string{
+			"bucketId": bucketID,
+			"fileName": name,
+		}, nil)
+		if b2IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	files, err := b.fileVersions(name)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err := b.call("b2_delete_file_version", map[string]string{
+			"fileName": name,
+			"fileId":   f.FileID,
+		}, nil)
+		if err != nil && !b2IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// download sends a request to the download URL, refreshing the authorization token when it expired
+func (b B2Backend) download(method string, path string, header http.Header) (*http.Response, error) {
+	var resp *http.Response
+	err := b.retry(func(token string) error {
+		b.session.Lock()
+		downloadURL := b.session.downloadURL
+		b.session.Unlock()
+
+		req, err := http.NewRequest(method, downloadURL+path, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", token)
+		resp, err = b.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				return ErrObjectNotFound
+			}
+			if method == http.MethodHead {
+				return &b2Error{Status: resp.StatusCode, Message: resp.Status}
+			}
+			return b2ResponseError(resp)
+		}
+		return nil
+	})
+	return resp, err
+}
+
+func b2DownloadLastModified(header http.Header) time.Time {
+	millis, err := strconv.ParseInt(header.Get("X-Bz-Info-src_last_modified_millis"), 10, 64)
+	if err != nil {
+		millis, _ = strconv.ParseInt(header.Get("X-Bz-Upload-Timestamp"), 10, 64)
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// GetObjectStream retrieves an object stream from B2 bucket, at prefix
+func (b B2Backend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	if _, _, err := b.credentials(); err != nil {
+		return object, err
+	}
+	resp, err := b.download(http.MethodGet, "/file/"+b2EscapeName(b.Bucket)+"/"+b2EscapeName(b.key(path)), nil)
+	if err != nil {
+		return object, err
+	}
+
+	object.LastModified = b2DownloadLastModified(resp.Header)
+	object.Content = resp.Body
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to B2 bucket, at prefix
+// Content up to the part size is sent with b2_upload_file, larger content with the large file API, one part at a time
+func (b B2Backend) PutObjectStream(path string, content io.Reader) error {
+	if _, _, err := b.credentials(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, b.partSize())
+	n, err := io.ReadFull(content, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return b.uploadFile(b.key(path), buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	// content of exactly one part is still a simple upload
+	var next [1]byte
+	if _, err := io.ReadFull(content, next[:]); err == io.EOF {
+		return b.uploadFile(b.key(path), buf)
+	} else if err != nil {
+		return err
+	}
+	return b.uploadLargeFile(b.key(path), buf, io.MultiReader(bytes.NewReader(next[:]), content))
+}
+
+// partSize returns the size of the parts of large files, PartSize or the recommended part size of the account
+// Credentials must have been obtained first for the recommended part size to be known
+func (b B2Backend) partSize() int64 {
+	partSize := b.PartSize
+	if partSize <= 0 {
+		b.session.Lock()
+		partSize = b.session.partSize
+		b.session.Unlock()
+	}
+	if partSize <= 0 || partSize > b2MaxSimpleFileSize {
+		partSize = 100 * 1000 * 1000
+	}
+	return partSize
+}
+
+// uploadFile sends a file with b2_upload_file, getting a new upload URL when the one in use is busy or expired
+func (b B2Backend) uploadFile(name string, data []byte) error {
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	header := http.Header{}
+	header.Set("X-Bz-File-Name", b2EscapeName(name))
+	header.Set("Content-Type", "b2/x-auto")
+	header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	header.Set("X-Bz-Info-src_last_modified_millis", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+
+	return b.upload("b2_get_upload_url", map[string]string{"bucketId": bucketID}, header, data)
+}
+
+// upload sends data to an upload URL; upload URLs are reused until they fail, as recommended by Backblaze
+func (b B2Backend) upload(operation string, request map[string]string, header http.Header, data []byte) error {
+	pooled := operation == "b2_get_upload_url"
+
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		var target b2UploadURL
+		b.session.Lock()
+		if pooled && len(b.session.uploadURLs) > 0 {
+			target = b.session.uploadURLs[len(b.session.uploadURLs)-1]
+			b.session.uploadURLs = b.session.uploadURLs[:len(b.session.uploadURLs)-1]
+		}
+		b.session.Unlock()
+		if target.UploadURL == "" {
+			if err := b.call(operation, request, &target); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target.UploadURL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", target.AuthorizationToken)
+		req.ContentLength = int64(len(data))
+
+		lastErr = b.decode(req, nil)
+		if lastErr == nil {
+			if pooled {
+				b.session.Lock()
+				b.session.uploadURLs = append(b.session.uploadURLs, target)
+				b.session.Unlock()
+			}
+			return nil
+		}
+
+		// a new upload URL is needed after authorization and availability errors, others are final
+		var b2err *b2Error
+		if errors.As(lastErr, &b2err) && b2err.Status != http.StatusUnauthorized && b2err.Status != http.StatusRequestTimeout && b2err.Status < 500 {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// uploadLargeFile sends a file with the large file API, first is the first part, already read from content
+func (b B2Backend) uploadLargeFile(name string, first []byte, content io.Reader) error {
+	bucketID, err := b.bucketID()
+	if err != nil {
+		return err
+	}
+	var large struct {
+		FileID string `json:"fileId"`
+	}
+	err = b.call("b2_start_large_file", map[string]interface{}{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": "b2/x-auto",
+		"fileInfo": map[string]string{
+			"src_last_modified_millis": strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+		},
+	}, &large)
+	if err != nil {
+		return err
+	}
+
+	var sums []string
+	err = func() error {
+		part, buf := first, make([]byte, len(first))
+		for number := 1; len(part) > 0; number++ {
+			sum := sha1.Sum(part)
+			sums = append(sums, hex.EncodeToString(sum[:]))
+			header := http.Header{}
+			header.Set("X-Bz-Part-Number", strconv.Itoa(number))
+			header.Set("X-Bz-Content-Sha1", sums[len(sums)-1])
+			if err := b.upload("b2_get_upload_part_url", map[string]string{"fileId": large.FileID}, header, part); err != nil {
+				return err
+			}
+
+			n, err := io.ReadFull(content, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			part = buf[:n]
+		}
+		return b.call("b2_finish_large_file", map[string]interface{}{
+			"fileId":        large.FileID,
+			"partSha1Array": sums,
+		}, nil)
+	}()
+	if err != nil {
+		// do not leave the uploaded parts behind
+		b.call("b2_cancel_large_file", map[string]string{"fileId": large.FileID}, nil)
+		return err
+	}
+	return nil
+}
+
+func (b B2Backend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	proxyHttpFileDownload(w, r, func(method string, header http.Header) (*http.Response, error) {
+		if _, _, err := b.credentials(); err != nil {
+			return nil, err
+		}
+		resp, err := b.download(method, "/file/"+b2EscapeName(b.Bucket)+"/"+b2EscapeName(b.key(path)), header)
+		var b2err *b2Error
+		if errors.As(err, &b2err) && (b2err.Status == http.StatusPreconditionFailed || b2err.Status == http.StatusRequestedRangeNotSatisfiable) {
+			// failed preconditions and ranges are errors of the B2 API, but answers of the download
+			return &http.Response{StatusCode: b2err.Status, Header: http.Header{}, Body: http.NoBody}, nil
+		}
+		return resp, err
+	})
+}
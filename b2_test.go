@@ -0,0 +1,646 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeB2 is an in-memory stand-in for the parts of the B2 native API used by B2Backend
+type fakeB2 struct {
+	sync.Mutex
+	server      *httptest.Server
+	token       int
+	nextID      int
+	versions    []b2File
+	contents    map[string][]byte
+	large       map[string]*fakeB2LargeFile
+	authorized  int
+	largeStarts int
+	copyParts   int
+}
+
+type fakeB2LargeFile struct {
+	file  b2File
+	parts map[int][]byte
+}
+
+func newFakeB2() *fakeB2 {
+	f := &fakeB2{
+		contents: map[string][]byte{},
+		large:    map[string]*fakeB2LargeFile{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// expire invalidates the current authorization token, as B2 does after 24 hours
+func (f *fakeB2) expire() {
+	f.Lock()
+	defer f.Unlock()
+	f.token++
+}
+
+func (f *fakeB2) currentToken() string {
+	return fmt.Sprintf("token-%d", f.token)
+}
+
+func fakeB2Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(b2Error{Status: status, Code: code, Message: code})
+}
+
+func (f *fakeB2) add(file b2File, content []byte) b2File {
+	f.nextID++
+	file.FileID = fmt.Sprintf("id-%d", f.nextID)
+	file.ContentLength = int64(len(content))
+	file.UploadTimestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	f.versions = append(f.versions, file)
+	f.contents[file.FileID] = content
+	return file
+}
+
+// sorted returns the versions ordered by name, newest first
+func (f *fakeB2) sorted() []b2File {
+	versions := append([]b2File{}, f.versions...)
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].FileName != versions[j].FileName {
+			return versions[i].FileName < versions[j].FileName
+		}
+		return i > j
+	})
+	return versions
+}
+
+func (f *fakeB2) latest(name string) (b2File, bool) {
+	for i := len(f.versions) - 1; i >= 0; i-- {
+		if f.versions[i].FileName == name {
+			return f.versions[i], f.versions[i].Action == "upload"
+		}
+	}
+	return b2File{}, false
+}
+
+func (f *fakeB2) byID(id string) (b2File, bool) {
+	for _, v := range f.versions {
+		if v.FileID == id {
+			return v, true
+		}
+	}
+	return b2File{}, false
+}
+
+func (f *fakeB2) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "key-id" || pass != "key" {
+			fakeB2Error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		f.authorized++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"accountId":           "account",
+			"authorizationToken":  f.currentToken(),
+			"apiUrl":              f.server.URL,
+			"downloadUrl":         f.server.URL,
+			"recommendedPartSize": 100,
+			"allowed":             map[string]interface{}{"bucketId": nil, "bucketName": nil},
+		})
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		f.upload(w, r, strings.TrimPrefix(r.URL.Path, "/upload/"))
+		return
+	}
+
+	if r.Header.Get("Authorization") != f.currentToken() {
+		fakeB2Error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/file/bucket/") {
+		file, ok := f.latest(strings.TrimPrefix(r.URL.Path, "/file/bucket/"))
+		if !ok {
+			fakeB2Error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		f.serveFile(w, r, file)
+		return
+	}
+
+	if r.URL.Path == "/b2api/v2/b2_download_file_by_id" {
+		file, ok := f.byID(r.URL.Query().Get("fileId"))
+		if !ok || file.Action != "upload" {
+			fakeB2Error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		f.serveFile(w, r, file)
+		return
+	}
+
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fakeB2Error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	str := func(k string) string {
+		s, _ := req[k].(string)
+		return s
+	}
+	var resp interface{} = map[string]interface{}{}
+
+	switch strings.TrimPrefix(r.URL.Path, "/b2api/v2/") {
+	case "b2_list_buckets":
+		if str("bucketName") != "bucket" {
+			resp = map[string]interface{}{"buckets": []interface{}{}}
+			break
+		}
+		resp = map[string]interface{}{"buckets": []interface{}{map[string]string{"bucketId": "bucket-id"}}}
+	case "b2_list_file_names":
+		resp = f.listFileNames(str("prefix"), str("delimiter"), str("startFileName"), int(req["maxFileCount"].(float64)))
+	case "b2_list_file_versions":
+		resp = f.listFileVersions(str("prefix"), str("startFileName"), str("startFileId"), int(req["maxFileCount"].(float64)))
+	case "b2_get_upload_url":
+		resp = b2UploadURL{UploadURL: f.server.URL + "/upload/", AuthorizationToken: f.currentToken()}
+	case "b2_start_large_file":
+		f.largeStarts++
+		f.nextID++
+		info := map[string]string{}
+		for k, v := range req["fileInfo"].(map[string]interface{}) {
+			info[k] = v.(string)
+		}
+		file := b2File{FileID: fmt.Sprintf("large-%d", f.nextID), FileName: str("fileName"), Action: "upload", FileInfo: info}
+		f.large[file.FileID] = &fakeB2LargeFile{file: file, parts: map[int][]byte{}}
+		resp = file
+	case "b2_get_upload_part_url":
+		resp = b2UploadURL{UploadURL: f.server.URL + "/upload/" + str("fileId"), AuthorizationToken: f.currentToken()}
+	case "b2_finish_large_file":
+		large, ok := f.large[str("fileId")]
+		if !ok {
+			fakeB2Error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		var content []byte
+		sums := req["partSha1Array"].([]interface{})
+		for i, sum := range sums {
+			part := large.parts[i+1]
+			partSum := sha1.Sum(part)
+			if hex.EncodeToString(partSum[:]) != sum.(string) || (i < len(sums)-1 && len(part) < 5) {
+				fakeB2Error(w, http.StatusBadRequest, "bad_request")
+				return
+			}
+			content = append(content, part...)
+		}
+		delete(f.large, str("fileId"))
+		resp = f.add(large.file, content)
+	case "b2_cancel_large_file":
+		delete(f.large, str("fileId"))
+	case "b2_copy_part":
+		large, ok := f.large[str("largeFileId")]
+		source, found := f.byID(str("sourceFileId"))
+		var start, end int
+		if n, _ := fmt.Sscanf(str("range"), "bytes=%d-%d", &start, &end); !ok || !found || n != 2 || end >= len(f.contents[source.FileID]) {
+			fakeB2Error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		f.copyParts++
+		number := int(req["partNumber"].(float64))
+		large.parts[number] = f.contents[source.FileID][start : end+1]
+		sum := sha1.Sum(large.parts[number])
+		resp = map[string]interface{}{"fileId": str("largeFileId"), "partNumber": number, "contentSha1": hex.EncodeToString(sum[:])}
+	case "b2_hide_file":
+		if _, ok := f.latest(str("fileName")); !ok {
+			fakeB2Error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		resp = f.add(b2File{FileName: str("fileName"), Action: "hide"}, nil)
+	case "b2_delete_file_version":
+		for i, v := range f.versions {
+			if v.FileID == str("fileId") && v.FileName == str("fileName") {
+				f.versions = append(f.versions[:i], f.versions[i+1:]...)
+				delete(f.contents, v.FileID)
+				resp = v
+				break
+			}
+		}
+	case "b2_copy_file":
+		source, ok := f.byID(str("sourceFileId"))
+		if !ok || str("metadataDirective") != "COPY" {
+			fakeB2Error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		resp = f.add(b2File{FileName: str("fileName"), Action: "upload", FileInfo: source.FileInfo}, f.contents[source.FileID])
+	default:
+		fakeB2Error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeB2) listFileNames(prefix, delimiter, startFileName string, maxFileCount int) b2ListFilesResponse {
+	var entries []b2File
+	seen := map[string]bool{}
+	for _, v := range f.sorted() {
+		if seen[v.FileName] || !strings.HasPrefix(v.FileName, prefix) {
+			continue
+		}
+		seen[v.FileName] = true
+		if v.Action != "upload" {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(v.FileName[len(prefix):], delimiter); i >= 0 {
+				folder := v.FileName[:len(prefix)+i+1]
+				if !seen[folder] {
+					seen[folder] = true
+					entries = append(entries, b2File{FileName: folder, Action: "folder"})
+				}
+				continue
+			}
+		}
+		entries = append(entries, v)
+	}
+
+	resp := b2ListFilesResponse{Files: []b2File{}}
+	for _, e := range entries {
+		if e.FileName < startFileName {
+			continue
+		}
+		if len(resp.Files) == maxFileCount {
+			name := e.FileName
+			resp.NextFileName = &name
+			break
+		}
+		resp.Files = append(resp.Files, e)
+	}
+	return resp
+}
+
+func (f *fakeB2) listFileVersions(prefix, startFileName, startFileID string, maxFileCount int) b2ListFilesResponse {
+	resp := b2ListFilesResponse{Files: []b2File{}}
+	started := startFileID == ""
+	for _, v := range f.sorted() {
+		if !strings.HasPrefix(v.FileName, prefix) || v.FileName < startFileName {
+			continue
+		}
+		if !started {
+			if v.FileID != startFileID {
+				continue
+			}
+			started = true
+		}
+		if len(resp.Files) == maxFileCount {
+			name, id := v.FileName, v.FileID
+			resp.NextFileName, resp.NextFileID = &name, &id
+			break
+		}
+		resp.Files = append(resp.Files, v)
+	}
+	return resp
+}
+
+func (f *fakeB2) upload(w http.ResponseWriter, r *http.Request, largeFileID string) {
+	if r.Header.Get("Authorization") != f.currentToken() {
+		fakeB2Error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	content, _ := ioutil.ReadAll(r.Body)
+	sum := sha1.Sum(content)
+	if hex.EncodeToString(sum[:]) != r.Header.Get("X-Bz-Content-Sha1") {
+		fakeB2Error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	if largeFileID != "" {
+		large, ok := f.large[largeFileID]
+		number, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		if !ok || number < 1 {
+			fakeB2Error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		large.parts[number] = content
+		json.NewEncoder(w).Encode(map[string]interface{}{"fileId": largeFileID, "partNumber": number})
+		return
+	}
+
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil || r.Header.Get("Content-Type") != "b2/x-auto" {
+		fakeB2Error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	info := map[string]string{}
+	for k := range r.Header {
+		if strings.HasPrefix(k, "X-Bz-Info-") {
+			info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = r.Header.Get(k)
+		}
+	}
+	json.NewEncoder(w).Encode(f.add(b2File{FileName: name, Action: "upload", FileInfo: info}, content))
+}
+
+func (f *fakeB2) serveFile(w http.ResponseWriter, r *http.Request, file b2File) {
+	for k, v := range file.FileInfo {
+		w.Header().Set("X-Bz-Info-"+k, v)
+	}
+	w.Header().Set("X-Bz-Upload-Timestamp", strconv.FormatInt(file.UploadTimestamp, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, file.FileName, time.Unix(0, file.UploadTimestamp*int64(time.Millisecond)), bytes.NewReader(f.contents[file.FileID]))
+}
+
+type B2TestSuite struct {
+	suite.Suite
+	B2Backend *B2Backend
+	Server    *fakeB2
+}
+
+func (suite *B2TestSuite) SetupSuite() {
+	suite.Server = newFakeB2()
+
+	os.Setenv("B2_APPLICATION_KEY_ID", "key-id")
+	os.Setenv("B2_APPLICATION_KEY", "key")
+	suite.B2Backend = NewB2Backend("bucket", "unittest", suite.Server.server.URL)
+	os.Unsetenv("B2_APPLICATION_KEY_ID")
+	os.Unsetenv("B2_APPLICATION_KEY")
+}
+
+func (suite *B2TestSuite) TearDownSuite() {
+	suite.Server.server.Close()
+}
+
+func (suite *B2TestSuite) TestPutGetDeleteObject() {
+	err := suite.B2Backend.PutObject("putget/test file.txt", []byte("some content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.B2Backend.GetObject("putget/test file.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content, "content matches")
+	suite.WithinDuration(time.Now(), object.LastModified, time.Minute, "last modified is set")
+
+	err = suite.B2Backend.DeleteObject("putget/test file.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.B2Backend.GetObject("putget/test file.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	versions, err := suite.B2Backend.ListObjectVersions("putget/test file.txt")
+	suite.Nil(err)
+	suite.Empty(versions, "every version is deleted")
+
+	err = suite.B2Backend.DeleteObject("putget/missing.txt")
+	suite.Nil(err, "deleting a missing object is not an error")
+}
+
+func (suite *B2TestSuite) TestLargeFile() {
+	// larger than the recommended part size of the fake server, so sent in three parts
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	starts := suite.Server.largeStarts
+
+	err := suite.B2Backend.PutObjectStream("large.bin", bytes.NewReader(content))
+	suite.Nil(err, "no error putting large object")
+	suite.Equal(starts+1, suite.Server.largeStarts, "large file API used")
+
+	object, err := suite.B2Backend.GetObject("large.bin")
+	suite.Nil(err)
+	suite.Equal(content, object.Content, "parts are assembled")
+
+	// exactly one part is a simple upload
+	err = suite.B2Backend.PutObjectStream("small.bin", bytes.NewReader(content[:100]))
+	suite.Nil(err)
+	suite.Equal(starts+1, suite.Server.largeStarts, "simple upload used")
+
+	suite.Nil(suite.B2Backend.DeleteObject("large.bin"))
+	suite.Nil(suite.B2Backend.DeleteObject("small.bin"))
+}
+
+func (suite *B2TestSuite) TestTokenRefresh() {
+	suite.Nil(suite.B2Backend.PutObject("refresh.txt", []byte("a")))
+	authorized := suite.Server.authorized
+
+	suite.Server.expire()
+	object, err := suite.B2Backend.GetObject("refresh.txt")
+	suite.Nil(err, "expired token is refreshed on download")
+	suite.Equal([]byte("a"), object.Content)
+	suite.Equal(authorized+1, suite.Server.authorized, "account authorized again")
+
+	suite.Server.expire()
+	suite.Nil(suite.B2Backend.PutObject("refresh.txt", []byte("b")), "expired token is refreshed on upload")
+
+	suite.Server.expire()
+	objects, err := suite.B2Backend.ListObjects("")
+	suite.Nil(err, "expired token is refreshed on api calls")
+	suite.NotEmpty(objects)
+
+	suite.Nil(suite.B2Backend.DeleteObject("refresh.txt"))
+}
+
+func (suite *B2TestSuite) TestHideOnDelete() {
+	b := *suite.B2Backend
+	b.HideOnDelete = true
+
+	suite.Nil(b.PutObject("hidden.txt", []byte("v1")))
+	suite.Nil(b.PutObject("hidden.txt", []byte("v2")))
+	suite.Nil(b.DeleteObject("hidden.txt"))
+
+	_, err := b.GetObject("hidden.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "hidden object is not found")
+	objects, err := b.ListObjects("")
+	suite.Nil(err)
+	for _, object := range objects {
+		suite.NotEqual("hidden.txt", object.Path, "hidden object is not listed")
+	}
+
+	versions, err := b.ListObjectVersions("hidden.txt")
+	suite.Nil(err)
+	suite.Len(versions, 3, "versions are kept")
+	suite.True(versions[0].Hidden, "newest version is the hide marker")
+	object, err := b.GetObjectVersion("hidden.txt", versions[1].ID)
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), object.Content, "hidden versions can be retrieved")
+
+	suite.Nil(b.DeleteObject("hidden.txt"), "hiding a hidden object is not an error")
+
+	suite.Nil(suite.B2Backend.DeleteObject("hidden.txt"))
+	versions, err = b.ListObjectVersions("hidden.txt")
+	suite.Nil(err)
+	suite.Empty(versions, "deleting removes hide markers too")
+}
+
+func (suite *B2TestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.B2Backend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.B2Backend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.B2Backend.DeleteObject(path))
+	}
+}
+
+func (suite *B2TestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.B2Backend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.B2Backend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.B2Backend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.B2Backend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		next, nextErr := output.NextPage()
+		_, againErr := output.NextPage()
+		suite.Error(againErr, "NextPage can only be called once")
+		output, err = next, nextErr
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+
+	for _, path := range paths {
+		suite.Nil(suite.B2Backend.DeleteObject(path))
+	}
+}
+
+func (suite *B2TestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.B2Backend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.B2Backend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.B2Backend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.B2Backend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.B2Backend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.B2Backend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "content follows rename")
+	_, err = suite.B2Backend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.B2Backend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.B2Backend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.B2Backend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"moved.txt", "renamed/sub/b.txt", "occupied.txt"} {
+		suite.Nil(suite.B2Backend.DeleteObject(path))
+	}
+}
+
+func (suite *B2TestSuite) TestRenameLargeFile() {
+	// larger than the recommended part size of the fake server, so copied in three parts
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	suite.Nil(suite.B2Backend.PutObjectStream("rename-large/large.bin", bytes.NewReader(content)))
+	suite.Nil(suite.B2Backend.PutObject("rename-large/small.bin", []byte("small")))
+	copyParts := suite.Server.copyParts
+
+	err := suite.B2Backend.RenamePrefixOrObject("rename-large", "renamed-large")
+	suite.Nil(err, "no error renaming a large file")
+	suite.Equal(copyParts+3, suite.Server.copyParts, "large file copied part by part")
+
+	object, err := suite.B2Backend.GetObject("renamed-large/large.bin")
+	suite.Nil(err)
+	suite.Equal(content, object.Content, "parts are assembled")
+	object, err = suite.B2Backend.GetObject("renamed-large/small.bin")
+	suite.Nil(err)
+	suite.Equal([]byte("small"), object.Content)
+	_, err = suite.B2Backend.GetObject("rename-large/large.bin")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	suite.Nil(suite.B2Backend.DeleteObject("renamed-large/large.bin"))
+	suite.Nil(suite.B2Backend.DeleteObject("renamed-large/small.bin"))
+}
+
+func (suite *B2TestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.B2Backend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.B2Backend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.B2Backend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.B2Backend.DeleteObject("download.txt"))
+}
+
+func (suite *B2TestSuite) TestBadCredentials() {
+	b := NewB2Backend("bucket", "", suite.Server.server.URL)
+	_, err := b.ListObjects("")
+	suite.Error(err, "unauthorized account")
+
+	b.KeyID, b.ApplicationKey = "key-id", "key"
+	b.Bucket = "missing"
+	_, err = b.ListObjects("")
+	suite.Error(err, "missing bucket")
+}
+
+func TestB2StorageTestSuite(t *testing.T) {
+	suite.Run(t, new(B2TestSuite))
+}
@@ -0,0 +1,518 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltRootBucket holds every object; bbolt only allows buckets at the top level of a database
+	boltRootBucket = "storage"
+
+	// every value starts with the last modified time of the object, in unix nanoseconds
+	boltHeaderSize = 8
+)
+
+type boltListObjectsFromDirectoryOutput struct {
+	backend         *BoltBackend
+	prefix          string
+	limit           int
+	startKey        []byte
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *boltListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *boltListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *boltListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *boltListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &boltListObjectsFromDirectoryOutput{
+		backend: l.backend,
+		prefix:  l.prefix,
+		limit:   l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	err := l.backend.DB.View(func(tx *bolt.Tx) error {
+		bucket := l.backend.bucket(tx, l.prefix)
+		if bucket == nil {
+			r.isEOF = true
+			return nil
+		}
+
+		c := bucket.Cursor()
+		k, v := c.First()
+		if l.startKey != nil {
+			// resume right after the last key of the previous page
+			k, v = c.Seek(l.startKey)
+			if k != nil && bytes.Equal(k, l.startKey) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if l.limit > 0 && len(r.directoriesRead)+len(r.filesRead) >= l.limit {
+				break
+			}
+			m := Metadata{
+				Path: pathutil.Join(l.prefix, string(k)),
+			}
+			if v == nil {
+				r.directoriesRead = append(r.directoriesRead, m)
+			} else {
+				m.LastModified = boltLastModified(v)
+				r.filesRead = append(r.filesRead, m)
+			}
+			r.startKey = append([]byte{}, k...)
+		}
+		r.isEOF = k == nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *boltListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *boltListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// boltObjectReader reads a value straight from the memory map of the database
+// The read transaction stays open until the reader is closed
+type boltObjectReader struct {
+	*bytes.Reader
+	tx *bolt.Tx
+}
+
+func (r *boltObjectReader) Close() error {
+	return r.tx.Rollback()
+}
+
+// BoltBackend is a storage backend for an embedded bbolt database
+// Path segments are mapped to nested buckets, objects are keys in the bucket of their directory
+type BoltBackend struct {
+	DB     *bolt.DB
+	Prefix string
+}
+
+// NewBoltBackend creates a new instance of BoltBackend
+// The database file is created if it does not exist; it is locked for as long as the backend is open
+func NewBoltBackend(path string, prefix string) *BoltBackend {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		panic("Failed to open bolt database: " + err.Error())
+	}
+	return NewBoltBackendWithDB(db, prefix)
+}
+
+// NewBoltBackendWithDB creates a new instance of BoltBackend with an existing bbolt database
+func NewBoltBackendWithDB(db *bolt.DB, prefix string) *BoltBackend {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(boltRootBucket))
+		return err
+	})
+	if err != nil {
+		panic("Failed to initialize bolt database: " + err.Error())
+	}
+
+	b := &BoltBackend{
+		DB:     db,
+		Prefix: cleanPrefix(prefix),
+	}
+	return b
+}
+
+// Close closes the underlying database, releasing its file lock
+func (b BoltBackend) Close() error {
+	return b.DB.Close()
+}
+
+// segments splits a path below Prefix into bucket names
+func (b BoltBackend) segments(path string) []string {
+	path = cleanPrefix(pathutil.Join(b.Prefix, path))
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// bucket returns the bucket at path, or nil if it does not exist
+func (b BoltBackend) bucket(tx *bolt.Tx, path string) *bolt.Bucket {
+	bucket := tx.Bucket([]byte(boltRootBucket))
+	for _, segment := range b.segments(path) {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(segment))
+	}
+	return bucket
+}
+
+// parent returns the bucket of the directory of path and the key of path within it
+func (b BoltBackend) parent(tx *bolt.Tx, path string) (*bolt.Bucket, []byte) {
+	segments := b.segments(path)
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	bucket := tx.Bucket([]byte(boltRootBucket))
+	for _, segment := range segments[:len(segments)-1] {
+		if bucket == nil {
+			return nil, nil
+		}
+		bucket = bucket.Bucket([]byte(segment))
+	}
+	return bucket, []byte(segments[len(segments)-1])
+}
+
+// createParent creates the buckets of the directory of path and returns the key of path within it
+func (b BoltBackend) createParent(tx *bolt.Tx, path string) (*bolt.Bucket, []byte, error) {
+	segments := b.segments(path)
+	if len(segments) == 0 {
+		return nil, nil, errors.New("object path is empty")
+	}
+	bucket := tx.Bucket([]byte(boltRootBucket))
+	for _, segment := range segments[:len(segments)-1] {
+		var err error
+		bucket, err = bucket.CreateBucketIfNotExists([]byte(segment))
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create directory %s: %w", segment, err)
+		}
+	}
+	return bucket, []byte(segments[len(segments)-1]), nil
+}
+
+// prune removes the empty buckets of the directory of path, keeping the buckets of Prefix
+func (b BoltBackend) prune(tx *bolt.Tx, path string) error {
+	segments := b.segments(path)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// buckets[i] is the bucket of the first i segments
+	buckets := []*bolt.Bucket{tx.Bucket([]byte(boltRootBucket))}
+	for _, segment := range segments[:len(segments)-1] {
+		bucket := buckets[len(buckets)-1].Bucket([]byte(segment))
+		if bucket == nil {
+			break
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for i := len(buckets) - 1; i > len(b.segments("")); i-- {
+		if k, _ := buckets[i].Cursor().First(); k != nil {
+			return nil
+		}
+		if err := buckets[i-1].DeleteBucket([]byte(segments[i-1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltExists reports whether key is either an object or a directory bucket
+func boltExists(bucket *bolt.Bucket, key []byte) bool {
+	return bucket != nil && (bucket.Get(key) != nil || bucket.Bucket(key) != nil)
+}
+
+func boltLastModified(value []byte) time.Time {
+	if len(value) < boltHeaderSize {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value[:boltHeaderSize])))
+}
+
+// ListObjects lists all objects in the bolt database, at prefix
+func (b BoltBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := b.bucket(tx, prefix)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				// nested bucket
+				return nil
+			}
+			object := Object{
+				Metadata: Metadata{
+					Path:         string(k),
+					LastModified: boltLastModified(v),
+				},
+				Content: []byte{},
+			}
+			objects = append(objects, object)
+			return nil
+		})
+	})
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+// Every page is read in its own transaction, resuming the cursor after the last key of the previous page
+func (b BoltBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket, key := b.parent(tx, prefix)
+		// Get returns nil for nested buckets
+		if bucket != nil && bucket.Get(key) != nil {
+			return ErrPrefixIsAnObject
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &boltListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves an object, or a whole directory bucket, to newPath in a single write transaction
+func (b BoltBackend) RenamePrefixOrObject(path, newPath string) error {
+	oldSegments, newSegments := b.segments(path), b.segments(newPath)
+	if len(newSegments) > len(oldSegments) && strings.Join(newSegments[:len(oldSegments)], "/") == strings.Join(oldSegments, "/") {
+		return fmt.Errorf("cannot move %s into itself", path)
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		// check if newPath is already occupied
+		if bucket, key := b.parent(tx, newPath); boltExists(bucket, key) {
+			return ErrNewPathNotEmpty
+		}
+
+		// ignore if the source does not exist
+		bucket, key := b.parent(tx, path)
+		if !boltExists(bucket, key) {
+			return nil
+		}
+
+		newBucket, newKey, err := b.createParent(tx, newPath)
+		if err != nil {
+			return err
+		}
+
+		if child := bucket.Bucket(key); child != nil {
+			if bytes.Equal(key, newKey) {
+				err = tx.MoveBucket(key, bucket, newBucket)
+			} else {
+				err = boltCopyBucket(child, newBucket, newKey)
+				if err == nil {
+					err = bucket.DeleteBucket(key)
+				}
+			}
+		} else {
+			err = newBucket.Put(newKey, append([]byte{}, bucket.Get(key)...))
+			if err == nil {
+				err = bucket.Delete(key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		return b.prune(tx, path)
+	})
+}
+
+// boltCopyBucket recursively copies src into a new bucket named key under dst
+func boltCopyBucket(src *bolt.Bucket, dst *bolt.Bucket, key []byte) error {
+	bucket, err := dst.CreateBucket(key)
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return boltCopyBucket(src.Bucket(k), bucket, k)
+		}
+		return bucket.Put(k, append([]byte{}, v...))
+	})
+}
+
+// GetObject retrieves an object from the bolt database, at prefix
+func (b BoltBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to the bolt database, at prefix
+func (b BoltBackend) PutObject(path string, content []byte) error {
+	value := make([]byte, boltHeaderSize+len(content))
+	binary.BigEndian.PutUint64(value, uint64(time.Now().UnixNano()))
+	copy(value[boltHeaderSize:], content)
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, key, err := b.createParent(tx, path)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+}
+
+// DeleteObject removes an object from the bolt database, at prefix
+// Directory buckets left empty are removed as well
+func (b BoltBackend) DeleteObject(path string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, key := b.parent(tx, path)
+		if bucket == nil || bucket.Get(key) == nil {
+			return nil
+		}
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		return b.prune(tx, path)
+	})
+}
+
+// GetObjectStream retrieves an object stream from the bolt database, at prefix
+// The content is read from the memory map without copying it; it holds a read transaction
+// open until it is closed, which keeps writers from growing the database file
+func (b BoltBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	tx, err := b.DB.Begin(false)
+	if err != nil {
+		return object, err
+	}
+
+	bucket, key := b.parent(tx, path)
+	var value []byte
+	if bucket != nil {
+		value = bucket.Get(key)
+	}
+	if value == nil {
+		tx.Rollback()
+		return object, ErrObjectNotFound
+	}
+
+	object.LastModified = boltLastModified(value)
+	object.Content = &boltObjectReader{
+		Reader: bytes.NewReader(value[boltHeaderSize:]),
+		tx:     tx,
+	}
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to the bolt database, at prefix
+// bbolt stores values in a single write, so the stream is read into memory first
+func (b BoltBackend) PutObjectStream(path string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return b.PutObject(path, data)
+}
+
+func (b BoltBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer obj.Content.Close()
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, obj.Content.(io.ReadSeeker))
+}
+
+// Backup writes a consistent copy of the whole database to w while it stays online
+// The copy is a regular bbolt file and can be opened with NewBoltBackend
+func (b BoltBackend) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,246 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltTestSuite struct {
+	suite.Suite
+	BoltBackend   *BoltBackend
+	TempDirectory string
+}
+
+func (suite *BoltTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-bolt/%s", timestamp)
+	suite.Nil(os.MkdirAll(suite.TempDirectory, 0777))
+
+	suite.BoltBackend = NewBoltBackend(suite.TempDirectory+"/storage.db", "unittest")
+}
+
+func (suite *BoltTestSuite) TearDownSuite() {
+	suite.BoltBackend.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *BoltTestSuite) TestPutGetDeleteObject() {
+	err := suite.BoltBackend.PutObject("a/b/test.txt", []byte("some content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.BoltBackend.GetObject("a/b/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content)
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	err = suite.BoltBackend.PutObject("a/b/test.txt/nested", []byte("x"))
+	suite.NotNil(err, "an object cannot be used as a directory")
+
+	_, err = suite.BoltBackend.GetObject("a/b")
+	suite.ErrorIs(err, ErrObjectNotFound, "a directory is not an object")
+
+	err = suite.BoltBackend.DeleteObject("a/b/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.BoltBackend.GetObject("a/b/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	err = suite.BoltBackend.DeleteObject("a/b/test.txt")
+	suite.Nil(err, "deleting a missing object is ignored")
+
+	suite.Nil(suite.BoltBackend.DB.View(func(tx *bolt.Tx) error {
+		suite.Nil(suite.BoltBackend.bucket(tx, "a"), "empty directories are pruned")
+		suite.NotNil(suite.BoltBackend.bucket(tx, ""), "prefix is kept")
+		return nil
+	}))
+}
+
+func (suite *BoltTestSuite) TestGetObjectStream() {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	suite.Nil(suite.BoltBackend.PutObjectStream("stream.txt", bytes.NewReader(content)))
+
+	stream, err := suite.BoltBackend.GetObjectStream("stream.txt")
+	suite.Nil(err, "no error getting object stream")
+	seeker, ok := stream.Content.(io.ReadSeeker)
+	suite.True(ok, "stream is seekable")
+	_, err = seeker.Seek(9990, io.SeekStart)
+	suite.Nil(err)
+	tail, err := ioutil.ReadAll(stream.Content)
+	suite.Nil(err)
+	suite.Equal(content[9990:], tail)
+	suite.Nil(stream.Content.Close(), "closing the stream ends its transaction")
+
+	suite.Nil(suite.BoltBackend.DeleteObject("stream.txt"))
+}
+
+func (suite *BoltTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt"} {
+		suite.Nil(suite.BoltBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.BoltBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested buckets are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	objects, err = suite.BoltBackend.ListObjects("does-not-exist")
+	suite.Nil(err, "listing a missing directory is not an error")
+	suite.Empty(objects)
+
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt"} {
+		suite.Nil(suite.BoltBackend.DeleteObject(path))
+	}
+}
+
+func (suite *BoltTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.BoltBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.BoltBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	var files, directories []string
+	output, err := suite.BoltBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+			suite.False(f.LastModified.IsZero(), "last modified is listed")
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		next, err2 := output.NextPage()
+		_, err3 := output.NextPage()
+		suite.NotNil(err3, "next page can only be called once")
+		output, err = next, err2
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories)
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files)
+
+	output, err = suite.BoltBackend.ListObjectsFromDirectory("does-not-exist", 0)
+	suite.ErrorIs(err, io.EOF, "missing directory is an empty listing")
+	suite.Empty(output.GetFiles())
+
+	for _, path := range paths {
+		suite.Nil(suite.BoltBackend.DeleteObject(path))
+	}
+}
+
+func (suite *BoltTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.BoltBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.BoltBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.BoltBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.BoltBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.BoltBackend.RenamePrefixOrObject("rename", "rename/sub/inner")
+	suite.NotNil(err, "cannot rename a directory into itself")
+
+	err = suite.BoltBackend.RenamePrefixOrObject("rename", "new/parent/renamed")
+	suite.Nil(err, "no error renaming directory")
+	object, err := suite.BoltBackend.GetObject("new/parent/renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "nested buckets are copied")
+	_, err = suite.BoltBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.BoltBackend.RenamePrefixOrObject("new/parent/renamed", "other/renamed")
+	suite.Nil(err, "no error moving directory to another parent")
+	object, err = suite.BoltBackend.GetObject("other/renamed/a.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.BoltBackend.RenamePrefixOrObject("other/renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.BoltBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.BoltBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"moved.txt", "other/renamed/sub/b.txt", "occupied.txt"} {
+		suite.Nil(suite.BoltBackend.DeleteObject(path))
+	}
+	suite.Nil(suite.BoltBackend.DB.View(func(tx *bolt.Tx) error {
+		for _, path := range []string{"new", "other", "rename"} {
+			suite.Nil(suite.BoltBackend.bucket(tx, path), "empty directories are pruned")
+		}
+		return nil
+	}))
+}
+
+func (suite *BoltTestSuite) TestBackup() {
+	suite.Nil(suite.BoltBackend.PutObject("backup/index.yaml", []byte("apiVersion: v1")))
+
+	var buf bytes.Buffer
+	n, err := suite.BoltBackend.Backup(&buf)
+	suite.Nil(err, "no error backing up")
+	suite.Equal(int64(buf.Len()), n)
+
+	path := suite.TempDirectory + "/backup.db"
+	suite.Nil(ioutil.WriteFile(path, buf.Bytes(), 0600))
+	restored := NewBoltBackend(path, "unittest")
+	defer restored.Close()
+	object, err := restored.GetObject("backup/index.yaml")
+	suite.Nil(err, "backup can be opened")
+	suite.Equal([]byte("apiVersion: v1"), object.Content)
+
+	suite.Nil(suite.BoltBackend.DeleteObject("backup/index.yaml"))
+}
+
+func (suite *BoltTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.BoltBackend.PutObject("download.txt", []byte("downloadable")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	suite.BoltBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	suite.Equal("down", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.BoltBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.BoltBackend.DeleteObject("download.txt"))
+}
+
+func TestBoltStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(BoltTestSuite))
+}
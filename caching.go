@@ -0,0 +1,590 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cachingNotFoundSize is what a cached not found result counts for in the memory tier, besides its path
+const cachingNotFoundSize = 64
+
+type (
+	// CachingBackend is a Backend wrapper caching the objects read with GetObject, in memory and optionally on disk
+	// Only the changes made through the wrapper invalidate the cache, the others are seen once the entries expire
+	// A CachingBackend not created with NewCachingBackend caches nothing
+	CachingBackend struct {
+		Backend Backend
+		// MaxSize is the total size of the entries kept in memory, in bytes, unbounded if zero
+		MaxSize int64
+		// TTL is how long an entry is served before being revalidated against the backend, forever if zero
+		// A revalidation reads the whole object from the backends without streams, see load
+		TTL time.Duration
+		// NegativeTTL is how long not found results are cached, not at all if zero
+		NegativeTTL time.Duration
+		// IsNotFound reports whether an error of the backend is a missing object, IsNotFoundError if nil
+		IsNotFound func(error) bool
+		// Directory is where the disk tier keeps its files, see NewCachingBackendWithDirectory
+		Directory string
+		// MaxDiskSize is the total size of the entries kept on disk, in bytes, unbounded if zero
+		MaxDiskSize int64
+		cache       *cachingState
+	}
+
+	// CacheStats counts the reads made through a CachingBackend
+	CacheStats struct {
+		// Hits are the reads served from the cache, not found results included
+		Hits uint64
+		// Misses are the reads sent to the backend, revalidations included
+		Misses uint64
+		// Revalidations are the misses that found the cached entry unchanged
+		Revalidations uint64
+		// Evictions are the entries dropped from either tier to make room
+		Evictions uint64
+	}
+
+	cachingEntry struct {
+		path         string
+		content      []byte // nil on disk, where it is in file
+		file         string
+		lastModified time.Time
+		etag         string
+		notFound     bool
+		expires      time.Time // never if zero
+		size         int64
+	}
+
+	// cachingLRU is a tier of the cache, bounded by the size of its entries
+	cachingLRU struct {
+		size    int64
+		order   *list.List
+		entries map[string]*list.Element
+		evicted func(*cachingEntry)
+	}
+
+	cachingState struct {
+		sync.Mutex
+		memory *cachingLRU
+		disk   *cachingLRU
+		group  singleflight.Group
+		// version changes on every invalidation, so that loads started before are not cached
+		version       uint64
+		files         uint64
+		hits          uint64
+		misses        uint64
+		revalidations uint64
+		evictions     uint64
+	}
+)
+
+func newCachingLRU(evicted func(*cachingEntry)) *cachingLRU {
+	return &cachingLRU{
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		evicted: evicted,
+	}
+}
+
+func (c *cachingLRU) get(path string) *cachingEntry {
+	if e, ok := c.entries[path]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*cachingEntry)
+	}
+	return nil
+}
+
+// add inserts or replaces an entry, evicting the least recently used ones when over maxSize, zero meaning unbounded
+// The file of a replaced entry is removed, without counting as an eviction
+// It reports false when the entry alone is larger than maxSize
+func (c *cachingLRU) add(entry *cachingEntry, maxSize int64) bool {
+	if maxSize > 0 && entry.size > maxSize {
+		return false
+	}
+	if old := c.remove(entry.path); old != nil && old.file != "" && old.file != entry.file {
+		os.Remove(old.file)
+	}
+	c.entries[entry.path] = c.order.PushFront(entry)
+	c.size += entry.size
+	for maxSize > 0 && c.size > maxSize {
+		oldest := c.order.Back().Value.(*cachingEntry)
+		c.remove(oldest.path)
+		if c.evicted != nil {
+			c.evicted(oldest)
+		}
+	}
+	return true
+}
+
+func (c *cachingLRU) remove(path string) *cachingEntry {
+	e, ok := c.entries[path]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cachingEntry)
+	c.order.Remove(e)
+	delete(c.entries, path)
+	c.size -= entry.size
+	return entry
+}
+
+// removePrefix removes path and every entry under it
+func (c *cachingLRU) removePrefix(path string) []*cachingEntry {
+	var removed []*cachingEntry
+	for p := range c.entries {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			removed = append(removed, c.remove(p))
+		}
+	}
+	return removed
+}
+
+// NewCachingBackend creates a new instance of CachingBackend, keeping up to maxSize bytes in memory
+func NewCachingBackend(backend Backend, maxSize int64, ttl time.Duration) *CachingBackend {
+	b := &CachingBackend{
+		Backend:     backend,
+		MaxSize:     maxSize,
+		TTL:         ttl,
+		NegativeTTL: ttl,
+		cache:       &cachingState{},
+	}
+	b.cache.memory = newCachingLRU(func(*cachingEntry) {
+		atomic.AddUint64(&b.cache.evictions, 1)
+	})
+	return b
+}
+
+// NewCachingBackendWithDirectory creates a new instance of CachingBackend with a disk tier of up to maxDiskSize bytes in directory
+// The disk tier does not outlive the process, the files left in directory by a previous one are removed
+func NewCachingBackendWithDirectory(backend Backend, maxSize int64, ttl time.Duration, directory string, maxDiskSize int64) *CachingBackend {
+	b := NewCachingBackend(backend, maxSize, ttl)
+	b.Directory = directory
+	b.MaxDiskSize = maxDiskSize
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		panic("Failed to create cache directory: " + err.Error())
+	}
+	stale, _ := filepath.Glob(filepath.Join(directory, "*.cache"))
+	for _, file := range stale {
+		os.Remove(file)
+	}
+
+	b.cache.disk = newCachingLRU(func(entry *cachingEntry) {
+		atomic.AddUint64(&b.cache.evictions, 1)
+		os.Remove(entry.file)
+	})
+	return b
+}
+
+// Stats returns the counters of the reads made through the cache
+func (b CachingBackend) Stats() CacheStats {
+	if b.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&b.cache.hits),
+		Misses:        atomic.LoadUint64(&b.cache.misses),
+		Revalidations: atomic.LoadUint64(&b.cache.revalidations),
+		Evictions:     atomic.LoadUint64(&b.cache.evictions),
+	}
+}
+
+// Purge empties the cache
+func (b CachingBackend) Purge() {
+	b.invalidate("", true)
+}
+
+func (b CachingBackend) isNotFound(err error) bool {
+	if b.IsNotFound != nil {
+		return b.IsNotFound(err)
+	}
+	return IsNotFoundError(err)
+}
+
+func (b CachingBackend) expires(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// invalidate drops the entries of path, and of everything under it if prefix is set, an empty path being the root
+func (b CachingBackend) invalidate(path string, prefix bool) {
+	if b.cache == nil {
+		return
+	}
+	path = cleanPrefix(path)
+
+	b.cache.Lock()
+	b.cache.version++
+	var removed []*cachingEntry
+	for _, tier := range []*cachingLRU{b.cache.memory, b.cache.disk} {
+		if tier == nil {
+			continue
+		}
+		switch {
+		case prefix && path == "":
+			for p := range tier.entries {
+				removed = append(removed, tier.remove(p))
+			}
+		case prefix:
+			removed = append(removed, tier.removePrefix(path)...)
+		default:
+			if entry := tier.remove(path); entry != nil {
+				removed = append(removed, entry)
+			}
+		}
+	}
+	b.cache.Unlock()
+
+	for _, entry := range removed {
+		b.cache.group.Forget(entry.path)
+		if entry.file != "" {
+			os.Remove(entry.file)
+		}
+	}
+	b.cache.group.Forget(path)
+}
+
+// lookup returns a copy of the cached entry of path, with its content read from disk if needed, or nil
+func (b CachingBackend) lookup(path string) *cachingEntry {
+	b.cache.Lock()
+	cached := b.cache.memory.get(path)
+	if cached == nil && b.cache.disk != nil {
+		cached = b.cache.disk.get(path)
+	}
+	if cached == nil {
+		b.cache.Unlock()
+		return nil
+	}
+	entry := *cached
+	b.cache.Unlock()
+	if entry.file == "" {
+		return &entry
+	}
+
+	content, err := ioutil.ReadFile(entry.file)
+	if err != nil {
+		return nil
+	}
+	entry.content = content
+	entry.file = ""
+
+	// promote the entry to memory, the disk keeps its copy
+	b.cache.Lock()
+	if b.cache.disk.get(path) == cached {
+		promoted := entry
+		b.cache.memory.add(&promoted, b.MaxSize)
+	}
+	b.cache.Unlock()
+	return &entry
+}
+
+// store caches an entry loaded at version, unless an invalidation happened since
+func (b CachingBackend) store(entry *cachingEntry, version uint64) {
+	var file string
+	if b.cache.disk != nil && !entry.notFound && (b.MaxDiskSize <= 0 || entry.size <= b.MaxDiskSize) {
+		file = b.writeFile(entry)
+	}
+
+	b.cache.Lock()
+	defer b.cache.Unlock()
+	if b.cache.version != version {
+		if file != "" {
+			os.Remove(file)
+		}
+		return
+	}
+
+	inMemory := *entry
+	b.cache.memory.add(&inMemory, b.MaxSize)
+	if file != "" {
+		onDisk := *entry
+		onDisk.content = nil
+		onDisk.file = file
+		if !b.cache.disk.add(&onDisk, b.MaxDiskSize) {
+			os.Remove(file)
+		}
+	} else if b.cache.disk != nil {
+		// the disk must not keep serving the entry this one replaces
+		if old := b.cache.disk.remove(entry.path); old != nil {
+			os.Remove(old.file)
+		}
+	}
+}
+
+// writeFile writes the content of an entry to a new file of the disk tier, returning its name or an empty string on failure
+func (b CachingBackend) writeFile(entry *cachingEntry) string {
+	sum := sha256.Sum256([]byte(entry.path))
+	name := filepath.Join(b.Directory, fmt.Sprintf("%s-%d.cache", hex.EncodeToString(sum[:]), atomic.AddUint64(&b.cache.files, 1)))
+
+	// a temporary name first, so that lookups never read a partial file
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, entry.content, 0600); err != nil {
+		os.Remove(tmp)
+		return ""
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return ""
+	}
+	return name
+}
+
+// refresh extends the life of a revalidated entry, in both tiers
+func (b CachingBackend) refresh(path string, expires time.Time) {
+	b.cache.Lock()
+	defer b.cache.Unlock()
+	for _, tier := range []*cachingLRU{b.cache.memory, b.cache.disk} {
+		if tier == nil {
+			continue
+		}
+		if entry := tier.get(path); entry != nil {
+			entry.expires = expires
+		}
+	}
+}
+
+func newCachingEntry(object Object) *cachingEntry {
+	sum := sha256.Sum256(object.Content)
+	return &cachingEntry{
+		path:         object.Path,
+		content:      object.Content,
+		lastModified: object.LastModified,
+		etag:         "\"" + hex.EncodeToString(sum[:16]) + "\"",
+		size:         int64(len(object.Path) + len(object.Content)),
+	}
+}
+
+// load reads an object from the backend, revalidating stale when set
+// Backends with streams are revalidated by LastModified, the content being read only when it changed
+// The others have no way to tell the metadata without the content: the object is read in full, and the entry is kept
+// when both its LastModified and its ETag, a sha256 of the content computed here and not one of the backend, are unchanged,
+// which saves writing the entry again but not the transfer
+func (b CachingBackend) load(path string, stale *cachingEntry) (*cachingEntry, error) {
+	b.cache.Lock()
+	version := b.cache.version
+	b.cache.Unlock()
+	atomic.AddUint64(&b.cache.misses, 1)
+
+	var object Object
+	if s, ok := b.Backend.(BackendStream); ok && stale != nil && !stale.notFound && !stale.lastModified.IsZero() {
+		stream, err := s.GetObjectStream(path)
+		if err == nil {
+			if stream.LastModified.Equal(stale.lastModified) {
+				stream.Content.Close()
+				return b.revalidated(stale), nil
+			}
+			object.Metadata = stream.Metadata
+			object.Content, err = ioutil.ReadAll(stream.Content)
+			stream.Content.Close()
+		}
+		if err != nil {
+			return nil, b.loadError(path, err, version)
+		}
+	} else {
+		var err error
+		object, err = b.Backend.GetObject(path)
+		if err != nil {
+			return nil, b.loadError(path, err, version)
+		}
+	}
+
+	object.Path = path
+	entry := newCachingEntry(object)
+	if stale != nil && !stale.notFound && entry.etag == stale.etag && entry.lastModified.Equal(stale.lastModified) {
+		return b.revalidated(stale), nil
+	}
+	entry.expires = b.expires(b.TTL)
+	b.store(entry, version)
+	return entry, nil
+}
+
+func (b CachingBackend) revalidated(stale *cachingEntry) *cachingEntry {
+	atomic.AddUint64(&b.cache.revalidations, 1)
+	entry := *stale
+	entry.expires = b.expires(b.TTL)
+	b.refresh(entry.path, entry.expires)
+	return &entry
+}
+
+// loadError caches a not found error of the backend, reported as ErrObjectNotFound
+func (b CachingBackend) loadError(path string, err error, version uint64) error {
+	if !b.isNotFound(err) {
+		return err
+	}
+	if b.NegativeTTL > 0 {
+		b.store(&cachingEntry{
+			path:     path,
+			notFound: true,
+			expires:  b.expires(b.NegativeTTL),
+			size:     int64(len(path) + cachingNotFoundSize),
+		}, version)
+	} else {
+		// a previous entry is stale now
+		b.invalidate(path, false)
+	}
+	return ErrObjectNotFound
+}
+
+// get returns the entry of path, from the cache when fresh, concurrent loads of a path being shared
+func (b CachingBackend) get(path string) (*cachingEntry, error) {
+	path = cleanPrefix(path)
+	if b.cache == nil {
+		object, err := b.Backend.GetObject(path)
+		if err != nil {
+			if b.isNotFound(err) {
+				return nil, ErrObjectNotFound
+			}
+			return nil, err
+		}
+		object.Path = path
+		return newCachingEntry(object), nil
+	}
+
+	entry := b.lookup(path)
+	if entry != nil && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		atomic.AddUint64(&b.cache.hits, 1)
+		if entry.notFound {
+			return nil, ErrObjectNotFound
+		}
+		return entry, nil
+	}
+	if entry != nil && entry.notFound {
+		entry = nil
+	}
+
+	v, err, _ := b.cache.group.Do(path, func() (interface{}, error) {
+		return b.load(path, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cachingEntry), nil
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b CachingBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b CachingBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix, listings are not cached
+func (b CachingBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend, listings are not cached
+func (b CachingBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the cache, or from the wrapped backend on a miss
+// Not found results are reported as ErrObjectNotFound
+func (b CachingBackend) GetObject(path string) (Object, error) {
+	entry, err := b.get(path)
+	if err != nil {
+		return Object{Metadata: Metadata{Path: path}}, err
+	}
+	// a copy, so that callers cannot alter the cache
+	content := make([]byte, len(entry.content))
+	copy(content, entry.content)
+	return Object{
+		Metadata: Metadata{
+			Path:         path,
+			LastModified: entry.lastModified,
+		},
+		Content: content,
+	}, nil
+}
+
+// PutObject uploads an object to the wrapped backend, and invalidates its entry
+func (b CachingBackend) PutObject(path string, content []byte) error {
+	defer b.invalidate(path, false)
+	return b.Backend.PutObject(path, content)
+}
+
+// DeleteObject removes an object from the wrapped backend, and invalidates its entry
+func (b CachingBackend) DeleteObject(path string) error {
+	defer b.invalidate(path, false)
+	return b.Backend.DeleteObject(path)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend, and invalidates the entries of both paths
+func (b CachingBackend) RenamePrefixOrObject(path, newPath string) error {
+	defer b.invalidate(newPath, true)
+	defer b.invalidate(path, true)
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the cache, or from the wrapped backend on a miss
+func (b CachingBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object, err := b.GetObject(path)
+	if err != nil {
+		return &ObjectStream{Metadata: object.Metadata}, err
+	}
+	return &ObjectStream{
+		Metadata: object.Metadata,
+		Content:  ioutil.NopCloser(bytes.NewReader(object.Content)),
+	}, nil
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend, and invalidates its entry
+func (b CachingBackend) PutObjectStream(path string, content io.Reader) error {
+	defer b.invalidate(path, false)
+	return putObjectStream(b.Backend, path, content)
+}
+
+func (b CachingBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	entry, err := b.get(path)
+	if err != nil {
+		if err == ErrObjectNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	serveObject(w, r, Object{
+		Metadata: Metadata{
+			Path:         path,
+			LastModified: entry.lastModified,
+		},
+		Content: entry.content,
+	}, entry.etag)
+}
@@ -0,0 +1,403 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	microsoft_storage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/googleapi"
+)
+
+// cachingCountingBackend counts the reads of a backend, and hides its streams
+type cachingCountingBackend struct {
+	Backend
+	gets int32
+}
+
+func (b *cachingCountingBackend) GetObject(path string) (Object, error) {
+	atomic.AddInt32(&b.gets, 1)
+	return b.Backend.GetObject(path)
+}
+
+// cachingSDKBackend fails the reads of missing objects with the error of an SDK
+type cachingSDKBackend struct {
+	Backend
+	err  error
+	gets int32
+}
+
+func (b *cachingSDKBackend) GetObject(path string) (Object, error) {
+	atomic.AddInt32(&b.gets, 1)
+	object, err := b.Backend.GetObject(path)
+	if isObjectNotFound(err) {
+		return object, b.err
+	}
+	return object, err
+}
+
+// cachingCountingStreamBackend counts the reads of a backend with streams
+type cachingCountingStreamBackend struct {
+	BackendStream
+	gets    int32
+	streams int32
+}
+
+func (b *cachingCountingStreamBackend) GetObject(path string) (Object, error) {
+	atomic.AddInt32(&b.gets, 1)
+	return b.BackendStream.GetObject(path)
+}
+
+func (b *cachingCountingStreamBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	atomic.AddInt32(&b.streams, 1)
+	return b.BackendStream.GetObjectStream(path)
+}
+
+type CachingTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+}
+
+func (suite *CachingTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-caching/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(filepath.Join(suite.TempDirectory, "storage"))
+}
+
+func (suite *CachingTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+// touch changes an object behind the back of the cache, with a distinct modification time
+func (suite *CachingTestSuite) touch(path string, content string, modTime time.Time) {
+	suite.Nil(suite.Local.PutObject(path, []byte(content)))
+	suite.Nil(os.Chtimes(filepath.Join(suite.Local.RootDirectory, path), modTime, modTime))
+}
+
+func (suite *CachingTestSuite) TestHitsAndMisses() {
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	cache := NewCachingBackend(inner, 1024, 0)
+	suite.Nil(cache.PutObject("hot.txt", []byte("hot")))
+
+	for i := 0; i < 3; i++ {
+		object, err := cache.GetObject("hot.txt")
+		suite.Nil(err, "no error getting object")
+		suite.Equal([]byte("hot"), object.Content)
+		suite.Equal("hot.txt", object.Path)
+		object.Content[0] = 'n'
+	}
+	suite.Equal(int32(1), inner.gets, "backend is read once")
+	suite.Equal(CacheStats{Hits: 2, Misses: 1}, cache.Stats())
+
+	var wg sync.WaitGroup
+	cache.Purge()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			object, err := cache.GetObject("hot.txt")
+			suite.Nil(err)
+			suite.Equal([]byte("hot"), object.Content, "cached content cannot be altered")
+		}()
+	}
+	wg.Wait()
+	suite.Equal(int32(2), inner.gets, "concurrent misses share a single read")
+}
+
+func (suite *CachingTestSuite) TestEviction() {
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	// room for two entries of a 5 bytes path and 5 bytes of content
+	cache := NewCachingBackend(inner, 20, 0)
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		suite.Nil(suite.Local.PutObject(path, []byte("01234")))
+	}
+
+	for _, path := range []string{"a.txt", "b.txt", "a.txt", "c.txt", "a.txt"} {
+		_, err := cache.GetObject(path)
+		suite.Nil(err)
+	}
+	suite.Equal(int32(3), inner.gets, "recently used entry is kept")
+	suite.Equal(uint64(1), cache.Stats().Evictions, "least recently used entry is evicted")
+
+	_, err := cache.GetObject("b.txt")
+	suite.Nil(err)
+	suite.Equal(int32(4), inner.gets, "evicted entry is read again")
+
+	suite.Nil(suite.Local.PutObject("large.txt", make([]byte, 100)))
+	for i := 0; i < 2; i++ {
+		_, err = cache.GetObject("large.txt")
+		suite.Nil(err)
+	}
+	suite.Equal(int32(6), inner.gets, "entries larger than the cache are not cached")
+}
+
+func (suite *CachingTestSuite) TestDiskTier() {
+	directory := filepath.Join(suite.TempDirectory, "cache")
+	suite.Nil(os.MkdirAll(directory, 0700))
+	suite.Nil(ioutil.WriteFile(filepath.Join(directory, "stale.cache"), []byte("stale"), 0600))
+	suite.Nil(ioutil.WriteFile(filepath.Join(directory, "keep.txt"), []byte("keep"), 0600))
+
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	cache := NewCachingBackendWithDirectory(inner, 20, 0, directory, 1024)
+	_, err := os.Stat(filepath.Join(directory, "stale.cache"))
+	suite.True(os.IsNotExist(err), "stale files are removed")
+	_, err = os.Stat(filepath.Join(directory, "keep.txt"))
+	suite.Nil(err, "other files are kept")
+
+	suite.Nil(suite.Local.PutObject("disk.txt", make([]byte, 100)))
+	for i := 0; i < 3; i++ {
+		object, err := cache.GetObject("disk.txt")
+		suite.Nil(err)
+		suite.Len(object.Content, 100)
+	}
+	suite.Equal(int32(1), inner.gets, "entries too large for memory are served from disk")
+	files, _ := filepath.Glob(filepath.Join(directory, "*.cache"))
+	suite.Len(files, 1, "entry is on disk")
+
+	suite.Nil(cache.DeleteObject("disk.txt"))
+	files, _ = filepath.Glob(filepath.Join(directory, "*.cache"))
+	suite.Empty(files, "invalidated entries are removed from disk")
+
+	// memory holds a single small entry, the disk keeps the others
+	for _, path := range []string{"a.txt", "b.txt"} {
+		suite.Nil(suite.Local.PutObject(path, []byte("01234")))
+	}
+	for _, path := range []string{"a.txt", "b.txt", "a.txt", "b.txt"} {
+		_, err := cache.GetObject(path)
+		suite.Nil(err)
+	}
+	suite.Equal(int32(3), inner.gets, "entries evicted from memory are served from disk")
+}
+
+func (suite *CachingTestSuite) TestDiskTierReplacedFiles() {
+	directory := filepath.Join(suite.TempDirectory, "cache")
+	cache := NewCachingBackendWithDirectory(suite.Local, 20, 20*time.Millisecond, directory, 1024)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("version %d", i)
+		suite.touch("changing.txt", content, past.Add(time.Duration(i)*time.Minute))
+		time.Sleep(30 * time.Millisecond)
+		object, err := cache.GetObject("changing.txt")
+		suite.Nil(err)
+		suite.Equal([]byte(content), object.Content)
+	}
+	files, _ := filepath.Glob(filepath.Join(directory, "*.cache"))
+	suite.Len(files, 1, "the files of replaced entries are removed")
+	suite.Equal(uint64(0), cache.Stats().Evictions, "replaced entries are not evicted")
+
+	suite.Nil(suite.Local.DeleteObject("changing.txt"))
+	time.Sleep(30 * time.Millisecond)
+	_, err := cache.GetObject("changing.txt")
+	suite.ErrorIs(err, ErrObjectNotFound)
+	files, _ = filepath.Glob(filepath.Join(directory, "*.cache"))
+	suite.Empty(files, "an entry replaced by a not found result is removed from disk")
+}
+
+func (suite *CachingTestSuite) TestRevalidation() {
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	suite.touch("stream.txt", "v1", past)
+
+	inner := &cachingCountingStreamBackend{BackendStream: suite.Local}
+	cache := NewCachingBackend(inner, 1024, 20*time.Millisecond)
+
+	object, err := cache.GetObject("stream.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), object.Content)
+	suite.Equal(past, object.LastModified.Truncate(time.Second))
+
+	time.Sleep(30 * time.Millisecond)
+	object, err = cache.GetObject("stream.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), object.Content)
+	suite.Equal(uint64(1), cache.Stats().Revalidations, "unchanged entry is revalidated by LastModified")
+	suite.Equal(int32(1), inner.streams, "revalidation opens a stream")
+
+	suite.touch("stream.txt", "v2", past.Add(time.Minute))
+	object, err = cache.GetObject("stream.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), object.Content, "changes behind the cache are not seen before the TTL")
+
+	time.Sleep(30 * time.Millisecond)
+	object, err = cache.GetObject("stream.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), object.Content, "changes are seen after the TTL")
+
+	// without streams the content is read again, and compared by ETag
+	suite.touch("plain.txt", "v1", past)
+	plain := &cachingCountingBackend{Backend: suite.Local}
+	cache = NewCachingBackend(plain, 1024, 20*time.Millisecond)
+	_, err = cache.GetObject("plain.txt")
+	suite.Nil(err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = cache.GetObject("plain.txt")
+	suite.Nil(err)
+	suite.Equal(int32(2), plain.gets)
+	suite.Equal(uint64(1), cache.Stats().Revalidations, "unchanged entry is revalidated by ETag")
+}
+
+func (suite *CachingTestSuite) TestNegativeCaching() {
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	cache := NewCachingBackend(inner, 1024, 20*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetObject("missing.txt")
+		suite.ErrorIs(err, ErrObjectNotFound, "not found is reported as ErrObjectNotFound")
+	}
+	suite.Equal(int32(1), inner.gets, "not found is cached")
+
+	suite.Nil(suite.Local.PutObject("missing.txt", []byte("here")))
+	_, err := cache.GetObject("missing.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "not found is served from the cache")
+	time.Sleep(30 * time.Millisecond)
+	object, err := cache.GetObject("missing.txt")
+	suite.Nil(err, "not found expires")
+	suite.Equal([]byte("here"), object.Content)
+
+	_, err = cache.GetObject("other.txt")
+	suite.ErrorIs(err, ErrObjectNotFound)
+	suite.Nil(cache.PutObject("other.txt", []byte("put")))
+	object, err = cache.GetObject("other.txt")
+	suite.Nil(err, "puts invalidate not found")
+	suite.Equal([]byte("put"), object.Content)
+
+	cache.NegativeTTL = 0
+	gets := inner.gets
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetObject("absent.txt")
+		suite.ErrorIs(err, ErrObjectNotFound)
+	}
+	suite.Equal(gets+2, inner.gets, "not found is not cached without NegativeTTL")
+}
+
+func (suite *CachingTestSuite) TestSDKNotFound() {
+	for _, err := range []error{
+		awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), 404, ""),
+		&googleapi.Error{Code: 404},
+		microsoft_storage.AzureStorageServiceError{Code: "BlobNotFound", StatusCode: 404},
+	} {
+		inner := &cachingSDKBackend{Backend: suite.Local, err: err}
+		cache := NewCachingBackend(inner, 1024, time.Minute)
+		for i := 0; i < 2; i++ {
+			_, getErr := cache.GetObject("missing.txt")
+			suite.ErrorIs(getErr, ErrObjectNotFound, "%T is a not found", err)
+		}
+		suite.Equal(int32(1), inner.gets, "%T is cached as not found", err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+		cache.HandleHttpFileDownload(w, r, "missing.txt")
+		suite.Equal(http.StatusNotFound, w.Code, "%T is served as not found", err)
+	}
+}
+
+func (suite *CachingTestSuite) TestStructLiteral() {
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	cache := CachingBackend{Backend: inner}
+
+	suite.Nil(cache.PutObject("literal.txt", []byte("literal")))
+	for i := 0; i < 2; i++ {
+		object, err := cache.GetObject("literal.txt")
+		suite.Nil(err)
+		suite.Equal([]byte("literal"), object.Content)
+	}
+	suite.Equal(int32(2), inner.gets, "nothing is cached")
+	_, err := cache.GetObject("missing.txt")
+	suite.ErrorIs(err, ErrObjectNotFound)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/literal.txt", nil)
+	cache.HandleHttpFileDownload(w, r, "literal.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Nil(cache.RenamePrefixOrObject("literal.txt", "renamed.txt"))
+	suite.Nil(cache.DeleteObject("renamed.txt"))
+	cache.Purge()
+	suite.Equal(CacheStats{}, cache.Stats())
+}
+
+func (suite *CachingTestSuite) TestInvalidation() {
+	inner := &cachingCountingBackend{Backend: suite.Local}
+	cache := NewCachingBackend(inner, 1024, 0)
+
+	suite.Nil(cache.PutObject("dir/a.txt", []byte("v1")))
+	_, err := cache.GetObject("dir/a.txt")
+	suite.Nil(err)
+	suite.Nil(cache.PutObject("dir/a.txt", []byte("v2")))
+	object, err := cache.GetObject("dir/a.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), object.Content, "puts invalidate")
+
+	_, err = cache.GetObject("moved/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound)
+	suite.Nil(cache.RenamePrefixOrObject("dir", "moved"))
+	_, err = cache.GetObject("dir/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "renames invalidate the old path")
+	object, err = cache.GetObject("moved/a.txt")
+	suite.Nil(err, "renames invalidate the new path")
+	suite.Equal([]byte("v2"), object.Content)
+
+	suite.Nil(cache.DeleteObject("moved/a.txt"))
+	_, err = cache.GetObject("moved/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deletes invalidate")
+}
+
+func (suite *CachingTestSuite) TestHandleHttpFileDownload() {
+	cache := NewCachingBackend(suite.Local, 1024, 0)
+	suite.Nil(cache.PutObject("download.txt", []byte("0123456789")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	cache.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("0123456789", w.Body.String())
+	etag := w.Header().Get("ETag")
+	suite.NotEmpty(etag, "ETag is set")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	cache.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusNotModified, w.Code, "ETag is revalidated")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	cache.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code)
+	suite.Equal("234", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	cache.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestCachingStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(CachingTestSuite))
+}
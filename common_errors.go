@@ -6,4 +6,7 @@ var (
 	ErrPrefixIsAnObject = errors.New("prefix is an object")
 	ErrNotImplemented   = errors.New("not implemented")
 	ErrNewPathNotEmpty  = errors.New("new path is not empty")
+	ErrObjectNotFound   = errors.New("object not found")
+	ErrReadOnly         = errors.New("backend is read-only")
+	ErrAccessDenied     = errors.New("access denied")
 )
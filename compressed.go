@@ -0,0 +1,336 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressedMagic starts every object written compressed by a CompressedBackend, followed by the id of its codec
+	compressedMagic = "CMCMP\x01"
+	// compressedSniffSize is how much of a stream is read ahead to recognize compressed content
+	compressedSniffSize = 512
+
+	compressedCodecNone = 'n'
+	compressedCodecGzip = 'g'
+	compressedCodecZstd = 'z'
+)
+
+var (
+	// compressedExtensions are the extensions of the objects already compressed
+	compressedExtensions = []string{".tgz", ".gz", ".zip", ".zst", ".bz2", ".xz", ".7z", ".jar", ".png", ".jpg", ".jpeg", ".gif", ".webp"}
+	// compressedSignatures are the magic bytes of the content already compressed
+	compressedSignatures = [][]byte{
+		{0x1f, 0x8b},                       // gzip
+		{'P', 'K', 0x03, 0x04},             // zip
+		{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+		{'B', 'Z', 'h'},                    // bzip2
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+		{0x89, 'P', 'N', 'G'},              // png
+		{0xff, 0xd8, 0xff},                 // jpeg
+		{'G', 'I', 'F', '8'},               // gif
+	}
+
+	// compressedZstdEncoder and compressedZstdDecoder are safe for concurrent use with EncodeAll and DecodeAll
+	compressedZstdEncoder, _ = zstd.NewWriter(nil)
+	compressedZstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type (
+	// CompressedBackend is a Backend wrapper compressing the content of the objects with zstd or gzip before it reaches the wrapped backend
+	// The content already compressed is stored as is, and so are the objects written before the wrapper was used
+	CompressedBackend struct {
+		Backend Backend
+		// Codec is the compression of the new objects, zstd or gzip; the objects of both are read whichever it is
+		Codec string
+	}
+
+	// compressedReadCloser closes both the decompressor and the stream it reads from
+	compressedReadCloser struct {
+		io.Reader
+		close func() error
+	}
+)
+
+// NewCompressedBackend creates a new instance of CompressedBackend, compressing with codec, zstd or gzip
+func NewCompressedBackend(backend Backend, codec string) *CompressedBackend {
+	if codec == "" {
+		codec = "zstd"
+	}
+	if _, err := compressedCodecID(codec); err != nil {
+		panic("Failed to create compressed backend: " + err.Error())
+	}
+	return &CompressedBackend{
+		Backend: backend,
+		Codec:   codec,
+	}
+}
+
+func compressedCodecID(codec string) (byte, error) {
+	switch codec {
+	case "zstd":
+		return compressedCodecZstd, nil
+	case "gzip":
+		return compressedCodecGzip, nil
+	}
+	return 0, fmt.Errorf("unsupported codec %q", codec)
+}
+
+// isCompressed reports whether an object is already compressed, by the extension of its path or the first bytes of its content
+func isCompressed(path string, content []byte) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range compressedExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	for _, signature := range compressedSignatures {
+		if bytes.HasPrefix(content, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c compressedReadCloser) Close() error {
+	return c.close()
+}
+
+// compress writes the header and the compressed content to w
+func (b CompressedBackend) compress(w io.Writer, content io.Reader) error {
+	codec, err := compressedCodecID(b.Codec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(compressedMagic), codec)); err != nil {
+		return err
+	}
+	var encoder io.WriteCloser
+	if codec == compressedCodecZstd {
+		encoder, err = zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+	} else {
+		encoder = gzip.NewWriter(w)
+	}
+	if _, err := io.Copy(encoder, content); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// compressBytes returns the header and the compressed content, zstd reusing its shared encoder
+func (b CompressedBackend) compressBytes(content []byte) ([]byte, error) {
+	if b.Codec == "zstd" {
+		return compressedZstdEncoder.EncodeAll(content, []byte(compressedMagic+string(compressedCodecZstd))), nil
+	}
+	var buf bytes.Buffer
+	err := b.compress(&buf, bytes.NewReader(content))
+	return buf.Bytes(), err
+}
+
+// decompress returns the content of an object as written by the wrapper
+func decompress(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(compressedMagic)) || len(content) == len(compressedMagic) {
+		return content, nil
+	}
+	data := content[len(compressedMagic)+1:]
+	switch content[len(compressedMagic)] {
+	case compressedCodecNone:
+		return data, nil
+	case compressedCodecZstd:
+		return compressedZstdDecoder.DecodeAll(data, nil)
+	case compressedCodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unsupported codec %q", content[len(compressedMagic)])
+}
+
+// decompressStream returns the content of an object stream as written by the wrapper
+func decompressStream(content io.ReadCloser) (io.ReadCloser, error) {
+	source := bufio.NewReader(content)
+	header, _ := source.Peek(len(compressedMagic) + 1)
+	if len(header) <= len(compressedMagic) || string(header[:len(compressedMagic)]) != compressedMagic {
+		return compressedReadCloser{Reader: source, close: content.Close}, nil
+	}
+	source.Discard(len(header))
+	switch header[len(compressedMagic)] {
+	case compressedCodecNone:
+		return compressedReadCloser{Reader: source, close: content.Close}, nil
+	case compressedCodecZstd:
+		decoder, err := zstd.NewReader(source, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			content.Close()
+			return nil, err
+		}
+		return compressedReadCloser{Reader: decoder, close: func() error {
+			decoder.Close()
+			return content.Close()
+		}}, nil
+	case compressedCodecGzip:
+		decoder, err := gzip.NewReader(source)
+		if err != nil {
+			content.Close()
+			return nil, err
+		}
+		return compressedReadCloser{Reader: decoder, close: func() error {
+			decoder.Close()
+			return content.Close()
+		}}, nil
+	}
+	content.Close()
+	return nil, fmt.Errorf("unsupported codec %q", header[len(compressedMagic)])
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b CompressedBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b CompressedBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b CompressedBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend
+func (b CompressedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the wrapped backend and decompresses it, Size is the size of the decompressed content
+func (b CompressedBackend) GetObject(path string) (Object, error) {
+	object, err := b.Backend.GetObject(path)
+	if err != nil {
+		return object, err
+	}
+	content, err := decompress(object.Content)
+	if err != nil {
+		return Object{Metadata: object.Metadata}, err
+	}
+	object.Content = content
+	object.Size = int64(len(content))
+	return object, nil
+}
+
+// PutObject compresses an object and uploads it to the wrapped backend
+// The content already compressed, or which does not shrink, is uploaded as is
+func (b CompressedBackend) PutObject(path string, content []byte) error {
+	if !isCompressed(path, content) {
+		compressed, err := b.compressBytes(content)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(content) {
+			return b.Backend.PutObject(path, compressed)
+		}
+	}
+	if bytes.HasPrefix(content, []byte(compressedMagic)) {
+		// stored as is, the content would be taken for the header of the wrapper
+		return b.Backend.PutObject(path, append([]byte(compressedMagic+string(compressedCodecNone)), content...))
+	}
+	return b.Backend.PutObject(path, content)
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b CompressedBackend) DeleteObject(path string) error {
+	return b.Backend.DeleteObject(path)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+func (b CompressedBackend) RenamePrefixOrObject(path, newPath string) error {
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend, decompressed as it is read
+func (b CompressedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	stream, err := getObjectStream(b.Backend, path)
+	if err != nil {
+		return stream, err
+	}
+	content, err := decompressStream(stream.Content)
+	if err != nil {
+		return &ObjectStream{Metadata: stream.Metadata}, err
+	}
+	stream.Content = content
+	// the size of the decompressed content is not known before reading it
+	stream.Size = 0
+	return stream, nil
+}
+
+// PutObjectStream compresses an object stream as it is uploaded to the wrapped backend
+// The first bytes of the stream are read ahead to recognize content already compressed, which is uploaded as is
+func (b CompressedBackend) PutObjectStream(path string, content io.Reader) error {
+	source := bufio.NewReaderSize(content, compressedSniffSize)
+	head, err := source.Peek(compressedSniffSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if isCompressed(path, head) {
+		if bytes.HasPrefix(head, []byte(compressedMagic)) {
+			header := bytes.NewReader([]byte(compressedMagic + string(compressedCodecNone)))
+			return putObjectStream(b.Backend, path, io.MultiReader(header, source))
+		}
+		return putObjectStream(b.Backend, path, source)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(b.compress(w, source))
+	}()
+	err = putObjectStream(b.Backend, path, r)
+	// unblocks the compression when the upload stopped reading
+	r.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+func (b CompressedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	object, err := b.GetObject(path)
+	if err != nil {
+		if isObjectNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	serveObject(w, r, object, "")
+}
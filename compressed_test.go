@@ -0,0 +1,174 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CompressedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Remote        *LocalFilesystemBackend
+	Zstd          *CompressedBackend
+	Gzip          *CompressedBackend
+	Index         []byte
+}
+
+func (suite *CompressedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-compressed/%s", timestamp)
+	suite.Remote = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.Zstd = NewCompressedBackend(suite.Remote, "zstd")
+	suite.Gzip = NewCompressedBackend(suite.Remote, "gzip")
+	suite.Index = []byte("apiVersion: v1\nentries:\n" + strings.Repeat("  mychart:\n  - version: 0.1.0\n    digest: abcdef\n", 200))
+}
+
+func (suite *CompressedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *CompressedTestSuite) stored(path string) []byte {
+	object, err := suite.Remote.GetObject(path)
+	suite.Nil(err)
+	return object.Content
+}
+
+func (suite *CompressedTestSuite) getStream(backend *CompressedBackend, path string) []byte {
+	stream, err := backend.GetObjectStream(path)
+	suite.Nil(err, "no error getting stream of %s", path)
+	content, err := ioutil.ReadAll(stream.Content)
+	suite.Nil(err, "no error reading stream of %s", path)
+	suite.Nil(stream.Content.Close())
+	return content
+}
+
+func (suite *CompressedTestSuite) TestCompression() {
+	for codec, backend := range map[byte]*CompressedBackend{compressedCodecZstd: suite.Zstd, compressedCodecGzip: suite.Gzip} {
+		path := fmt.Sprintf("%c/index.yaml", codec)
+		suite.Nil(backend.PutObject(path, suite.Index), "no error putting object with %s", backend.Codec)
+		stored := suite.stored(path)
+		suite.Equal(append([]byte(compressedMagic), codec), stored[:len(compressedMagic)+1], "codec is recorded in the header")
+		suite.True(len(stored)*10 < len(suite.Index), "%s compresses the index, %d bytes", backend.Codec, len(stored))
+
+		object, err := backend.GetObject(path)
+		suite.Nil(err)
+		suite.Equal(suite.Index, object.Content)
+		suite.Equal(int64(len(suite.Index)), object.Size)
+		suite.Equal(suite.Index, suite.getStream(backend, path))
+
+		streamPath := fmt.Sprintf("%c/stream.yaml", codec)
+		suite.Nil(backend.PutObjectStream(streamPath, bytes.NewReader(suite.Index)), "no error putting stream with %s", backend.Codec)
+		suite.Equal(codec, suite.stored(streamPath)[len(compressedMagic)], "streams are compressed")
+		suite.Equal(suite.Index, suite.getStream(backend, streamPath))
+	}
+
+	// either codec is read whatever the codec of the wrapper
+	object, err := suite.Gzip.GetObject("z/index.yaml")
+	suite.Nil(err)
+	suite.Equal(suite.Index, object.Content)
+	suite.Equal(suite.Index, suite.getStream(suite.Zstd, "g/stream.yaml"))
+}
+
+func (suite *CompressedTestSuite) TestSkipping() {
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write(suite.Index)
+	w.Close()
+	header := []byte(compressedMagic + "z plain content")
+
+	for path, content := range map[string][]byte{
+		"mychart-0.1.0.tgz": suite.Index,     // by extension
+		"index.yaml.bin":    gzipped.Bytes(), // by magic bytes
+		"tiny.txt":          []byte("tiny"),  // would not shrink
+		"header.txt":        header,          // would be taken for the header of the wrapper
+	} {
+		suite.Nil(suite.Zstd.PutObject(path, content), "no error putting %s", path)
+		object, err := suite.Zstd.GetObject(path)
+		suite.Nil(err)
+		suite.Equal(content, object.Content, "%s round trips", path)
+
+		streamPath := "stream-" + path
+		suite.Nil(suite.Zstd.PutObjectStream(streamPath, bytes.NewReader(content)), "no error putting stream %s", path)
+		suite.Equal(content, suite.getStream(suite.Zstd, streamPath), "%s round trips as a stream", path)
+	}
+	suite.Equal(suite.Index, suite.stored("mychart-0.1.0.tgz"), "compressed extensions are stored as is")
+	suite.Equal(gzipped.Bytes(), suite.stored("stream-index.yaml.bin"), "compressed content is stored as is")
+	suite.Equal([]byte("tiny"), suite.stored("tiny.txt"))
+	suite.Equal(append([]byte(compressedMagic+string(compressedCodecNone)), header...), suite.stored("header.txt"))
+}
+
+func (suite *CompressedTestSuite) TestLegacyObjects() {
+	suite.Nil(suite.Remote.PutObject("legacy/index.yaml", suite.Index))
+	suite.Nil(suite.Remote.PutObject("legacy/empty.txt", []byte{}))
+
+	object, err := suite.Zstd.GetObject("legacy/index.yaml")
+	suite.Nil(err, "legacy objects are read")
+	suite.Equal(suite.Index, object.Content)
+	suite.Equal(suite.Index, suite.getStream(suite.Zstd, "legacy/index.yaml"))
+
+	object, err = suite.Zstd.GetObject("legacy/empty.txt")
+	suite.Nil(err)
+	suite.Empty(object.Content)
+	suite.Empty(suite.getStream(suite.Zstd, "legacy/empty.txt"))
+
+	objects, err := suite.Zstd.ListObjects("legacy")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+
+	suite.Nil(suite.Zstd.RenamePrefixOrObject("legacy/index.yaml", "renamed/index.yaml"))
+	suite.Nil(suite.Zstd.DeleteObject("legacy/empty.txt"))
+	_, err = suite.Zstd.GetObject("legacy/empty.txt")
+	suite.NotNil(err)
+}
+
+func (suite *CompressedTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.Zstd.PutObject("index.yaml", suite.Index))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	suite.Zstd.HandleHttpFileDownload(w, r, "index.yaml")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(suite.Index, w.Body.Bytes(), "objects are served decompressed")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.yaml", nil)
+	suite.Zstd.HandleHttpFileDownload(w, r, "missing.yaml")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func (suite *CompressedTestSuite) TestUnsupportedCodec() {
+	suite.Panics(func() {
+		NewCompressedBackend(suite.Remote, "lz4")
+	})
+	suite.Equal("zstd", NewCompressedBackend(suite.Remote, "").Codec, "zstd by default")
+}
+
+func TestCompressedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(CompressedTestSuite))
+}
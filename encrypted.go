@@ -0,0 +1,594 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// encryptedMagic starts every object written by an EncryptedBackend, followed by the length of its header
+	encryptedMagic            = "CMENC\x01"
+	encryptedDefaultChunkSize = 64 * 1024
+	encryptedMaxChunkSize     = 16 * 1024 * 1024
+	encryptedMaxHeaderSize    = 64 * 1024
+	encryptedKeySize          = 32
+	// encryptedNoncePrefixSize leaves room in the nonce for the chunk counter and the last chunk flag
+	encryptedNoncePrefixSize = 7
+)
+
+var errEncryptedFormat = errors.New("object is not encrypted or is corrupted")
+
+type (
+	// KeyProvider protects the data keys of an EncryptedBackend with key encryption keys, e.g. kept by a KMS
+	KeyProvider interface {
+		// WrapKey encrypts a data key with the current key encryption key, and returns the id of that key
+		WrapKey(dataKey []byte) (keyID string, wrappedKey []byte, err error)
+		// UnwrapKey decrypts a data key wrapped with the key encryption key keyID
+		UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+	}
+
+	// LocalKeyProvider is a KeyProvider with AES-256 key encryption keys kept in a local file
+	// Every line of the file is the id of a key and the key encoded in base64, separated by a space,
+	// the last key wraps the new data keys and the previous ones still unwrap the keys they wrapped
+	LocalKeyProvider struct {
+		Keyfile string
+		mutex   sync.RWMutex
+		keys    map[string][]byte
+		current string
+	}
+
+	// EncryptedBackend is a Backend wrapper encrypting the content of the objects with AES-256-GCM before it reaches the wrapped backend
+	// Every object has its own data key, wrapped by the KeyProvider and stored in the header of the object
+	// Paths and modification times are not encrypted
+	EncryptedBackend struct {
+		Backend     Backend
+		KeyProvider KeyProvider
+		// ChunkSize is the size of the plaintext chunks sealed separately, so that objects are decrypted as they are streamed
+		ChunkSize int
+	}
+
+	// encryptedHeader is stored in front of the sealed chunks of an object
+	encryptedHeader struct {
+		KeyID       string `json:"key_id"`
+		WrappedKey  []byte `json:"wrapped_key"`
+		NoncePrefix []byte `json:"nonce_prefix"`
+		ChunkSize   int    `json:"chunk_size"`
+		Size        int64  `json:"size"`
+	}
+
+	// encryptedReader decrypts the sealed chunks of an object as they are read
+	encryptedReader struct {
+		source  *bufio.Reader
+		closer  io.Closer
+		aead    cipher.AEAD
+		header  encryptedHeader
+		chunk   []byte
+		plain   []byte
+		counter uint32
+		read    int64
+		last    bool
+		err     error
+	}
+)
+
+// NewLocalKeyProvider creates a new instance of LocalKeyProvider with the keys of keyfile
+// The keyfile is created with a new key if it does not exist
+func NewLocalKeyProvider(keyfile string) *LocalKeyProvider {
+	p := &LocalKeyProvider{
+		Keyfile: keyfile,
+		keys:    map[string][]byte{},
+	}
+
+	content, err := ioutil.ReadFile(keyfile)
+	if err != nil && !os.IsNotExist(err) {
+		panic("Failed to read keyfile: " + err.Error())
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			panic(fmt.Sprintf("Failed to read keyfile: invalid line %d", i+1))
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != encryptedKeySize {
+			panic(fmt.Sprintf("Failed to read keyfile: line %d is not a base64 encoded 256 bits key", i+1))
+		}
+		p.keys[fields[0]] = key
+		p.current = fields[0]
+	}
+
+	if p.current == "" {
+		_, err = p.Rotate()
+		if err != nil {
+			panic("Failed to create keyfile: " + err.Error())
+		}
+	}
+	return p
+}
+
+// Rotate appends a new key to the keyfile, which wraps the data keys from then on, and returns its id
+// The data keys wrapped before are rewrapped with EncryptedBackend.RotateKeys
+func (p *LocalKeyProvider) Rotate() (string, error) {
+	key := make([]byte, encryptedKeySize)
+	id := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	keyID := hex.EncodeToString(id)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p.Keyfile), 0700); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(p.Keyfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(file, "%s %s\n", keyID, base64.StdEncoding.EncodeToString(key))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	p.keys[keyID] = key
+	p.current = keyID
+	return keyID, nil
+}
+
+// WrapKey encrypts a data key with the last key of the keyfile
+func (p *LocalKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	p.mutex.RLock()
+	keyID := p.current
+	key := p.keys[keyID]
+	p.mutex.RUnlock()
+
+	aead, err := newEncryptedAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return keyID, aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped with the key keyID of the keyfile
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	p.mutex.RLock()
+	key, ok := p.keys[keyID]
+	p.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+
+	aead, err := newEncryptedAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, errEncryptedFormat
+	}
+	nonce := wrappedKey[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrappedKey[aead.NonceSize():], []byte(keyID))
+}
+
+func newEncryptedAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedNonce is the nonce of a chunk, its counter and last flag prevent chunks from being reordered, dropped or appended
+func encryptedNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (h encryptedHeader) marshal() ([]byte, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(encryptedMagic)+4+len(header))
+	buf = append(buf, encryptedMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)))
+	return append(buf, header...), nil
+}
+
+// readEncryptedHeader reads the header in front of the sealed chunks, and returns its length
+func readEncryptedHeader(r io.Reader) (encryptedHeader, int, error) {
+	var header encryptedHeader
+	prefix := make([]byte, len(encryptedMagic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return header, 0, errEncryptedFormat
+	}
+	if string(prefix[:len(encryptedMagic)]) != encryptedMagic {
+		return header, 0, errEncryptedFormat
+	}
+	length := binary.BigEndian.Uint32(prefix[len(encryptedMagic):])
+	if length > encryptedMaxHeaderSize {
+		return header, 0, errEncryptedFormat
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return header, 0, errEncryptedFormat
+	}
+	if err := json.Unmarshal(buf, &header); err != nil {
+		return header, 0, errEncryptedFormat
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > encryptedMaxChunkSize ||
+		len(header.NoncePrefix) != encryptedNoncePrefixSize || header.Size < 0 {
+		return header, 0, errEncryptedFormat
+	}
+	return header, len(prefix) + int(length), nil
+}
+
+// NewEncryptedBackend creates a new instance of EncryptedBackend, with the data keys wrapped by keyProvider
+func NewEncryptedBackend(backend Backend, keyProvider KeyProvider) *EncryptedBackend {
+	return &EncryptedBackend{
+		Backend:     backend,
+		KeyProvider: keyProvider,
+		ChunkSize:   encryptedDefaultChunkSize,
+	}
+}
+
+// newHeader generates the data key of a new object, and the header storing it wrapped
+func (b EncryptedBackend) newHeader() (encryptedHeader, cipher.AEAD, error) {
+	chunkSize := b.ChunkSize
+	if chunkSize <= 0 || chunkSize > encryptedMaxChunkSize {
+		chunkSize = encryptedDefaultChunkSize
+	}
+	header := encryptedHeader{
+		NoncePrefix: make([]byte, encryptedNoncePrefixSize),
+		ChunkSize:   chunkSize,
+	}
+	dataKey := make([]byte, encryptedKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return header, nil, err
+	}
+	if _, err := rand.Read(header.NoncePrefix); err != nil {
+		return header, nil, err
+	}
+	var err error
+	header.KeyID, header.WrappedKey, err = b.KeyProvider.WrapKey(dataKey)
+	if err != nil {
+		return header, nil, err
+	}
+	aead, err := newEncryptedAEAD(dataKey)
+	return header, aead, err
+}
+
+// sealChunks encrypts content into w chunk by chunk, and returns the size of the plaintext
+func sealChunks(w io.Writer, content io.Reader, aead cipher.AEAD, header encryptedHeader) (int64, error) {
+	source := bufio.NewReader(content)
+	plain := make([]byte, header.ChunkSize)
+	sealed := make([]byte, 0, header.ChunkSize+aead.Overhead())
+	var size int64
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(source, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		last := err != nil
+		if !last {
+			// a full chunk is the last one when nothing follows it
+			if _, err := source.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return size, err
+			}
+		}
+		size += int64(n)
+		sealed = aead.Seal(sealed[:0], encryptedNonce(header.NoncePrefix, counter, last), plain[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return size, err
+		}
+		if last {
+			return size, nil
+		}
+		if counter == ^uint32(0) {
+			return size, errors.New("object is too large to be encrypted")
+		}
+	}
+}
+
+// open decrypts the object read from source, which is closed with the returned reader
+func (b EncryptedBackend) open(source io.ReadCloser) (*encryptedReader, error) {
+	r := &encryptedReader{
+		source: bufio.NewReader(source),
+		closer: source,
+	}
+	header, _, err := readEncryptedHeader(r.source)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	dataKey, err := b.KeyProvider.UnwrapKey(header.KeyID, header.WrappedKey)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	r.aead, err = newEncryptedAEAD(dataKey)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	r.header = header
+	r.chunk = make([]byte, header.ChunkSize+r.aead.Overhead())
+	return r, nil
+}
+
+// Read decrypts the chunks one at a time, and fails if they were altered, reordered or truncated
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.last {
+			if r.read != r.header.Size {
+				r.err = errEncryptedFormat
+			} else {
+				r.err = io.EOF
+			}
+			continue
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *encryptedReader) next() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	if err == io.EOF {
+		// the last chunk is missing
+		return errEncryptedFormat
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := r.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.aead.Open(r.chunk[:0], encryptedNonce(r.header.NoncePrefix, r.counter, last), r.chunk[:n], nil)
+	if err != nil {
+		return errEncryptedFormat
+	}
+	r.plain = plain
+	r.read += int64(len(plain))
+	r.last = last
+	r.counter++
+	return nil
+}
+
+func (r *encryptedReader) Close() error {
+	return r.closer.Close()
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b EncryptedBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b EncryptedBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b EncryptedBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend
+func (b EncryptedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the wrapped backend and decrypts it, Size is the size of the plaintext
+func (b EncryptedBackend) GetObject(path string) (Object, error) {
+	object, err := b.Backend.GetObject(path)
+	if err != nil {
+		return object, err
+	}
+	r, err := b.open(ioutil.NopCloser(bytes.NewReader(object.Content)))
+	if err != nil {
+		return Object{Metadata: object.Metadata}, err
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Object{Metadata: object.Metadata}, err
+	}
+	object.Content = content
+	object.Size = int64(len(content))
+	return object, nil
+}
+
+// PutObject encrypts an object and uploads it to the wrapped backend
+func (b EncryptedBackend) PutObject(path string, content []byte) error {
+	header, aead, err := b.newHeader()
+	if err != nil {
+		return err
+	}
+	header.Size = int64(len(content))
+	buf, err := header.marshal()
+	if err != nil {
+		return err
+	}
+	sealed := bytes.NewBuffer(buf)
+	if _, err := sealChunks(sealed, bytes.NewReader(content), aead, header); err != nil {
+		return err
+	}
+	return b.Backend.PutObject(path, sealed.Bytes())
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b EncryptedBackend) DeleteObject(path string) error {
+	return b.Backend.DeleteObject(path)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend, the objects are not encrypted again
+func (b EncryptedBackend) RenamePrefixOrObject(path, newPath string) error {
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend, decrypted as it is read
+// Size is the size of the plaintext, reading fails at the end of the stream if it was altered
+func (b EncryptedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	stream, err := getObjectStream(b.Backend, path)
+	if err != nil {
+		return stream, err
+	}
+	r, err := b.open(stream.Content)
+	if err != nil {
+		return &ObjectStream{Metadata: stream.Metadata}, err
+	}
+	stream.Size = r.header.Size
+	stream.Content = r
+	return stream, nil
+}
+
+// PutObjectStream encrypts an object stream and uploads it to the wrapped backend
+// The sealed chunks are spooled to a temporary file, as the header stores the size of the plaintext
+func (b EncryptedBackend) PutObjectStream(path string, content io.Reader) error {
+	header, aead, err := b.newHeader()
+	if err != nil {
+		return err
+	}
+	spool, err := ioutil.TempFile("", "storage-encrypted-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	header.Size, err = sealChunks(spool, content, aead, header)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	buf, err := header.marshal()
+	if err != nil {
+		return err
+	}
+	return putObjectStream(b.Backend, path, io.MultiReader(bytes.NewReader(buf), spool))
+}
+
+func (b EncryptedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	object, err := b.GetObject(path)
+	if err != nil {
+		if isObjectNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	serveObject(w, r, object, "")
+}
+
+// RotateKeys rewraps the data keys of the objects at prefix with the current key of the KeyProvider, and returns how many were rewrapped
+// Only the headers change, the content is not encrypted again; the objects must not be written meanwhile
+func (b EncryptedBackend) RotateKeys(prefix string) (int, error) {
+	objects, err := b.Backend.ListObjects(prefix)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for _, o := range objects {
+		path := pathutil.Join(prefix, o.Path)
+		object, err := b.Backend.GetObject(path)
+		if err != nil {
+			return rewrapped, err
+		}
+		header, length, err := readEncryptedHeader(bytes.NewReader(object.Content))
+		if err != nil {
+			return rewrapped, fmt.Errorf("%s: %w", path, err)
+		}
+		dataKey, err := b.KeyProvider.UnwrapKey(header.KeyID, header.WrappedKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("%s: %w", path, err)
+		}
+		keyID, wrappedKey, err := b.KeyProvider.WrapKey(dataKey)
+		if err != nil {
+			return rewrapped, err
+		}
+		if keyID == header.KeyID {
+			continue
+		}
+		header.KeyID, header.WrappedKey = keyID, wrappedKey
+		buf, err := header.marshal()
+		if err != nil {
+			return rewrapped, err
+		}
+		err = b.Backend.PutObject(path, append(buf, object.Content[length:]...))
+		if err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
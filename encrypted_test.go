@@ -0,0 +1,207 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type EncryptedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Keyfile       string
+	Remote        *LocalFilesystemBackend
+	KeyProvider   *LocalKeyProvider
+	Encrypted     *EncryptedBackend
+}
+
+func (suite *EncryptedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-encrypted/%s", timestamp)
+	suite.Remote = NewLocalFilesystemBackend(filepath.Join(suite.TempDirectory, "remote"))
+	suite.Keyfile = filepath.Join(suite.TempDirectory, "keyfile")
+	suite.KeyProvider = NewLocalKeyProvider(suite.Keyfile)
+	suite.Encrypted = NewEncryptedBackend(suite.Remote, suite.KeyProvider)
+	suite.Encrypted.ChunkSize = 16
+}
+
+func (suite *EncryptedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *EncryptedTestSuite) keyID(path string) string {
+	object, err := suite.Remote.GetObject(path)
+	suite.Nil(err)
+	header, _, err := readEncryptedHeader(bytes.NewReader(object.Content))
+	suite.Nil(err)
+	return header.KeyID
+}
+
+func (suite *EncryptedTestSuite) TestRoundTrip() {
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		path := fmt.Sprintf("roundtrip/%d.txt", size)
+		content := bytes.Repeat([]byte("s"), size)
+
+		suite.Nil(suite.Encrypted.PutObject(path, content), "no error putting object of size %d", size)
+		object, err := suite.Encrypted.GetObject(path)
+		suite.Nil(err, "no error getting object of size %d", size)
+		suite.Equal(content, object.Content, "content of size %d", size)
+		suite.Equal(int64(size), object.Size)
+		suite.Equal(path, object.Path)
+
+		suite.Nil(suite.Encrypted.PutObjectStream(path, bytes.NewReader(content)), "no error putting stream of size %d", size)
+		stream, err := suite.Encrypted.GetObjectStream(path)
+		suite.Nil(err, "no error getting stream of size %d", size)
+		suite.Equal(int64(size), stream.Size, "plaintext size is known before reading")
+		read, err := ioutil.ReadAll(stream.Content)
+		suite.Nil(err)
+		suite.Nil(stream.Content.Close())
+		suite.Equal(content, read, "streamed content of size %d", size)
+	}
+
+	suite.Nil(suite.Encrypted.PutObject("secret.txt", []byte("the secret content")))
+	stored, err := suite.Remote.GetObject("secret.txt")
+	suite.Nil(err)
+	suite.False(bytes.Contains(stored.Content, []byte("secret")), "content is encrypted at rest")
+
+	objects, err := suite.Encrypted.ListObjects("roundtrip")
+	suite.Nil(err)
+	suite.Len(objects, 7)
+
+	suite.Nil(suite.Encrypted.RenamePrefixOrObject("secret.txt", "renamed.txt"))
+	object, err := suite.Encrypted.GetObject("renamed.txt")
+	suite.Nil(err, "renamed objects are still decrypted")
+	suite.Equal([]byte("the secret content"), object.Content)
+
+	suite.Nil(suite.Encrypted.DeleteObject("renamed.txt"))
+	_, err = suite.Encrypted.GetObject("renamed.txt")
+	suite.NotNil(err)
+}
+
+func (suite *EncryptedTestSuite) TestTampering() {
+	content := []byte(strings.Repeat("0123456789abcdef", 3))
+	suite.Nil(suite.Encrypted.PutObject("tampered.txt", content))
+	stored, err := suite.Remote.GetObject("tampered.txt")
+	suite.Nil(err)
+	_, length, err := readEncryptedHeader(bytes.NewReader(stored.Content))
+	suite.Nil(err)
+	chunk := suite.Encrypted.ChunkSize + 16
+
+	flipped := append([]byte{}, stored.Content...)
+	flipped[len(flipped)-1] ^= 1
+	truncated := stored.Content[:length+2*chunk]
+	swapped := append(append(append([]byte{}, stored.Content[:length]...),
+		stored.Content[length+chunk:length+2*chunk]...), stored.Content[length:length+chunk]...)
+	swapped = append(swapped, stored.Content[length+2*chunk:]...)
+
+	for name, content := range map[string][]byte{
+		"altered":   flipped,
+		"truncated": truncated,
+		"reordered": swapped,
+		"plaintext": []byte("plaintext"),
+	} {
+		suite.Nil(suite.Remote.PutObject("tampered.txt", content))
+		_, err = suite.Encrypted.GetObject("tampered.txt")
+		suite.Equal(errEncryptedFormat, err, "%s content is rejected", name)
+
+		stream, err := suite.Encrypted.GetObjectStream("tampered.txt")
+		if err == nil {
+			_, err = ioutil.ReadAll(stream.Content)
+			stream.Content.Close()
+		}
+		suite.Equal(errEncryptedFormat, err, "%s stream is rejected", name)
+	}
+}
+
+func (suite *EncryptedTestSuite) TestKeyRotation() {
+	firstKey := suite.KeyProvider.current
+	suite.Nil(suite.Encrypted.PutObject("rotation/old.txt", []byte("old")))
+
+	secondKey, err := suite.KeyProvider.Rotate()
+	suite.Nil(err, "no error rotating key")
+	suite.NotEqual(firstKey, secondKey)
+	suite.Nil(suite.Encrypted.PutObject("rotation/new.txt", []byte("new")))
+	suite.Equal(firstKey, suite.keyID("rotation/old.txt"))
+	suite.Equal(secondKey, suite.keyID("rotation/new.txt"), "new objects use the new key")
+
+	// a new instance reads the keys back, the last one being the current key
+	provider := NewLocalKeyProvider(suite.Keyfile)
+	suite.Equal(secondKey, provider.current)
+	reopened := NewEncryptedBackend(suite.Remote, provider)
+	object, err := reopened.GetObject("rotation/old.txt")
+	suite.Nil(err, "objects of previous keys are still decrypted")
+	suite.Equal([]byte("old"), object.Content)
+
+	rewrapped, err := reopened.RotateKeys("rotation")
+	suite.Nil(err, "no error rotating keys of objects")
+	suite.Equal(1, rewrapped, "only the objects of previous keys are rewrapped")
+	suite.Equal(secondKey, suite.keyID("rotation/old.txt"))
+
+	// once rewrapped, the objects do not need the previous key anymore
+	keyfile, err := ioutil.ReadFile(suite.Keyfile)
+	suite.Nil(err)
+	lines := strings.SplitAfter(string(keyfile), "\n")
+	suite.Nil(ioutil.WriteFile(suite.Keyfile, []byte(lines[1]), 0600))
+	reopened = NewEncryptedBackend(suite.Remote, NewLocalKeyProvider(suite.Keyfile))
+	for path, content := range map[string]string{"rotation/old.txt": "old", "rotation/new.txt": "new"} {
+		object, err = reopened.GetObject(path)
+		suite.Nil(err, "no error getting %s with the new key only", path)
+		suite.Equal([]byte(content), object.Content)
+	}
+
+	_, err = NewEncryptedBackend(suite.Remote, NewLocalKeyProvider(filepath.Join(suite.TempDirectory, "other"))).GetObject("rotation/old.txt")
+	suite.NotNil(err, "objects are not decrypted with unknown keys")
+}
+
+func (suite *EncryptedTestSuite) TestInvalidKeyfile() {
+	keyfile := filepath.Join(suite.TempDirectory, "invalid")
+	suite.Nil(ioutil.WriteFile(keyfile, []byte("# comment\nkey notbase64\n"), 0600))
+	suite.Panics(func() {
+		NewLocalKeyProvider(keyfile)
+	})
+}
+
+func (suite *EncryptedTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.Encrypted.PutObject("download.txt", []byte("0123456789")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	suite.Encrypted.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code)
+	suite.Equal("234", w.Body.String(), "ranges are served from the plaintext")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.Encrypted.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestEncryptedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(EncryptedTestSuite))
+}
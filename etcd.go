@@ -0,0 +1,636 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// etcd rejects requests above 1.5MiB by default, keep each chunk well under it
+	defaultEtcdChunkSize = 1024 * 1024
+
+	etcdObjectsNamespace = "objects"
+	etcdChunksNamespace  = "chunks"
+)
+
+// etcdObjectMeta is the value stored at an object key
+// the content itself lives in chunk keys, so renaming an object only moves this small value
+type etcdObjectMeta struct {
+	ID           string `json:"id"`
+	Size         int64  `json:"size"`
+	ChunkSize    int    `json:"chunkSize"`
+	Chunks       int    `json:"chunks"`
+	LastModified int64  `json:"lastModified"`
+}
+
+type etcdListObjectsFromDirectoryOutput struct {
+	backend         *EtcdBackend
+	prefix          string
+	limit           int
+	revision        int64
+	startKey        string
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &etcdListObjectsFromDirectoryOutput{
+		backend:  l.backend,
+		prefix:   l.prefix,
+		limit:    l.limit,
+		revision: l.revision,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	dirKey := l.backend.objectKey(l.prefix) + "/"
+	endKey := clientv3.GetPrefixRangeEnd(dirKey)
+	startKey := l.startKey
+	if startKey == "" {
+		startKey = dirKey
+	}
+
+	// etcd has no delimiter support, so directories are found by scanning the range
+	// and skipping past every key below a directory once it has been seen
+	for startKey < endKey && (l.limit <= 0 || len(r.directoriesRead)+len(r.filesRead) < l.limit) {
+		batch := int64(1000)
+		if l.limit > 0 && int64(l.limit-len(r.directoriesRead)-len(r.filesRead)) < batch {
+			batch = int64(l.limit - len(r.directoriesRead) - len(r.filesRead))
+		}
+		opts := []clientv3.OpOption{clientv3.WithRange(endKey), clientv3.WithLimit(batch)}
+		if r.revision > 0 {
+			// pin every page to the revision of the first one so the listing is consistent
+			opts = append(opts, clientv3.WithRev(r.revision))
+		}
+		resp, err := l.backend.Client.Get(l.backend.Context, startKey, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if r.revision == 0 {
+			r.revision = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			if key < startKey {
+				// below a directory that was already listed
+				continue
+			}
+			if l.limit > 0 && len(r.directoriesRead)+len(r.filesRead) >= l.limit {
+				break
+			}
+			name := strings.TrimPrefix(key, dirKey)
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[:i]
+				r.directoriesRead = append(r.directoriesRead, Metadata{
+					Path: pathutil.Join(l.prefix, name),
+				})
+				startKey = clientv3.GetPrefixRangeEnd(dirKey + name + "/")
+				continue
+			}
+
+			m := Metadata{
+				Path: pathutil.Join(l.prefix, name),
+			}
+			var meta etcdObjectMeta
+			if err := json.Unmarshal(kv.Value, &meta); err == nil {
+				m.LastModified = time.Unix(0, meta.LastModified)
+			}
+			r.filesRead = append(r.filesRead, m)
+			startKey = key + "\x00"
+		}
+
+		if !resp.More && (len(resp.Kvs) == 0 || startKey > string(resp.Kvs[len(resp.Kvs)-1].Key)) {
+			startKey = endKey
+		}
+	}
+
+	r.startKey = startKey
+	r.isEOF = startKey >= endKey
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *etcdListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// etcdObjectReader reads the chunks of an object lazily, pinned to the revision its metadata was read at
+type etcdObjectReader struct {
+	backend  *EtcdBackend
+	meta     etcdObjectMeta
+	revision int64
+	offset   int64
+	chunk    []byte
+	index    int
+}
+
+func (r *etcdObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.meta.Size {
+		return 0, io.EOF
+	}
+
+	index := int(r.offset / int64(r.meta.ChunkSize))
+	if r.chunk == nil || r.index != index {
+		resp, err := r.backend.Client.Get(r.backend.Context, r.backend.chunkKey(r.meta.ID, index), clientv3.WithRev(r.revision))
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Kvs) == 0 {
+			return 0, fmt.Errorf("chunk %d of object %s is missing", index, r.meta.ID)
+		}
+		r.chunk = resp.Kvs[0].Value
+		r.index = index
+	}
+
+	n := copy(p, r.chunk[r.offset-int64(index)*int64(r.meta.ChunkSize):])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *etcdObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.meta.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = abs
+	return abs, nil
+}
+
+func (r *etcdObjectReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// EtcdBackend is a storage backend for etcd
+// Objects are stored as keys under Prefix; contents larger than ChunkSize are split across several keys
+type EtcdBackend struct {
+	Client    *clientv3.Client
+	Prefix    string
+	ChunkSize int
+	Context   context.Context
+}
+
+// NewEtcdBackend creates a new instance of EtcdBackend
+// endpoints is a comma separated list of etcd client URLs; cafile, certfile and keyfile are optional
+func NewEtcdBackend(endpoints string, cafile string, certfile string, keyfile string, prefix string) *EtcdBackend {
+	config := clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	}
+
+	if cafile != "" || certfile != "" || keyfile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      certfile,
+			KeyFile:       keyfile,
+			TrustedCAFile: cafile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			panic("Failed to load etcd TLS configuration: " + err.Error())
+		}
+		config.TLS = tlsConfig
+	}
+
+	client, err := clientv3.New(config)
+	if err != nil {
+		panic("Failed to create etcd client: " + err.Error())
+	}
+
+	return NewEtcdBackendWithClient(client, prefix)
+}
+
+// NewEtcdBackendWithClient creates a new instance of EtcdBackend with an existing etcd client
+func NewEtcdBackendWithClient(client *clientv3.Client, prefix string) *EtcdBackend {
+	b := &EtcdBackend{
+		Client:    client,
+		Prefix:    cleanPrefix(prefix),
+		ChunkSize: defaultEtcdChunkSize,
+		Context:   context.Background(),
+	}
+	return b
+}
+
+func (b EtcdBackend) objectKey(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, etcdObjectsNamespace, path))
+}
+
+func (b EtcdBackend) chunkKey(id string, index int) string {
+	return fmt.Sprintf("%s/%08d", cleanPrefix(pathutil.Join(b.Prefix, etcdChunksNamespace, id)), index)
+}
+
+func (b EtcdBackend) chunksPrefix(id string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, etcdChunksNamespace, id)) + "/"
+}
+
+// getMeta reads the metadata of an object, returning the revision it was read at
+func (b EtcdBackend) getMeta(path string, opts ...clientv3.OpOption) (etcdObjectMeta, int64, error) {
+	var meta etcdObjectMeta
+	resp, err := b.Client.Get(b.Context, b.objectKey(path), opts...)
+	if err != nil {
+		return meta, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return meta, resp.Header.Revision, ErrObjectNotFound
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &meta)
+	return meta, resp.Header.Revision, err
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b EtcdBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b EtcdBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects in etcd, at prefix
+func (b EtcdBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	prefixKey := b.objectKey(prefix) + "/"
+	endKey := clientv3.GetPrefixRangeEnd(prefixKey)
+
+	var revision int64
+	for startKey := prefixKey; ; {
+		opts := []clientv3.OpOption{clientv3.WithRange(endKey), clientv3.WithLimit(1000)}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		resp, err := b.Client.Get(b.Context, startKey, opts...)
+		if err != nil {
+			return objects, err
+		}
+		revision = resp.Header.Revision
+
+		for _, kv := range resp.Kvs {
+			path := strings.TrimPrefix(string(kv.Key), prefixKey)
+			if objectPathIsInvalid(path) {
+				continue
+			}
+			var meta etcdObjectMeta
+			if err := json.Unmarshal(kv.Value, &meta); err != nil {
+				return objects, err
+			}
+			object := Object{
+				Metadata: Metadata{
+					Path:         path,
+					LastModified: time.Unix(0, meta.LastModified),
+				},
+				Content: []byte{},
+			}
+			objects = append(objects, object)
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		startKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+// All the pages are read at the etcd revision of the first one
+func (b EtcdBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if cleanPrefix(prefix) != "" {
+		_, _, err := b.getMeta(prefix)
+		if err == nil {
+			return nil, ErrPrefixIsAnObject
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+
+	output := &etcdListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves an object, or every object under a prefix, to newPath in a single transaction
+// The number of objects that can be moved at once is bounded by the server --max-txn-ops setting
+func (b EtcdBackend) RenamePrefixOrObject(path, newPath string) error {
+	newKey := b.objectKey(newPath)
+	newDirKey := newKey + "/"
+
+	// check if newPath is already occupied
+	resp, err := b.Client.Get(b.Context, newKey, clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 {
+		return ErrNewPathNotEmpty
+	}
+	resp, err = b.Client.Get(b.Context, newDirKey, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	// the source is either an object or a prefix with objects, read both at the same revision
+	key := b.objectKey(path)
+	resp, err = b.Client.Get(b.Context, key)
+	if err != nil {
+		return err
+	}
+	kvs := resp.Kvs
+	oldPrefix, newPrefix := key, newKey
+	if len(kvs) == 0 {
+		resp, err = b.Client.Get(b.Context, key+"/", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision))
+		if err != nil {
+			return err
+		}
+		kvs = resp.Kvs
+		oldPrefix, newPrefix = key+"/", newDirKey
+	}
+
+	// ignore if the source does not exist
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0),
+		clientv3.Compare(clientv3.CreateRevision(newDirKey).WithPrefix(), "=", 0),
+	}
+	ops := make([]clientv3.Op, 0, 2*len(kvs))
+	for _, kv := range kvs {
+		oldKey := string(kv.Key)
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(oldKey), "=", kv.ModRevision))
+		ops = append(ops,
+			clientv3.OpPut(newPrefix+strings.TrimPrefix(oldKey, oldPrefix), string(kv.Value)),
+			clientv3.OpDelete(oldKey),
+		)
+	}
+
+	txnResp, err := b.Client.Txn(b.Context).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errors.New("objects were modified during rename, try again")
+	}
+	return nil
+}
+
+// GetObject retrieves an object from etcd, at prefix
+func (b EtcdBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// GetObjectRevision retrieves an object from etcd as it was at the given revision
+// Revisions older than the last compaction are no longer available
+func (b EtcdBackend) GetObjectRevision(path string, revision int64) (Object, error) {
+	var object Object
+	object.Path = path
+
+	meta, _, err := b.getMeta(path, clientv3.WithRev(revision))
+	if err != nil {
+		return object, err
+	}
+	reader := &etcdObjectReader{
+		backend:  &b,
+		meta:     meta,
+		revision: revision,
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = time.Unix(0, meta.LastModified)
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to etcd, at prefix
+func (b EtcdBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from etcd, at prefix
+func (b EtcdBackend) DeleteObject(path string) error {
+	resp, err := b.Client.Delete(b.Context, b.objectKey(path), clientv3.WithPrevKV())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.PrevKvs {
+		var meta etcdObjectMeta
+		if err := json.Unmarshal(kv.Value, &meta); err != nil {
+			return err
+		}
+		_, err = b.Client.Delete(b.Context, b.chunksPrefix(meta.ID), clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetObjectStream retrieves an object stream from etcd, at prefix
+// The returned content is an io.ReadSeeker that fetches one chunk at a time
+func (b EtcdBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	meta, revision, err := b.getMeta(path)
+	if err != nil {
+		return object, err
+	}
+
+	object.LastModified = time.Unix(0, meta.LastModified)
+	object.Content = &etcdObjectReader{
+		backend:  &b,
+		meta:     meta,
+		revision: revision,
+	}
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to etcd, at prefix
+// Chunks are written first and the object key is switched to them last, so readers never see a partial object
+func (b EtcdBackend) PutObjectStream(path string, content io.Reader) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	chunkSize := b.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultEtcdChunkSize
+	}
+
+	meta := etcdObjectMeta{
+		ID:        hex.EncodeToString(id),
+		ChunkSize: chunkSize,
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			_, putErr := b.Client.Put(b.Context, b.chunkKey(meta.ID, meta.Chunks), string(buf[:n]))
+			if putErr != nil {
+				b.Client.Delete(b.Context, b.chunksPrefix(meta.ID), clientv3.WithPrefix())
+				return putErr
+			}
+			meta.Chunks++
+			meta.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			b.Client.Delete(b.Context, b.chunksPrefix(meta.ID), clientv3.WithPrefix())
+			return err
+		}
+	}
+
+	meta.LastModified = time.Now().UnixNano()
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.Client.Put(b.Context, b.objectKey(path), string(value), clientv3.WithPrevKV())
+	if err != nil {
+		b.Client.Delete(b.Context, b.chunksPrefix(meta.ID), clientv3.WithPrefix())
+		return err
+	}
+
+	// drop the chunks of the replaced version
+	if resp.PrevKv != nil {
+		var prev etcdObjectMeta
+		if err := json.Unmarshal(resp.PrevKv.Value, &prev); err == nil && prev.ID != "" {
+			_, err = b.Client.Delete(b.Context, b.chunksPrefix(prev.ID), clientv3.WithPrefix())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b EtcdBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer obj.Content.Close()
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, obj.Content.(io.ReadSeeker))
+}
@@ -0,0 +1,253 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+type EtcdTestSuite struct {
+	suite.Suite
+	Server        *embed.Etcd
+	EtcdBackend   *EtcdBackend
+	TempDirectory string
+}
+
+func freeLocalURL() url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func (suite *EtcdTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-etcd/%s", timestamp)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = suite.TempDirectory
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeLocalURL(), freeLocalURL()
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	suite.Nil(err, "no error starting embedded etcd")
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		suite.FailNow("embedded etcd did not start")
+	}
+	suite.Server = server
+
+	suite.EtcdBackend = NewEtcdBackend(clientURL.String(), "", "", "", "unittest")
+	// small chunks so that every object spans several keys
+	suite.EtcdBackend.ChunkSize = 4
+}
+
+func (suite *EtcdTestSuite) TearDownSuite() {
+	suite.EtcdBackend.Client.Close()
+	suite.Server.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *EtcdTestSuite) TestPutGetDeleteObject() {
+	err := suite.EtcdBackend.PutObject("putget/test.txt", []byte("some chunked content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.EtcdBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some chunked content"), object.Content, "content matches across chunks")
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	err = suite.EtcdBackend.PutObject("putget/test.txt", []byte("short"))
+	suite.Nil(err, "no error overwriting object")
+	object, err = suite.EtcdBackend.GetObject("putget/test.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("short"), object.Content, "content replaced")
+
+	err = suite.EtcdBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.EtcdBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	resp, err := suite.EtcdBackend.Client.Get(suite.EtcdBackend.Context, "unittest/chunks/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	suite.Nil(err)
+	suite.Zero(resp.Count, "no chunks left behind")
+}
+
+func (suite *EtcdTestSuite) TestGetObjectRevision() {
+	err := suite.EtcdBackend.PutObject("revision.txt", []byte("first version"))
+	suite.Nil(err)
+	object, err := suite.EtcdBackend.GetObjectStream("revision.txt")
+	suite.Nil(err)
+	revision := object.Content.(*etcdObjectReader).revision
+	object.Content.Close()
+
+	err = suite.EtcdBackend.PutObject("revision.txt", []byte("second version"))
+	suite.Nil(err)
+
+	old, err := suite.EtcdBackend.GetObjectRevision("revision.txt", revision)
+	suite.Nil(err, "no error getting old revision")
+	suite.Equal([]byte("first version"), old.Content, "old revision content")
+
+	suite.Nil(suite.EtcdBackend.DeleteObject("revision.txt"))
+}
+
+func (suite *EtcdTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt"} {
+		suite.Nil(suite.EtcdBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.EtcdBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt"} {
+		suite.Nil(suite.EtcdBackend.DeleteObject(path))
+	}
+}
+
+func (suite *EtcdTestSuite) TestListObjectsPages() {
+	// more objects than the 1000 keys of a page
+	for i := 0; i < 1100; i++ {
+		suite.Nil(suite.EtcdBackend.PutObject(fmt.Sprintf("pages/%04d.txt", i), []byte("x")))
+	}
+
+	objects, err := suite.EtcdBackend.ListObjects("pages")
+	suite.Nil(err, "no error listing objects")
+	suite.Equal(1100, len(objects), "objects past the first page are listed")
+	suite.Equal("1099.txt", objects[1099].Path)
+
+	for i := 0; i < 1100; i++ {
+		suite.Nil(suite.EtcdBackend.DeleteObject(fmt.Sprintf("pages/%04d.txt", i)))
+	}
+}
+
+func (suite *EtcdTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.EtcdBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.EtcdBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.EtcdBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.False(output.IsTruncated())
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.EtcdBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+
+	for _, path := range paths {
+		suite.Nil(suite.EtcdBackend.DeleteObject(path))
+	}
+}
+
+func (suite *EtcdTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.EtcdBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.EtcdBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.EtcdBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.EtcdBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.EtcdBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.EtcdBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "content follows rename")
+	_, err = suite.EtcdBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.EtcdBackend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.EtcdBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.EtcdBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"moved.txt", "renamed/sub/b.txt", "occupied.txt"} {
+		suite.Nil(suite.EtcdBackend.DeleteObject(path))
+	}
+}
+
+func (suite *EtcdTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.EtcdBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.EtcdBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.EtcdBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.EtcdBackend.DeleteObject("download.txt"))
+}
+
+func TestEtcdStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(EtcdTestSuite))
+}
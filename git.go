@@ -0,0 +1,830 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitstorage "github.com/go-git/go-git/v5/storage"
+)
+
+const (
+	defaultGitBranch      = "main"
+	defaultGitAuthorName  = "chartmuseum"
+	defaultGitAuthorEmail = "chartmuseum@localhost"
+	// attempts to move the branch when another writer of the repository moved it first
+	gitCommitAttempts = 5
+)
+
+// gitEntry is a member of a directory listing
+type gitEntry struct {
+	name         string
+	isDir        bool
+	lastModified time.Time
+}
+
+type gitListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []gitEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *gitListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *gitListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *gitListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *gitListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &gitListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the tree of the directory is read at once, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *gitListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *gitListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// GitBackend is a storage backend for git repositories
+// Objects are read from the head of Branch, and every change is a commit on Branch, written
+// without a worktree so that bare repositories work too. LastModified is the time of the last
+// commit that changed an object, found by walking the first parents of the head; the walk costs
+// up to the length of the history, its results are cached per head for the backends of the repository
+// until Close.
+type GitBackend struct {
+	Repository  *git.Repository
+	Branch      string
+	Prefix      string
+	AuthorName  string
+	AuthorEmail string
+	// Remote is the name of a remote the branch is pushed to after every commit, no push if empty
+	Remote  string
+	Auth    transport.AuthMethod
+	Context context.Context
+}
+
+// gitTimesLimit is the number of last modified times cached for a repository before the cache is cleared
+const gitTimesLimit = 10000
+
+// gitRepositoryState is shared by the backends of a repository, including struct literals
+type gitRepositoryState struct {
+	// storer guards the storer of the repository, which is not safe for concurrent writes;
+	// commits and blobs are written holding it, reads of the head and its objects are done sharing it
+	storer sync.RWMutex
+	// mutex guards times, the last modified times of the keys at a head
+	mutex sync.Mutex
+	times map[gitTimeKey]time.Time
+}
+
+type gitTimeKey struct {
+	head plumbing.Hash
+	key  string
+}
+
+var (
+	gitStatesMutex sync.Mutex
+	gitStates      = map[*git.Repository]*gitRepositoryState{}
+)
+
+// state returns the state shared by the backends of the repository, released by Close
+func (b GitBackend) state() *gitRepositoryState {
+	gitStatesMutex.Lock()
+	defer gitStatesMutex.Unlock()
+	state, ok := gitStates[b.Repository]
+	if !ok {
+		state = &gitRepositoryState{times: map[gitTimeKey]time.Time{}}
+		gitStates[b.Repository] = state
+	}
+	return state
+}
+
+// Close releases the state shared by the backends of the repository, the lock of its storer and
+// the cache of last modified times; no backend of the repository may be used after Close
+func (b GitBackend) Close() error {
+	gitStatesMutex.Lock()
+	defer gitStatesMutex.Unlock()
+	delete(gitStates, b.Repository)
+	return nil
+}
+
+// NewGitBackend creates a new instance of GitBackend
+// The repository at path is opened, or created as a bare repository; an empty branch is "main"
+// The author is read from GIT_AUTHOR_NAME and GIT_AUTHOR_EMAIL, credentials to push
+// over HTTP from GIT_REMOTE_USERNAME and GIT_REMOTE_PASSWORD
+func NewGitBackend(path string, branch string, prefix string) *GitBackend {
+	repo, err := git.PlainOpen(path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(path, true)
+	}
+	if err != nil {
+		panic("Failed to open git repository: " + err.Error())
+	}
+	return NewGitBackendWithRepository(repo, branch, prefix)
+}
+
+// NewGitBackendWithRepository creates a new instance of GitBackend from an open repository
+func NewGitBackendWithRepository(repo *git.Repository, branch string, prefix string) *GitBackend {
+	if branch == "" {
+		branch = defaultGitBranch
+	}
+	b := &GitBackend{
+		Repository:  repo,
+		Branch:      branch,
+		Prefix:      cleanPrefix(prefix),
+		AuthorName:  os.Getenv("GIT_AUTHOR_NAME"),
+		AuthorEmail: os.Getenv("GIT_AUTHOR_EMAIL"),
+		Context:     context.Background(),
+	}
+	if b.AuthorName == "" {
+		b.AuthorName = defaultGitAuthorName
+	}
+	if b.AuthorEmail == "" {
+		b.AuthorEmail = defaultGitAuthorEmail
+	}
+	if username := os.Getenv("GIT_REMOTE_USERNAME"); username != "" {
+		b.Auth = &githttp.BasicAuth{Username: username, Password: os.Getenv("GIT_REMOTE_PASSWORD")}
+	}
+	return b
+}
+
+func (b GitBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+func (b GitBackend) branchRef() plumbing.ReferenceName {
+	return plumbing.NewBranchReferenceName(b.Branch)
+}
+
+// head returns the commit at the head of the branch, nil if the branch has no commit yet
+// It and the other reads of the storer are called sharing the storer lock of the state
+func (b GitBackend) head() (*object.Commit, error) {
+	ref, err := b.Repository.Reference(b.branchRef(), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Repository.CommitObject(ref.Hash())
+}
+
+// gitFindEntry returns the entry at path in tree, nil if there is none
+func gitFindEntry(tree *object.Tree, path string) (*object.TreeEntry, error) {
+	if tree == nil {
+		return nil, nil
+	}
+	if path == "" {
+		return &object.TreeEntry{Mode: filemode.Dir, Hash: tree.Hash}, nil
+	}
+	e, err := tree.FindEntry(path)
+	if errors.Is(err, object.ErrEntryNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		return nil, nil
+	}
+	return e, err
+}
+
+// gitTreeLess orders tree entries the way git does, comparing directories as if they ended with a slash
+func gitTreeLess(a, b object.TreeEntry) bool {
+	an, bn := a.Name, b.Name
+	if a.Mode == filemode.Dir {
+		an += "/"
+	}
+	if b.Mode == filemode.Dir {
+		bn += "/"
+	}
+	return an < bn
+}
+
+// lastModified returns the time of the commits that last changed the objects at keys, walking the first parents of head
+// The times do not change for a head, they are cached so that reading the same head walks its history once per key
+func (b GitBackend) lastModified(head *object.Commit, keys []string) (map[string]time.Time, error) {
+	result := map[string]time.Time{}
+	if head == nil || len(keys) == 0 {
+		return result, nil
+	}
+
+	state := b.state()
+	var missing []string
+	state.mutex.Lock()
+	for _, key := range keys {
+		if t, ok := state.times[gitTimeKey{head.Hash, key}]; ok {
+			result[key] = t
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	state.mutex.Unlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	times, err := b.walkLastModified(head, missing)
+	if err != nil {
+		return result, err
+	}
+	state.mutex.Lock()
+	if len(state.times)+len(times) > gitTimesLimit {
+		state.times = map[gitTimeKey]time.Time{}
+	}
+	for key, t := range times {
+		state.times[gitTimeKey{head.Hash, key}] = t
+		result[key] = t
+	}
+	state.mutex.Unlock()
+	return result, nil
+}
+
+// walkLastModified finds the time of the commits that last changed the objects at keys, walking the first parents of head
+func (b GitBackend) walkLastModified(head *object.Commit, keys []string) (map[string]time.Time, error) {
+	result := map[string]time.Time{}
+	tree, err := head.Tree()
+	if err != nil {
+		return result, err
+	}
+	pending := map[string]plumbing.Hash{}
+	for _, key := range keys {
+		e, err := gitFindEntry(tree, key)
+		if err != nil {
+			return result, err
+		}
+		if e != nil {
+			pending[key] = e.Hash
+		}
+	}
+
+	for c := head; len(pending) > 0; {
+		var parent *object.Commit
+		var parentTree *object.Tree
+		if c.NumParents() > 0 {
+			if parent, err = c.Parent(0); err != nil {
+				return result, err
+			}
+			if parentTree, err = parent.Tree(); err != nil {
+				return result, err
+			}
+		}
+		for key, hash := range pending {
+			e, err := gitFindEntry(parentTree, key)
+			if err != nil {
+				return result, err
+			}
+			if e != nil && e.Hash == hash {
+				continue
+			}
+			result[key] = c.Committer.When
+			delete(pending, key)
+		}
+		if parent == nil {
+			break
+		}
+		c = parent
+	}
+	return result, nil
+}
+
+// writeBlob stores content as a blob of the repository
+func (b GitBackend) writeBlob(content io.Reader) (plumbing.Hash, error) {
+	obj := b.Repository.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// the content is read into obj first, so that reads only wait for it to be stored
+	state := b.state()
+	state.storer.Lock()
+	defer state.storer.Unlock()
+	return b.Repository.Storer.SetEncodedObject(obj)
+}
+
+// writeTree stores a copy of tree with changes applied, changes maps paths relative to tree to
+// their new entry, or to nil to remove them; it returns the hash and the number of entries of the new tree
+func (b GitBackend) writeTree(tree *object.Tree, changes map[string]*object.TreeEntry) (plumbing.Hash, int, error) {
+	entries := map[string]object.TreeEntry{}
+	if tree != nil {
+		for _, e := range tree.Entries {
+			entries[e.Name] = e
+		}
+	}
+
+	nested := map[string]map[string]*object.TreeEntry{}
+	for path, change := range changes {
+		i := strings.Index(path, "/")
+		if i < 0 {
+			if change == nil {
+				delete(entries, path)
+			} else {
+				if e, ok := entries[path]; ok && e.Mode == filemode.Dir && change.Mode != filemode.Dir {
+					return plumbing.ZeroHash, 0, fmt.Errorf("%s is a directory", path)
+				}
+				e := *change
+				e.Name = path
+				entries[path] = e
+			}
+			continue
+		}
+		if nested[path[:i]] == nil {
+			nested[path[:i]] = map[string]*object.TreeEntry{}
+		}
+		nested[path[:i]][path[i+1:]] = change
+	}
+
+	for name, subchanges := range nested {
+		var subtree *object.Tree
+		if e, ok := entries[name]; ok {
+			if e.Mode != filemode.Dir {
+				return plumbing.ZeroHash, 0, fmt.Errorf("%s: %w", name, ErrPrefixIsAnObject)
+			}
+			var err error
+			if subtree, err = object.GetTree(b.Repository.Storer, e.Hash); err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+		}
+		hash, n, err := b.writeTree(subtree, subchanges)
+		if err != nil {
+			return plumbing.ZeroHash, 0, fmt.Errorf("%s/%w", name, err)
+		}
+		if n == 0 {
+			delete(entries, name)
+		} else {
+			entries[name] = object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash}
+		}
+	}
+
+	result := &object.Tree{}
+	for _, e := range entries {
+		result.Entries = append(result.Entries, e)
+	}
+	sort.Slice(result.Entries, func(i, j int) bool { return gitTreeLess(result.Entries[i], result.Entries[j]) })
+
+	obj := b.Repository.Storer.NewEncodedObject()
+	if err := result.Encode(obj); err != nil {
+		return plumbing.ZeroHash, 0, err
+	}
+	hash, err := b.Repository.Storer.SetEncodedObject(obj)
+	return hash, len(result.Entries), err
+}
+
+// commit records the changes returned by changes, called with the tree of the head, as a new commit on the branch
+// No commit is made if changes returns no change, or changes leaving the tree as it is
+func (b GitBackend) commit(message string, changes func(tree *object.Tree) (map[string]*object.TreeEntry, error)) error {
+	// the branch is pushed holding the lock too, pushing updates the references of the remote
+	state := b.state()
+	state.storer.Lock()
+	defer state.storer.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		ref, err := b.Repository.Reference(b.branchRef(), true)
+		if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return err
+		}
+
+		var parents []plumbing.Hash
+		var tree *object.Tree
+		if ref != nil {
+			head, err := b.Repository.CommitObject(ref.Hash())
+			if err != nil {
+				return err
+			}
+			if tree, err = head.Tree(); err != nil {
+				return err
+			}
+			parents = append(parents, head.Hash)
+		}
+
+		c, err := changes(tree)
+		if err != nil || len(c) == 0 {
+			return err
+		}
+		treeHash, _, err := b.writeTree(tree, c)
+		if err != nil {
+			return err
+		}
+		if tree != nil && treeHash == tree.Hash {
+			return nil
+		}
+
+		signature := object.Signature{Name: b.AuthorName, Email: b.AuthorEmail, When: time.Now()}
+		commit := &object.Commit{
+			Author:       signature,
+			Committer:    signature,
+			Message:      message,
+			TreeHash:     treeHash,
+			ParentHashes: parents,
+		}
+		obj := b.Repository.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return err
+		}
+		hash, err := b.Repository.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return err
+		}
+
+		// the branch only moves if no other writer of the repository moved it meanwhile
+		err = b.Repository.Storer.CheckAndSetReference(plumbing.NewHashReference(b.branchRef(), hash), ref)
+		if errors.Is(err, gitstorage.ErrReferenceHasChanged) && attempt < gitCommitAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return b.push()
+	}
+}
+
+// push sends the branch to Remote, if any
+func (b GitBackend) push() error {
+	if b.Remote == "" {
+		return nil
+	}
+	refSpec := config.RefSpec(b.branchRef() + ":" + b.branchRef())
+	err := b.Repository.PushContext(b.Context, &git.PushOptions{
+		RemoteName: b.Remote,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       b.Auth,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
+
+// directory returns the head and its tree at key, a nil tree if there is no directory at key
+func (b GitBackend) directory(key string) (*object.Commit, *object.Tree, error) {
+	head, err := b.head()
+	if err != nil || head == nil {
+		return head, nil, err
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return head, nil, err
+	}
+	e, err := gitFindEntry(tree, key)
+	if err != nil {
+		return head, nil, err
+	}
+	if e == nil {
+		return head, nil, nil
+	}
+	if e.Mode != filemode.Dir {
+		return head, nil, ErrPrefixIsAnObject
+	}
+	tree, err = object.GetTree(b.Repository.Storer, e.Hash)
+	return head, tree, err
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b GitBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b GitBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects at the head of the branch, at prefix
+func (b GitBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	state := b.state()
+	state.storer.RLock()
+	defer state.storer.RUnlock()
+
+	dir := b.key(prefix)
+	head, tree, err := b.directory(dir)
+	if errors.Is(err, ErrPrefixIsAnObject) || tree == nil {
+		return objects, nil
+	}
+	if err != nil {
+		return objects, err
+	}
+
+	var keys []string
+	for _, e := range tree.Entries {
+		if e.Mode.IsFile() {
+			keys = append(keys, pathutil.Join(dir, e.Name))
+		}
+	}
+	times, err := b.lastModified(head, keys)
+	if err != nil {
+		return objects, err
+	}
+	for _, key := range keys {
+		object := Object{
+			Metadata: Metadata{
+				Path:         removePrefixFromObjectPath(dir, key),
+				LastModified: times[key],
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b GitBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	output := &gitListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+
+	state := b.state()
+	state.storer.RLock()
+	defer state.storer.RUnlock()
+
+	dir := b.key(prefix)
+	head, tree, err := b.directory(dir)
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		output.isEOF = true
+		return output, nil
+	}
+
+	var keys []string
+	for _, e := range tree.Entries {
+		if e.Mode.IsFile() {
+			keys = append(keys, pathutil.Join(dir, e.Name))
+		}
+	}
+	times, err := b.lastModified(head, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range tree.Entries {
+		switch {
+		case e.Mode == filemode.Dir:
+			output.entries = append(output.entries, gitEntry{name: e.Name, isDir: true})
+		case e.Mode.IsFile():
+			output.entries = append(output.entries, gitEntry{name: e.Name, lastModified: times[pathutil.Join(dir, e.Name)]})
+		}
+	}
+
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves an object, or a whole prefix, to newPath by rewriting the tree in a single commit
+func (b GitBackend) RenamePrefixOrObject(path, newPath string) error {
+	key, newKey := b.key(path), b.key(newPath)
+	if key == "" || newKey == "" {
+		return errors.New("cannot rename the root of the backend")
+	}
+
+	return b.commit(fmt.Sprintf("Rename %s to %s", key, newKey), func(tree *object.Tree) (map[string]*object.TreeEntry, error) {
+		// check if newPath is already occupied
+		occupied, err := gitFindEntry(tree, newKey)
+		if err != nil {
+			return nil, err
+		}
+		if occupied != nil {
+			return nil, ErrNewPathNotEmpty
+		}
+
+		// ignore if the source does not exist
+		e, err := gitFindEntry(tree, key)
+		if err != nil || e == nil {
+			return nil, err
+		}
+		return map[string]*object.TreeEntry{key: nil, newKey: e}, nil
+	})
+}
+
+// GetObject retrieves an object from the head of the branch, at prefix
+func (b GitBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject commits an object to the branch, at prefix
+func (b GitBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject commits the removal of an object from the branch, at prefix
+func (b GitBackend) DeleteObject(path string) error {
+	key := b.key(path)
+	return b.commit("Delete "+key, func(tree *object.Tree) (map[string]*object.TreeEntry, error) {
+		e, err := gitFindEntry(tree, key)
+		if err != nil || e == nil || !e.Mode.IsFile() {
+			return nil, err
+		}
+		return map[string]*object.TreeEntry{key: nil}, nil
+	})
+}
+
+// file returns the head and the blob of the object at key
+func (b GitBackend) file(key string) (*object.Commit, *object.TreeEntry, error) {
+	head, err := b.head()
+	if err != nil {
+		return nil, nil, err
+	}
+	if head == nil {
+		return nil, nil, ErrObjectNotFound
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := gitFindEntry(tree, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e == nil || !e.Mode.IsFile() {
+		return nil, nil, ErrObjectNotFound
+	}
+	return head, e, nil
+}
+
+// GetObjectStream retrieves an object stream from the head of the branch, at prefix
+func (b GitBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	state := b.state()
+	state.storer.RLock()
+	defer state.storer.RUnlock()
+
+	key := b.key(path)
+	head, e, err := b.file(key)
+	if err != nil {
+		return object, err
+	}
+	blob, err := b.Repository.BlobObject(e.Hash)
+	if err != nil {
+		return object, err
+	}
+	times, err := b.lastModified(head, []string{key})
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = times[key]
+
+	object.Content, err = blob.Reader()
+	return object, err
+}
+
+// PutObjectStream commits an object stream to the branch, at prefix
+func (b GitBackend) PutObjectStream(path string, content io.Reader) error {
+	key := b.key(path)
+	if key == "" {
+		return errors.New("cannot put an object at the root of the backend")
+	}
+
+	// blobs are addressed by their content, they are written before the commit
+	hash, err := b.writeBlob(content)
+	if err != nil {
+		return err
+	}
+	return b.commit("Put "+key, func(tree *object.Tree) (map[string]*object.TreeEntry, error) {
+		return map[string]*object.TreeEntry{key: {Mode: filemode.Regular, Hash: hash}}, nil
+	})
+}
+
+func (b GitBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObject(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// the blob hash identifies the content
+	state := b.state()
+	state.storer.RLock()
+	_, e, err := b.file(b.key(path))
+	state.storer.RUnlock()
+	if err == nil {
+		w.Header().Set("ETag", `"`+e.Hash.String()+`"`)
+	}
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, bytes.NewReader(obj.Content))
+}
@@ -0,0 +1,352 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/suite"
+)
+
+type GitTestSuite struct {
+	suite.Suite
+	GitBackend *GitBackend
+}
+
+func (suite *GitTestSuite) SetupTest() {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	suite.Nil(err)
+	suite.GitBackend = NewGitBackendWithRepository(repo, "", "unittest")
+	suite.GitBackend.AuthorName = "Unit Test"
+	suite.GitBackend.AuthorEmail = "unittest@example.com"
+}
+
+// commits returns the commits of the branch, newest first
+func (suite *GitTestSuite) commits() []*object.Commit {
+	var commits []*object.Commit
+	head, err := suite.GitBackend.head()
+	suite.Nil(err)
+	for c := head; c != nil; {
+		commits = append(commits, c)
+		if c.NumParents() == 0 {
+			break
+		}
+		c, err = c.Parent(0)
+		suite.Nil(err)
+	}
+	return commits
+}
+
+func (suite *GitTestSuite) TestPutGetDeleteObject() {
+	_, err := suite.GitBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "empty repository")
+
+	err = suite.GitBackend.PutObject("putget/test.txt", []byte("some content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.GitBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content, "content matches")
+
+	commits := suite.commits()
+	suite.Len(commits, 1, "put is a commit")
+	suite.Equal("Put unittest/putget/test.txt", commits[0].Message)
+	suite.Equal("Unit Test", commits[0].Author.Name)
+	suite.Equal("unittest@example.com", commits[0].Author.Email)
+	suite.Equal(commits[0].Committer.When, object.LastModified, "last modified is the time of the commit")
+
+	suite.Nil(suite.GitBackend.PutObject("putget/test.txt", []byte("some content")))
+	suite.Len(suite.commits(), 1, "no commit when nothing changes")
+
+	err = suite.GitBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.GitBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	commits = suite.commits()
+	suite.Len(commits, 2, "delete is a commit")
+	suite.Equal("Delete unittest/putget/test.txt", commits[0].Message)
+	tree, err := commits[0].Tree()
+	suite.Nil(err)
+	suite.Empty(tree.Entries, "empty directories are removed")
+
+	suite.Nil(suite.GitBackend.DeleteObject("putget/test.txt"), "deleting a missing object is not an error")
+	suite.Len(suite.commits(), 2, "no commit for a missing object")
+
+	suite.Nil(suite.GitBackend.PutObject("putget/test.txt", []byte("x")))
+	err = suite.GitBackend.PutObject("putget/test.txt/nested", []byte("x"))
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot put an object below an object")
+	err = suite.GitBackend.PutObject("putget", []byte("x"))
+	suite.Error(err, "cannot put an object over a directory")
+}
+
+func (suite *GitTestSuite) TestLastModified() {
+	suite.Nil(suite.GitBackend.PutObject("a.txt", []byte("a")))
+	suite.Nil(suite.GitBackend.PutObject("b.txt", []byte("b")))
+	suite.Nil(suite.GitBackend.PutObject("b.txt", []byte("bb")))
+
+	commits := suite.commits()
+	suite.Len(commits, 3)
+
+	a, err := suite.GitBackend.GetObject("a.txt")
+	suite.Nil(err)
+	suite.Equal(commits[2].Committer.When, a.LastModified, "time of the commit that put a.txt")
+
+	objects, err := suite.GitBackend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+	suite.Equal(commits[2].Committer.When, objects[0].LastModified)
+	suite.Equal(commits[0].Committer.When, objects[1].LastModified, "time of the last change of b.txt")
+}
+
+func (suite *GitTestSuite) TestLastModifiedCache() {
+	suite.Nil(suite.GitBackend.PutObject("a.txt", []byte("a")))
+	head, err := suite.GitBackend.head()
+	suite.Nil(err)
+	key := suite.GitBackend.key("a.txt")
+
+	state := suite.GitBackend.state()
+	cached := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	state.mutex.Lock()
+	state.times[gitTimeKey{head.Hash, key}] = cached
+	state.mutex.Unlock()
+
+	a, err := suite.GitBackend.GetObject("a.txt")
+	suite.Nil(err)
+	suite.Equal(cached, a.LastModified, "times are cached per head")
+
+	other := NewGitBackendWithRepository(suite.GitBackend.Repository, "", "unittest")
+	a, err = other.GetObject("a.txt")
+	suite.Nil(err)
+	suite.Equal(cached, a.LastModified, "the cache is shared by the backends of the repository")
+
+	suite.Nil(suite.GitBackend.PutObject("a.txt", []byte("aa")))
+	a, err = suite.GitBackend.GetObject("a.txt")
+	suite.Nil(err)
+	suite.Equal(suite.commits()[0].Committer.When, a.LastModified, "a new head is walked")
+}
+
+func (suite *GitTestSuite) TestConcurrentPutGet() {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("concurrent/%d.txt", i)
+			suite.Nil(suite.GitBackend.PutObject(path, []byte(path)))
+			object, err := suite.GitBackend.GetObject(path)
+			suite.Nil(err)
+			suite.Equal([]byte(path), object.Content)
+			_, err = suite.GitBackend.ListObjects("concurrent")
+			suite.Nil(err)
+		}(i)
+	}
+	wg.Wait()
+
+	objects, err := suite.GitBackend.ListObjects("concurrent")
+	suite.Nil(err)
+	suite.Len(objects, 20)
+}
+
+func (suite *GitTestSuite) TestClose() {
+	state := suite.GitBackend.state()
+	suite.Nil(suite.GitBackend.Close())
+	gitStatesMutex.Lock()
+	_, ok := gitStates[suite.GitBackend.Repository]
+	gitStatesMutex.Unlock()
+	suite.False(ok, "the state of the repository is released")
+	suite.NotSame(state, suite.GitBackend.state())
+}
+
+func (suite *GitTestSuite) TestStructLiteral() {
+	backend := GitBackend{
+		Repository:  suite.GitBackend.Repository,
+		Branch:      defaultGitBranch,
+		AuthorName:  "Unit Test",
+		AuthorEmail: "unittest@example.com",
+		Context:     context.Background(),
+	}
+	suite.Nil(backend.PutObject("literal.txt", []byte("literal")), "a struct literal can write")
+	object, err := backend.GetObject("literal.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("literal"), object.Content)
+}
+
+func (suite *GitTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.GitBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.GitBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	objects, err = suite.GitBackend.ListObjects("missing")
+	suite.Nil(err)
+	suite.Empty(objects)
+}
+
+func (suite *GitTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.GitBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.GitBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.GitBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.GitBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+}
+
+func (suite *GitTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.GitBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.GitBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.GitBackend.PutObject("occupied.txt", []byte("x")))
+	commits := len(suite.commits())
+
+	err := suite.GitBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.GitBackend.RenamePrefixOrObject("rename", "renamed/deeper")
+	suite.Nil(err, "no error renaming prefix")
+	suite.Len(suite.commits(), commits+1, "rename is a single commit")
+	suite.Equal("Rename unittest/rename to unittest/renamed/deeper", suite.commits()[0].Message)
+	object, err := suite.GitBackend.GetObject("renamed/deeper/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "content follows rename")
+	_, err = suite.GitBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.GitBackend.RenamePrefixOrObject("renamed/deeper/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.GitBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.GitBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+	suite.Len(suite.commits(), commits+2, "no commit for a missing path")
+}
+
+func (suite *GitTestSuite) TestPush() {
+	// an in-memory remote, served in process
+	remote := memory.NewStorage()
+	endpoint, err := transport.NewEndpoint("file:///remote.git")
+	suite.Nil(err)
+	client.InstallProtocol("file", server.NewClient(server.MapLoader{endpoint.String(): remote}))
+	defer client.InstallProtocol("file", file.DefaultClient)
+
+	_, err = git.Init(remote, nil)
+	suite.Nil(err)
+	_, err = suite.GitBackend.Repository.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{endpoint.String()}})
+	suite.Nil(err)
+	suite.GitBackend.Remote = "origin"
+
+	suite.Nil(suite.GitBackend.PutObject("pushed.txt", []byte("pushed")))
+	suite.Nil(suite.GitBackend.PutObject("pushed.txt", []byte("pushed again")))
+
+	ref, err := remote.Reference(plumbing.NewBranchReferenceName("main"))
+	suite.Nil(err, "branch pushed")
+	suite.Equal(suite.commits()[0].Hash, ref.Hash(), "remote is at the head of the branch")
+}
+
+func (suite *GitTestSuite) TestConcurrentWriter() {
+	suite.Nil(suite.GitBackend.PutObject("first.txt", []byte("1")))
+
+	// another writer of the same repository, with its own lock
+	other := NewGitBackendWithRepository(suite.GitBackend.Repository, "", "unittest")
+	suite.Nil(other.PutObject("second.txt", []byte("2")))
+	suite.Nil(suite.GitBackend.PutObject("third.txt", []byte("3")))
+
+	objects, err := suite.GitBackend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 3, "no write is lost")
+	suite.Len(suite.commits(), 3)
+}
+
+func (suite *GitTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.GitBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.GitBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+	etag := w.Header().Get("ETag")
+	suite.True(strings.HasPrefix(etag, `"`), "blob hash is the ETag")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	suite.GitBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusNotModified, w.Code, "conditional requests are served")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.GitBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestGitStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(GitTestSuite))
+}
@@ -49,6 +49,17 @@ func NewGoogleCSBackend(bucket string, prefix string) *GoogleCSBackend {
 	return b
 }
 
+// BackendContext returns the context of the requests of the backend
+func (b GoogleCSBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b GoogleCSBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
 // ListObjects lists all objects in Google Cloud Storage bucket, at prefix
 func (b GoogleCSBackend) ListObjects(prefix string) ([]Object, error) {
 	var objects []Object
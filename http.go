@@ -0,0 +1,614 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	pathutil "path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// defaultHTTPCacheMaxObjectSize is the largest object kept in memory for conditional revalidation
+	defaultHTTPCacheMaxObjectSize = 8 * 1024 * 1024
+	// defaultHTTPCacheMaxSize is the size of all the objects kept in memory for conditional revalidation
+	defaultHTTPCacheMaxSize = 64 * 1024 * 1024
+)
+
+var (
+	// dates printed next to the links of autoindex pages: nginx ("02-Jan-2006 15:04") and Apache ("2006-01-02 15:04")
+	httpIndexDateRegexp  = regexp.MustCompile(`\d{2}-[A-Z][a-z]{2}-\d{4} \d{2}:\d{2}|\d{4}-\d{2}-\d{2} \d{2}:\d{2}`)
+	httpIndexDateLayouts = []string{"02-Jan-2006 15:04", "2006-01-02 15:04"}
+)
+
+type (
+	// httpEntry is a member of a directory listing
+	httpEntry struct {
+		name         string
+		isDir        bool
+		lastModified time.Time
+	}
+
+	// httpJSONEntry is a member of a JSON directory listing, as written by nginx (autoindex_format json) or Caddy (browse)
+	httpJSONEntry struct {
+		Name    string `json:"name"`
+		Type    string `json:"type"`
+		IsDir   bool   `json:"is_dir"`
+		MTime   string `json:"mtime"`
+		ModTime string `json:"mod_time"`
+	}
+
+	// httpCacheEntry is the last response of an object, revalidated with If-None-Match and If-Modified-Since
+	httpCacheEntry struct {
+		etag         string
+		lastModified string
+		content      []byte
+	}
+
+	// httpCache keeps the last responses, the least recently used ones are evicted first
+	httpCache struct {
+		sync.Mutex
+		entries *cachingLRU
+	}
+)
+
+func newHTTPCache() *httpCache {
+	return &httpCache{entries: newCachingLRU(nil)}
+}
+
+func (c *httpCache) get(path string) (httpCacheEntry, bool) {
+	if c == nil {
+		return httpCacheEntry{}, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	cached := c.entries.get(path)
+	if cached == nil {
+		return httpCacheEntry{}, false
+	}
+	entry := httpCacheEntry{etag: cached.etag, content: cached.content}
+	if !cached.lastModified.IsZero() {
+		entry.lastModified = cached.lastModified.UTC().Format(http.TimeFormat)
+	}
+	return entry, true
+}
+
+// set caches the response of path, evicting the least recently used responses when over maxSize, zero meaning unbounded
+func (c *httpCache) set(path string, entry httpCacheEntry, maxSize int64) {
+	if c == nil {
+		return
+	}
+	lastModified, _ := http.ParseTime(entry.lastModified)
+	c.Lock()
+	defer c.Unlock()
+	added := c.entries.add(&cachingEntry{
+		path:         path,
+		content:      entry.content,
+		lastModified: lastModified,
+		etag:         entry.etag,
+		size:         int64(len(path) + len(entry.content)),
+	}, maxSize)
+	if !added {
+		c.entries.remove(path)
+	}
+}
+
+func (c *httpCache) delete(path string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries.remove(path)
+}
+
+// httpCachedReader serves an object from the cache after a 304 response
+type httpCachedReader struct {
+	*bytes.Reader
+}
+
+func (r httpCachedReader) Close() error {
+	return nil
+}
+
+// httpCachingReader stores the body of a response in the cache once it was read completely
+type httpCachingReader struct {
+	io.ReadCloser
+	cache   *httpCache
+	maxSize int64
+	path    string
+	entry   httpCacheEntry
+	buf     bytes.Buffer
+}
+
+func (r *httpCachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF {
+		r.entry.content = r.buf.Bytes()
+		r.cache.set(r.path, r.entry, r.maxSize)
+	}
+	return n, err
+}
+
+type httpListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []httpEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *httpListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *httpListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *httpListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *httpListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &httpListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the index page lists the whole directory at once, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *httpListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *httpListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// HTTPBackend is a read-only storage backend for static HTTP file trees, e.g. third-party chart repository mirrors
+// Directories are listed from their index page, either an autoindex HTML page or a JSON listing
+type HTTPBackend struct {
+	Endpoint    string
+	Prefix      string
+	Client      *http.Client
+	Username    string
+	Password    string
+	BearerToken string
+	// CacheMaxObjectSize is the size of the largest object kept in memory to revalidate it with conditional requests
+	CacheMaxObjectSize int64
+	// CacheMaxSize is the size of all the objects kept in memory, the least recently used are evicted first; zero is unbounded
+	CacheMaxSize int64
+	cache        *httpCache
+}
+
+// NewHTTPBackend creates a new instance of HTTPBackend
+// endpoint is the base URL of the file tree, e.g. https://charts.example.com/stable
+// Credentials are taken from HTTP_MIRROR_USERNAME and HTTP_MIRROR_PASSWORD (basic auth), or HTTP_MIRROR_BEARER_TOKEN
+func NewHTTPBackend(endpoint string, prefix string) *HTTPBackend {
+	if _, err := url.Parse(endpoint); err != nil {
+		panic("Failed to parse HTTP endpoint: " + err.Error())
+	}
+
+	b := &HTTPBackend{
+		Endpoint:           strings.TrimSuffix(endpoint, "/"),
+		Prefix:             cleanPrefix(prefix),
+		Client:             http.DefaultClient,
+		Username:           os.Getenv("HTTP_MIRROR_USERNAME"),
+		Password:           os.Getenv("HTTP_MIRROR_PASSWORD"),
+		BearerToken:        os.Getenv("HTTP_MIRROR_BEARER_TOKEN"),
+		CacheMaxObjectSize: defaultHTTPCacheMaxObjectSize,
+		CacheMaxSize:       defaultHTTPCacheMaxSize,
+		cache:              newHTTPCache(),
+	}
+	return b
+}
+
+// url returns the escaped URL of path, at prefix
+func (b HTTPBackend) url(path string) string {
+	p := pathutil.Join("/", b.Prefix, path)
+	return b.Endpoint + (&url.URL{Path: p}).EscapedPath()
+}
+
+// dirURL returns the escaped URL of the index page of the directory at path
+func (b HTTPBackend) dirURL(path string) string {
+	return strings.TrimSuffix(b.url(path), "/") + "/"
+}
+
+func (b HTTPBackend) do(method string, rawURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+b.BearerToken)
+	} else if b.Username != "" || b.Password != "" {
+		req.SetBasicAuth(b.Username, b.Password)
+	}
+	return b.Client.Do(req)
+}
+
+func httpStatusError(resp *http.Response) error {
+	return fmt.Errorf("http: %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// list reads the index page of the directory at path
+// A missing directory is not an error, it has no entries
+func (b HTTPBackend) list(path string) ([]httpEntry, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/json, text/html;q=0.9")
+	resp, err := b.do(http.MethodGet, b.dirURL(path), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp)
+	}
+
+	var entries []httpEntry
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		entries, err = httpParseJSONIndex(resp.Body)
+	} else {
+		entries, err = httpParseHTMLIndex(resp.Body, resp.Request.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries, nil
+}
+
+// httpParseJSONIndex reads a JSON listing, an array of entries with a name, a type and a modification time
+func httpParseJSONIndex(body io.Reader) ([]httpEntry, error) {
+	var listing []httpJSONEntry
+	if err := json.NewDecoder(body).Decode(&listing); err != nil {
+		return nil, err
+	}
+
+	entries := make([]httpEntry, 0, len(listing))
+	for _, e := range listing {
+		entry := httpEntry{
+			name:  strings.Trim(e.Name, "/"),
+			isDir: e.IsDir || e.Type == "directory" || strings.HasSuffix(e.Name, "/"),
+		}
+		if entry.name == "" || entry.name == ".." {
+			continue
+		}
+		if t, err := http.ParseTime(e.MTime); err == nil {
+			entry.lastModified = t
+		} else if t, err := time.Parse(time.RFC3339, e.ModTime); err == nil {
+			entry.lastModified = t
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// httpParseHTMLIndex reads an autoindex HTML page, every link to a direct child of the page is an entry
+// Modification times are taken from the text following a link, as printed by nginx and Apache
+func httpParseHTMLIndex(body io.Reader, base *url.URL) ([]httpEntry, error) {
+	var entries []httpEntry
+	seen := map[string]bool{}
+	var current *httpEntry
+
+	tokenizer := html.NewTokenizer(body)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, err
+			}
+			return entries, nil
+		case html.TextToken:
+			if current != nil && current.lastModified.IsZero() {
+				if match := httpIndexDateRegexp.Find(tokenizer.Text()); match != nil {
+					for _, layout := range httpIndexDateLayouts {
+						if t, err := time.Parse(layout, string(match)); err == nil {
+							current.lastModified = t
+							break
+						}
+					}
+				}
+			}
+		case html.StartTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if string(name) != "a" || !hasAttr {
+				continue
+			}
+			for {
+				key, value, more := tokenizer.TagAttr()
+				if string(key) == "href" {
+					if entry, ok := httpIndexEntry(base, string(value)); ok && !seen[entry.name] {
+						seen[entry.name] = true
+						entries = append(entries, entry)
+						current = &entries[len(entries)-1]
+					}
+					break
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	}
+}
+
+// httpIndexEntry maps a link of an index page to an entry, if it points to a direct child of the page
+func httpIndexEntry(base *url.URL, href string) (httpEntry, bool) {
+	ref, err := url.Parse(href)
+	if err != nil || ref.RawQuery != "" || ref.Fragment != "" {
+		return httpEntry{}, false
+	}
+	target := base.ResolveReference(ref)
+	if target.Host != base.Host {
+		return httpEntry{}, false
+	}
+
+	dir := strings.TrimSuffix(base.Path, "/") + "/"
+	if !strings.HasPrefix(target.Path, dir) {
+		return httpEntry{}, false
+	}
+	name := strings.TrimPrefix(target.Path, dir)
+	isDir := strings.HasSuffix(name, "/")
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || strings.Contains(name, "/") {
+		return httpEntry{}, false
+	}
+	return httpEntry{name: name, isDir: isDir}, true
+}
+
+// ListObjects lists all objects in the HTTP file tree, at prefix
+func (b HTTPBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	entries, err := b.list(prefix)
+	if err != nil {
+		return objects, err
+	}
+	for _, e := range entries {
+		if e.isDir {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         e.name,
+				LastModified: e.lastModified,
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b HTTPBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if cleanPrefix(prefix) != "" {
+		// static servers redirect a directory without a trailing slash, only an object answers directly
+		client := *b.Client
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		head := b
+		head.Client = &client
+		resp, err := head.do(http.MethodHead, b.url(prefix), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, ErrPrefixIsAnObject
+		}
+	}
+
+	entries, err := b.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &httpListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		entries: entries,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject is not supported, HTTPBackend is read-only
+func (b HTTPBackend) RenamePrefixOrObject(path, newPath string) error {
+	return ErrReadOnly
+}
+
+// GetObject retrieves an object from the HTTP file tree, at prefix
+func (b HTTPBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject is not supported, HTTPBackend is read-only
+func (b HTTPBackend) PutObject(path string, content []byte) error {
+	return ErrReadOnly
+}
+
+// DeleteObject is not supported, HTTPBackend is read-only
+func (b HTTPBackend) DeleteObject(path string) error {
+	return ErrReadOnly
+}
+
+// GetObjectStream retrieves an object stream from the HTTP file tree, at prefix
+// Objects read before are revalidated with a conditional request and served from memory while unchanged
+func (b HTTPBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	header := http.Header{}
+	cached, isCached := b.cache.get(path)
+	if isCached {
+		if cached.etag != "" {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := b.do(http.MethodGet, b.url(path), header)
+	if err != nil {
+		return object, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && isCached:
+		resp.Body.Close()
+		object.LastModified, _ = http.ParseTime(cached.lastModified)
+		object.Content = httpCachedReader{bytes.NewReader(cached.content)}
+		return object, nil
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		b.cache.delete(path)
+		return object, ErrObjectNotFound
+	default:
+		resp.Body.Close()
+		return object, httpStatusError(resp)
+	}
+
+	entry := httpCacheEntry{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	object.LastModified, _ = http.ParseTime(entry.lastModified)
+	object.Content = resp.Body
+
+	cacheable := entry.etag != "" || entry.lastModified != ""
+	if b.cache != nil && cacheable && resp.ContentLength >= 0 && resp.ContentLength <= b.CacheMaxObjectSize {
+		object.Content = &httpCachingReader{
+			ReadCloser: resp.Body,
+			cache:      b.cache,
+			maxSize:    b.CacheMaxSize,
+			path:       path,
+			entry:      entry,
+		}
+	} else {
+		b.cache.delete(path)
+	}
+	return object, nil
+}
+
+// PutObjectStream is not supported, HTTPBackend is read-only
+func (b HTTPBackend) PutObjectStream(path string, content io.Reader) error {
+	return ErrReadOnly
+}
+
+func (b HTTPBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	proxyHttpFileDownload(w, r, func(method string, header http.Header) (*http.Response, error) {
+		return b.do(method, b.url(path), header)
+	})
+}
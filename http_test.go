@@ -0,0 +1,248 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const httpTestNginxIndex = `<html>
+<head><title>Index of /nginx/</title></head>
+<body>
+<h1>Index of /nginx/</h1><hr><pre><a href="../">../</a>
+<a href="charts/">charts/</a>                                            02-Mar-2021 10:15                   -
+<a href="index.yaml">index.yaml</a>                                        03-Mar-2021 11:30                1234
+<a href="mychart-0.1.0.tgz">mychart-0.1.0.tgz</a>                                 04-Mar-2021 12:45                5678
+<a href="?C=N;O=D">Name</a>
+<a href="https://example.com/elsewhere.tgz">elsewhere.tgz</a>
+</pre><hr></body>
+</html>`
+
+const httpTestJSONIndex = `[
+{ "name":"charts", "type":"directory", "mtime":"Tue, 02 Mar 2021 10:15:00 GMT" },
+{ "name":"index.yaml", "type":"file", "mtime":"Wed, 03 Mar 2021 11:30:00 GMT", "size":1234 },
+{ "name":"mychart-0.1.0.tgz", "is_dir":false, "mod_time":"2021-03-04T12:45:00Z", "size":5678 }
+]`
+
+type HTTPTestSuite struct {
+	suite.Suite
+	Server        *httptest.Server
+	HTTPBackend   *HTTPBackend
+	TempDirectory string
+	NotModified   int32
+}
+
+func (suite *HTTPTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-http/%s", timestamp)
+	for path, content := range map[string]string{
+		"index.yaml":                "apiVersion: v1",
+		"charts/a-0.1.0.tgz":        "a",
+		"charts/b-0.1.0.tgz":        "b",
+		"charts/c-0.1.0.tgz":        "c",
+		"charts/sub/d-0.1.0.tgz":    "d",
+		"charts/with space.tgz":     "space",
+		"download/downloadable.txt": "downloadable",
+	} {
+		fullPath := filepath.Join(suite.TempDirectory, path)
+		suite.Nil(os.MkdirAll(filepath.Dir(fullPath), 0777))
+		suite.Nil(ioutil.WriteFile(fullPath, []byte(content), 0644))
+	}
+
+	fileServer := http.StripPrefix("/mirror", http.FileServer(http.Dir(suite.TempDirectory)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mirror/", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "chartmuseum" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		fileServer.ServeHTTP(recorder, r)
+		if recorder.Code == http.StatusNotModified {
+			atomic.AddInt32(&suite.NotModified, 1)
+		}
+		for k, v := range recorder.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(recorder.Code)
+		io.Copy(w, recorder.Body)
+	})
+	mux.HandleFunc("/nginx/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, httpTestNginxIndex)
+	})
+	mux.HandleFunc("/json/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, httpTestJSONIndex)
+	})
+	suite.Server = httptest.NewServer(mux)
+
+	os.Setenv("HTTP_MIRROR_USERNAME", "chartmuseum")
+	os.Setenv("HTTP_MIRROR_PASSWORD", "secret")
+	defer os.Unsetenv("HTTP_MIRROR_USERNAME")
+	defer os.Unsetenv("HTTP_MIRROR_PASSWORD")
+	suite.HTTPBackend = NewHTTPBackend(suite.Server.URL+"/", "mirror")
+}
+
+func (suite *HTTPTestSuite) TearDownSuite() {
+	suite.Server.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *HTTPTestSuite) TestGetObject() {
+	object, err := suite.HTTPBackend.GetObject("index.yaml")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("apiVersion: v1"), object.Content)
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	before := atomic.LoadInt32(&suite.NotModified)
+	object, err = suite.HTTPBackend.GetObject("index.yaml")
+	suite.Nil(err, "no error getting object again")
+	suite.Equal([]byte("apiVersion: v1"), object.Content, "content served from the cache")
+	suite.Equal(before+1, atomic.LoadInt32(&suite.NotModified), "object was revalidated")
+
+	fullPath := filepath.Join(suite.TempDirectory, "index.yaml")
+	suite.Nil(ioutil.WriteFile(fullPath, []byte("apiVersion: v2"), 0644))
+	suite.Nil(os.Chtimes(fullPath, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	object, err = suite.HTTPBackend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v2"), object.Content, "changed object is downloaded again")
+
+	_, err = suite.HTTPBackend.GetObject("missing.yaml")
+	suite.ErrorIs(err, ErrObjectNotFound)
+
+	unauthorized := NewHTTPBackend(suite.Server.URL, "mirror")
+	_, err = unauthorized.GetObject("index.yaml")
+	suite.NotNil(err, "cannot get object without credentials")
+}
+
+func (suite *HTTPTestSuite) TestCacheMaxSize() {
+	backend := NewHTTPBackend(suite.Server.URL, "mirror")
+	backend.Username, backend.Password = "chartmuseum", "secret"
+	// room for two entries of an 18 bytes path and 1 byte of content
+	backend.CacheMaxSize = 40
+
+	for _, path := range []string{"charts/a-0.1.0.tgz", "charts/b-0.1.0.tgz", "charts/c-0.1.0.tgz"} {
+		_, err := backend.GetObject(path)
+		suite.Nil(err)
+	}
+
+	before := atomic.LoadInt32(&suite.NotModified)
+	object, err := backend.GetObject("charts/a-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+	suite.Equal(before, atomic.LoadInt32(&suite.NotModified), "least recently used object is evicted")
+
+	object, err = backend.GetObject("charts/c-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("c"), object.Content)
+	suite.Equal(before+1, atomic.LoadInt32(&suite.NotModified), "recently used object is revalidated")
+}
+
+func (suite *HTTPTestSuite) TestReadOnly() {
+	suite.ErrorIs(suite.HTTPBackend.PutObject("new.txt", []byte("x")), ErrReadOnly)
+	suite.ErrorIs(suite.HTTPBackend.DeleteObject("index.yaml"), ErrReadOnly)
+	suite.ErrorIs(suite.HTTPBackend.RenamePrefixOrObject("charts", "moved"), ErrReadOnly)
+	suite.ErrorIs(suite.HTTPBackend.PutObjectStream("new.txt", nil), ErrReadOnly)
+}
+
+func (suite *HTTPTestSuite) TestListObjects() {
+	objects, err := suite.HTTPBackend.ListObjects("charts")
+	suite.Nil(err, "no error listing objects")
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Path)
+	}
+	suite.Equal([]string{"a-0.1.0.tgz", "b-0.1.0.tgz", "c-0.1.0.tgz", "with space.tgz"}, names, "directories are skipped")
+
+	objects, err = suite.HTTPBackend.ListObjects("does-not-exist")
+	suite.Nil(err, "listing a missing directory is not an error")
+	suite.Empty(objects)
+}
+
+func (suite *HTTPTestSuite) TestListObjectsFromDirectory() {
+	_, err := suite.HTTPBackend.ListObjectsFromDirectory("index.yaml", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	var files, directories []string
+	output, err := suite.HTTPBackend.ListObjectsFromDirectory("charts", 2)
+	for {
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"charts/sub"}, directories)
+	suite.Equal([]string{"charts/a-0.1.0.tgz", "charts/b-0.1.0.tgz", "charts/c-0.1.0.tgz", "charts/with space.tgz"}, files)
+}
+
+func (suite *HTTPTestSuite) TestIndexFormats() {
+	expected := []httpEntry{
+		{name: "charts", isDir: true, lastModified: time.Date(2021, 3, 2, 10, 15, 0, 0, time.UTC)},
+		{name: "index.yaml", lastModified: time.Date(2021, 3, 3, 11, 30, 0, 0, time.UTC)},
+		{name: "mychart-0.1.0.tgz", lastModified: time.Date(2021, 3, 4, 12, 45, 0, 0, time.UTC)},
+	}
+	for _, format := range []string{"nginx", "json"} {
+		backend := NewHTTPBackend(suite.Server.URL, format)
+		entries, err := backend.list("")
+		suite.Nil(err, "no error parsing %s index", format)
+		suite.Len(entries, len(expected), "parent, sort and external links are skipped in %s index", format)
+		for i, e := range entries {
+			suite.Equal(expected[i].name, e.name)
+			suite.Equal(expected[i].isDir, e.isDir)
+			suite.True(expected[i].lastModified.Equal(e.lastModified), "%s modification time is parsed from %s index", e.name, format)
+		}
+	}
+}
+
+func (suite *HTTPTestSuite) TestHandleHttpFileDownload() {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/downloadable.txt", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	suite.HTTPBackend.HandleHttpFileDownload(w, r, "download/downloadable.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range is passed through")
+	suite.Equal("down", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.HTTPBackend.HandleHttpFileDownload(w, r, "download/missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestHTTPStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(HTTPTestSuite))
+}
@@ -0,0 +1,651 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"strings"
+
+	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
+)
+
+const (
+	// huaweiOBSMaxKeys is the largest page of the ListObjects API
+	huaweiOBSMaxKeys = 1000
+	// huaweiOBSMaxCopySize is the largest object CopyObject can copy in a single request, and the largest part of a multipart copy
+	huaweiOBSMaxCopySize = 5 * 1024 * 1024 * 1024
+	// huaweiOBSMaxParts is the largest number of parts of a multipart upload
+	huaweiOBSMaxParts = 10000
+	// huaweiOBSDefaultPartSize is the size of the parts of multipart uploads when PartSize is not set
+	huaweiOBSDefaultPartSize = 16 * 1024 * 1024
+)
+
+// huaweiOBSIsNotFound reports whether err is a missing object, a missing bucket is reported as is
+func huaweiOBSIsNotFound(err error) bool {
+	var obsErr obs.ObsError
+	return errors.As(err, &obsErr) && obsErr.StatusCode == http.StatusNotFound && obsErr.Code != "NoSuchBucket"
+}
+
+type huaweiOBSListObjectsFromDirectoryOutput struct {
+	backend         *HuaweiOBSBackend
+	prefix          string
+	limit           int
+	marker          string
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &huaweiOBSListObjectsFromDirectoryOutput{
+		backend: l.backend,
+		prefix:  l.prefix,
+		limit:   l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	prefix := l.backend.key(l.prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	maxKeys := l.limit
+	if maxKeys <= 0 || maxKeys > huaweiOBSMaxKeys {
+		maxKeys = huaweiOBSMaxKeys
+	}
+
+	input := &obs.ListObjectsInput{}
+	input.Bucket = l.backend.Bucket
+	input.Prefix = prefix
+	input.Delimiter = "/"
+	input.MaxKeys = maxKeys
+	input.Marker = l.marker
+	output, err := l.backend.Client.ListObjects(input)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range output.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(d, prefix), "/")
+		if name == "" {
+			continue
+		}
+		r.directoriesRead = append(r.directoriesRead, Metadata{
+			Path: pathutil.Join(l.prefix, name),
+		})
+	}
+
+	for _, f := range output.Contents {
+		name := strings.TrimPrefix(f.Key, prefix)
+		// skip the placeholders of the folders created in the console
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		r.filesRead = append(r.filesRead, Metadata{
+			Path:         pathutil.Join(l.prefix, name),
+			LastModified: f.LastModified,
+		})
+	}
+
+	r.marker = output.NextMarker
+	r.isEOF = !output.IsTruncated
+
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *huaweiOBSListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// HuaweiOBSBackend is a storage backend for Huawei Cloud OBS
+type HuaweiOBSBackend struct {
+	Bucket string
+	Client *obs.ObsClient
+	Prefix string
+	// SSE is the server-side encryption of new objects: "kms" for SSE-KMS, "AES256" for SSE-OBS, none if empty
+	SSE string
+	// SSEKMSKeyID is the KMS key of SSE-KMS, the default key of the project is used if empty
+	SSEKMSKeyID string
+	// PartSize is the size of the parts of multipart uploads, 16 MiB if zero
+	PartSize int64
+}
+
+// NewHuaweiOBSBackend creates a new instance of HuaweiOBSBackend
+// Credentials are taken from HUAWEI_CLOUD_ACCESS_KEY_ID and HUAWEI_CLOUD_SECRET_ACCESS_KEY, and HUAWEI_CLOUD_SECURITY_TOKEN for temporary credentials
+func NewHuaweiOBSBackend(bucket string, prefix string, endpoint string, sse string) *HuaweiOBSBackend {
+	accessKeyID := os.Getenv("HUAWEI_CLOUD_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("HUAWEI_CLOUD_SECRET_ACCESS_KEY")
+	securityToken := os.Getenv("HUAWEI_CLOUD_SECURITY_TOKEN")
+
+	if len(accessKeyID) == 0 {
+		panic("HUAWEI_CLOUD_ACCESS_KEY_ID environment variable is not set")
+	}
+
+	if len(secretAccessKey) == 0 {
+		panic("HUAWEI_CLOUD_SECRET_ACCESS_KEY environment variable is not set")
+	}
+
+	if len(endpoint) == 0 {
+		// Set default endpoint
+		endpoint = "https://obs.cn-north-4.myhuaweicloud.com"
+	}
+
+	client, err := obs.New(accessKeyID, secretAccessKey, endpoint, obs.WithSecurityToken(securityToken))
+	if err != nil {
+		panic("Failed to create OBS client: " + err.Error())
+	}
+
+	return NewHuaweiOBSBackendWithClient(bucket, prefix, client, sse)
+}
+
+// NewHuaweiOBSBackendWithClient creates a new instance of HuaweiOBSBackend with an existing OBS client
+func NewHuaweiOBSBackendWithClient(bucket string, prefix string, client *obs.ObsClient, sse string) *HuaweiOBSBackend {
+	b := &HuaweiOBSBackend{
+		Bucket: bucket,
+		Client: client,
+		Prefix: cleanPrefix(prefix),
+		SSE:    sse,
+	}
+	return b
+}
+
+func (b HuaweiOBSBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+// sseHeader returns the encryption header of new objects, nil without encryption
+func (b HuaweiOBSBackend) sseHeader() obs.ISseHeader {
+	switch strings.ToLower(b.SSE) {
+	case "":
+		return nil
+	case "kms", "aws:kms":
+		// the SDK picks the value matching the signature in use
+		return obs.SseKmsHeader{Key: b.SSEKMSKeyID}
+	default:
+		return obs.SseKmsHeader{Encryption: b.SSE}
+	}
+}
+
+// head returns the metadata of an object, ErrObjectNotFound if it does not exist
+func (b HuaweiOBSBackend) head(key string) (*obs.GetObjectMetadataOutput, error) {
+	input := &obs.GetObjectMetadataInput{
+		Bucket: b.Bucket,
+		Key:    key,
+	}
+	output, err := b.Client.GetObjectMetadata(input)
+	if huaweiOBSIsNotFound(err) {
+		return nil, ErrObjectNotFound
+	}
+	return output, err
+}
+
+// listObjects lists the objects starting with prefix, at any depth
+func (b HuaweiOBSBackend) listObjects(prefix string, fn func(obs.Content) error) error {
+	input := &obs.ListObjectsInput{}
+	input.Bucket = b.Bucket
+	input.Prefix = prefix
+	input.MaxKeys = huaweiOBSMaxKeys
+	for {
+		output, err := b.Client.ListObjects(input)
+		if err != nil {
+			return err
+		}
+		for _, obj := range output.Contents {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+		if !output.IsTruncated || len(output.Contents) == 0 {
+			return nil
+		}
+		// NextMarker is only returned for listings with a delimiter
+		input.Marker = output.Contents[len(output.Contents)-1].Key
+	}
+}
+
+// ListObjects lists all objects in Huawei Cloud OBS bucket, at prefix
+func (b HuaweiOBSBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	prefix = b.key(prefix)
+	err := b.listObjects(prefix, func(obj obs.Content) error {
+		path := removePrefixFromObjectPath(prefix, obj.Key)
+		if objectPathIsInvalid(path) {
+			return nil
+		}
+		objects = append(objects, Object{
+			Metadata: Metadata{
+				Path:         path,
+				LastModified: obj.LastModified,
+			},
+			Content: []byte{},
+		})
+		return nil
+	})
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b HuaweiOBSBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if cleanPrefix(prefix) != "" {
+		_, err := b.head(b.key(prefix))
+		if err == nil {
+			return nil, ErrPrefixIsAnObject
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+
+	output := &huaweiOBSListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject copies an object, or every object under a prefix, to newPath with CopyObject, then deletes the originals
+// Objects larger than the part size are copied part by part with a multipart copy
+// The copy is done server side, but the whole move is not atomic
+func (b HuaweiOBSBackend) RenamePrefixOrObject(path, newPath string) error {
+	// check if newPath is already occupied
+	if _, err := b.head(b.key(newPath)); err == nil {
+		return ErrNewPathNotEmpty
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	input := &obs.ListObjectsInput{}
+	input.Bucket = b.Bucket
+	input.Prefix = b.key(newPath) + "/"
+	input.MaxKeys = 1
+	output, err := b.Client.ListObjects(input)
+	if err != nil {
+		return err
+	}
+	if len(output.Contents) > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	var objects []obs.Content
+	if head, err := b.head(b.key(path)); err == nil {
+		objects = append(objects, obs.Content{Key: b.key(path), Size: head.ContentLength})
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	} else {
+		err := b.listObjects(b.key(path)+"/", func(obj obs.Content) error {
+			objects = append(objects, obj)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// ignore if the source does not exist
+	for _, obj := range objects {
+		if err := b.copyObject(obj, b.key(newPath)+strings.TrimPrefix(obj.Key, b.key(path))); err != nil {
+			return err
+		}
+		if err := b.deleteObject(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partSize returns the size of the parts of multipart uploads and copies
+func (b HuaweiOBSBackend) partSize() int64 {
+	if b.PartSize <= 0 {
+		return huaweiOBSDefaultPartSize
+	}
+	return b.PartSize
+}
+
+// copyObject copies an object to key, with CopyObject up to the part size and with a multipart copy above
+func (b HuaweiOBSBackend) copyObject(obj obs.Content, key string) error {
+	partSize := b.partSize()
+	if obj.Size <= partSize {
+		input := &obs.CopyObjectInput{}
+		input.Bucket = b.Bucket
+		input.Key = key
+		input.CopySourceBucket = b.Bucket
+		input.CopySourceKey = obj.Key
+		input.MetadataDirective = obs.CopyMetadata
+		input.SseHeader = b.sseHeader()
+		_, err := b.Client.CopyObject(input)
+		return err
+	}
+
+	// a multipart copy does not copy the metadata, it is read from the source
+	head, err := b.head(obj.Key)
+	if err != nil {
+		return err
+	}
+	if parts := (head.ContentLength + partSize - 1) / partSize; parts > huaweiOBSMaxParts {
+		partSize = (head.ContentLength + huaweiOBSMaxParts - 1) / huaweiOBSMaxParts
+	}
+	if partSize > huaweiOBSMaxCopySize {
+		partSize = huaweiOBSMaxCopySize
+	}
+	initiateInput := &obs.InitiateMultipartUploadInput{}
+	initiateInput.Bucket = b.Bucket
+	initiateInput.Key = key
+	initiateInput.SseHeader = b.sseHeader()
+	initiateInput.ContentType = head.ContentType
+	initiateInput.Metadata = head.Metadata
+	upload, err := b.Client.InitiateMultipartUpload(initiateInput)
+	if err != nil {
+		return err
+	}
+
+	var parts []obs.Part
+	err = func() error {
+		for number, start := 1, int64(0); start < head.ContentLength; number++ {
+			end := start + partSize
+			if end > head.ContentLength {
+				end = head.ContentLength
+			}
+			// the SDK sends no range for a single byte, which would copy the whole object, so the last part is never one byte
+			if head.ContentLength-end == 1 {
+				end--
+			}
+			output, err := b.Client.CopyPart(&obs.CopyPartInput{
+				Bucket:               b.Bucket,
+				Key:                  key,
+				UploadId:             upload.UploadId,
+				PartNumber:           number,
+				CopySourceBucket:     b.Bucket,
+				CopySourceKey:        obj.Key,
+				CopySourceRangeStart: start,
+				CopySourceRangeEnd:   end - 1,
+				SseHeader:            b.sseHeader(),
+			})
+			if err != nil {
+				return err
+			}
+			parts = append(parts, obs.Part{PartNumber: number, ETag: output.ETag})
+			start = end
+		}
+		_, err := b.Client.CompleteMultipartUpload(&obs.CompleteMultipartUploadInput{
+			Bucket:   b.Bucket,
+			Key:      key,
+			UploadId: upload.UploadId,
+			Parts:    parts,
+		})
+		return err
+	}()
+	if err != nil {
+		// do not leave the copied parts behind
+		b.Client.AbortMultipartUpload(&obs.AbortMultipartUploadInput{
+			Bucket:   b.Bucket,
+			Key:      key,
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+// GetObject retrieves an object from Huawei Cloud OBS bucket, at prefix
+func (b HuaweiOBSBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to Huawei Cloud OBS bucket, at prefix
+func (b HuaweiOBSBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from Huawei Cloud OBS bucket, at prefix
+func (b HuaweiOBSBackend) DeleteObject(path string) error {
+	return b.deleteObject(b.key(path))
+}
+
+func (b HuaweiOBSBackend) deleteObject(key string) error {
+	input := &obs.DeleteObjectInput{
+		Bucket: b.Bucket,
+		Key:    key,
+	}
+	_, err := b.Client.DeleteObject(input)
+	if huaweiOBSIsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetObjectStream retrieves an object stream from Huawei Cloud OBS bucket, at prefix
+func (b HuaweiOBSBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	input := &obs.GetObjectInput{}
+	input.Bucket = b.Bucket
+	input.Key = b.key(path)
+	output, err := b.Client.GetObject(input)
+	if huaweiOBSIsNotFound(err) {
+		return object, ErrObjectNotFound
+	}
+	if err != nil {
+		return object, err
+	}
+
+	object.LastModified = output.LastModified
+	object.Content = output.Body
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to Huawei Cloud OBS bucket, at prefix
+// Content up to the part size is sent with PutObject, larger content with a multipart upload, one part at a time
+func (b HuaweiOBSBackend) PutObjectStream(path string, content io.Reader) error {
+	buf := make([]byte, b.partSize())
+	n, err := io.ReadFull(content, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return b.putObject(b.key(path), buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	// content of exactly one part is still a simple upload
+	var next [1]byte
+	if _, err := io.ReadFull(content, next[:]); err == io.EOF {
+		return b.putObject(b.key(path), buf)
+	} else if err != nil {
+		return err
+	}
+	return b.putMultipartObject(b.key(path), buf, io.MultiReader(bytes.NewReader(next[:]), content))
+}
+
+func (b HuaweiOBSBackend) putObject(key string, data []byte) error {
+	input := &obs.PutObjectInput{}
+	input.Bucket = b.Bucket
+	input.Key = key
+	input.SseHeader = b.sseHeader()
+	input.ContentLength = int64(len(data))
+	input.Body = bytes.NewReader(data)
+	_, err := b.Client.PutObject(input)
+	return err
+}
+
+// putMultipartObject sends an object with a multipart upload, first is the first part, already read from content
+func (b HuaweiOBSBackend) putMultipartObject(key string, first []byte, content io.Reader) error {
+	initiateInput := &obs.InitiateMultipartUploadInput{}
+	initiateInput.Bucket = b.Bucket
+	initiateInput.Key = key
+	initiateInput.SseHeader = b.sseHeader()
+	upload, err := b.Client.InitiateMultipartUpload(initiateInput)
+	if err != nil {
+		return err
+	}
+
+	var parts []obs.Part
+	err = func() error {
+		part, buf := first, make([]byte, len(first))
+		for number := 1; len(part) > 0; number++ {
+			output, err := b.Client.UploadPart(&obs.UploadPartInput{
+				Bucket:     b.Bucket,
+				Key:        key,
+				PartNumber: number,
+				UploadId:   upload.UploadId,
+				Body:       bytes.NewReader(part),
+				PartSize:   int64(len(part)),
+			})
+			if err != nil {
+				return err
+			}
+			parts = append(parts, obs.Part{PartNumber: number, ETag: output.ETag})
+
+			n, err := io.ReadFull(content, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			part = buf[:n]
+		}
+		_, err := b.Client.CompleteMultipartUpload(&obs.CompleteMultipartUploadInput{
+			Bucket:   b.Bucket,
+			Key:      key,
+			UploadId: upload.UploadId,
+			Parts:    parts,
+		})
+		return err
+	}()
+	if err != nil {
+		// do not leave the uploaded parts behind
+		b.Client.AbortMultipartUpload(&obs.AbortMultipartUploadInput{
+			Bucket:   b.Bucket,
+			Key:      key,
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+func (b HuaweiOBSBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	proxyHttpFileDownload(w, r, func(method string, header http.Header) (*http.Response, error) {
+		input := &obs.GetObjectInput{}
+		input.Bucket = b.Bucket
+		input.Key = b.key(path)
+		input.IfMatch = header.Get("If-Match")
+		input.IfNoneMatch = header.Get("If-None-Match")
+		// invalid dates are ignored, as HTTP servers do
+		input.IfModifiedSince, _ = http.ParseTime(header.Get("If-Modified-Since"))
+		input.IfUnmodifiedSince, _ = http.ParseTime(header.Get("If-Unmodified-Since"))
+
+		// the input only takes closed ranges, the header is sent as is for the others
+		var output *obs.GetObjectOutput
+		var err error
+		switch rangeHeader, ifRange := header.Get("Range"), header.Get("If-Range"); {
+		case rangeHeader != "" && ifRange != "":
+			output, err = b.Client.GetObject(input, obs.WithCustomHeader("Range", rangeHeader), obs.WithCustomHeader("If-Range", ifRange))
+		case rangeHeader != "":
+			output, err = b.Client.GetObject(input, obs.WithCustomHeader("Range", rangeHeader))
+		default:
+			output, err = b.Client.GetObject(input)
+		}
+
+		var obsErr obs.ObsError
+		switch {
+		case huaweiOBSIsNotFound(err):
+			return nil, ErrObjectNotFound
+		case errors.As(err, &obsErr) && (obsErr.StatusCode == http.StatusNotModified || obsErr.StatusCode == http.StatusPreconditionFailed || obsErr.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+			// failed conditions and ranges are errors of the SDK, but answers of the download
+			return huaweiOBSResponse(obsErr.StatusCode, obsErr.ResponseHeaders, http.NoBody), nil
+		case err != nil:
+			return nil, err
+		}
+		if method == http.MethodHead {
+			output.Body.Close()
+			output.Body = http.NoBody
+		}
+		return huaweiOBSResponse(output.StatusCode, output.ResponseHeaders, output.Body), nil
+	})
+}
+
+// huaweiOBSResponse makes an HTTP response of a status, the headers of the SDK, which are lower cased, and a body
+func huaweiOBSResponse(status int, headers map[string][]string, body io.ReadCloser) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}, Body: body}
+	for k, values := range headers {
+		for _, v := range values {
+			resp.Header.Add(k, v)
+		}
+	}
+	return resp
+}
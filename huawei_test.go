@@ -0,0 +1,533 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeOBSObject struct {
+	data         []byte
+	lastModified time.Time
+	sse          string
+	kmsKeyID     string
+}
+
+type fakeOBSUpload struct {
+	key   string
+	sse   string
+	parts map[int][]byte
+}
+
+type fakeOBSListBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string   `xml:"Name"`
+	Prefix      string   `xml:"Prefix"`
+	Marker      string   `xml:"Marker"`
+	NextMarker  string   `xml:"NextMarker,omitempty"`
+	MaxKeys     int      `xml:"MaxKeys"`
+	Delimiter   string   `xml:"Delimiter,omitempty"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Contents    []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []string `xml:"CommonPrefixes>Prefix"`
+}
+
+// fakeOBS is an in-memory stand-in of the OBS REST API, for a single bucket addressed in path style
+type fakeOBS struct {
+	sync.Mutex
+	bucket      string
+	objects     map[string]fakeOBSObject
+	uploads     map[string]*fakeOBSUpload
+	nextID      int
+	listCalls   int
+	copyCalls   int
+	partUploads int
+	partCopies  int
+}
+
+func newFakeOBS(bucket string) *fakeOBS {
+	return &fakeOBS{
+		bucket:  bucket,
+		objects: map[string]fakeOBSObject{},
+		uploads: map[string]*fakeOBSUpload{},
+	}
+}
+
+// header reads a header of the OBS API, sent with the x-obs- or the x-amz- prefix depending on the signature
+func (f *fakeOBS) header(r *http.Request, name string) string {
+	if v := r.Header.Get("x-obs-" + name); v != "" {
+		return v
+	}
+	return r.Header.Get("x-amz-" + name)
+}
+
+func (f *fakeOBS) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+func (f *fakeOBS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method != http.MethodGet {
+			f.error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+			return
+		}
+		f.list(w, query)
+		return
+	}
+	key := parts[1]
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeOBSUpload{key: key, sse: f.header(r, "server-side-encryption"), parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", f.bucket, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId") && f.header(r, "copy-source") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		source, _ := url.PathUnescape(strings.TrimPrefix(f.header(r, "copy-source"), "/"))
+		object, found := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+		var start, end int
+		if n, _ := fmt.Sscanf(f.header(r, "copy-source-range"), "bytes=%d-%d", &start, &end); !ok || !found || n != 2 || end >= len(object.data) {
+			f.error(w, r, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[number] = object.data[start : end+1]
+		f.partCopies++
+		fmt.Fprintf(w, "<CopyPartResult><LastModified>%s</LastModified><ETag>\"copy-%d\"</ETag></CopyPartResult>", time.Now().UTC().Format(time.RFC3339), number)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := ioutil.ReadAll(r.Body)
+		upload.parts[number] = data
+		f.partUploads++
+		w.Header().Set("ETag", fmt.Sprintf("\"part-%d\"", number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			f.error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for _, p := range complete.Parts {
+			data = append(data, upload.parts[p.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[upload.key] = fakeOBSObject{data: data, lastModified: time.Now(), sse: upload.sse}
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"complete\"</ETag></CompleteMultipartUploadResult>", f.bucket, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && f.header(r, "copy-source") != "":
+		source, _ := url.PathUnescape(strings.TrimPrefix(f.header(r, "copy-source"), "/"))
+		object, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+		if !ok {
+			f.error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.copyCalls++
+		object.sse = f.header(r, "server-side-encryption")
+		object.kmsKeyID = f.header(r, "server-side-encryption-aws-kms-key-id") + f.header(r, "server-side-encryption-kms-key-id")
+		f.objects[key] = object
+		fmt.Fprintf(w, "<CopyObjectResult><LastModified>%s</LastModified><ETag>\"copy\"</ETag></CopyObjectResult>", object.lastModified.UTC().Format(time.RFC3339))
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = fakeOBSObject{
+			data:         data,
+			lastModified: time.Now(),
+			sse:          f.header(r, "server-side-encryption"),
+			kmsKeyID:     f.header(r, "server-side-encryption-aws-kms-key-id") + f.header(r, "server-side-encryption-kms-key-id"),
+		}
+		w.Header().Set("ETag", "\"put\"")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			f.error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf("\"%x\"", len(object.data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", object.lastModified, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeOBS) list(w http.ResponseWriter, query url.Values) {
+	f.listCalls++
+	result := fakeOBSListBucketResult{
+		Name:      f.bucket,
+		Prefix:    query.Get("prefix"),
+		Marker:    query.Get("marker"),
+		MaxKeys:   1000,
+		Delimiter: query.Get("delimiter"),
+	}
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil {
+		result.MaxKeys = maxKeys
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	count, last := 0, ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, result.Prefix) {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(result.Prefix):], result.Delimiter); result.Delimiter != "" && i >= 0 {
+			entry = key[:len(result.Prefix)+i+len(result.Delimiter)]
+		}
+		if entry <= result.Marker || entry == last {
+			continue
+		}
+		if count == result.MaxKeys {
+			result.IsTruncated = true
+			if result.Delimiter != "" {
+				result.NextMarker = last
+			}
+			break
+		}
+		if entry == key {
+			result.Contents = append(result.Contents, struct {
+				Key          string `xml:"Key"`
+				LastModified string `xml:"LastModified"`
+				ETag         string `xml:"ETag"`
+				Size         int    `xml:"Size"`
+			}{key, f.objects[key].lastModified.UTC().Format(time.RFC3339), "\"etag\"", len(f.objects[key].data)})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, entry)
+		}
+		count, last = count+1, entry
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+type HuaweiTestSuite struct {
+	suite.Suite
+	Fake                   *fakeOBS
+	Server                 *httptest.Server
+	HuaweiOBSBackend       *HuaweiOBSBackend
+	SSEHuaweiOBSBackend    *HuaweiOBSBackend
+	BrokenHuaweiOBSBackend *HuaweiOBSBackend
+}
+
+func (suite *HuaweiTestSuite) SetupSuite() {
+	os.Setenv("HUAWEI_CLOUD_ACCESS_KEY_ID", "test-access-key-id")
+	os.Setenv("HUAWEI_CLOUD_SECRET_ACCESS_KEY", "test-secret-access-key")
+
+	suite.Fake = newFakeOBS("charts")
+	suite.Server = httptest.NewServer(suite.Fake)
+
+	suite.HuaweiOBSBackend = NewHuaweiOBSBackend("charts", "unittest", suite.Server.URL, "")
+	suite.HuaweiOBSBackend.PartSize = 8
+	suite.SSEHuaweiOBSBackend = NewHuaweiOBSBackend("charts", "ssetest", suite.Server.URL, "kms")
+	suite.SSEHuaweiOBSBackend.SSEKMSKeyID = "test-key"
+	suite.BrokenHuaweiOBSBackend = NewHuaweiOBSBackend("fake-bucket-cant-exist-fbce123", "", suite.Server.URL, "")
+}
+
+func (suite *HuaweiTestSuite) TearDownSuite() {
+	suite.Server.Close()
+	os.Unsetenv("HUAWEI_CLOUD_ACCESS_KEY_ID")
+	os.Unsetenv("HUAWEI_CLOUD_SECRET_ACCESS_KEY")
+}
+
+func (suite *HuaweiTestSuite) TestPutGetDeleteObject() {
+	err := suite.HuaweiOBSBackend.PutObject("putget.txt", []byte("small"))
+	suite.Nil(err, "no error putting small object")
+	suite.Contains(suite.Fake.objects, "unittest/putget.txt", "object stored under prefix")
+
+	object, err := suite.HuaweiOBSBackend.GetObject("putget.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal("putget.txt", object.Path)
+	suite.Equal([]byte("small"), object.Content)
+	suite.WithinDuration(time.Now(), object.LastModified, time.Minute, "last modified is set")
+
+	err = suite.HuaweiOBSBackend.DeleteObject("putget.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.HuaweiOBSBackend.GetObject("putget.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	_, err = suite.BrokenHuaweiOBSBackend.GetObject("putget.txt")
+	suite.NotNil(err, "cannot get objects with bad bucket")
+	suite.NotErrorIs(err, ErrObjectNotFound, "missing bucket is not a missing object")
+}
+
+func (suite *HuaweiTestSuite) TestMultipartUpload() {
+	parts := suite.Fake.partUploads
+	content := []byte("0123456789abcdefghij")
+	err := suite.HuaweiOBSBackend.PutObjectStream("multipart.txt", bytes.NewReader(content))
+	suite.Nil(err, "no error putting large object")
+	suite.Equal(3, suite.Fake.partUploads-parts, "content is sent in parts")
+	suite.Empty(suite.Fake.uploads, "upload is completed")
+
+	stream, err := suite.HuaweiOBSBackend.GetObjectStream("multipart.txt")
+	suite.Nil(err, "no error getting object stream")
+	data, _ := ioutil.ReadAll(stream.Content)
+	stream.Content.Close()
+	suite.Equal(content, data, "parts are assembled in order")
+
+	parts = suite.Fake.partUploads
+	err = suite.HuaweiOBSBackend.PutObject("exact.txt", content[:8])
+	suite.Nil(err)
+	suite.Equal(parts, suite.Fake.partUploads, "content of exactly one part is a simple upload")
+
+	for _, path := range []string{"multipart.txt", "exact.txt"} {
+		suite.Nil(suite.HuaweiOBSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *HuaweiTestSuite) TestSSEKMS() {
+	err := suite.SSEHuaweiOBSBackend.PutObject("encrypted.txt", []byte("secret"))
+	suite.Nil(err, "no error putting encrypted object")
+	object := suite.Fake.objects["ssetest/encrypted.txt"]
+	suite.Contains(object.sse, "kms", "SSE-KMS is requested")
+	suite.Equal("test-key", object.kmsKeyID, "KMS key is passed")
+
+	err = suite.SSEHuaweiOBSBackend.RenamePrefixOrObject("encrypted.txt", "renamed.txt")
+	suite.Nil(err, "no error renaming encrypted object")
+	object = suite.Fake.objects["ssetest/renamed.txt"]
+	suite.Contains(object.sse, "kms", "copies are encrypted")
+	suite.Equal("test-key", object.kmsKeyID)
+
+	suite.Nil(suite.SSEHuaweiOBSBackend.DeleteObject("renamed.txt"))
+}
+
+func (suite *HuaweiTestSuite) TestListObjects() {
+	paths := []string{"list/a.txt", "list/b.txt", "list/nested/c.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.HuaweiOBSBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.HuaweiOBSBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	_, err = suite.BrokenHuaweiOBSBackend.ListObjects("")
+	suite.NotNil(err, "cannot list objects with bad bucket")
+
+	for _, path := range paths {
+		suite.Nil(suite.HuaweiOBSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *HuaweiTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.HuaweiOBSBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.HuaweiOBSBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.HuaweiOBSBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.HuaweiOBSBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+
+	_, err = output.NextPage()
+	suite.NotNil(err, "cannot call NextPage more than once")
+
+	for _, path := range paths {
+		suite.Nil(suite.HuaweiOBSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *HuaweiTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("occupied/c.txt", []byte("c")))
+
+	err := suite.HuaweiOBSBackend.RenamePrefixOrObject("rename", "occupied")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto a prefix with objects")
+	err = suite.HuaweiOBSBackend.RenamePrefixOrObject("rename/a.txt", "occupied/c.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	copies := suite.Fake.copyCalls
+	err = suite.HuaweiOBSBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	suite.Equal(2, suite.Fake.copyCalls-copies, "objects are copied server side")
+	object, err := suite.HuaweiOBSBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "content follows rename")
+	_, err = suite.HuaweiOBSBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.HuaweiOBSBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"renamed/a.txt", "renamed/sub/b.txt", "occupied/c.txt"} {
+		suite.Nil(suite.HuaweiOBSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *HuaweiTestSuite) TestRenameLargeObject() {
+	// larger than the part size of the backend, so copied in three parts
+	content := []byte("0123456789abcdefghij")
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("rename-large/large.txt", content))
+	copies, partCopies := suite.Fake.copyCalls, suite.Fake.partCopies
+
+	err := suite.HuaweiOBSBackend.RenamePrefixOrObject("rename-large", "renamed-large")
+	suite.Nil(err, "no error renaming a large object")
+	suite.Equal(copies, suite.Fake.copyCalls, "large objects are not copied in a single request")
+	suite.Equal(partCopies+3, suite.Fake.partCopies, "large objects are copied part by part")
+	suite.Empty(suite.Fake.uploads, "multipart copy is completed")
+
+	object, err := suite.HuaweiOBSBackend.GetObject("renamed-large/large.txt")
+	suite.Nil(err)
+	suite.Equal(content, object.Content, "parts are assembled in order")
+	_, err = suite.HuaweiOBSBackend.GetObject("rename-large/large.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	// one byte past a part is never a part of its own
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("odd.txt", content[:17]))
+	suite.Nil(suite.HuaweiOBSBackend.RenamePrefixOrObject("odd.txt", "renamed-odd.txt"))
+	object, err = suite.HuaweiOBSBackend.GetObject("renamed-odd.txt")
+	suite.Nil(err)
+	suite.Equal(content[:17], object.Content)
+
+	for _, path := range []string{"renamed-large/large.txt", "renamed-odd.txt"} {
+		suite.Nil(suite.HuaweiOBSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *HuaweiTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.HuaweiOBSBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(content, w.Body.Bytes(), "content is served")
+	etag := w.Header().Get("ETag")
+	suite.NotEmpty(etag, "ETag is passed through")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=-10")
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are passed through")
+	suite.Equal(content[90:], w.Body.Bytes(), "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusNotModified, w.Code, "conditional requests are passed through")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("If-Modified-Since", "yesterday")
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code, "invalid dates are ignored")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodHead, "/download.txt", nil)
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("100", w.Header().Get("Content-Length"))
+	suite.Empty(w.Body.Bytes(), "no content is sent to HEAD requests")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.HuaweiOBSBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.HuaweiOBSBackend.DeleteObject("download.txt"))
+}
+
+func TestHuaweiStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(HuaweiTestSuite))
+}
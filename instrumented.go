@@ -0,0 +1,351 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// InstrumentedBackend is a Backend wrapper recording Prometheus metrics of the operations of the wrapped backend
+	InstrumentedBackend struct {
+		Backend Backend
+		// BackendType is the backend label of the metrics, the type of the wrapped backend by default
+		BackendType string
+		metrics     *instrumentedMetrics
+	}
+
+	instrumentedMetrics struct {
+		duration     *prometheus.HistogramVec
+		errors       *prometheus.CounterVec
+		bytesRead    *prometheus.CounterVec
+		bytesWritten *prometheus.CounterVec
+		inFlight     *prometheus.GaugeVec
+		downloads    *prometheus.CounterVec
+	}
+
+	// instrumentedReader counts the bytes read from a stream
+	instrumentedReader struct {
+		io.Reader
+		counter prometheus.Counter
+	}
+
+	// instrumentedReadCloser counts the bytes read from a stream, which is in flight until it is closed
+	instrumentedReadCloser struct {
+		io.ReadCloser
+		counter prometheus.Counter
+		done    func()
+	}
+
+	// instrumentedListOutput records the pages following the first one
+	instrumentedListOutput struct {
+		ListObjectsFromDirectoryOutput
+		backend InstrumentedBackend
+	}
+
+	// instrumentedResponseWriter records the status code and the size of a response
+	instrumentedResponseWriter struct {
+		http.ResponseWriter
+		status int
+		bytes  int
+	}
+)
+
+// NewInstrumentedBackend creates a new instance of InstrumentedBackend, with its metrics registered on registerer
+// Several instances may share a registerer, their metrics are told apart by the backend label
+func NewInstrumentedBackend(backend Backend, registerer prometheus.Registerer) *InstrumentedBackend {
+	labels := []string{"backend", "operation"}
+	metrics := &instrumentedMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "storage_operation_duration_seconds",
+			Help:    "Duration of the storage operations, every page of the listings included.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_operation_errors_total",
+			Help: "Number of failed storage operations, by class of error.",
+		}, append(labels, "class")),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_read_bytes_total",
+			Help: "Number of bytes of content read from the storage.",
+		}, labels),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_written_bytes_total",
+			Help: "Number of bytes of content written to the storage.",
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "storage_operations_in_flight",
+			Help: "Number of storage operations in progress, open streams included.",
+		}, labels),
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_http_downloads_total",
+			Help: "Number of objects served over HTTP, by status code.",
+		}, []string{"backend", "code"}),
+	}
+
+	metrics.duration = registerInstrumented(registerer, metrics.duration).(*prometheus.HistogramVec)
+	metrics.errors = registerInstrumented(registerer, metrics.errors).(*prometheus.CounterVec)
+	metrics.bytesRead = registerInstrumented(registerer, metrics.bytesRead).(*prometheus.CounterVec)
+	metrics.bytesWritten = registerInstrumented(registerer, metrics.bytesWritten).(*prometheus.CounterVec)
+	metrics.inFlight = registerInstrumented(registerer, metrics.inFlight).(*prometheus.GaugeVec)
+	metrics.downloads = registerInstrumented(registerer, metrics.downloads).(*prometheus.CounterVec)
+
+	return &InstrumentedBackend{
+		Backend:     backend,
+		BackendType: instrumentedBackendType(backend),
+		metrics:     metrics,
+	}
+}
+
+// registerInstrumented registers a collector, or returns the one already registered by another instance
+func registerInstrumented(registerer prometheus.Registerer, collector prometheus.Collector) prometheus.Collector {
+	err := registerer.Register(collector)
+	if err == nil {
+		return collector
+	}
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) && fmt.Sprintf("%T", registered.ExistingCollector) == fmt.Sprintf("%T", collector) {
+		return registered.ExistingCollector
+	}
+	panic("Failed to register storage metrics: " + err.Error())
+}
+
+// instrumentedBackendType is the name of the type of a backend, e.g. AmazonS3Backend
+func instrumentedBackendType(backend Backend) string {
+	name := fmt.Sprintf("%T", backend)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// errorClass is the class label of an error
+func errorClass(err error) string {
+	switch {
+	case isObjectNotFound(err):
+		return "not_found"
+	case errors.Is(err, ErrPrefixIsAnObject):
+		return "prefix_is_an_object"
+	case errors.Is(err, ErrNewPathNotEmpty):
+		return "new_path_not_empty"
+	case errors.Is(err, ErrReadOnly):
+		return "read_only"
+	case errors.Is(err, ErrAccessDenied):
+		return "access_denied"
+	case errors.Is(err, ErrNotImplemented):
+		return "not_implemented"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case IsRetryableError(err):
+		return "transient"
+	}
+	return "other"
+}
+
+// start records an operation in flight, and returns the function recording its outcome
+func (b InstrumentedBackend) start(operation string) func(error) {
+	inFlight := b.metrics.inFlight.WithLabelValues(b.BackendType, operation)
+	inFlight.Inc()
+	start := time.Now()
+	return func(err error) {
+		inFlight.Dec()
+		b.metrics.duration.WithLabelValues(b.BackendType, operation).Observe(time.Since(start).Seconds())
+		if err != nil && err != io.EOF {
+			b.metrics.errors.WithLabelValues(b.BackendType, operation, errorClass(err)).Inc()
+		}
+	}
+}
+
+func (b InstrumentedBackend) read(operation string, n int) {
+	b.metrics.bytesRead.WithLabelValues(b.BackendType, operation).Add(float64(n))
+}
+
+func (b InstrumentedBackend) written(operation string, n int) {
+	b.metrics.bytesWritten.WithLabelValues(b.BackendType, operation).Add(float64(n))
+}
+
+func (r instrumentedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+func (r instrumentedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+func (r instrumentedReadCloser) Close() error {
+	defer r.done()
+	return r.ReadCloser.Close()
+}
+
+func (w *instrumentedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *instrumentedResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b InstrumentedBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b InstrumentedBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b InstrumentedBackend) ListObjects(prefix string) ([]Object, error) {
+	done := b.start("ListObjects")
+	objects, err := b.Backend.ListObjects(prefix)
+	done(err)
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend, every page being recorded
+func (b InstrumentedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	done := b.start("ListObjectsFromDirectory")
+	output, err := b.Backend.ListObjectsFromDirectory(prefix, limit)
+	done(err)
+	if output == nil {
+		return output, err
+	}
+	return instrumentedListOutput{ListObjectsFromDirectoryOutput: output, backend: b}, err
+}
+
+func (o instrumentedListOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	done := o.backend.start("ListObjectsFromDirectory")
+	output, err := o.ListObjectsFromDirectoryOutput.NextPage()
+	done(err)
+	if output == nil {
+		return output, err
+	}
+	return instrumentedListOutput{ListObjectsFromDirectoryOutput: output, backend: o.backend}, err
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b InstrumentedBackend) GetObject(path string) (Object, error) {
+	done := b.start("GetObject")
+	object, err := b.Backend.GetObject(path)
+	done(err)
+	b.read("GetObject", len(object.Content))
+	return object, err
+}
+
+// PutObject uploads an object to the wrapped backend
+func (b InstrumentedBackend) PutObject(path string, content []byte) error {
+	done := b.start("PutObject")
+	err := b.Backend.PutObject(path, content)
+	done(err)
+	if err == nil {
+		b.written("PutObject", len(content))
+	}
+	return err
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b InstrumentedBackend) DeleteObject(path string) error {
+	done := b.start("DeleteObject")
+	err := b.Backend.DeleteObject(path)
+	done(err)
+	return err
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+func (b InstrumentedBackend) RenamePrefixOrObject(path, newPath string) error {
+	done := b.start("RenamePrefixOrObject")
+	err := b.Backend.RenamePrefixOrObject(path, newPath)
+	done(err)
+	return err
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+// The duration is the time to open the stream, which is in flight until it is closed
+func (b InstrumentedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	done := b.start("GetObjectStream")
+	stream, err := getObjectStream(b.Backend, path)
+	done(err)
+	if err != nil || stream.Content == nil {
+		return stream, err
+	}
+	inFlight := b.metrics.inFlight.WithLabelValues(b.BackendType, "GetObjectStream")
+	inFlight.Inc()
+	var once sync.Once
+	stream.Content = instrumentedReadCloser{
+		ReadCloser: stream.Content,
+		counter:    b.metrics.bytesRead.WithLabelValues(b.BackendType, "GetObjectStream"),
+		done: func() {
+			once.Do(inFlight.Dec)
+		},
+	}
+	return stream, nil
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend, counting the bytes it reads
+func (b InstrumentedBackend) PutObjectStream(path string, content io.Reader) error {
+	done := b.start("PutObjectStream")
+	err := putObjectStream(b.Backend, path, instrumentedReader{
+		Reader:  content,
+		counter: b.metrics.bytesWritten.WithLabelValues(b.BackendType, "PutObjectStream"),
+	})
+	done(err)
+	return err
+}
+
+// HandleHttpFileDownload serves an object of the wrapped backend, recording the status code of the response
+func (b InstrumentedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	done := b.start("HandleHttpFileDownload")
+	recorder := &instrumentedResponseWriter{ResponseWriter: w}
+	handleHttpFileDownload(b.Backend, recorder, r, path)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	var err error
+	if recorder.status == http.StatusNotFound {
+		err = ErrObjectNotFound
+	} else if recorder.status == http.StatusForbidden {
+		err = ErrAccessDenied
+	} else if recorder.status >= http.StatusInternalServerError {
+		err = fmt.Errorf("download failed with status %d", recorder.status)
+	}
+	done(err)
+	b.read("HandleHttpFileDownload", recorder.bytes)
+	b.metrics.downloads.WithLabelValues(b.BackendType, strconv.Itoa(recorder.status)).Inc()
+}
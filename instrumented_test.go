@@ -0,0 +1,179 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/suite"
+)
+
+type InstrumentedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Registry      *prometheus.Registry
+	Local         *LocalFilesystemBackend
+	Instrumented  *InstrumentedBackend
+}
+
+func (suite *InstrumentedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-instrumented/%s", timestamp)
+	suite.Registry = prometheus.NewRegistry()
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.Instrumented = NewInstrumentedBackend(suite.Local, suite.Registry)
+}
+
+func (suite *InstrumentedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *InstrumentedTestSuite) operations(operation string) uint64 {
+	observer, err := suite.Instrumented.metrics.duration.GetMetricWithLabelValues("LocalFilesystemBackend", operation)
+	suite.Nil(err)
+	metric := &dto.Metric{}
+	suite.Nil(observer.(prometheus.Histogram).Write(metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func (suite *InstrumentedTestSuite) TestOperations() {
+	m := suite.Instrumented.metrics
+	suite.Equal("LocalFilesystemBackend", suite.Instrumented.BackendType, "the backend label is the type of the wrapped backend")
+
+	suite.Nil(suite.Instrumented.PutObject("a.txt", []byte("12345")))
+	suite.Nil(suite.Instrumented.PutObjectStream("b.txt", bytes.NewReader([]byte("123"))))
+	suite.Equal(5.0, testutil.ToFloat64(m.bytesWritten.WithLabelValues("LocalFilesystemBackend", "PutObject")))
+	suite.Equal(3.0, testutil.ToFloat64(m.bytesWritten.WithLabelValues("LocalFilesystemBackend", "PutObjectStream")))
+
+	_, err := suite.Instrumented.GetObject("a.txt")
+	suite.Nil(err)
+	suite.Equal(5.0, testutil.ToFloat64(m.bytesRead.WithLabelValues("LocalFilesystemBackend", "GetObject")))
+
+	stream, err := suite.Instrumented.GetObjectStream("b.txt")
+	suite.Nil(err)
+	inFlight := m.inFlight.WithLabelValues("LocalFilesystemBackend", "GetObjectStream")
+	suite.Equal(1.0, testutil.ToFloat64(inFlight), "open streams are in flight")
+	_, err = ioutil.ReadAll(stream.Content)
+	suite.Nil(err)
+	stream.Content.Close()
+	stream.Content.Close()
+	suite.Equal(0.0, testutil.ToFloat64(inFlight), "closed streams are not")
+	suite.Equal(3.0, testutil.ToFloat64(m.bytesRead.WithLabelValues("LocalFilesystemBackend", "GetObjectStream")))
+
+	_, err = suite.Instrumented.GetObject("missing.txt")
+	suite.NotNil(err)
+	suite.Nil(suite.Instrumented.PutObject("c.txt", []byte("c")))
+	suite.Equal(ErrNewPathNotEmpty, suite.Instrumented.RenamePrefixOrObject("a.txt", "c.txt"))
+	suite.Equal(1.0, testutil.ToFloat64(m.errors.WithLabelValues("LocalFilesystemBackend", "GetObject", "not_found")))
+	suite.Equal(1.0, testutil.ToFloat64(m.errors.WithLabelValues("LocalFilesystemBackend", "RenamePrefixOrObject", "new_path_not_empty")))
+
+	output, err := suite.Instrumented.ListObjectsFromDirectory("", 1)
+	for err != io.EOF {
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.True(suite.operations("ListObjectsFromDirectory") >= 3, "every page is recorded")
+	suite.Equal(2, int(suite.operations("GetObject")))
+	suite.Equal(2, testutil.CollectAndCount(m.errors), "the last page is not an error")
+
+	suite.Equal(0.0, testutil.ToFloat64(m.inFlight.WithLabelValues("LocalFilesystemBackend", "GetObject")))
+}
+
+func (suite *InstrumentedTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.Local.PutObject("download.txt", []byte("0123456789")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	suite.Instrumented.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+		suite.Instrumented.HandleHttpFileDownload(w, r, "missing.txt")
+		suite.Equal(http.StatusNotFound, w.Code)
+	}
+
+	m := suite.Instrumented.metrics
+	suite.Equal(1.0, testutil.ToFloat64(m.downloads.WithLabelValues("LocalFilesystemBackend", "206")))
+	suite.Equal(2.0, testutil.ToFloat64(m.downloads.WithLabelValues("LocalFilesystemBackend", "404")))
+	suite.Equal(4.0, testutil.ToFloat64(m.bytesRead.WithLabelValues("LocalFilesystemBackend", "HandleHttpFileDownload")))
+	suite.Equal(2.0, testutil.ToFloat64(m.errors.WithLabelValues("LocalFilesystemBackend", "HandleHttpFileDownload", "not_found")))
+}
+
+func (suite *InstrumentedTestSuite) TestHandleHttpFileDownloadDenied() {
+	suite.Nil(suite.Local.PutObject("private.txt", []byte("private")))
+	policy, err := LoadPolicy([]byte(testPolicyYAML))
+	suite.Nil(err)
+	instrumented := NewInstrumentedBackend(NewPolicyBackend(suite.Local, policy), suite.Registry)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/private.txt", nil)
+	instrumented.HandleHttpFileDownload(w, r, "private.txt")
+	suite.Equal(http.StatusForbidden, w.Code)
+
+	m := instrumented.metrics
+	suite.Equal(1.0, testutil.ToFloat64(m.downloads.WithLabelValues("PolicyBackend", "403")))
+	suite.Equal(1.0, testutil.ToFloat64(m.errors.WithLabelValues("PolicyBackend", "HandleHttpFileDownload", "access_denied")))
+}
+
+func (suite *InstrumentedTestSuite) TestSharedRegisterer() {
+	other := NewInstrumentedBackend(NewCompressedBackend(suite.Local, "zstd"), suite.Registry)
+	suite.Equal("CompressedBackend", other.BackendType)
+	suite.Nil(other.PutObject("shared.txt", []byte("shared")))
+	suite.Nil(suite.Instrumented.PutObject("shared.txt", []byte("shared")))
+
+	m := suite.Instrumented.metrics
+	suite.Equal(6.0, testutil.ToFloat64(m.bytesWritten.WithLabelValues("CompressedBackend", "PutObject")))
+	suite.Equal(2, testutil.CollectAndCount(m.bytesWritten), "instances share the collectors")
+
+	suite.Panics(func() {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "storage_operation_duration_seconds", Help: "clash"}))
+		NewInstrumentedBackend(suite.Local, registry)
+	})
+}
+
+func (suite *InstrumentedTestSuite) TestErrorClass() {
+	for err, class := range map[error]string{
+		ErrObjectNotFound:           "not_found",
+		os.ErrNotExist:              "not_found",
+		ErrPrefixIsAnObject:         "prefix_is_an_object",
+		ErrReadOnly:                 "read_only",
+		syscall.ECONNRESET:          "transient",
+		fmt.Errorf("invalid chart"): "other",
+	} {
+		suite.Equal(class, errorClass(err), "%v", err)
+	}
+}
+
+func TestInstrumentedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(InstrumentedTestSuite))
+}
@@ -0,0 +1,729 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	kubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	kubernetesManagedBy      = "chartmuseum-storage"
+	// labels and annotations of the objects, see KubernetesBackend
+	kubernetesKeyPrefix        = "storage.chartmuseum.com/"
+	kubernetesObjectLabel      = kubernetesKeyPrefix + "object"
+	kubernetesShardLabel       = kubernetesKeyPrefix + "shard"
+	kubernetesDepthLabel       = kubernetesKeyPrefix + "depth"
+	kubernetesDirLabelPrefix   = kubernetesKeyPrefix + "dir-"
+	kubernetesPathAnnotation   = kubernetesKeyPrefix + "path"
+	kubernetesModAnnotation    = kubernetesKeyPrefix + "last-modified"
+	kubernetesShardsAnnotation = kubernetesKeyPrefix + "shards"
+	kubernetesGenAnnotation    = kubernetesKeyPrefix + "generation"
+	kubernetesDataKey          = "content"
+
+	// ConfigMaps and Secrets are limited to 1MiB, metadata included
+	defaultKubernetesShardSize = 900 * 1024
+	kubernetesListLimit        = 500
+)
+
+// errKubernetesShardsReplaced is returned when the shards of an object are replaced while it is read
+var errKubernetesShardsReplaced = errors.New("shards replaced by a concurrent write")
+
+// kubernetesObject is the part of a ConfigMap or a Secret used by KubernetesBackend
+type kubernetesObject struct {
+	metav1.ObjectMeta
+	Data []byte
+}
+
+// kubernetesEntry is a member of a directory listing
+type kubernetesEntry struct {
+	name         string
+	isDir        bool
+	lastModified time.Time
+}
+
+type kubernetesListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []kubernetesEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &kubernetesListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// directories are derived from the paths of every object below the prefix, pages are sliced from them
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *kubernetesListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// KubernetesBackend is a storage backend keeping small objects in ConfigMaps, or Secrets, of a namespace
+// Each object has a head ConfigMap named after its path, holding the path and the modification time as annotations.
+// Content larger than ShardSize is split across extra ConfigMaps, written before the head points to them, so that
+// a reader sees either the old or the new content. Directories are found through labels holding hashes of the path ancestors.
+type KubernetesBackend struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Prefix    string
+	// Secrets stores objects in Secrets instead of ConfigMaps
+	Secrets bool
+	// ShardSize is the largest content held by a single ConfigMap or Secret
+	ShardSize int
+	Context   context.Context
+}
+
+// NewKubernetesBackend creates a new instance of KubernetesBackend
+// The client is configured from KUBECONFIG or ~/.kube/config, or from the service account when running in a cluster
+// An empty namespace is the namespace of the current context, or of the service account
+func NewKubernetesBackend(namespace string, prefix string) *KubernetesBackend {
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		panic("Failed to load Kubernetes client configuration: " + err.Error())
+	}
+	if namespace == "" {
+		namespace, _, err = config.Namespace()
+		if err != nil {
+			panic("Failed to find Kubernetes namespace: " + err.Error())
+		}
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		panic("Failed to create Kubernetes client: " + err.Error())
+	}
+	return NewKubernetesBackendWithClient(client, namespace, prefix)
+}
+
+// NewKubernetesBackendWithClient creates a new instance of KubernetesBackend from an existing client
+func NewKubernetesBackendWithClient(client kubernetes.Interface, namespace string, prefix string) *KubernetesBackend {
+	b := &KubernetesBackend{
+		Client:    client,
+		Namespace: namespace,
+		Prefix:    cleanPrefix(prefix),
+		ShardSize: defaultKubernetesShardSize,
+		Context:   context.Background(),
+	}
+	return b
+}
+
+func (b KubernetesBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+// kubernetesHash is the label value standing for a path, label values are limited to 63 characters
+func kubernetesHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:40]
+}
+
+// kubernetesName returns a valid ConfigMap name for a path: the path with dashes for anything
+// but lowercase letters and digits, followed by a hash of the path to keep names unique
+func kubernetesName(key string) string {
+	var name strings.Builder
+	for _, c := range strings.ToLower(key) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			name.WriteRune(c)
+		} else if name.Len() > 0 && !strings.HasSuffix(name.String(), "-") {
+			name.WriteRune('-')
+		}
+		if name.Len() >= 200 {
+			break
+		}
+	}
+	readable := strings.TrimSuffix(name.String(), "-")
+	if readable == "" {
+		return kubernetesHash(key)[:12]
+	}
+	return readable + "-" + kubernetesHash(key)[:12]
+}
+
+func kubernetesShardName(name string, generation string, shard int) string {
+	return name + "-" + generation + "-" + strconv.Itoa(shard)
+}
+
+// kubernetesLabels returns the labels of the head of an object: one label per ancestor directory, and the depth
+func kubernetesLabels(key string) map[string]string {
+	segments := strings.Split(key, "/")
+	l := map[string]string{
+		kubernetesManagedByLabel: kubernetesManagedBy,
+		kubernetesObjectLabel:    kubernetesHash(key),
+		kubernetesShardLabel:     "0",
+		kubernetesDepthLabel:     strconv.Itoa(len(segments)),
+	}
+	for depth := 1; depth < len(segments); depth++ {
+		l[kubernetesDirLabelPrefix+strconv.Itoa(depth)] = kubernetesHash(strings.Join(segments[:depth], "/"))
+	}
+	return l
+}
+
+// directorySelector selects the heads of the objects below dir, at any depth, or at depth only if depth > 0
+func kubernetesDirectorySelector(dir string, depth int) string {
+	set := labels.Set{
+		kubernetesManagedByLabel: kubernetesManagedBy,
+		kubernetesShardLabel:     "0",
+	}
+	if dir != "" {
+		set[kubernetesDirLabelPrefix+strconv.Itoa(len(strings.Split(dir, "/")))] = kubernetesHash(dir)
+	}
+	if depth > 0 {
+		set[kubernetesDepthLabel] = strconv.Itoa(depth)
+	}
+	return set.AsSelector().String()
+}
+
+func kubernetesGeneration() string {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func (b KubernetesBackend) get(name string) (kubernetesObject, error) {
+	if b.Secrets {
+		s, err := b.Client.CoreV1().Secrets(b.Namespace).Get(b.Context, name, metav1.GetOptions{})
+		if err != nil {
+			return kubernetesObject{}, err
+		}
+		return kubernetesObject{ObjectMeta: s.ObjectMeta, Data: s.Data[kubernetesDataKey]}, nil
+	}
+	cm, err := b.Client.CoreV1().ConfigMaps(b.Namespace).Get(b.Context, name, metav1.GetOptions{})
+	if err != nil {
+		return kubernetesObject{}, err
+	}
+	return kubernetesObject{ObjectMeta: cm.ObjectMeta, Data: cm.BinaryData[kubernetesDataKey]}, nil
+}
+
+func (b KubernetesBackend) list(selector string) ([]kubernetesObject, error) {
+	var objects []kubernetesObject
+
+	opts := metav1.ListOptions{LabelSelector: selector, Limit: kubernetesListLimit}
+	for {
+		var meta metav1.ListMeta
+		if b.Secrets {
+			list, err := b.Client.CoreV1().Secrets(b.Namespace).List(b.Context, opts)
+			if err != nil {
+				return objects, err
+			}
+			for _, s := range list.Items {
+				objects = append(objects, kubernetesObject{ObjectMeta: s.ObjectMeta})
+			}
+			meta = list.ListMeta
+		} else {
+			list, err := b.Client.CoreV1().ConfigMaps(b.Namespace).List(b.Context, opts)
+			if err != nil {
+				return objects, err
+			}
+			for _, cm := range list.Items {
+				objects = append(objects, kubernetesObject{ObjectMeta: cm.ObjectMeta})
+			}
+			meta = list.ListMeta
+		}
+		if meta.Continue == "" {
+			return objects, nil
+		}
+		opts.Continue = meta.Continue
+	}
+}
+
+func (b KubernetesBackend) create(o kubernetesObject) error {
+	var err error
+	if b.Secrets {
+		s := &corev1.Secret{ObjectMeta: o.ObjectMeta, Type: corev1.SecretTypeOpaque, Data: map[string][]byte{kubernetesDataKey: o.Data}}
+		_, err = b.Client.CoreV1().Secrets(b.Namespace).Create(b.Context, s, metav1.CreateOptions{})
+	} else {
+		cm := &corev1.ConfigMap{ObjectMeta: o.ObjectMeta, BinaryData: map[string][]byte{kubernetesDataKey: o.Data}}
+		_, err = b.Client.CoreV1().ConfigMaps(b.Namespace).Create(b.Context, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// update replaces an object, failing with a conflict if it changed since its resourceVersion was read
+func (b KubernetesBackend) update(o kubernetesObject) error {
+	var err error
+	if b.Secrets {
+		s := &corev1.Secret{ObjectMeta: o.ObjectMeta, Type: corev1.SecretTypeOpaque, Data: map[string][]byte{kubernetesDataKey: o.Data}}
+		_, err = b.Client.CoreV1().Secrets(b.Namespace).Update(b.Context, s, metav1.UpdateOptions{})
+	} else {
+		cm := &corev1.ConfigMap{ObjectMeta: o.ObjectMeta, BinaryData: map[string][]byte{kubernetesDataKey: o.Data}}
+		_, err = b.Client.CoreV1().ConfigMaps(b.Namespace).Update(b.Context, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// delete removes an object, only at resourceVersion if not empty; a missing object is not an error
+func (b KubernetesBackend) delete(name string, resourceVersion string) error {
+	opts := metav1.DeleteOptions{}
+	if resourceVersion != "" {
+		opts.Preconditions = &metav1.Preconditions{ResourceVersion: &resourceVersion}
+	}
+	var err error
+	if b.Secrets {
+		err = b.Client.CoreV1().Secrets(b.Namespace).Delete(b.Context, name, opts)
+	} else {
+		err = b.Client.CoreV1().ConfigMaps(b.Namespace).Delete(b.Context, name, opts)
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// head returns the head of the object at key
+func (b KubernetesBackend) head(key string) (kubernetesObject, error) {
+	o, err := b.get(kubernetesName(key))
+	if apierrors.IsNotFound(err) || (err == nil && o.Annotations[kubernetesPathAnnotation] != key) {
+		return o, ErrObjectNotFound
+	}
+	return o, err
+}
+
+func (b KubernetesBackend) deleteShards(head kubernetesObject) error {
+	shards, _ := strconv.Atoi(head.Annotations[kubernetesShardsAnnotation])
+	for i := 1; i < shards; i++ {
+		if err := b.delete(kubernetesShardName(head.Name, head.Annotations[kubernetesGenAnnotation], i), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func kubernetesLastModified(o kubernetesObject) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, o.Annotations[kubernetesModAnnotation])
+	if err != nil {
+		return o.CreationTimestamp.Time
+	}
+	return t
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b KubernetesBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b KubernetesBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects in the namespace, at prefix
+func (b KubernetesBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	dir := b.key(prefix)
+	depth := 1
+	if dir != "" {
+		depth = len(strings.Split(dir, "/")) + 1
+	}
+	heads, err := b.list(kubernetesDirectorySelector(dir, depth))
+	if err != nil {
+		return objects, err
+	}
+	for _, head := range heads {
+		key := head.Annotations[kubernetesPathAnnotation]
+		object := Object{
+			Metadata: Metadata{
+				Path:         removePrefixFromObjectPath(dir, key),
+				LastModified: kubernetesLastModified(head),
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b KubernetesBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	dir := b.key(prefix)
+	if dir != "" {
+		_, err := b.head(dir)
+		if err == nil {
+			return nil, ErrPrefixIsAnObject
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+
+	heads, err := b.list(kubernetesDirectorySelector(dir, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &kubernetesListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+	seen := map[string]bool{}
+	for _, head := range heads {
+		name := removePrefixFromObjectPath(dir, head.Annotations[kubernetesPathAnnotation])
+		if i := strings.Index(name, "/"); i >= 0 {
+			if !seen[name[:i]] {
+				seen[name[:i]] = true
+				output.entries = append(output.entries, kubernetesEntry{name: name[:i], isDir: true})
+			}
+			continue
+		}
+		output.entries = append(output.entries, kubernetesEntry{name: name, lastModified: kubernetesLastModified(head)})
+	}
+	sort.Slice(output.entries, func(i, j int) bool { return output.entries[i].name < output.entries[j].name })
+
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject copies an object, or every object under a prefix, to newPath then deletes the originals
+// Each object is moved on its own, the whole move is not atomic
+func (b KubernetesBackend) RenamePrefixOrObject(path, newPath string) error {
+	key, newKey := b.key(path), b.key(newPath)
+
+	// check if newPath is already occupied
+	if _, err := b.head(newKey); err == nil {
+		return ErrNewPathNotEmpty
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	occupied, err := b.list(kubernetesDirectorySelector(newKey, 0))
+	if err != nil {
+		return err
+	}
+	if len(occupied) > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	var keys []string
+	if _, err := b.head(key); err == nil {
+		keys = append(keys, key)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	} else {
+		heads, err := b.list(kubernetesDirectorySelector(key, 0))
+		if err != nil {
+			return err
+		}
+		for _, head := range heads {
+			keys = append(keys, head.Annotations[kubernetesPathAnnotation])
+		}
+	}
+
+	// ignore if the source does not exist
+	for _, k := range keys {
+		content, lastModified, err := b.read(k)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.write(newKey+strings.TrimPrefix(k, key), content, lastModified, true); err != nil {
+			return err
+		}
+		if err := b.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read returns the content of the object at key, starting over if its shards are replaced meanwhile
+func (b KubernetesBackend) read(key string) ([]byte, time.Time, error) {
+	var content []byte
+	var lastModified time.Time
+
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool { return err == errKubernetesShardsReplaced }, func() error {
+		head, err := b.head(key)
+		if err != nil {
+			return err
+		}
+		content = append([]byte{}, head.Data...)
+		lastModified = kubernetesLastModified(head)
+
+		generation := head.Annotations[kubernetesGenAnnotation]
+		shards, _ := strconv.Atoi(head.Annotations[kubernetesShardsAnnotation])
+		for i := 1; i < shards; i++ {
+			shard, err := b.get(kubernetesShardName(head.Name, generation, i))
+			if apierrors.IsNotFound(err) {
+				return errKubernetesShardsReplaced
+			}
+			if err != nil {
+				return err
+			}
+			content = append(content, shard.Data...)
+		}
+		return nil
+	})
+	return content, lastModified, err
+}
+
+// write stores content at key: the extra shards are created first, then the head is created or updated
+// at the resourceVersion it was read at, and the shards of the previous content are deleted last
+// If exclusive is set, an existing object at key is an ErrNewPathNotEmpty error
+func (b KubernetesBackend) write(key string, content []byte, lastModified time.Time, exclusive bool) error {
+	shardSize := b.ShardSize
+	if shardSize <= 0 {
+		shardSize = defaultKubernetesShardSize
+	}
+	name := kubernetesName(key)
+	generation := kubernetesGeneration()
+
+	first := content
+	if len(first) > shardSize {
+		first = first[:shardSize]
+	}
+	shards := 1
+	for offset := shardSize; offset < len(content); offset += shardSize {
+		end := offset + shardSize
+		if end > len(content) {
+			end = len(content)
+		}
+		err := b.create(kubernetesObject{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: kubernetesShardName(name, generation, shards),
+				Labels: map[string]string{
+					kubernetesManagedByLabel: kubernetesManagedBy,
+					kubernetesObjectLabel:    kubernetesHash(key),
+					kubernetesShardLabel:     strconv.Itoa(shards),
+				},
+				Annotations: map[string]string{
+					kubernetesPathAnnotation: key,
+					kubernetesGenAnnotation:  generation,
+				},
+			},
+			Data: content[offset:end],
+		})
+		if err != nil {
+			b.deleteShards(kubernetesObject{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+				kubernetesGenAnnotation:    generation,
+				kubernetesShardsAnnotation: strconv.Itoa(shards),
+			}}})
+			return err
+		}
+		shards++
+	}
+
+	head := kubernetesObject{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: kubernetesLabels(key),
+			Annotations: map[string]string{
+				kubernetesPathAnnotation:   key,
+				kubernetesModAnnotation:    lastModified.UTC().Format(time.RFC3339Nano),
+				kubernetesShardsAnnotation: strconv.Itoa(shards),
+				kubernetesGenAnnotation:    generation,
+			},
+		},
+		Data: first,
+	}
+
+	var previous kubernetesObject
+	conflict := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, conflict, func() error {
+		current, err := b.get(name)
+		if apierrors.IsNotFound(err) {
+			previous = kubernetesObject{}
+			head.ResourceVersion = ""
+			return b.create(head)
+		}
+		if err != nil {
+			return err
+		}
+		if exclusive || current.Annotations[kubernetesPathAnnotation] != key {
+			return ErrNewPathNotEmpty
+		}
+		previous = current
+		head.ResourceVersion = current.ResourceVersion
+		return b.update(head)
+	})
+	if err != nil {
+		b.deleteShards(head)
+		return err
+	}
+	if previous.Name != "" {
+		return b.deleteShards(previous)
+	}
+	return nil
+}
+
+// deleteKey deletes the head of an object at the resourceVersion it was read at, then its shards
+func (b KubernetesBackend) deleteKey(key string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		head, err := b.head(key)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.delete(head.Name, head.ResourceVersion); err != nil {
+			return err
+		}
+		return b.deleteShards(head)
+	})
+}
+
+// GetObject retrieves an object from the namespace, at prefix
+func (b KubernetesBackend) GetObject(path string) (Object, error) {
+	var object Object
+	object.Path = path
+
+	content, lastModified, err := b.read(b.key(path))
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	object.LastModified = lastModified
+	return object, nil
+}
+
+// PutObject uploads an object to the namespace, at prefix
+func (b KubernetesBackend) PutObject(path string, content []byte) error {
+	return b.write(b.key(path), content, time.Now(), false)
+}
+
+// DeleteObject removes an object from the namespace, at prefix
+func (b KubernetesBackend) DeleteObject(path string) error {
+	return b.deleteKey(b.key(path))
+}
+
+// GetObjectStream retrieves an object stream from the namespace, at prefix
+// Objects are small, the content is read at once
+func (b KubernetesBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object, err := b.GetObject(path)
+	if err != nil {
+		return &ObjectStream{Metadata: object.Metadata}, err
+	}
+	return &ObjectStream{
+		Metadata: object.Metadata,
+		Content:  ioutil.NopCloser(bytes.NewReader(object.Content)),
+	}, nil
+}
+
+// PutObjectStream uploads an object stream to the namespace, at prefix
+func (b KubernetesBackend) PutObjectStream(path string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return b.PutObject(path, data)
+}
+
+func (b KubernetesBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObject(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, bytes.NewReader(obj.Content))
+}
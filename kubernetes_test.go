@@ -0,0 +1,251 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type KubernetesTestSuite struct {
+	suite.Suite
+	KubernetesBackend *KubernetesBackend
+	Client            *fake.Clientset
+}
+
+func (suite *KubernetesTestSuite) SetupTest() {
+	suite.Client = fake.NewClientset()
+	suite.KubernetesBackend = NewKubernetesBackendWithClient(suite.Client, "charts", "unittest")
+	// small shards so that objects span several ConfigMaps
+	suite.KubernetesBackend.ShardSize = 4
+}
+
+func (suite *KubernetesTestSuite) configMaps() []corev1.ConfigMap {
+	list, err := suite.Client.CoreV1().ConfigMaps("charts").List(suite.KubernetesBackend.Context, metav1.ListOptions{})
+	suite.Nil(err)
+	return list.Items
+}
+
+func (suite *KubernetesTestSuite) TestNames() {
+	for _, key := range []string{"unittest/Chart_A-0.1.0.tgz", "a/../b", "--", "", "x/" + string(bytes.Repeat([]byte("y"), 300))} {
+		name := kubernetesName(key)
+		suite.Empty(validation.IsDNS1123Subdomain(name), "%q is a valid name", name)
+		suite.Empty(validation.IsDNS1123Subdomain(kubernetesShardName(name, kubernetesGeneration(), 12)), "shard names are valid")
+		for k, v := range kubernetesLabels(key) {
+			suite.Empty(validation.IsQualifiedName(k), "%q is a valid label key", k)
+			suite.Empty(validation.IsValidLabelValue(v), "%q is a valid label value", v)
+		}
+	}
+	suite.NotEqual(kubernetesName("a/b"), kubernetesName("a.b"), "names are unique")
+}
+
+func (suite *KubernetesTestSuite) TestPutGetDeleteObject() {
+	err := suite.KubernetesBackend.PutObject("putget/test.txt", []byte("some sharded content"))
+	suite.Nil(err, "no error putting object")
+	suite.Len(suite.configMaps(), 5, "content is sharded")
+
+	object, err := suite.KubernetesBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some sharded content"), object.Content, "content matches across shards")
+	suite.WithinDuration(time.Now(), object.LastModified, time.Minute, "last modified is set")
+
+	err = suite.KubernetesBackend.PutObject("putget/test.txt", []byte("short"))
+	suite.Nil(err, "no error overwriting object")
+	suite.Len(suite.configMaps(), 2, "shards of the previous content are deleted")
+	object, err = suite.KubernetesBackend.GetObject("putget/test.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("short"), object.Content, "content replaced")
+
+	err = suite.KubernetesBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.KubernetesBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+	suite.Empty(suite.configMaps(), "no shards left behind")
+
+	err = suite.KubernetesBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "deleting a missing object is not an error")
+}
+
+func (suite *KubernetesTestSuite) TestSecrets() {
+	b := *suite.KubernetesBackend
+	b.Secrets = true
+
+	suite.Nil(b.PutObject("secret.txt", []byte("password")))
+	secrets, err := suite.Client.CoreV1().Secrets("charts").List(b.Context, metav1.ListOptions{})
+	suite.Nil(err)
+	suite.Len(secrets.Items, 2, "content is kept in Secrets")
+	suite.Empty(suite.configMaps(), "no ConfigMaps are created")
+
+	object, err := b.GetObject("secret.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("password"), object.Content)
+
+	objects, err := b.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+
+	suite.Nil(b.DeleteObject("secret.txt"))
+	secrets, err = suite.Client.CoreV1().Secrets("charts").List(b.Context, metav1.ListOptions{})
+	suite.Nil(err)
+	suite.Empty(secrets.Items)
+}
+
+func (suite *KubernetesTestSuite) TestConflict() {
+	suite.Nil(suite.KubernetesBackend.PutObject("conflict.txt", []byte("first")))
+
+	// another writer updates the head between our read and our update, once
+	updates := 0
+	suite.Client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), "conflict", nil)
+		}
+		return false, nil, nil
+	})
+
+	err := suite.KubernetesBackend.PutObject("conflict.txt", []byte("second content"))
+	suite.Nil(err, "conflicts are retried")
+	suite.Equal(2, updates, "head updated again after a conflict")
+
+	object, err := suite.KubernetesBackend.GetObject("conflict.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("second content"), object.Content)
+
+	// the update carries the resourceVersion it was read at
+	suite.Client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		cm := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap)
+		current, _ := suite.Client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("configmaps"), "charts", cm.Name)
+		suite.Equal(current.(*corev1.ConfigMap).ResourceVersion, cm.ResourceVersion, "update is conditional")
+		return false, nil, nil
+	})
+	suite.Nil(suite.KubernetesBackend.PutObject("conflict.txt", []byte("third")))
+}
+
+func (suite *KubernetesTestSuite) TestListObjects() {
+	for _, path := range []string{"list/b.txt", "list/a.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.KubernetesBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.KubernetesBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	objects, err = suite.KubernetesBackend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1, "objects at the root")
+	suite.Equal("list0.txt", objects[0].Path)
+}
+
+func (suite *KubernetesTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.KubernetesBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.KubernetesBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.KubernetesBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.KubernetesBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+}
+
+func (suite *KubernetesTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.KubernetesBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.KubernetesBackend.PutObject("rename/sub/b.txt", []byte("bbbbbbbbbb")))
+	suite.Nil(suite.KubernetesBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.KubernetesBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.KubernetesBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.KubernetesBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("bbbbbbbbbb"), object.Content, "content follows rename")
+	_, err = suite.KubernetesBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.KubernetesBackend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.KubernetesBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.KubernetesBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	suite.Len(suite.configMaps(), 5, "shards of the moved objects are deleted")
+}
+
+func (suite *KubernetesTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.KubernetesBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.KubernetesBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.KubernetesBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestKubernetesStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(KubernetesTestSuite))
+}
@@ -0,0 +1,503 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSObjectChange is a change of an object, as seen by NATSObjectStoreBackend.Watch
+type NATSObjectChange struct {
+	Metadata
+	Deleted bool
+}
+
+// natsEntry is a member of a directory listing
+type natsEntry struct {
+	name         string
+	isDir        bool
+	lastModified time.Time
+}
+
+type natsListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []natsEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *natsListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *natsListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *natsListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *natsListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &natsListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the object store lists every object at once, pages are sliced from the directory built from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *natsListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *natsListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// NATSObjectStoreBackend is a storage backend for NATS JetStream object stores
+// Objects are named after their full path, directories are emulated from the names.
+// Renames only rewrite the metadata of the objects, copies are links to the original.
+type NATSObjectStoreBackend struct {
+	Conn   *nats.Conn
+	Store  jetstream.ObjectStore
+	Prefix string
+	// ChunkSize is the size of the chunks objects are split in, the default of the client (128KiB) if zero
+	ChunkSize uint32
+	Context   context.Context
+}
+
+// NewNATSObjectStoreBackend creates a new instance of NATSObjectStoreBackend
+// The object store bucket is created if it does not exist
+// Credentials are read from NATS_CREDS (a credentials file), NATS_USER and NATS_PASSWORD, or NATS_TOKEN
+func NewNATSObjectStoreBackend(url string, bucket string, prefix string) *NATSObjectStoreBackend {
+	var opts []nats.Option
+	if creds := os.Getenv("NATS_CREDS"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	if user := os.Getenv("NATS_USER"); user != "" {
+		opts = append(opts, nats.UserInfo(user, os.Getenv("NATS_PASSWORD")))
+	}
+	if token := os.Getenv("NATS_TOKEN"); token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		panic("Failed to connect to NATS: " + err.Error())
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		panic("Failed to create JetStream context: " + err.Error())
+	}
+
+	ctx := context.Background()
+	store, err := js.ObjectStore(ctx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		store, err = js.CreateObjectStore(ctx, jetstream.ObjectStoreConfig{Bucket: bucket})
+	}
+	if err != nil {
+		panic("Failed to open NATS object store: " + err.Error())
+	}
+
+	b := NewNATSObjectStoreBackendWithStore(store, prefix)
+	b.Conn = conn
+	return b
+}
+
+// NewNATSObjectStoreBackendWithStore creates a new instance of NATSObjectStoreBackend from an open object store
+func NewNATSObjectStoreBackendWithStore(store jetstream.ObjectStore, prefix string) *NATSObjectStoreBackend {
+	b := &NATSObjectStoreBackend{
+		Store:   store,
+		Prefix:  cleanPrefix(prefix),
+		Context: context.Background(),
+	}
+	return b
+}
+
+// Close closes the connection opened by NewNATSObjectStoreBackend
+func (b NATSObjectStoreBackend) Close() error {
+	if b.Conn == nil {
+		return nil
+	}
+	return b.Conn.Drain()
+}
+
+func (b NATSObjectStoreBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+// list returns every object of the store, with a name under dir if not empty
+func (b NATSObjectStoreBackend) list(dir string) ([]*jetstream.ObjectInfo, error) {
+	var objects []*jetstream.ObjectInfo
+
+	infos, err := b.Store.List(b.Context)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return objects, nil
+	}
+	if err != nil {
+		return objects, err
+	}
+	for _, info := range infos {
+		if dir == "" || strings.HasPrefix(info.Name, dir+"/") {
+			objects = append(objects, info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// info returns the info of the object at key, ErrObjectNotFound if there is none
+func (b NATSObjectStoreBackend) info(key string) (*jetstream.ObjectInfo, error) {
+	info, err := b.Store.GetInfo(b.Context, key)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, ErrObjectNotFound
+	}
+	return info, err
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b NATSObjectStoreBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b NATSObjectStoreBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects in the object store, at prefix
+func (b NATSObjectStoreBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	dir := b.key(prefix)
+	infos, err := b.list(dir)
+	if err != nil {
+		return objects, err
+	}
+	for _, info := range infos {
+		path := removePrefixFromObjectPath(dir, info.Name)
+		if objectPathIsInvalid(path) {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         path,
+				LastModified: info.ModTime,
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b NATSObjectStoreBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	dir := b.key(prefix)
+	if dir != "" {
+		_, err := b.info(dir)
+		if err == nil {
+			return nil, ErrPrefixIsAnObject
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+
+	infos, err := b.list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &natsListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+	seen := map[string]bool{}
+	for _, info := range infos {
+		name := removePrefixFromObjectPath(dir, info.Name)
+		if i := strings.Index(name, "/"); i >= 0 {
+			if !seen[name[:i]] {
+				seen[name[:i]] = true
+				output.entries = append(output.entries, natsEntry{name: name[:i], isDir: true})
+			}
+			continue
+		}
+		output.entries = append(output.entries, natsEntry{name: name, lastModified: info.ModTime})
+	}
+	sort.Slice(output.entries, func(i, j int) bool { return output.entries[i].name < output.entries[j].name })
+
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject renames an object, or every object under a prefix, by rewriting their metadata only
+// The chunks stay where they are; links to the renamed objects, made by CopyObject, are not followed
+func (b NATSObjectStoreBackend) RenamePrefixOrObject(path, newPath string) error {
+	key, newKey := b.key(path), b.key(newPath)
+
+	// check if newPath is already occupied
+	if _, err := b.info(newKey); err == nil {
+		return ErrNewPathNotEmpty
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	occupied, err := b.list(newKey)
+	if err != nil {
+		return err
+	}
+	if len(occupied) > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	var infos []*jetstream.ObjectInfo
+	if info, err := b.info(key); err == nil {
+		infos = append(infos, info)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	} else if infos, err = b.list(key); err != nil {
+		return err
+	}
+
+	// ignore if the source does not exist
+	for _, info := range infos {
+		meta := info.ObjectMeta
+		meta.Name = newKey + strings.TrimPrefix(info.Name, key)
+		if err := b.Store.UpdateMeta(b.Context, info.Name, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyObject makes the object at newPath a link to the object at path, no content is copied
+// The link follows the object: it sees its later versions, and breaks once it is deleted or renamed
+func (b NATSObjectStoreBackend) CopyObject(path, newPath string) error {
+	info, err := b.info(b.key(path))
+	if err != nil {
+		return err
+	}
+	// links cannot point to links, copies of a copy point to the original
+	if link := info.Opts; link != nil && link.Link != nil {
+		if link.Link.Bucket != info.Bucket || link.Link.Name == "" {
+			return fmt.Errorf("%s links to another bucket: %w", path, ErrNotImplemented)
+		}
+		if info, err = b.info(link.Link.Name); err != nil {
+			return err
+		}
+	}
+	_, err = b.Store.AddLink(b.Context, b.key(newPath), info)
+	if errors.Is(err, jetstream.ErrObjectAlreadyExists) {
+		return ErrNewPathNotEmpty
+	}
+	return err
+}
+
+// Watch returns the changes of the objects under prefix, as they happen, until ctx is done
+// Renamed objects are only seen under their new path
+func (b NATSObjectStoreBackend) Watch(ctx context.Context) (<-chan NATSObjectChange, error) {
+	watcher, err := b.Store.Watch(ctx, jetstream.UpdatesOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan NATSObjectChange)
+	go func() {
+		defer close(changes)
+		defer watcher.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case info, ok := <-watcher.Updates():
+				if !ok {
+					return
+				}
+				if info == nil || (b.Prefix != "" && !strings.HasPrefix(info.Name, b.Prefix+"/")) {
+					continue
+				}
+				change := NATSObjectChange{
+					Metadata: Metadata{
+						Path:         removePrefixFromObjectPath(b.Prefix, info.Name),
+						LastModified: info.ModTime,
+					},
+					Deleted: info.Deleted,
+				}
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// GetObject retrieves an object from the object store, at prefix
+func (b NATSObjectStoreBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to the object store, at prefix
+func (b NATSObjectStoreBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from the object store, at prefix
+func (b NATSObjectStoreBackend) DeleteObject(path string) error {
+	err := b.Store.Delete(b.Context, b.key(path))
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+// GetObjectStream retrieves an object stream from the object store, at prefix
+// The chunks are read as the stream is, links are followed
+func (b NATSObjectStoreBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	result, err := b.Store.Get(b.Context, b.key(path))
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return object, ErrObjectNotFound
+	}
+	if err != nil {
+		return object, err
+	}
+	info, err := result.Info()
+	if err != nil {
+		result.Close()
+		return object, err
+	}
+
+	object.LastModified = info.ModTime
+	object.Content = result
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to the object store, at prefix, one chunk at a time
+func (b NATSObjectStoreBackend) PutObjectStream(path string, content io.Reader) error {
+	meta := jetstream.ObjectMeta{Name: b.key(path)}
+	if b.ChunkSize > 0 {
+		meta.Opts = &jetstream.ObjectMetaOptions{ChunkSize: b.ChunkSize}
+	}
+	_, err := b.Store.Put(b.Context, meta, content)
+	return err
+}
+
+func (b NATSObjectStoreBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObject(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// the digest of the content, as computed by the object store
+	if info, err := b.info(b.key(path)); err == nil && info.Digest != "" {
+		w.Header().Set("ETag", `"`+info.Digest+`"`)
+	}
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, bytes.NewReader(obj.Content))
+}
@@ -0,0 +1,263 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type NATSTestSuite struct {
+	suite.Suite
+	NATSBackend   *NATSObjectStoreBackend
+	Server        *server.Server
+	TempDirectory string
+}
+
+func (suite *NATSTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-nats/%s", timestamp)
+	suite.Nil(os.MkdirAll(suite.TempDirectory, 0777))
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  suite.TempDirectory,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	suite.Nil(err)
+	go s.Start()
+	suite.True(s.ReadyForConnections(10*time.Second), "server started")
+	suite.Server = s
+
+	suite.NATSBackend = NewNATSObjectStoreBackend(s.ClientURL(), "charts", "unittest")
+	// small chunks so that objects span several messages
+	suite.NATSBackend.ChunkSize = 4
+}
+
+func (suite *NATSTestSuite) TearDownSuite() {
+	suite.NATSBackend.Close()
+	suite.Server.Shutdown()
+	suite.Server.WaitForShutdown()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *NATSTestSuite) TestPutGetDeleteObject() {
+	err := suite.NATSBackend.PutObject("putget/test.txt", []byte("some chunked content"))
+	suite.Nil(err, "no error putting object")
+
+	info, err := suite.NATSBackend.info("unittest/putget/test.txt")
+	suite.Nil(err)
+	suite.Equal(uint32(5), info.Chunks, "content is chunked")
+
+	object, err := suite.NATSBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some chunked content"), object.Content, "content matches across chunks")
+	suite.WithinDuration(time.Now(), object.LastModified, time.Minute, "last modified is set")
+
+	err = suite.NATSBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.NATSBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	err = suite.NATSBackend.DeleteObject("putget/missing.txt")
+	suite.Nil(err, "deleting a missing object is not an error")
+}
+
+func (suite *NATSTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.NATSBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.NATSBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.NATSBackend.DeleteObject(path))
+	}
+
+	objects, err = suite.NATSBackend.ListObjects("list")
+	suite.Nil(err)
+	suite.Empty(objects, "deleted objects are not listed")
+}
+
+func (suite *NATSTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.NATSBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.NATSBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.NATSBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.NATSBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+
+	for _, path := range paths {
+		suite.Nil(suite.NATSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *NATSTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.NATSBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.NATSBackend.PutObject("rename/sub/b.txt", []byte("bbbbbbbbbb")))
+	suite.Nil(suite.NATSBackend.PutObject("occupied.txt", []byte("x")))
+	before, err := suite.NATSBackend.info("unittest/rename/sub/b.txt")
+	suite.Nil(err)
+
+	err = suite.NATSBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.NATSBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.NATSBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("bbbbbbbbbb"), object.Content, "content follows rename")
+	after, err := suite.NATSBackend.info("unittest/renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal(before.NUID, after.NUID, "chunks are not copied")
+	_, err = suite.NATSBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.NATSBackend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.NATSBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.NATSBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"moved.txt", "renamed/sub/b.txt", "occupied.txt"} {
+		suite.Nil(suite.NATSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *NATSTestSuite) TestCopyObject() {
+	suite.Nil(suite.NATSBackend.PutObject("original.txt", []byte("v1")))
+
+	suite.Nil(suite.NATSBackend.CopyObject("original.txt", "copy.txt"))
+	suite.Nil(suite.NATSBackend.CopyObject("copy.txt", "copy-of-copy.txt"), "copies of copies link to the original")
+	object, err := suite.NATSBackend.GetObject("copy-of-copy.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), object.Content, "links are followed")
+
+	err = suite.NATSBackend.CopyObject("copy.txt", "original.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot copy onto an object")
+	err = suite.NATSBackend.CopyObject("missing.txt", "anywhere.txt")
+	suite.ErrorIs(err, ErrObjectNotFound)
+
+	suite.Nil(suite.NATSBackend.PutObject("original.txt", []byte("v2")))
+	object, err = suite.NATSBackend.GetObject("copy.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), object.Content, "links follow the original")
+
+	for _, path := range []string{"original.txt", "copy.txt", "copy-of-copy.txt"} {
+		suite.Nil(suite.NATSBackend.DeleteObject(path))
+	}
+}
+
+func (suite *NATSTestSuite) TestWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := suite.NATSBackend.Watch(ctx)
+	suite.Nil(err)
+
+	// objects of other prefixes are not seen
+	other := *suite.NATSBackend
+	other.Prefix = "other"
+	suite.Nil(other.PutObject("watched.txt", []byte("other")))
+
+	suite.Nil(suite.NATSBackend.PutObject("watched.txt", []byte("watched")))
+	suite.Nil(suite.NATSBackend.DeleteObject("watched.txt"))
+
+	for _, deleted := range []bool{false, true} {
+		select {
+		case change := <-changes:
+			suite.Equal("watched.txt", change.Path)
+			suite.Equal(deleted, change.Deleted)
+		case <-time.After(5 * time.Second):
+			suite.Fail("no change seen")
+		}
+	}
+
+	cancel()
+	for range changes {
+	}
+	suite.Nil(other.DeleteObject("watched.txt"))
+}
+
+func (suite *NATSTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.NATSBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.NATSBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+	suite.NotEmpty(w.Header().Get("ETag"), "digest is the ETag")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.NATSBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.NATSBackend.DeleteObject("download.txt"))
+}
+
+func TestNATSStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(NATSTestSuite))
+}
@@ -0,0 +1,676 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"regexp"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+const (
+	// OCIObjectArtifactType is the artifact type of the manifests written by OCIRegistryBackend
+	OCIObjectArtifactType = "application/vnd.chartmuseum.storage.object.v1"
+	// OCIObjectMediaType is the media type of the single layer holding the content of an object
+	OCIObjectMediaType = "application/octet-stream"
+)
+
+var (
+	ociTagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// base32hex sorts like the original bytes and only uses characters valid in a tag
+	ociTagEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+	errOCIStopIteration = errors.New("stop iteration")
+)
+
+// ociTag maps an object name to a tag
+// Names that are not valid tags, or that start with the "_" marker, are stored base32 encoded behind the marker
+func ociTag(name string) (string, error) {
+	if ociTagRegexp.MatchString(name) && !strings.HasPrefix(name, "_") {
+		return name, nil
+	}
+	tag := "_" + strings.ToLower(ociTagEncoding.EncodeToString([]byte(name)))
+	if len(tag) > 128 {
+		return "", fmt.Errorf("object name %q is too long to be stored as a tag", name)
+	}
+	return tag, nil
+}
+
+// ociName maps a tag back to an object name
+func ociName(tag string) (string, error) {
+	if !strings.HasPrefix(tag, "_") {
+		return tag, nil
+	}
+	name, err := ociTagEncoding.DecodeString(strings.ToUpper(tag[1:]))
+	return string(name), err
+}
+
+func ociIsNotFound(err error) bool {
+	var errResp *errcode.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp.StatusCode == http.StatusNotFound
+	}
+	return errors.Is(err, errdef.ErrNotFound)
+}
+
+type ociListObjectsFromDirectoryOutput struct {
+	backend         *OCIRegistryBackend
+	prefix          string
+	limit           int
+	lastRepository  string
+	lastTag         string
+	directoriesDone bool
+	seen            map[string]bool
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *ociListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *ociListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *ociListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *ociListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &ociListObjectsFromDirectoryOutput{
+		backend:         l.backend,
+		prefix:          l.prefix,
+		limit:           l.limit,
+		lastRepository:  l.lastRepository,
+		lastTag:         l.lastTag,
+		directoriesDone: l.directoriesDone,
+		seen:            l.seen,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	full := func() bool {
+		return l.limit > 0 && len(r.directoriesRead)+len(r.filesRead) >= l.limit
+	}
+
+	name := l.backend.repositoryName(l.prefix)
+
+	// directories are the repositories below the one of prefix, found with the catalog API
+	if !r.directoriesDone {
+		base := name + "/"
+		if name == "" {
+			base = ""
+		}
+		last := r.lastRepository
+		if last == "" {
+			last = name
+		}
+		r.directoriesDone = true
+		err := l.backend.Registry.Repositories(l.backend.Context, last, func(repositories []string) error {
+			for _, repository := range repositories {
+				if !strings.HasPrefix(repository, base) {
+					if repository > base {
+						// past the repositories below prefix
+						return errOCIStopIteration
+					}
+					continue
+				}
+				dir := strings.SplitN(strings.TrimPrefix(repository, base), "/", 2)[0]
+				if !r.seen[dir] {
+					if full() {
+						r.directoriesDone = false
+						return errOCIStopIteration
+					}
+					r.seen[dir] = true
+					r.directoriesRead = append(r.directoriesRead, Metadata{
+						Path: pathutil.Join(l.prefix, dir),
+					})
+				}
+				r.lastRepository = repository
+			}
+			return nil
+		})
+		if err != nil && err != errOCIStopIteration {
+			return nil, err
+		}
+	}
+
+	// files are the tags of the repository of prefix, there is none at the root of the registry
+	if r.directoriesDone && name == "" {
+		r.isEOF = true
+	} else if r.directoriesDone {
+		repo, err := l.backend.repository(l.prefix)
+		if err != nil {
+			return nil, err
+		}
+		err = repo.Tags(l.backend.Context, r.lastTag, func(tags []string) error {
+			for _, tag := range tags {
+				if full() {
+					return errOCIStopIteration
+				}
+				object, err := ociName(tag)
+				if err != nil {
+					// not written by this backend
+					r.lastTag = tag
+					continue
+				}
+				manifest, _, err := l.backend.fetchManifest(repo, tag)
+				if err != nil {
+					return err
+				}
+				r.lastTag = tag
+				if manifest.ArtifactType != OCIObjectArtifactType {
+					continue
+				}
+				r.filesRead = append(r.filesRead, Metadata{
+					Path:         pathutil.Join(l.prefix, object),
+					LastModified: ociLastModified(manifest),
+				})
+			}
+			return nil
+		})
+		if err != nil && err != errOCIStopIteration && !ociIsNotFound(err) {
+			return nil, err
+		}
+		r.isEOF = err != errOCIStopIteration
+	}
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *ociListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *ociListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.seen = nil
+}
+
+// OCIRegistryBackend is a storage backend for OCI registries
+// An object at dir/name is stored as the tag name of the repository Prefix/dir, as an artifact with a single layer
+type OCIRegistryBackend struct {
+	Registry *remote.Registry
+	Prefix   string
+	Context  context.Context
+}
+
+// NewOCIRegistryBackend creates a new instance of OCIRegistryBackend
+// registry is a host with an optional port, prefixed with http:// to talk to a registry without TLS
+// Credentials are read from OCI_REGISTRY_USERNAME and OCI_REGISTRY_PASSWORD, or from
+// OCI_REGISTRY_IDENTITY_TOKEN (refresh token) or OCI_REGISTRY_ACCESS_TOKEN (registry token)
+func NewOCIRegistryBackend(registryHost string, prefix string) *OCIRegistryBackend {
+	plainHTTP := strings.HasPrefix(registryHost, "http://")
+	registryHost = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registryHost, "http://"), "https://"), "/")
+
+	reg, err := remote.NewRegistry(registryHost)
+	if err != nil {
+		panic("Failed to create OCI registry client: " + err.Error())
+	}
+	reg.PlainHTTP = plainHTTP
+	reg.Client = &auth.Client{
+		Client: retry.DefaultClient,
+		Cache:  auth.NewCache(),
+		Credential: auth.StaticCredential(reg.Reference.Registry, auth.Credential{
+			Username:     os.Getenv("OCI_REGISTRY_USERNAME"),
+			Password:     os.Getenv("OCI_REGISTRY_PASSWORD"),
+			RefreshToken: os.Getenv("OCI_REGISTRY_IDENTITY_TOKEN"),
+			AccessToken:  os.Getenv("OCI_REGISTRY_ACCESS_TOKEN"),
+		}),
+	}
+
+	b := &OCIRegistryBackend{
+		Registry: reg,
+		Prefix:   cleanPrefix(prefix),
+		Context:  context.Background(),
+	}
+	return b
+}
+
+// repositoryName returns the repository holding the objects of directory dir
+func (b OCIRegistryBackend) repositoryName(dir string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, dir))
+}
+
+func (b OCIRegistryBackend) repository(dir string) (registry.Repository, error) {
+	name := b.repositoryName(dir)
+	if name == "" {
+		return nil, errors.New("objects at the root of the registry need a prefix")
+	}
+	return b.Registry.Repository(b.Context, name)
+}
+
+// locate returns the repository and the tag of an object
+func (b OCIRegistryBackend) locate(path string) (registry.Repository, string, error) {
+	path = cleanPrefix(path)
+	repo, err := b.repository(pathutil.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+	tag, err := ociTag(pathutil.Base(path))
+	return repo, tag, err
+}
+
+func (b OCIRegistryBackend) fetchManifest(repo registry.Repository, tag string) (ocispec.Manifest, ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	desc, rc, err := repo.FetchReference(b.Context, tag)
+	if err != nil {
+		return manifest, desc, err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&manifest)
+	return manifest, desc, err
+}
+
+func ociLastModified(manifest ocispec.Manifest) time.Time {
+	t, _ := time.Parse(time.RFC3339, manifest.Annotations[ocispec.AnnotationCreated])
+	return t
+}
+
+func (b OCIRegistryBackend) objectExists(path string) (bool, error) {
+	if cleanPrefix(path) == "" {
+		return false, nil
+	}
+	repo, tag, err := b.locate(path)
+	if err != nil {
+		return false, err
+	}
+	_, err = repo.Resolve(b.Context, tag)
+	if ociIsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b OCIRegistryBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b OCIRegistryBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects in the OCI registry, at prefix
+// Only the tags of the repository of prefix are listed, every one of them costs a manifest request
+func (b OCIRegistryBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	if b.repositoryName(prefix) == "" {
+		// there is no repository, and so no object, at the root of the registry
+		return objects, nil
+	}
+	repo, err := b.repository(prefix)
+	if err != nil {
+		return objects, err
+	}
+	err = repo.Tags(b.Context, "", func(tags []string) error {
+		for _, tag := range tags {
+			name, err := ociName(tag)
+			if err != nil {
+				continue
+			}
+			manifest, _, err := b.fetchManifest(repo, tag)
+			if err != nil {
+				return err
+			}
+			if manifest.ArtifactType != OCIObjectArtifactType {
+				continue
+			}
+			object := Object{
+				Metadata: Metadata{
+					Path:         name,
+					LastModified: ociLastModified(manifest),
+				},
+				Content: []byte{},
+			}
+			objects = append(objects, object)
+		}
+		return nil
+	})
+	if err != nil && !ociIsNotFound(err) {
+		return objects, err
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+// Directories come from the catalog API and files from the tags list API; registries keep repositories
+// whose tags were all deleted, so those keep showing up as directories
+func (b OCIRegistryBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if b.repositoryName(pathutil.Dir(cleanPrefix(prefix))) != "" {
+		exists, err := b.objectExists(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrPrefixIsAnObject
+		}
+	}
+
+	output := &ociListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+		seen:    map[string]bool{},
+	}
+	return output.NextPage()
+}
+
+// objectsUnder lists the paths of every object stored under prefix, at any depth
+// Only the repositories below the one of prefix are read from the catalog, and only the tags of the artifacts
+// written by this backend are objects, every tag costing a manifest request
+func (b OCIRegistryBackend) objectsUnder(prefix string) ([]string, error) {
+	var paths []string
+	collect := func(repository string) error {
+		dir := strings.TrimPrefix(strings.TrimPrefix(repository, b.Prefix), "/")
+		repo, err := b.repository(dir)
+		if err != nil {
+			return err
+		}
+		err = repo.Tags(b.Context, "", func(tags []string) error {
+			for _, tag := range tags {
+				object, err := ociName(tag)
+				if err != nil {
+					continue
+				}
+				manifest, _, err := b.fetchManifest(repo, tag)
+				if err != nil {
+					return err
+				}
+				if manifest.ArtifactType == OCIObjectArtifactType {
+					paths = append(paths, pathutil.Join(dir, object))
+				}
+			}
+			return nil
+		})
+		if err != nil && !ociIsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	name := b.repositoryName(prefix)
+	base := ""
+	if name != "" {
+		if err := collect(name); err != nil {
+			return nil, err
+		}
+		base = name + "/"
+	}
+	// the catalog is sorted, the repositories below name follow it
+	err := b.Registry.Repositories(b.Context, name, func(repositories []string) error {
+		for _, repository := range repositories {
+			if !strings.HasPrefix(repository, base) {
+				if repository > base {
+					return errOCIStopIteration
+				}
+				continue
+			}
+			if err := collect(repository); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errOCIStopIteration {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// RenamePrefixOrObject moves an object, or every object under a prefix, to newPath
+// Registries have no rename operation: every object is written again at its new tag before
+// its old manifest is deleted, so the move is not atomic
+func (b OCIRegistryBackend) RenamePrefixOrObject(path, newPath string) error {
+	// check if newPath is already occupied
+	exists, err := b.objectExists(newPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrNewPathNotEmpty
+	}
+	occupied, err := b.objectsUnder(newPath)
+	if err != nil {
+		return err
+	}
+	if len(occupied) > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	moves := map[string]string{}
+	exists, err = b.objectExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		moves[path] = newPath
+	} else {
+		// nothing is moved if the source does not exist
+		paths, err := b.objectsUnder(path)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			moves[p] = pathutil.Join(newPath, strings.TrimPrefix(p, cleanPrefix(path)))
+		}
+	}
+
+	for oldPath, newPath := range moves {
+		object, err := b.GetObject(oldPath)
+		if err != nil {
+			return err
+		}
+		if err := b.PutObject(newPath, object.Content); err != nil {
+			return err
+		}
+		if err := b.DeleteObject(oldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetObject retrieves an object from the OCI registry, at prefix
+func (b OCIRegistryBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to the OCI registry, at prefix
+// The content is pushed as a blob, then an artifact manifest referencing it is tagged
+func (b OCIRegistryBackend) PutObject(path string, content []byte) error {
+	repo, tag, err := b.locate(path)
+	if err != nil {
+		return err
+	}
+
+	layer, err := oras.PushBytes(b.Context, repo, OCIObjectMediaType, content)
+	if err != nil {
+		return err
+	}
+	// the title makes the manifest unique to its tag, so deleting it never removes another object
+	layer.Annotations = map[string]string{
+		ocispec.AnnotationTitle: pathutil.Base(cleanPrefix(path)),
+	}
+
+	desc, err := oras.PackManifest(b.Context, repo, oras.PackManifestVersion1_1, OCIObjectArtifactType, oras.PackManifestOptions{
+		Layers: []ocispec.Descriptor{layer},
+		ManifestAnnotations: map[string]string{
+			ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return repo.Tag(b.Context, desc, tag)
+}
+
+// DeleteObject removes an object from the OCI registry, at prefix
+// The manifest is deleted; its blob is left for the registry garbage collection
+func (b OCIRegistryBackend) DeleteObject(path string) error {
+	repo, tag, err := b.locate(path)
+	if err != nil {
+		return err
+	}
+	desc, err := repo.Resolve(b.Context, tag)
+	if err != nil {
+		if ociIsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	err = repo.Delete(b.Context, desc)
+	if err != nil && !ociIsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// GetObjectStream retrieves an object stream from the OCI registry, at prefix
+// The content is seekable when the registry supports range requests
+func (b OCIRegistryBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	repo, tag, err := b.locate(path)
+	if err != nil {
+		return object, err
+	}
+	manifest, _, err := b.fetchManifest(repo, tag)
+	if err != nil {
+		if ociIsNotFound(err) {
+			return object, ErrObjectNotFound
+		}
+		return object, err
+	}
+	if manifest.ArtifactType != OCIObjectArtifactType || len(manifest.Layers) != 1 {
+		return object, fmt.Errorf("%s is not an object artifact", path)
+	}
+
+	rc, err := repo.Fetch(b.Context, manifest.Layers[0])
+	if err != nil {
+		if ociIsNotFound(err) {
+			return object, ErrObjectNotFound
+		}
+		return object, err
+	}
+	object.LastModified = ociLastModified(manifest)
+	object.Content = rc
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to the OCI registry, at prefix
+// The digest of a blob must be known before it is pushed, so the stream is read into memory first
+func (b OCIRegistryBackend) PutObjectStream(path string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return b.PutObject(path, data)
+}
+
+func (b OCIRegistryBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer obj.Content.Close()
+
+	name := pathutil.Base(obj.Path)
+	if seeker, ok := obj.Content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, obj.LastModified, seeker)
+		return
+	}
+
+	// the registry does not support range requests, buffer the blob to still serve them
+	content, err := ioutil.ReadAll(obj.Content)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, obj.LastModified, bytes.NewReader(content))
+}
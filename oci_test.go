@@ -0,0 +1,310 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/stretchr/testify/suite"
+	"oras.land/oras-go/v2"
+)
+
+type OCIRegistryTestSuite struct {
+	suite.Suite
+	Server             *httptest.Server
+	OCIRegistryBackend *OCIRegistryBackend
+}
+
+func (suite *OCIRegistryTestSuite) SetupSuite() {
+	config := &configuration.Configuration{}
+	config.Storage = configuration.Storage{
+		"inmemory": configuration.Parameters{},
+		"delete":   configuration.Parameters{"enabled": true},
+	}
+	config.Catalog.MaxEntries = 1000
+	app := handlers.NewApp(context.Background(), config)
+
+	// a minimal token service in front of the registry
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "chartmuseum" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "registry-token"})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		app.ServeHTTP(w, r)
+	})
+	suite.Server = httptest.NewServer(mux)
+
+	os.Setenv("OCI_REGISTRY_USERNAME", "chartmuseum")
+	os.Setenv("OCI_REGISTRY_PASSWORD", "secret")
+	defer os.Unsetenv("OCI_REGISTRY_USERNAME")
+	defer os.Unsetenv("OCI_REGISTRY_PASSWORD")
+	suite.OCIRegistryBackend = NewOCIRegistryBackend(suite.Server.URL, "unittest")
+	// small pages to exercise the pagination of the catalog and tags list APIs
+	suite.OCIRegistryBackend.Registry.RepositoryListPageSize = 2
+	suite.OCIRegistryBackend.Registry.TagListPageSize = 2
+}
+
+func (suite *OCIRegistryTestSuite) TearDownSuite() {
+	suite.Server.Close()
+}
+
+func (suite *OCIRegistryTestSuite) TestTagEncoding() {
+	for _, name := range []string{"mychart-0.1.0.tgz", "index-cache.yaml", "_hidden", "with spaces+plus.txt", ".dotfile"} {
+		tag, err := ociTag(name)
+		suite.Nil(err)
+		suite.True(ociTagRegexp.MatchString(tag), "%s is a valid tag", tag)
+		decoded, err := ociName(tag)
+		suite.Nil(err)
+		suite.Equal(name, decoded, "tag maps back to the object name")
+	}
+	tag, _ := ociTag("mychart-0.1.0.tgz")
+	suite.Equal("mychart-0.1.0.tgz", tag, "valid names are kept readable")
+
+	_, err := ociTag(strings.Repeat("x", 100) + " ")
+	suite.NotNil(err, "names too long for a tag are rejected")
+}
+
+func (suite *OCIRegistryTestSuite) TestAuth() {
+	backend := NewOCIRegistryBackend(suite.Server.URL, "unittest")
+	err := backend.PutObject("auth.txt", []byte("x"))
+	suite.NotNil(err, "cannot push without credentials")
+}
+
+func (suite *OCIRegistryTestSuite) TestPutGetDeleteObject() {
+	err := suite.OCIRegistryBackend.PutObject("charts/mychart-0.1.0.tgz", []byte("some content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.OCIRegistryBackend.GetObject("charts/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content)
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	err = suite.OCIRegistryBackend.PutObject("charts/mychart-0.1.0.tgz", []byte("new content"))
+	suite.Nil(err, "no error overwriting object")
+	object, err = suite.OCIRegistryBackend.GetObject("charts/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("new content"), object.Content, "tag points to the new manifest")
+
+	err = suite.OCIRegistryBackend.DeleteObject("charts/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.OCIRegistryBackend.GetObject("charts/mychart-0.1.0.tgz")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	err = suite.OCIRegistryBackend.DeleteObject("charts/mychart-0.1.0.tgz")
+	suite.Nil(err, "deleting a missing object is ignored")
+}
+
+func (suite *OCIRegistryTestSuite) TestListObjects() {
+	paths := []string{"list/a.txt", "list/b.txt", "list/c d.txt", "list/nested/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.OCIRegistryBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.OCIRegistryBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Path)
+		suite.False(object.LastModified.IsZero(), "last modified is listed")
+	}
+	suite.ElementsMatch([]string{"a.txt", "b.txt", "c d.txt"}, names, "tags of the repository are listed across pages")
+
+	objects, err = suite.OCIRegistryBackend.ListObjects("does-not-exist")
+	suite.Nil(err, "listing a missing repository is not an error")
+	suite.Empty(objects)
+
+	for _, path := range paths {
+		suite.Nil(suite.OCIRegistryBackend.DeleteObject(path))
+	}
+}
+
+func (suite *OCIRegistryTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/sub/2.txt", "dir/c.txt", "dir/d/1.txt", "dir-other/x.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.OCIRegistryBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.OCIRegistryBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	var files, directories []string
+	output, err := suite.OCIRegistryBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.ElementsMatch([]string{"dir/b", "dir/d"}, directories, "directories come from the catalog")
+	suite.ElementsMatch([]string{"dir/a.txt", "dir/c.txt"}, files, "files come from the tags list")
+
+	for _, path := range paths {
+		suite.Nil(suite.OCIRegistryBackend.DeleteObject(path))
+	}
+}
+
+func (suite *OCIRegistryTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.OCIRegistryBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.OCIRegistryBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.OCIRegistryBackend.PutObject("occupied/x.txt", []byte("x")))
+
+	err := suite.OCIRegistryBackend.RenamePrefixOrObject("rename", "occupied")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto existing objects")
+
+	err = suite.OCIRegistryBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.OCIRegistryBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content)
+	_, err = suite.OCIRegistryBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.OCIRegistryBackend.RenamePrefixOrObject("renamed/a.txt", "renamed/moved.txt")
+	suite.Nil(err, "no error renaming object within its repository")
+	object, err = suite.OCIRegistryBackend.GetObject("renamed/moved.txt")
+	suite.Nil(err, "deleting the old manifest keeps the new one")
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.OCIRegistryBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"renamed/moved.txt", "renamed/sub/b.txt", "occupied/x.txt"} {
+		suite.Nil(suite.OCIRegistryBackend.DeleteObject(path))
+	}
+}
+
+func (suite *OCIRegistryTestSuite) TestRenameSkipsForeignTags() {
+	suite.Nil(suite.OCIRegistryBackend.PutObject("foreign/a.txt", []byte("a")))
+	suite.Nil(suite.OCIRegistryBackend.PutObject("foreign/sub/b.txt", []byte("b")))
+	suite.Nil(suite.OCIRegistryBackend.PutObject("foreign-sibling/c.txt", []byte("c")))
+
+	// an image pushed by another client to a repository of the backend
+	repo, err := suite.OCIRegistryBackend.repository("foreign")
+	suite.Nil(err)
+	desc, err := oras.PackManifest(context.Background(), repo, oras.PackManifestVersion1_1, "application/vnd.example.other", oras.PackManifestOptions{})
+	suite.Nil(err)
+	suite.Nil(repo.Tag(context.Background(), desc, "latest"))
+
+	paths, err := suite.OCIRegistryBackend.objectsUnder("foreign")
+	suite.Nil(err)
+	suite.ElementsMatch([]string{"foreign/a.txt", "foreign/sub/b.txt"}, paths, "foreign tags and sibling repositories are not objects")
+
+	suite.Nil(suite.OCIRegistryBackend.RenamePrefixOrObject("foreign", "moved"), "foreign tags do not fail the rename")
+	object, err := suite.OCIRegistryBackend.GetObject("moved/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content)
+	_, err = repo.Resolve(context.Background(), "latest")
+	suite.Nil(err, "foreign tags are left in place")
+	object, err = suite.OCIRegistryBackend.GetObject("foreign-sibling/c.txt")
+	suite.Nil(err, "sibling repositories are not moved")
+
+	for _, path := range []string{"moved/a.txt", "moved/sub/b.txt", "foreign-sibling/c.txt"} {
+		suite.Nil(suite.OCIRegistryBackend.DeleteObject(path))
+	}
+	suite.Nil(repo.Delete(context.Background(), desc))
+}
+
+func (suite *OCIRegistryTestSuite) TestListRoot() {
+	suite.Nil(suite.OCIRegistryBackend.PutObject("root/a.txt", []byte("a")))
+
+	root := NewOCIRegistryBackend(suite.Server.URL, "")
+	root.Registry.Client = suite.OCIRegistryBackend.Registry.Client
+	var directories []string
+	output, err := root.ListObjectsFromDirectory("", 0)
+	for {
+		suite.Empty(output.GetFiles(), "there are no files at the root of the registry")
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "the root of the registry is listed")
+		output, err = output.NextPage()
+	}
+	suite.Contains(directories, "unittest")
+	objects, err := root.ListObjects("")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	directories = nil
+	output, err = suite.OCIRegistryBackend.ListObjectsFromDirectory("", 0)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "the root of the prefix is listed")
+		output, err = output.NextPage()
+	}
+	suite.Contains(directories, "root")
+
+	suite.Nil(suite.OCIRegistryBackend.DeleteObject("root/a.txt"))
+}
+
+func (suite *OCIRegistryTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.OCIRegistryBackend.PutObject("download/file.txt", []byte("downloadable")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	suite.OCIRegistryBackend.HandleHttpFileDownload(w, r, "download/file.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	suite.Equal("down", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.OCIRegistryBackend.HandleHttpFileDownload(w, r, "download/missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.OCIRegistryBackend.DeleteObject("download/file.txt"))
+}
+
+func TestOCIRegistryStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(OCIRegistryTestSuite))
+}
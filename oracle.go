@@ -128,6 +128,17 @@ func getNamespace(ctx context.Context, c objectstorage.ObjectStorageClient) (str
 	return *r.Value, nil
 }
 
+// BackendContext returns the context of the requests of the backend
+func (b OracleCSBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b OracleCSBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
 // ListObjects lists all objects in OCI Object Storage bucket, at prefix
 func (b OracleCSBackend) ListObjects(prefix string) ([]Object, error) {
 	var objects []Object
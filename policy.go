@@ -0,0 +1,344 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Operations of a PolicyStatement
+const (
+	PolicyList     = "list"
+	PolicyGet      = "get"
+	PolicyPut      = "put"
+	PolicyDelete   = "delete"
+	PolicyRename   = "rename"
+	PolicyDownload = "download"
+)
+
+// Effects of a PolicyStatement
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+type (
+	// Policy is a list of statements allowing or denying operations to principals.
+	// A request is allowed when a statement allows it and none denies it.
+	Policy struct {
+		Statements []PolicyStatement `json:"statements"`
+	}
+
+	// PolicyStatement allows or denies operations on paths to principals.
+	// The principal "*" matches everyone, even without an actor in the context.
+	// In the paths, "*" matches within a path segment and "**" matches any number of segments, as in "charts/x/**"
+	PolicyStatement struct {
+		ID         string   `json:"id,omitempty"`
+		Effect     string   `json:"effect"`
+		Principals []string `json:"principals"`
+		Operations []string `json:"operations"`
+		Paths      []string `json:"paths"`
+	}
+
+	// PolicyDecision is the result of the evaluation of a request against a Policy
+	PolicyDecision struct {
+		Allowed bool
+		// Statement is the index of the statement deciding, -1 when no statement matches
+		Statement int
+		Reason    string
+	}
+
+	// PolicyBackend is a Backend wrapper enforcing a Policy on the actor of its context, see WithActor.
+	// Listings need the list operation on their prefix, renames need the rename operation on both paths.
+	PolicyBackend struct {
+		Backend Backend
+		Policy  *Policy
+		Context context.Context
+	}
+
+	// PolicyError is the error of a request denied by a PolicyBackend, errors.Is matches it with ErrAccessDenied
+	PolicyError struct {
+		Principal string
+		Operation string
+		Path      string
+		Reason    string
+	}
+)
+
+// LoadPolicy parses and validates a JSON or YAML policy
+func LoadPolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// LoadPolicyFile parses and validates a JSON or YAML policy file
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPolicy(data)
+}
+
+// NewPolicyBackend creates a new instance of PolicyBackend, panicking on an invalid policy
+func NewPolicyBackend(backend Backend, policy *Policy) *PolicyBackend {
+	if err := policy.Validate(); err != nil {
+		panic(err)
+	}
+	return &PolicyBackend{
+		Backend: backend,
+		Policy:  policy,
+		Context: context.Background(),
+	}
+}
+
+// Validate checks the effects, operations and path patterns of the statements
+func (p *Policy) Validate() error {
+	for i, statement := range p.Statements {
+		if statement.Effect != PolicyAllow && statement.Effect != PolicyDeny {
+			return fmt.Errorf("statement %d: invalid effect %q", i, statement.Effect)
+		}
+		if len(statement.Principals) == 0 || len(statement.Operations) == 0 || len(statement.Paths) == 0 {
+			return fmt.Errorf("statement %d: principals, operations and paths are required", i)
+		}
+		for _, operation := range statement.Operations {
+			switch operation {
+			case PolicyList, PolicyGet, PolicyPut, PolicyDelete, PolicyRename, PolicyDownload, "*":
+			default:
+				return fmt.Errorf("statement %d: invalid operation %q", i, operation)
+			}
+		}
+		for _, pattern := range statement.Paths {
+			if _, err := pathutil.Match(pattern, ""); err != nil {
+				return fmt.Errorf("statement %d: invalid path %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Simulate evaluates a request of principal, which is empty without an actor, against the policy.
+// Paths are cleaned like the backends do, so that "/charts/x/" is "charts/x". Paths with a ".."
+// segment are always denied, some backends store them as they are, below another directory.
+func (p *Policy) Simulate(principal, operation, path string) PolicyDecision {
+	if hasDotDotSegment(path) {
+		return PolicyDecision{Statement: -1, Reason: "the path has a .. segment"}
+	}
+	path = cleanPrefix(pathutil.Clean("/" + path))
+	decision := PolicyDecision{Statement: -1, Reason: "no statement allows it"}
+	for i, statement := range p.Statements {
+		if !statement.matches(principal, operation, path) {
+			continue
+		}
+		if statement.Effect == PolicyDeny {
+			return PolicyDecision{Statement: i, Reason: fmt.Sprintf("denied by statement %s", statement.name(i))}
+		}
+		if !decision.Allowed {
+			decision = PolicyDecision{Allowed: true, Statement: i, Reason: fmt.Sprintf("allowed by statement %s", statement.name(i))}
+		}
+	}
+	return decision
+}
+
+// name is the ID of the statement, or its index
+func (s PolicyStatement) name(i int) string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return fmt.Sprint(i)
+}
+
+// matches tells whether the statement applies to a request
+func (s PolicyStatement) matches(principal, operation, path string) bool {
+	return matchAny(s.Principals, func(p string) bool {
+		return p == "*" || (principal != "" && p == principal)
+	}) && matchAny(s.Operations, func(o string) bool {
+		return o == "*" || o == operation
+	}) && matchAny(s.Paths, func(pattern string) bool {
+		return matchPathPattern(strings.Split(cleanPrefix(pattern), "/"), strings.Split(path, "/"))
+	})
+}
+
+func matchAny(values []string, match func(string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPattern matches path segments against pattern segments, where "**" matches any number of segments
+func matchPathPattern(pattern, path []string) bool {
+	if len(path) == 1 && path[0] == "" {
+		path = nil
+	}
+	if len(pattern) == 1 && pattern[0] == "" {
+		pattern = nil
+	}
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if matchPathPattern(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := pathutil.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+func (e *PolicyError) Error() string {
+	principal := e.Principal
+	if principal == "" {
+		principal = "anonymous"
+	}
+	return fmt.Sprintf("%s: %s may not %s %s, %s", ErrAccessDenied, principal, e.Operation, e.Path, e.Reason)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrAccessDenied
+}
+
+// WithContext returns a copy of the backend authorizing the actor of ctx
+// The wrapped backend makes its requests with ctx too when it implements ContextBackend
+func (b PolicyBackend) WithContext(ctx context.Context) *PolicyBackend {
+	b.Context = ctx
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// authorize returns a PolicyError when the policy denies the request to the actor of ctx
+func (b PolicyBackend) authorize(ctx context.Context, operation string, paths ...string) error {
+	principal, _ := ActorFromContext(ctx)
+	for _, path := range paths {
+		decision := b.Policy.Simulate(principal, operation, path)
+		if !decision.Allowed {
+			return &PolicyError{Principal: principal, Operation: operation, Path: path, Reason: decision.Reason}
+		}
+	}
+	return nil
+}
+
+// BackendContext returns the Context of the backend
+func (b PolicyBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext is WithContext returning a Backend, see ContextBackend
+func (b PolicyBackend) WithBackendContext(ctx context.Context) Backend {
+	return b.WithContext(ctx)
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b PolicyBackend) ListObjects(prefix string) ([]Object, error) {
+	if err := b.authorize(b.Context, PolicyList, prefix); err != nil {
+		return nil, err
+	}
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend
+func (b PolicyBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if err := b.authorize(b.Context, PolicyList, prefix); err != nil {
+		return nil, err
+	}
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b PolicyBackend) GetObject(path string) (Object, error) {
+	if err := b.authorize(b.Context, PolicyGet, path); err != nil {
+		return Object{Metadata: Metadata{Path: path}}, err
+	}
+	return b.Backend.GetObject(path)
+}
+
+// PutObject uploads an object to the wrapped backend
+func (b PolicyBackend) PutObject(path string, content []byte) error {
+	if err := b.authorize(b.Context, PolicyPut, path); err != nil {
+		return err
+	}
+	return b.Backend.PutObject(path, content)
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b PolicyBackend) DeleteObject(path string) error {
+	if err := b.authorize(b.Context, PolicyDelete, path); err != nil {
+		return err
+	}
+	return b.Backend.DeleteObject(path)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+func (b PolicyBackend) RenamePrefixOrObject(path, newPath string) error {
+	if err := b.authorize(b.Context, PolicyRename, path, newPath); err != nil {
+		return err
+	}
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+func (b PolicyBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	if err := b.authorize(b.Context, PolicyGet, path); err != nil {
+		return &ObjectStream{Metadata: Metadata{Path: path}}, err
+	}
+	return getObjectStream(b.Backend, path)
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend
+func (b PolicyBackend) PutObjectStream(path string, content io.Reader) error {
+	if err := b.authorize(b.Context, PolicyPut, path); err != nil {
+		return err
+	}
+	return putObjectStream(b.Backend, path, content)
+}
+
+// HandleHttpFileDownload authorizes the actor of the request context, or else of the backend context, answering 403 on denial
+func (b PolicyBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	ctx := r.Context()
+	if _, ok := ActorFromContext(ctx); !ok {
+		ctx = b.Context
+	}
+	if err := b.authorize(ctx, PolicyDownload, path); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	handleHttpFileDownload(b.Backend, w, r, path)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	pathutil "path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const testPolicyYAML = `
+statements:
+  - id: ci-incoming
+    effect: allow
+    principals: [ci]
+    operations: [list, get, put]
+    paths: ["incoming/**"]
+  - id: ci-never-deletes
+    effect: deny
+    principals: [ci]
+    operations: [delete, rename]
+    paths: ["**"]
+  - id: team-x
+    effect: allow
+    principals: [team-x]
+    operations: ["*"]
+    paths: ["charts/x/**"]
+  - id: public-index
+    effect: allow
+    principals: ["*"]
+    operations: [get, download]
+    paths: ["index.yaml", "charts/*/index.yaml"]
+`
+
+type PolicyTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	Policy        *Policy
+	PolicyBackend *PolicyBackend
+}
+
+func (suite *PolicyTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-policy/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	policy, err := LoadPolicy([]byte(testPolicyYAML))
+	suite.Nil(err)
+	suite.Policy = policy
+	suite.PolicyBackend = NewPolicyBackend(suite.Local, policy)
+	for _, path := range []string{"index.yaml", "incoming/a.tgz", "charts/x/x-0.1.0.tgz", "charts/y/y-0.1.0.tgz"} {
+		suite.Nil(suite.Local.PutObject(path, []byte(path)))
+	}
+}
+
+func (suite *PolicyTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *PolicyTestSuite) as(actor string) *PolicyBackend {
+	return suite.PolicyBackend.WithContext(WithActor(context.Background(), actor))
+}
+
+func (suite *PolicyTestSuite) TestSimulate() {
+	for _, test := range []struct {
+		principal, operation, path string
+		allowed                    bool
+		statement                  int
+	}{
+		{"ci", PolicyPut, "incoming/b.tgz", true, 0},
+		{"ci", PolicyList, "incoming", true, 0},
+		{"ci", PolicyList, "/incoming/", true, 0},
+		{"ci", PolicyDelete, "incoming/a.tgz", false, 1},
+		{"ci", PolicyPut, "charts/x/x-0.2.0.tgz", false, -1},
+		{"ci", PolicyGet, "incoming/../charts/x/x-0.1.0.tgz", false, -1},
+		{"ci", PolicyPut, "charts/x/../../incoming/a.tgz", false, -1},
+		{"team-x", PolicyGet, "charts/x/sub/../x.tgz", false, -1},
+		{"team-x", PolicyDelete, "charts/x/x-0.1.0.tgz", true, 2},
+		{"team-x", PolicyGet, "charts/x/sub/x.tgz", true, 2},
+		{"team-x", PolicyGet, "charts/y/y-0.1.0.tgz", false, -1},
+		{"team-x", PolicyGet, "charts/xx/xx.tgz", false, -1},
+		{"team-x", PolicyGet, "charts/y/index.yaml", true, 3},
+		{"", PolicyDownload, "index.yaml", true, 3},
+		{"", PolicyList, "", false, -1},
+		{"", PolicyPut, "index.yaml", false, -1},
+	} {
+		decision := suite.Policy.Simulate(test.principal, test.operation, test.path)
+		suite.Equal(test.allowed, decision.Allowed, "%s %s %s: %s", test.principal, test.operation, test.path, decision.Reason)
+		suite.Equal(test.statement, decision.Statement, "%s %s %s", test.principal, test.operation, test.path)
+	}
+}
+
+func (suite *PolicyTestSuite) TestLoadPolicy() {
+	policy, err := LoadPolicy([]byte(`{"statements": [{"effect": "allow", "principals": ["*"], "operations": ["get"], "paths": ["**"]}]}`))
+	suite.Nil(err, "JSON policies are loaded")
+	suite.True(policy.Simulate("", PolicyGet, "any/thing").Allowed)
+
+	for _, invalid := range []string{
+		`statements: [{effect: maybe, principals: ["*"], operations: [get], paths: ["**"]}]`,
+		`statements: [{effect: allow, principals: ["*"], operations: [chmod], paths: ["**"]}]`,
+		`statements: [{effect: allow, principals: ["*"], operations: [get], paths: ["[a-"]}]`,
+		`statements: [{effect: allow, operations: [get], paths: ["**"]}]`,
+		`statements: [{effect: allow, principal: ["*"], operations: [get], paths: ["**"]}]`,
+	} {
+		_, err := LoadPolicy([]byte(invalid))
+		suite.NotNil(err, invalid)
+	}
+
+	path := pathutil.Join(suite.TempDirectory, "policy.yaml")
+	suite.Nil(ioutil.WriteFile(path, []byte(testPolicyYAML), 0644))
+	policy, err = LoadPolicyFile(path)
+	suite.Nil(err)
+	suite.Len(policy.Statements, 4)
+
+	suite.Panics(func() {
+		NewPolicyBackend(suite.Local, &Policy{Statements: []PolicyStatement{{Effect: "maybe"}}})
+	})
+}
+
+func (suite *PolicyTestSuite) TestEnforcement() {
+	ci := suite.as("ci")
+	suite.Nil(ci.PutObject("incoming/b.tgz", []byte("b")))
+	suite.Nil(ci.PutObjectStream("incoming/c.tgz", strings.NewReader("c")))
+	objects, err := ci.ListObjects("incoming")
+	suite.Nil(err)
+	suite.Len(objects, 3)
+	_, err = ci.ListObjectsFromDirectory("incoming", 0)
+	suite.True(err == nil || err == io.EOF)
+	_, err = ci.GetObject("incoming/b.tgz")
+	suite.Nil(err)
+	stream, err := ci.GetObjectStream("incoming/c.tgz")
+	suite.Nil(err)
+	stream.Content.Close()
+
+	err = ci.DeleteObject("incoming/a.tgz")
+	suite.ErrorIs(err, ErrAccessDenied)
+	var policyErr *PolicyError
+	suite.True(errors.As(err, &policyErr))
+	suite.Equal("ci", policyErr.Principal)
+	suite.Equal(PolicyDelete, policyErr.Operation)
+	suite.Equal("incoming/a.tgz", policyErr.Path)
+	suite.Equal("access denied: ci may not delete incoming/a.tgz, denied by statement ci-never-deletes", err.Error())
+	_, err = suite.Local.GetObject("incoming/a.tgz")
+	suite.Nil(err, "the denied delete did not happen")
+
+	suite.ErrorIs(ci.RenamePrefixOrObject("incoming/a.tgz", "incoming/d.tgz"), ErrAccessDenied)
+	err = ci.PutObject("charts/x/../../incoming/a.tgz", []byte("x"))
+	suite.ErrorIs(err, ErrAccessDenied, "the rules see the path the backend gets")
+	suite.Contains(err.Error(), "the path has a .. segment")
+	suite.ErrorIs(ci.PutObject("charts/x/x-0.2.0.tgz", []byte("x")), ErrAccessDenied)
+	_, err = ci.ListObjects("")
+	suite.ErrorIs(err, ErrAccessDenied)
+	_, err = ci.ListObjectsFromDirectory("charts", 0)
+	suite.ErrorIs(err, ErrAccessDenied)
+
+	teamX := suite.as("team-x")
+	suite.Nil(teamX.RenamePrefixOrObject("charts/x/x-0.1.0.tgz", "charts/x/archive/x-0.1.0.tgz"))
+	suite.ErrorIs(teamX.RenamePrefixOrObject("charts/x/archive", "charts/y/archive"), ErrAccessDenied, "both paths of a rename are authorized")
+	object, err := teamX.GetObject("charts/y/y-0.1.0.tgz")
+	suite.ErrorIs(err, ErrAccessDenied)
+	suite.Equal("charts/y/y-0.1.0.tgz", object.Path, "the path is set on denial")
+	stream, err = teamX.GetObjectStream("charts/y/y-0.1.0.tgz")
+	suite.ErrorIs(err, ErrAccessDenied)
+	suite.Equal("charts/y/y-0.1.0.tgz", stream.Path, "the path is set on denial")
+	suite.Nil(teamX.DeleteObject("charts/x/archive/x-0.1.0.tgz"))
+
+	anonymous := suite.PolicyBackend
+	_, err = anonymous.GetObject("index.yaml")
+	suite.Nil(err)
+	err = anonymous.PutObjectStream("index.yaml", strings.NewReader("x"))
+	suite.ErrorIs(err, ErrAccessDenied)
+	suite.Contains(err.Error(), "anonymous may not put index.yaml")
+}
+
+func (suite *PolicyTestSuite) TestHandleHttpFileDownload() {
+	download := func(backend *PolicyBackend, r *http.Request, path string) int {
+		w := httptest.NewRecorder()
+		backend.HandleHttpFileDownload(w, r, path)
+		return w.Code
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	suite.Equal(http.StatusOK, download(suite.PolicyBackend, r, "index.yaml"))
+	suite.Equal(http.StatusForbidden, download(suite.PolicyBackend, r, "charts/x/x-0.1.0.tgz"))
+	suite.Equal(http.StatusOK, download(suite.as("team-x"), r, "charts/x/x-0.1.0.tgz"), "the actor of the backend context is used without one in the request")
+
+	r = r.WithContext(WithActor(r.Context(), "team-x"))
+	suite.Equal(http.StatusOK, download(suite.PolicyBackend, r, "charts/x/x-0.1.0.tgz"), "the actor of the request context is used")
+	suite.Equal(http.StatusForbidden, download(suite.PolicyBackend, r, "charts/y/y-0.1.0.tgz"))
+	suite.Equal(http.StatusForbidden, download(suite.as("ci"), r, "incoming/a.tgz"), "download is an operation of its own")
+}
+
+func TestPolicyStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(PolicyTestSuite))
+}
@@ -0,0 +1,364 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type (
+	// RateLimitedBackend is a Backend wrapper limiting the rate of the operations, per class of operation, and how many are in flight
+	// A request first waits for a token of its class, then for an in-flight slot, given in turn to the prefixes waiting with PrefixDepth,
+	// so that the requests throttled by their class do not hold the slots needed by the others
+	RateLimitedBackend struct {
+		Backend Backend
+		// Context cancels the waits of the requests, see WithContext; the waits are not cancelled if nil
+		Context context.Context
+		// PrefixDepth is the number of leading path segments sharing the in-flight slots fairly with the other prefixes,
+		// e.g. 1 so that a bulk job on one repository does not starve the others; the slots are given in order if zero
+		PrefixDepth int
+		limits      *rateLimits
+	}
+
+	// RateLimits are the token buckets of the classes of operations of a RateLimitedBackend
+	RateLimits struct {
+		// List limits ListObjects and every page of ListObjectsFromDirectory
+		List RateLimit
+		// Read limits GetObject, GetObjectStream and HandleHttpFileDownload
+		Read RateLimit
+		// Write limits PutObject, PutObjectStream and RenamePrefixOrObject
+		Write RateLimit
+		// Delete limits DeleteObject
+		Delete RateLimit
+	}
+
+	// RateLimit is a token bucket
+	RateLimit struct {
+		// Rate is the number of operations per second, unlimited if zero
+		Rate float64
+		// Burst is the number of operations allowed at once, 1 if zero
+		Burst int
+	}
+
+	rateLimits struct {
+		list, read, write, delete *rate.Limiter
+		slots                     *fairSemaphore
+	}
+
+	// fairSemaphore gives its slots in turn to the keys waiting for one, and in order to the waiters of a key
+	fairSemaphore struct {
+		sync.Mutex
+		capacity int // unlimited if zero
+		inFlight int
+		waiters  map[string][]chan struct{}
+		turns    []string // the keys with waiters, in turn
+	}
+
+	// rateLimitedListOutput limits the pages following the first one
+	rateLimitedListOutput struct {
+		ListObjectsFromDirectoryOutput
+		backend RateLimitedBackend
+		prefix  string
+	}
+
+	// rateLimitedReadCloser holds an in-flight slot until it is closed
+	rateLimitedReadCloser struct {
+		io.ReadCloser
+		release func()
+	}
+)
+
+// NewRateLimitedBackend creates a new instance of RateLimitedBackend, with at most maxInFlight requests at once, unlimited if zero
+func NewRateLimitedBackend(backend Backend, limits RateLimits, maxInFlight int) *RateLimitedBackend {
+	return &RateLimitedBackend{
+		Backend: backend,
+		limits: &rateLimits{
+			list:   newRateLimiter(limits.List),
+			read:   newRateLimiter(limits.Read),
+			write:  newRateLimiter(limits.Write),
+			delete: newRateLimiter(limits.Delete),
+			slots: &fairSemaphore{
+				capacity: maxInFlight,
+				waiters:  map[string][]chan struct{}{},
+			},
+		},
+	}
+}
+
+func newRateLimiter(limit RateLimit) *rate.Limiter {
+	if limit.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(limit.Rate), burst)
+}
+
+// acquire waits for a slot, or for ctx to be done
+func (s *fairSemaphore) acquire(ctx context.Context, key string) error {
+	s.Lock()
+	if s.capacity <= 0 || (s.inFlight < s.capacity && len(s.turns) == 0) {
+		s.inFlight++
+		s.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	if len(s.waiters[key]) == 0 {
+		s.turns = append(s.turns, key)
+	}
+	s.waiters[key] = append(s.waiters[key], ready)
+	s.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.Lock()
+		defer s.Unlock()
+		select {
+		case <-ready:
+			// given a slot meanwhile, which goes to the next waiter
+			s.handOver()
+		default:
+			s.dequeue(key, ready)
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a slot, or gives it to the next waiter
+func (s *fairSemaphore) release() {
+	if s.capacity <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.handOver()
+}
+
+// handOver gives a slot held to the first waiter of the next key in turn
+func (s *fairSemaphore) handOver() {
+	if len(s.turns) == 0 {
+		s.inFlight--
+		return
+	}
+	key := s.turns[0]
+	s.turns = s.turns[1:]
+	waiters := s.waiters[key]
+	close(waiters[0])
+	if len(waiters) > 1 {
+		s.waiters[key] = waiters[1:]
+		s.turns = append(s.turns, key)
+	} else {
+		delete(s.waiters, key)
+	}
+}
+
+func (s *fairSemaphore) dequeue(key string, ready chan struct{}) {
+	waiters := s.waiters[key]
+	for i, w := range waiters {
+		if w == ready {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		s.waiters[key] = waiters
+		return
+	}
+	delete(s.waiters, key)
+	for i, k := range s.turns {
+		if k == key {
+			s.turns = append(s.turns[:i:i], s.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// WithContext returns a copy of the backend whose waits are cancelled with ctx, sharing the limits of the original
+// The wrapped backend makes its requests with ctx too when it implements ContextBackend
+func (b RateLimitedBackend) WithContext(ctx context.Context) *RateLimitedBackend {
+	b.Context = ctx
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// key is the prefix of path sharing the in-flight slots fairly
+func (b RateLimitedBackend) key(path string) string {
+	if b.PrefixDepth <= 0 {
+		return ""
+	}
+	segments := strings.SplitN(cleanPrefix(path), "/", b.PrefixDepth+1)
+	if len(segments) > b.PrefixDepth {
+		segments = segments[:b.PrefixDepth]
+	}
+	return strings.Join(segments, "/")
+}
+
+// wait takes a token of limiter and an in-flight slot, and returns the release of the slot
+func (b RateLimitedBackend) wait(limiter *rate.Limiter, path string) (func(), error) {
+	ctx := b.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	if err := b.limits.slots.acquire(ctx, b.key(path)); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(b.limits.slots.release)
+	}, nil
+}
+
+// BackendContext returns the Context of the backend
+func (b RateLimitedBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext is WithContext returning a Backend, see ContextBackend
+func (b RateLimitedBackend) WithBackendContext(ctx context.Context) Backend {
+	return b.WithContext(ctx)
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b RateLimitedBackend) ListObjects(prefix string) ([]Object, error) {
+	release, err := b.wait(b.limits.list, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend, every page waiting for a token
+func (b RateLimitedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	release, err := b.wait(b.limits.list, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	output, err := b.Backend.ListObjectsFromDirectory(prefix, limit)
+	if output == nil {
+		return output, err
+	}
+	return rateLimitedListOutput{ListObjectsFromDirectoryOutput: output, backend: b, prefix: prefix}, err
+}
+
+func (o rateLimitedListOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	release, err := o.backend.wait(o.backend.limits.list, o.prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	output, err := o.ListObjectsFromDirectoryOutput.NextPage()
+	if output == nil {
+		return output, err
+	}
+	return rateLimitedListOutput{ListObjectsFromDirectoryOutput: output, backend: o.backend, prefix: o.prefix}, err
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b RateLimitedBackend) GetObject(path string) (Object, error) {
+	release, err := b.wait(b.limits.read, path)
+	if err != nil {
+		return Object{Metadata: Metadata{Path: path}}, err
+	}
+	defer release()
+	return b.Backend.GetObject(path)
+}
+
+// PutObject uploads an object to the wrapped backend
+func (b RateLimitedBackend) PutObject(path string, content []byte) error {
+	release, err := b.wait(b.limits.write, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return b.Backend.PutObject(path, content)
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b RateLimitedBackend) DeleteObject(path string) error {
+	release, err := b.wait(b.limits.delete, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return b.Backend.DeleteObject(path)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend, as a single write
+func (b RateLimitedBackend) RenamePrefixOrObject(path, newPath string) error {
+	release, err := b.wait(b.limits.write, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+// The stream holds its in-flight slot until it is closed
+func (b RateLimitedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	release, err := b.wait(b.limits.read, path)
+	if err != nil {
+		return &ObjectStream{Metadata: Metadata{Path: path}}, err
+	}
+	stream, err := getObjectStream(b.Backend, path)
+	if err != nil || stream.Content == nil {
+		release()
+		return stream, err
+	}
+	stream.Content = rateLimitedReadCloser{ReadCloser: stream.Content, release: release}
+	return stream, nil
+}
+
+func (r rateLimitedReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend
+func (b RateLimitedBackend) PutObjectStream(path string, content io.Reader) error {
+	release, err := b.wait(b.limits.write, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return putObjectStream(b.Backend, path, content)
+}
+
+func (b RateLimitedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	release, err := b.WithContext(r.Context()).wait(b.limits.read, path)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	handleHttpFileDownload(b.Backend, w, r, path)
+}
@@ -0,0 +1,265 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// rateLimitedBlockingBackend blocks the reads until they are let through, and records their order
+type rateLimitedBlockingBackend struct {
+	Backend
+	sync.Mutex
+	proceed chan struct{}
+	started chan string
+	order   []string
+}
+
+func (b *rateLimitedBlockingBackend) GetObject(path string) (Object, error) {
+	b.started <- path
+	<-b.proceed
+	b.Lock()
+	b.order = append(b.order, path)
+	b.Unlock()
+	return Object{Metadata: Metadata{Path: path}}, nil
+}
+
+type RateLimitedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	Blocking      *rateLimitedBlockingBackend
+}
+
+func (suite *RateLimitedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-ratelimited/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.Blocking = &rateLimitedBlockingBackend{
+		Backend: suite.Local,
+		proceed: make(chan struct{}),
+		started: make(chan string, 10),
+	}
+}
+
+func (suite *RateLimitedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+// waiting is the number of requests waiting for an in-flight slot
+func (suite *RateLimitedTestSuite) waiting(backend *RateLimitedBackend) int {
+	slots := backend.limits.slots
+	slots.Lock()
+	defer slots.Unlock()
+	n := 0
+	for _, waiters := range slots.waiters {
+		n += len(waiters)
+	}
+	return n
+}
+
+func (suite *RateLimitedTestSuite) TestRateLimits() {
+	backend := NewRateLimitedBackend(suite.Local, RateLimits{
+		Read:  RateLimit{Rate: 50, Burst: 1},
+		Write: RateLimit{Rate: 0.001, Burst: 1},
+	}, 0)
+
+	suite.Nil(backend.PutObject("a.txt", []byte("a")), "the burst is allowed at once")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := backend.WithContext(ctx).PutObject("b.txt", []byte("b"))
+	suite.NotNil(err, "waits do not outlast the context")
+	suite.Nil(backend.DeleteObject("a.txt"), "classes have their own buckets")
+	suite.Nil(suite.Local.PutObject("a.txt", []byte("a")))
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := backend.GetObject("a.txt")
+		suite.Nil(err)
+	}
+	suite.True(time.Since(start) >= 80*time.Millisecond, "reads are limited to 50 per second, took %s", time.Since(start))
+
+	for i := 0; i < 3; i++ {
+		suite.Nil(suite.Local.PutObject(fmt.Sprintf("list/%d.txt", i), []byte("x")))
+	}
+	output, err := backend.ListObjectsFromDirectory("list", 2)
+	files, pages := 0, 0
+	for {
+		files += len(output.GetFiles())
+		pages++
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.Equal(3, files, "pages are listed through the wrapper")
+	suite.True(pages > 1)
+}
+
+func (suite *RateLimitedTestSuite) TestMaxInFlight() {
+	backend := NewRateLimitedBackend(suite.Blocking, RateLimits{}, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		backend.GetObject("first.txt")
+	}()
+	suite.Equal("first.txt", <-suite.Blocking.started)
+	go func() {
+		defer wg.Done()
+		backend.GetObject("second.txt")
+	}()
+	suite.Eventually(func() bool {
+		return suite.waiting(backend) == 1
+	}, time.Second, time.Millisecond, "the second read waits for a slot")
+	select {
+	case <-suite.Blocking.started:
+		suite.Fail("the second read started while the first was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	suite.Blocking.proceed <- struct{}{}
+	suite.Equal("second.txt", <-suite.Blocking.started, "the slot is given to the second read")
+	suite.Blocking.proceed <- struct{}{}
+	wg.Wait()
+}
+
+func (suite *RateLimitedTestSuite) TestFairness() {
+	backend := NewRateLimitedBackend(suite.Blocking, RateLimits{}, 1)
+	backend.PrefixDepth = 1
+
+	var wg sync.WaitGroup
+	get := func(path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend.GetObject(path)
+		}()
+	}
+	get("bulk/0.txt")
+	<-suite.Blocking.started
+	for i, path := range []string{"bulk/1.txt", "bulk/2.txt", "bulk/3.txt", "interactive/index.yaml"} {
+		get(path)
+		suite.Eventually(func() bool {
+			return suite.waiting(backend) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		suite.Blocking.proceed <- struct{}{}
+		if i < 4 {
+			<-suite.Blocking.started
+		}
+	}
+	wg.Wait()
+	suite.Equal([]string{"bulk/0.txt", "bulk/1.txt", "interactive/index.yaml", "bulk/2.txt", "bulk/3.txt"}, suite.Blocking.order,
+		"prefixes take turns")
+}
+
+func (suite *RateLimitedTestSuite) TestCancellation() {
+	backend := NewRateLimitedBackend(suite.Blocking, RateLimits{}, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		backend.GetObject("held.txt")
+	}()
+	<-suite.Blocking.started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := backend.WithContext(ctx).GetObject("cancelled.txt")
+		errs <- err
+	}()
+	suite.Eventually(func() bool {
+		return suite.waiting(backend) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	suite.Equal(context.Canceled, <-errs, "waits respect cancellation")
+	suite.Equal(0, suite.waiting(backend))
+
+	suite.Blocking.proceed <- struct{}{}
+	<-done
+	suite.Equal(0, backend.limits.slots.inFlight, "slots are released")
+}
+
+func (suite *RateLimitedTestSuite) TestThrottledWritesDoNotHoldSlots() {
+	suite.Nil(suite.Local.PutObject("index.yaml", []byte("index")))
+	backend := NewRateLimitedBackend(suite.Local, RateLimits{
+		Write: RateLimit{Rate: 0.001, Burst: 1},
+	}, 1)
+	suite.Nil(backend.PutObject("bulk/0.tgz", []byte("0")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 3)
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			errs <- backend.WithContext(ctx).PutObject(fmt.Sprintf("bulk/%d.tgz", i), []byte("x"))
+		}(i)
+	}
+	suite.Eventually(func() bool {
+		return backend.limits.write.Tokens() < -0.5
+	}, time.Second, time.Millisecond, "a write waits for a token")
+
+	for i := 0; i < 5; i++ {
+		readCtx, readCancel := context.WithTimeout(context.Background(), time.Second)
+		object, err := backend.WithContext(readCtx).GetObject("index.yaml")
+		readCancel()
+		suite.Nil(err, "reads proceed while the writes wait for a token")
+		suite.Equal([]byte("index"), object.Content)
+	}
+	suite.Equal(0, suite.waiting(backend), "the throttled writes do not wait for a slot")
+
+	cancel()
+	for i := 0; i < 3; i++ {
+		suite.Equal(context.Canceled, <-errs)
+	}
+	suite.Equal(0, backend.limits.slots.inFlight)
+}
+
+func (suite *RateLimitedTestSuite) TestStreamsHoldSlots() {
+	suite.Nil(suite.Local.PutObject("stream.txt", []byte("content")))
+	backend := NewRateLimitedBackend(suite.Local, RateLimits{}, 1)
+
+	stream, err := backend.GetObjectStream("stream.txt")
+	suite.Nil(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = backend.WithContext(ctx).GetObject("stream.txt")
+	suite.Equal(context.DeadlineExceeded, err, "the open stream holds its slot")
+
+	suite.Nil(stream.Content.Close())
+	stream.Content.Close()
+	suite.Equal(0, backend.limits.slots.inFlight, "closing twice releases once")
+	_, err = backend.GetObject("stream.txt")
+	suite.Nil(err)
+}
+
+func TestRateLimitedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitedTestSuite))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type (
+	// ReadOnlyBackend is a view of a Backend rejecting the mutations with a ReadOnlyError
+	ReadOnlyBackend struct {
+		Backend Backend
+	}
+
+	// ReadOnlyError is the error of a mutation of a ReadOnlyBackend, errors.Is matches it with ErrReadOnly
+	ReadOnlyError struct {
+		Operation string
+		Path      string
+	}
+)
+
+// ReadOnly creates a read-only view of backend
+func ReadOnly(backend Backend) *ReadOnlyBackend {
+	return &ReadOnlyBackend{Backend: backend}
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Operation, e.Path, ErrReadOnly)
+}
+
+func (e *ReadOnlyError) Unwrap() error {
+	return ErrReadOnly
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b ReadOnlyBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b ReadOnlyBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b ReadOnlyBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend
+func (b ReadOnlyBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	return b.Backend.ListObjectsFromDirectory(prefix, limit)
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b ReadOnlyBackend) GetObject(path string) (Object, error) {
+	return b.Backend.GetObject(path)
+}
+
+// PutObject is rejected with a ReadOnlyError
+func (b ReadOnlyBackend) PutObject(path string, content []byte) error {
+	return &ReadOnlyError{Operation: "PutObject", Path: path}
+}
+
+// DeleteObject is rejected with a ReadOnlyError
+func (b ReadOnlyBackend) DeleteObject(path string) error {
+	return &ReadOnlyError{Operation: "DeleteObject", Path: path}
+}
+
+// RenamePrefixOrObject is rejected with a ReadOnlyError
+func (b ReadOnlyBackend) RenamePrefixOrObject(path, newPath string) error {
+	return &ReadOnlyError{Operation: "RenamePrefixOrObject", Path: path}
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+func (b ReadOnlyBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	return getObjectStream(b.Backend, path)
+}
+
+// PutObjectStream is rejected with a ReadOnlyError
+func (b ReadOnlyBackend) PutObjectStream(path string, content io.Reader) error {
+	return &ReadOnlyError{Operation: "PutObjectStream", Path: path}
+}
+
+func (b ReadOnlyBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	handleHttpFileDownload(b.Backend, w, r, path)
+}
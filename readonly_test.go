@@ -0,0 +1,97 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReadOnlyTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	ReadOnly      *ReadOnlyBackend
+}
+
+func (suite *ReadOnlyTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-readonly/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.ReadOnly = ReadOnly(suite.Local)
+	suite.Nil(suite.Local.PutObject("index.yaml", []byte("index")))
+}
+
+func (suite *ReadOnlyTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *ReadOnlyTestSuite) TestReads() {
+	object, err := suite.ReadOnly.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("index"), object.Content)
+
+	stream, err := suite.ReadOnly.GetObjectStream("index.yaml")
+	suite.Nil(err)
+	content, _ := ioutil.ReadAll(stream.Content)
+	stream.Content.Close()
+	suite.Equal("index", string(content))
+
+	objects, err := suite.ReadOnly.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	output, _ := suite.ReadOnly.ListObjectsFromDirectory("", 0)
+	suite.Len(output.GetFiles(), 1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	suite.ReadOnly.HandleHttpFileDownload(w, r, "index.yaml")
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+func (suite *ReadOnlyTestSuite) TestMutations() {
+	for operation, err := range map[string]error{
+		"PutObject":            suite.ReadOnly.PutObject("index.yaml", []byte("x")),
+		"PutObjectStream":      suite.ReadOnly.PutObjectStream("index.yaml", strings.NewReader("x")),
+		"DeleteObject":         suite.ReadOnly.DeleteObject("index.yaml"),
+		"RenamePrefixOrObject": suite.ReadOnly.RenamePrefixOrObject("index.yaml", "moved.yaml"),
+	} {
+		suite.ErrorIs(err, ErrReadOnly, "%s is rejected", operation)
+		var readOnlyErr *ReadOnlyError
+		suite.True(errors.As(err, &readOnlyErr), "%s is rejected with a ReadOnlyError", operation)
+		suite.Equal(operation, readOnlyErr.Operation)
+		suite.Equal("index.yaml", readOnlyErr.Path)
+	}
+	suite.Equal("PutObject index.yaml: backend is read-only", suite.ReadOnly.PutObject("index.yaml", nil).Error())
+
+	object, err := suite.Local.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("index"), object.Content, "nothing was changed")
+}
+
+func TestReadOnlyStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(ReadOnlyTestSuite))
+}
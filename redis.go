@@ -0,0 +1,647 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisNamespace starts every key; the scripts compute the keys they touch rather than taking them in KEYS
+	redisNamespace           = "{chartmuseum-storage}"
+	defaultRedisChunkSize    = 1024 * 1024
+	redisListBatch           = 1000
+	redisReadAttempts        = 5
+	redisErrOccupied         = "OCCUPIED"
+	redisErrParentIsObject   = "PARENT"
+	redisErrIsADirectory     = "DIRECTORY"
+	redisErrRenameIntoItself = "INTO_ITSELF"
+)
+
+// redisLuaHelpers are shared by the scripts, directories are sorted sets of their members, with a trailing slash for subdirectories
+const redisLuaHelpers = `
+local function parent(key)
+	local i = key:match('^.*()/')
+	if i then
+		return key:sub(1, i - 1), key:sub(i + 1)
+	end
+	return '', key
+end
+
+local function parent_is_object(ns, key)
+	local dir = parent(key)
+	while dir ~= '' do
+		if redis.call('EXISTS', ns .. ':meta:' .. dir) == 1 then
+			return true
+		end
+		dir = parent(dir)
+	end
+	return false
+end
+
+-- adds key to its parent directories, a directory lives as long as its longest living member
+local function link(ns, key, suffix, ttl)
+	local name = key
+	while true do
+		local dir, member = parent(name)
+		local dkey = ns .. ':dir:' .. dir
+		local existed = redis.call('EXISTS', dkey) == 1
+		redis.call('ZADD', dkey, 0, member .. suffix)
+		if ttl <= 0 then
+			redis.call('PERSIST', dkey)
+		else
+			local current = redis.call('PTTL', dkey)
+			if not existed or (current >= 0 and current < ttl) then
+				redis.call('PEXPIRE', dkey, ttl)
+			end
+		end
+		if dir == '' then
+			return
+		end
+		name, suffix = dir, '/'
+	end
+end
+
+-- removes key from its parent directory, and the directories left empty from theirs
+local function unlink(ns, key, suffix)
+	local name = key
+	while true do
+		local dir, member = parent(name)
+		local dkey = ns .. ':dir:' .. dir
+		redis.call('ZREM', dkey, member .. suffix)
+		if dir == '' or redis.call('EXISTS', dkey) == 1 then
+			return
+		end
+		name, suffix = dir, '/'
+	end
+end
+
+local function drop_chunks(ns, key, generation, chunks)
+	for i = 0, (tonumber(chunks) or 0) - 1 do
+		redis.call('DEL', ns .. ':data:' .. key .. ':' .. generation .. ':' .. i)
+	end
+end
+`
+
+var (
+	// redisPutScript points the metadata of an object at the chunks of a new generation, already written
+	redisPutScript = redis.NewScript(redisLuaHelpers + `
+local ns, key, generation, chunks, mtime, size, ttl = ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], tonumber(ARGV[7])
+local meta = ns .. ':meta:' .. key
+if redis.call('EXISTS', ns .. ':dir:' .. key) == 1 then
+	return redis.error_reply('` + redisErrIsADirectory + `')
+end
+if parent_is_object(ns, key) then
+	return redis.error_reply('` + redisErrParentIsObject + `')
+end
+local old = redis.call('HMGET', meta, 'generation', 'chunks')
+redis.call('HSET', meta, 'generation', generation, 'chunks', chunks, 'mtime', mtime, 'size', size)
+if ttl > 0 then
+	redis.call('PEXPIRE', meta, ttl)
+else
+	redis.call('PERSIST', meta)
+end
+link(ns, key, '', ttl)
+if old[1] and old[1] ~= generation then
+	drop_chunks(ns, key, old[1], old[2])
+end
+return 1
+`)
+
+	redisDeleteScript = redis.NewScript(redisLuaHelpers + `
+local ns, key = ARGV[1], ARGV[2]
+local meta = ns .. ':meta:' .. key
+local old = redis.call('HMGET', meta, 'generation', 'chunks')
+if not old[1] then
+	return 0
+end
+redis.call('DEL', meta)
+drop_chunks(ns, key, old[1], old[2])
+unlink(ns, key, '')
+return 1
+`)
+
+	// redisRenameScript moves an object, or every object of a directory, at once
+	redisRenameScript = redis.NewScript(redisLuaHelpers + `
+local ns, src, dst = ARGV[1], ARGV[2], ARGV[3]
+if redis.call('EXISTS', ns .. ':meta:' .. dst) == 1 or redis.call('EXISTS', ns .. ':dir:' .. dst) == 1 then
+	return redis.error_reply('` + redisErrOccupied + `')
+end
+if dst:sub(1, #src + 1) == src .. '/' then
+	return redis.error_reply('` + redisErrRenameIntoItself + `')
+end
+if parent_is_object(ns, dst) then
+	return redis.error_reply('` + redisErrParentIsObject + `')
+end
+
+local objects, dirs = {}, {}
+local function collect(dir)
+	table.insert(dirs, dir)
+	for _, member in ipairs(redis.call('ZRANGE', ns .. ':dir:' .. dir, 0, -1)) do
+		if member:sub(-1) == '/' then
+			collect(dir .. '/' .. member:sub(1, -2))
+		elseif redis.call('EXISTS', ns .. ':meta:' .. dir .. '/' .. member) == 1 then
+			table.insert(objects, dir .. '/' .. member)
+		end
+	end
+end
+if redis.call('EXISTS', ns .. ':meta:' .. src) == 1 then
+	objects = {src}
+elseif redis.call('EXISTS', ns .. ':dir:' .. src) == 1 then
+	collect(src)
+end
+
+for _, key in ipairs(objects) do
+	local new = dst .. key:sub(#src + 1)
+	local meta = redis.call('HMGET', ns .. ':meta:' .. key, 'generation', 'chunks')
+	for i = 0, (tonumber(meta[2]) or 0) - 1 do
+		local chunk = ':' .. meta[1] .. ':' .. i
+		if redis.call('EXISTS', ns .. ':data:' .. key .. chunk) == 1 then
+			redis.call('RENAME', ns .. ':data:' .. key .. chunk, ns .. ':data:' .. new .. chunk)
+		end
+	end
+	redis.call('RENAME', ns .. ':meta:' .. key, ns .. ':meta:' .. new)
+	unlink(ns, key, '')
+	link(ns, new, '', redis.call('PTTL', ns .. ':meta:' .. new))
+end
+-- members of expired objects are left in the directories, they go with them
+for _, dir in ipairs(dirs) do
+	redis.call('DEL', ns .. ':dir:' .. dir)
+end
+if #dirs > 0 then
+	unlink(ns, src, '/')
+end
+return #objects
+`)
+
+	// redisListScript returns a page of the members of a directory after cursor, with the modification
+	// time of the objects; members of expired objects and directories are removed on the way
+	redisListScript = redis.NewScript(`
+local ns, dir, cursor, limit, batch = ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]), tonumber(ARGV[5])
+local dkey = ns .. ':dir:' .. dir
+local result = {''}
+local count = 0
+local start = '-'
+if cursor ~= '' then
+	start = '(' .. cursor
+end
+while true do
+	local members = redis.call('ZRANGEBYLEX', dkey, start, '+', 'LIMIT', 0, batch)
+	for _, member in ipairs(members) do
+		if limit > 0 and count == limit then
+			return result
+		end
+		local child = member
+		if dir ~= '' then
+			child = dir .. '/' .. member
+		end
+		local mtime = false
+		local live
+		if member:sub(-1) == '/' then
+			live = redis.call('EXISTS', ns .. ':dir:' .. child:sub(1, -2)) == 1
+			mtime = ''
+		else
+			mtime = redis.call('HGET', ns .. ':meta:' .. child, 'mtime')
+			live = mtime ~= false
+		end
+		if live then
+			table.insert(result, member)
+			table.insert(result, mtime)
+			count = count + 1
+			result[1] = member
+		else
+			redis.call('ZREM', dkey, member)
+		end
+		start = '(' .. member
+	end
+	if #members < batch then
+		result[1] = ''
+		return result
+	end
+end
+`)
+)
+
+type redisListObjectsFromDirectoryOutput struct {
+	backend         *RedisBackend
+	prefix          string
+	limit           int
+	cursor          string
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *redisListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *redisListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *redisListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *redisListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &redisListObjectsFromDirectoryOutput{
+		backend: l.backend,
+		prefix:  l.prefix,
+		limit:   l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the cursor is the last member returned, members added or removed meanwhile do not shift the pages
+	cursor, entries, err := l.backend.list(l.backend.key(l.prefix), l.cursor, l.limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.cursor = cursor
+	r.isEOF = cursor == ""
+
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *redisListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *redisListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// redisEntry is a member of a directory
+type redisEntry struct {
+	name         string
+	isDir        bool
+	lastModified time.Time
+}
+
+// RedisBackend is a storage backend for Redis
+// The content of an object is split in strings of ChunkSize bytes, with a hash holding the chunk count
+// and the modification time; every directory is a sorted set of its members. Objects can expire,
+// the directories then live as long as their longest living member.
+// The scripts access keys they were not given, which Redis Cluster does not allow: a single server is needed,
+// possibly with replicas and Sentinel
+type RedisBackend struct {
+	Client    redis.UniversalClient
+	Prefix    string
+	ChunkSize int
+	// TTL is the time to live of the objects, zero for no expiry
+	TTL     time.Duration
+	Context context.Context
+}
+
+// NewRedisBackend creates a new instance of RedisBackend
+// Credentials are read from REDIS_USERNAME and REDIS_PASSWORD
+func NewRedisBackend(address string, db int, prefix string) *RedisBackend {
+	client := redis.NewClient(&redis.Options{
+		Addr:     address,
+		DB:       db,
+		Username: os.Getenv("REDIS_USERNAME"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+	return NewRedisBackendWithClient(client, prefix)
+}
+
+// NewRedisBackendWithClient creates a new instance of RedisBackend from an existing client
+func NewRedisBackendWithClient(client redis.UniversalClient, prefix string) *RedisBackend {
+	b := &RedisBackend{
+		Client:    client,
+		Prefix:    cleanPrefix(prefix),
+		ChunkSize: defaultRedisChunkSize,
+		Context:   context.Background(),
+	}
+	return b
+}
+
+func (b RedisBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+func redisMetaKey(key string) string {
+	return redisNamespace + ":meta:" + key
+}
+
+func redisChunkKey(key string, generation string, chunk int) string {
+	return redisNamespace + ":data:" + key + ":" + generation + ":" + strconv.Itoa(chunk)
+}
+
+// redisError maps the errors returned by the scripts
+func redisError(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+	// Redis versions differ in adding the generic ERR code to the replies of the scripts
+	switch msg := strings.TrimPrefix(err.Error(), "ERR "); {
+	case strings.HasPrefix(msg, redisErrOccupied):
+		return ErrNewPathNotEmpty
+	case strings.HasPrefix(msg, redisErrParentIsObject):
+		return fmt.Errorf("%s: %w", key, ErrPrefixIsAnObject)
+	case strings.HasPrefix(msg, redisErrIsADirectory):
+		return fmt.Errorf("%s is a directory", key)
+	case strings.HasPrefix(msg, redisErrRenameIntoItself):
+		return fmt.Errorf("cannot move %s into itself", key)
+	}
+	return err
+}
+
+func redisMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func redisTime(millis string) time.Time {
+	ms, _ := strconv.ParseInt(millis, 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// list returns a page of the members of dir after cursor, and the cursor of the next page, empty at the end
+func (b RedisBackend) list(dir string, cursor string, limit int) (string, []redisEntry, error) {
+	var entries []redisEntry
+
+	result, err := redisListScript.Run(b.Context, b.Client, []string{redisNamespace + ":dir:" + dir},
+		redisNamespace, dir, cursor, limit, redisListBatch).StringSlice()
+	if err != nil {
+		return "", entries, err
+	}
+	for i := 1; i+1 < len(result); i += 2 {
+		if strings.HasSuffix(result[i], "/") {
+			entries = append(entries, redisEntry{name: strings.TrimSuffix(result[i], "/"), isDir: true})
+		} else {
+			entries = append(entries, redisEntry{name: result[i], lastModified: redisTime(result[i+1])})
+		}
+	}
+	return result[0], entries, nil
+}
+
+// BackendContext returns the context of the requests of the backend
+func (b RedisBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext returns a copy of the backend making its requests with ctx
+func (b RedisBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+// ListObjects lists all objects in Redis, at prefix
+func (b RedisBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	_, entries, err := b.list(b.key(prefix), "", 0)
+	if err != nil {
+		return objects, err
+	}
+	for _, e := range entries {
+		if e.isDir {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         e.name,
+				LastModified: e.lastModified,
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b RedisBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if key := b.key(prefix); key != "" {
+		n, err := b.Client.Exists(b.Context, redisMetaKey(key)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, ErrPrefixIsAnObject
+		}
+	}
+
+	output := &redisListObjectsFromDirectoryOutput{
+		backend: &b,
+		prefix:  prefix,
+		limit:   limit,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves an object, or every object under a prefix, to newPath in a single script
+// Objects keep their time to live
+func (b RedisBackend) RenamePrefixOrObject(path, newPath string) error {
+	key, newKey := b.key(path), b.key(newPath)
+	if key == "" || newKey == "" {
+		return errors.New("cannot rename the root of the backend")
+	}
+	err := redisRenameScript.Run(b.Context, b.Client, []string{redisMetaKey(key)}, redisNamespace, key, newKey).Err()
+	return redisError(err, newKey)
+}
+
+// GetObject retrieves an object from Redis, at prefix
+func (b RedisBackend) GetObject(path string) (Object, error) {
+	var object Object
+	object.Path = path
+
+	key := b.key(path)
+	for attempt := 0; attempt < redisReadAttempts; attempt++ {
+		meta, err := b.Client.HGetAll(b.Context, redisMetaKey(key)).Result()
+		if err != nil {
+			return object, err
+		}
+		if len(meta) == 0 {
+			return object, ErrObjectNotFound
+		}
+
+		chunks, _ := strconv.Atoi(meta["chunks"])
+		keys := make([]string, chunks)
+		for i := range keys {
+			keys[i] = redisChunkKey(key, meta["generation"], i)
+		}
+		values, err := b.Client.MGet(b.Context, keys...).Result()
+		if err != nil {
+			return object, err
+		}
+
+		var content bytes.Buffer
+		complete := true
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				complete = false
+				break
+			}
+			content.WriteString(s)
+		}
+		if !complete {
+			// replaced by a concurrent write, read the new generation
+			continue
+		}
+		object.Content = content.Bytes()
+		object.LastModified = redisTime(meta["mtime"])
+		return object, nil
+	}
+	return object, fmt.Errorf("%s was replaced while reading it", key)
+}
+
+// PutObject uploads an object to Redis, at prefix
+func (b RedisBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// PutObjectWithTTL uploads an object to Redis, at prefix, expiring after ttl instead of TTL
+func (b RedisBackend) PutObjectWithTTL(path string, content []byte, ttl time.Duration) error {
+	b.TTL = ttl
+	return b.PutObject(path, content)
+}
+
+// DeleteObject removes an object from Redis, at prefix
+func (b RedisBackend) DeleteObject(path string) error {
+	key := b.key(path)
+	return redisDeleteScript.Run(b.Context, b.Client, []string{redisMetaKey(key)}, redisNamespace, key).Err()
+}
+
+// GetObjectStream retrieves an object stream from Redis, at prefix
+func (b RedisBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object, err := b.GetObject(path)
+	if err != nil {
+		return &ObjectStream{Metadata: object.Metadata}, err
+	}
+	return &ObjectStream{
+		Metadata: object.Metadata,
+		Content:  ioutil.NopCloser(bytes.NewReader(object.Content)),
+	}, nil
+}
+
+// PutObjectStream uploads an object stream to Redis, at prefix
+// The chunks are written first under a new generation, the object then points to them in a single script
+func (b RedisBackend) PutObjectStream(path string, content io.Reader) error {
+	key := b.key(path)
+	if key == "" {
+		return errors.New("cannot put an object at the root of the backend")
+	}
+	chunkSize := b.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultRedisChunkSize
+	}
+
+	var generation [4]byte
+	rand.Read(generation[:])
+	gen := hex.EncodeToString(generation[:])
+
+	chunks, size := 0, 0
+	cleanup := func() {
+		for i := 0; i < chunks; i++ {
+			b.Client.Del(b.Context, redisChunkKey(key, gen, i))
+		}
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 || chunks == 0 {
+			if err := b.Client.Set(b.Context, redisChunkKey(key, gen, chunks), buf[:n], b.TTL).Err(); err != nil {
+				cleanup()
+				return err
+			}
+			chunks++
+			size += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	err := redisPutScript.Run(b.Context, b.Client, []string{redisMetaKey(key)},
+		redisNamespace, key, gen, chunks, redisMillis(time.Now()), size, b.TTL.Milliseconds()).Err()
+	if err != nil {
+		cleanup()
+	}
+	return redisError(err, key)
+}
+
+func (b RedisBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObject(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, bytes.NewReader(obj.Content))
+}
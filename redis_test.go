@@ -0,0 +1,223 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+)
+
+type RedisTestSuite struct {
+	suite.Suite
+	RedisBackend *RedisBackend
+	Server       *miniredis.Miniredis
+}
+
+func (suite *RedisTestSuite) SetupTest() {
+	suite.Server = miniredis.RunT(suite.T())
+	client := redis.NewClient(&redis.Options{Addr: suite.Server.Addr()})
+	suite.RedisBackend = NewRedisBackendWithClient(client, "unittest")
+	// small chunks so that objects span several strings
+	suite.RedisBackend.ChunkSize = 4
+}
+
+func (suite *RedisTestSuite) TearDownTest() {
+	suite.RedisBackend.Client.Close()
+}
+
+func (suite *RedisTestSuite) TestPutGetDeleteObject() {
+	err := suite.RedisBackend.PutObject("putget/test.txt", []byte("some chunked content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.RedisBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some chunked content"), object.Content, "content matches across chunks")
+	suite.WithinDuration(time.Now(), object.LastModified, time.Minute, "last modified is set")
+
+	err = suite.RedisBackend.PutObject("putget/test.txt", []byte("short"))
+	suite.Nil(err, "no error overwriting object")
+	object, err = suite.RedisBackend.GetObject("putget/test.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("short"), object.Content, "content replaced")
+	suite.Len(suite.Server.Keys(), 6, "chunks of the previous content are deleted")
+
+	err = suite.RedisBackend.PutObject("putget/test.txt/nested", []byte("x"))
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot put an object below an object")
+	err = suite.RedisBackend.PutObject("putget", []byte("x"))
+	suite.Error(err, "cannot put an object over a directory")
+
+	err = suite.RedisBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.RedisBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+	suite.Empty(suite.Server.Keys(), "no keys left behind")
+
+	err = suite.RedisBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "deleting a missing object is not an error")
+
+	suite.Nil(suite.RedisBackend.PutObject("empty.txt", []byte{}))
+	object, err = suite.RedisBackend.GetObject("empty.txt")
+	suite.Nil(err)
+	suite.Empty(object.Content, "empty objects are kept")
+}
+
+func (suite *RedisTestSuite) TestTTL() {
+	suite.Nil(suite.RedisBackend.PutObjectWithTTL("ttl/short.txt", []byte("short lived"), time.Minute))
+	suite.Nil(suite.RedisBackend.PutObjectWithTTL("ttl/long.txt", []byte("long lived"), time.Hour))
+	suite.Nil(suite.RedisBackend.PutObjectWithTTL("scratch/a/b.txt", []byte("scratch"), time.Minute))
+	suite.Nil(suite.RedisBackend.PutObject("kept.txt", []byte("kept")))
+
+	suite.Server.FastForward(2 * time.Minute)
+
+	_, err := suite.RedisBackend.GetObject("ttl/short.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "object expired")
+	object, err := suite.RedisBackend.GetObject("ttl/long.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("long lived"), object.Content, "object not expired yet")
+
+	output, err := suite.RedisBackend.ListObjectsFromDirectory("", 0)
+	suite.ErrorIs(err, io.EOF)
+	suite.Len(output.GetDirectories(), 1, "directories of expired objects are gone")
+	suite.Equal("ttl", output.GetDirectories()[0].Path)
+	suite.Len(output.GetFiles(), 1)
+
+	objects, err := suite.RedisBackend.ListObjects("ttl")
+	suite.Nil(err)
+	suite.Len(objects, 1, "expired objects are not listed")
+
+	suite.Server.FastForward(2 * time.Hour)
+	objects, err = suite.RedisBackend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1, "objects without TTL are kept")
+	suite.Len(suite.Server.Keys(), 4, "only the kept object and its directories are left")
+}
+
+func (suite *RedisTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.RedisBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.RedisBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+}
+
+func (suite *RedisTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.RedisBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.RedisBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.RedisBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.RedisBackend.ListObjectsFromDirectory("dir", 2)
+	for page := 0; ; page++ {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		if page == 0 {
+			// changes before the cursor do not shift the next pages
+			suite.Nil(suite.RedisBackend.DeleteObject("dir/a.txt"))
+			suite.Nil(suite.RedisBackend.PutObject("dir/0.txt", []byte("0")))
+		}
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+}
+
+func (suite *RedisTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.RedisBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.RedisBackend.PutObjectWithTTL("rename/sub/b.txt", []byte("bbbbbbbbbb"), time.Hour))
+	suite.Nil(suite.RedisBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.RedisBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+	err = suite.RedisBackend.RenamePrefixOrObject("rename", "rename/deeper")
+	suite.Error(err, "cannot rename a prefix into itself")
+
+	err = suite.RedisBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.RedisBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("bbbbbbbbbb"), object.Content, "content follows rename")
+	suite.Equal(time.Hour, suite.Server.TTL(redisMetaKey("unittest/renamed/sub/b.txt")), "TTL follows rename")
+	_, err = suite.RedisBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.RedisBackend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.RedisBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.RedisBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	output, err := suite.RedisBackend.ListObjectsFromDirectory("", 0)
+	suite.ErrorIs(err, io.EOF)
+	suite.Len(output.GetDirectories(), 1, "empty directories are removed")
+	suite.Equal("renamed", output.GetDirectories()[0].Path)
+}
+
+func (suite *RedisTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.RedisBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.RedisBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.RedisBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestRedisStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(RedisTestSuite))
+}
@@ -0,0 +1,400 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	microsoft_storage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"google.golang.org/api/googleapi"
+)
+
+// retryableCodes are the error codes of the SDKs for throttling and transient failures of the services
+var retryableCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"TooManyRequests":          true,
+	"TooManyRequestsException": true,
+	"RequestLimitExceeded":     true,
+	"RequestThrottled":         true,
+	"RequestTimeout":           true,
+	"RequestTimeoutException":  true,
+	"InternalError":            true,
+	"ServiceUnavailable":       true,
+	"ServerBusy":               true,
+	"OperationTimedOut":        true,
+	"PriorRequestNotComplete":  true,
+	"RequestError":             true, // connection failures of the AWS SDK
+}
+
+// notFoundCodes are the error codes of the SDKs for missing objects
+var notFoundCodes = map[string]bool{
+	"NoSuchKey":        true,
+	"NotFound":         true,
+	"BlobNotFound":     true,
+	"ResourceNotFound": true,
+}
+
+type (
+	// RetryingBackend is a Backend wrapper retrying the operations which failed with transient errors, with jittered exponential backoff
+	// Renames are not retried, as they are not idempotent, nor are the streams uploaded with PutObjectStream unless they are seekable
+	RetryingBackend struct {
+		Backend Backend
+		// MaxAttempts is the number of attempts of an operation, the first one included
+		MaxAttempts int
+		// BaseDelay is the wait before the first retry, doubled at every retry
+		BaseDelay time.Duration
+		// MaxDelay bounds the wait before a retry
+		MaxDelay time.Duration
+		// BudgetRatio is the number of retries allowed for every operation, 0.1 allowing one retry every ten operations,
+		// so that an outage does not multiply the load on the backend; unbounded if zero or without NewRetryingBackend
+		BudgetRatio float64
+		// BudgetBurst is the number of retries allowed before BudgetRatio applies
+		BudgetBurst float64
+		// IsRetryable reports whether an error is transient, IsRetryableError if nil
+		IsRetryable func(error) bool
+		// OnRetry is called before every retry, e.g. to count them
+		OnRetry func(RetryEvent)
+		budget  *retryBudget
+	}
+
+	// RetryEvent describes a retry of a RetryingBackend
+	RetryEvent struct {
+		// Operation is the name of the method retried
+		Operation string
+		Path      string
+		// Attempt is the number of the attempt which failed, 1 for the first one
+		Attempt int
+		Err     error
+		// Delay is the wait before the retry
+		Delay time.Duration
+	}
+
+	// retryBudget is a token bucket, every operation adds BudgetRatio tokens and every retry takes one
+	retryBudget struct {
+		sync.Mutex
+		tokens float64
+	}
+)
+
+// NewRetryingBackend creates a new instance of RetryingBackend, attempting every operation up to maxAttempts times
+func NewRetryingBackend(backend Backend, maxAttempts int) *RetryingBackend {
+	return &RetryingBackend{
+		Backend:     backend,
+		MaxAttempts: maxAttempts,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		BudgetRatio: 0.1,
+		BudgetBurst: 10,
+		budget:      &retryBudget{tokens: 10},
+	}
+}
+
+// IsRetryableError reports whether an error returned by a backend of this package is transient:
+// throttling, server errors and timeouts of the services, and connection failures
+func IsRetryableError(err error) bool {
+	if err == nil || isObjectNotFound(err) {
+		return false
+	}
+
+	var awsFailure awserr.RequestFailure
+	if errors.As(err, &awsFailure) {
+		return retryableCodes[awsFailure.Code()] || isRetryableStatus(awsFailure.StatusCode()) || IsRetryableError(awsFailure.OrigErr())
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return retryableCodes[awsErr.Code()] || IsRetryableError(awsErr.OrigErr())
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isRetryableStatus(googleErr.Code)
+	}
+	var azureErr microsoft_storage.AzureStorageServiceError
+	if errors.As(err, &azureErr) {
+		return retryableCodes[azureErr.Code] || isRetryableStatus(azureErr.StatusCode)
+	}
+	var ossErr oss.ServiceError
+	if errors.As(err, &ossErr) {
+		return retryableCodes[ossErr.Code] || isRetryableStatus(ossErr.StatusCode)
+	}
+	var cosErr *cos.ErrorResponse
+	if errors.As(err, &cosErr) {
+		return retryableCodes[cosErr.Code] || (cosErr.Response != nil && isRetryableStatus(cosErr.Response.StatusCode))
+	}
+	var obsErr obs.ObsError
+	if errors.As(err, &obsErr) {
+		return retryableCodes[obsErr.Code] || isRetryableStatus(obsErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsNotFoundError reports whether err is a missing object, ErrObjectNotFound, fs.ErrNotExist or a not found error
+// of the SDKs recognized by IsRetryableError, which the backends using them return as is
+func IsNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isObjectNotFound(err) || errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+
+	var awsFailure awserr.RequestFailure
+	if errors.As(err, &awsFailure) {
+		return notFoundCodes[awsFailure.Code()] || awsFailure.StatusCode() == http.StatusNotFound
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return notFoundCodes[awsErr.Code()]
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusNotFound
+	}
+	var azureErr microsoft_storage.AzureStorageServiceError
+	if errors.As(err, &azureErr) {
+		return notFoundCodes[azureErr.Code] || azureErr.StatusCode == http.StatusNotFound
+	}
+	var ossErr oss.ServiceError
+	if errors.As(err, &ossErr) {
+		return notFoundCodes[ossErr.Code] || ossErr.StatusCode == http.StatusNotFound
+	}
+	var cosErr *cos.ErrorResponse
+	if errors.As(err, &cosErr) {
+		return notFoundCodes[cosErr.Code] || (cosErr.Response != nil && cosErr.Response.StatusCode == http.StatusNotFound)
+	}
+	var obsErr obs.ObsError
+	if errors.As(err, &obsErr) {
+		return notFoundCodes[obsErr.Code] || obsErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// spend takes a token for a retry, if any is left
+func (b *retryBudget) spend() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) earn(ratio, burst float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += ratio
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// delay is the wait before the retry following attempt, with full jitter
+func (b RetryingBackend) delay(attempt int) time.Duration {
+	delay := b.BaseDelay << uint(attempt-1)
+	if delay <= 0 || (b.MaxDelay > 0 && delay > b.MaxDelay) {
+		delay = b.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retry runs op until it succeeds, fails with an error which is not transient, or runs out of attempts or budget
+// rewind, if not nil, prepares a retry and may refuse it
+func (b RetryingBackend) retry(operation, path string, rewind func() error, op func() error) error {
+	// a RetryingBackend not created with NewRetryingBackend has no budget
+	budget := b.budget
+	if budget != nil && b.BudgetRatio > 0 {
+		budget.earn(b.BudgetRatio, b.BudgetBurst)
+	}
+	isRetryable := b.IsRetryable
+	if isRetryable == nil {
+		isRetryable = IsRetryableError
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= b.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		if budget != nil && b.BudgetRatio > 0 && !budget.spend() {
+			return err
+		}
+		if rewind != nil {
+			if rewindErr := rewind(); rewindErr != nil {
+				return err
+			}
+		}
+		delay := b.delay(attempt)
+		if b.OnRetry != nil {
+			b.OnRetry(RetryEvent{Operation: operation, Path: path, Attempt: attempt, Err: err, Delay: delay})
+		}
+		time.Sleep(delay)
+	}
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b RetryingBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b RetryingBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix, retrying transient errors
+func (b RetryingBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	err := b.retry("ListObjects", prefix, nil, func() error {
+		var err error
+		objects, err = b.Backend.ListObjects(prefix)
+		return err
+	})
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend, retrying transient errors of the first page
+func (b RetryingBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	var output ListObjectsFromDirectoryOutput
+	var last error
+	err := b.retry("ListObjectsFromDirectory", prefix, nil, func() error {
+		output, last = b.Backend.ListObjectsFromDirectory(prefix, limit)
+		if last == io.EOF {
+			// the only page
+			return nil
+		}
+		return last
+	})
+	if err != nil {
+		return output, err
+	}
+	return output, last
+}
+
+// GetObject retrieves an object from the wrapped backend, retrying transient errors
+func (b RetryingBackend) GetObject(path string) (Object, error) {
+	var object Object
+	err := b.retry("GetObject", path, nil, func() error {
+		var err error
+		object, err = b.Backend.GetObject(path)
+		return err
+	})
+	return object, err
+}
+
+// PutObject uploads an object to the wrapped backend, retrying transient errors
+func (b RetryingBackend) PutObject(path string, content []byte) error {
+	return b.retry("PutObject", path, nil, func() error {
+		return b.Backend.PutObject(path, content)
+	})
+}
+
+// DeleteObject removes an object from the wrapped backend, retrying transient errors
+func (b RetryingBackend) DeleteObject(path string) error {
+	return b.retry("DeleteObject", path, nil, func() error {
+		return b.Backend.DeleteObject(path)
+	})
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend, without retries
+// A rename failing midway may have moved some objects already
+func (b RetryingBackend) RenamePrefixOrObject(path, newPath string) error {
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend, retrying the transient errors of opening it
+func (b RetryingBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	var stream *ObjectStream
+	err := b.retry("GetObjectStream", path, nil, func() error {
+		var err error
+		stream, err = getObjectStream(b.Backend, path)
+		return err
+	})
+	return stream, err
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend
+// Transient errors are retried if the stream is an io.Seeker, rewound to where it started
+func (b RetryingBackend) PutObjectStream(path string, content io.Reader) error {
+	seeker, ok := content.(io.Seeker)
+	if !ok {
+		return putObjectStream(b.Backend, path, content)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return putObjectStream(b.Backend, path, content)
+	}
+	rewind := func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}
+	return b.retry("PutObjectStream", path, rewind, func() error {
+		return putObjectStream(b.Backend, path, content)
+	})
+}
+
+// HandleHttpFileDownload serves an object of the wrapped backend
+// Backends with streams serve it themselves, without retries, as the response is written while the object is read
+func (b RetryingBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	if s, ok := b.Backend.(BackendStream); ok {
+		s.HandleHttpFileDownload(w, r, path)
+		return
+	}
+	object, err := b.GetObject(path)
+	if err != nil {
+		if isObjectNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	serveObject(w, r, object, "")
+}
@@ -0,0 +1,258 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	microsoft_storage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
+	"github.com/stretchr/testify/suite"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"google.golang.org/api/googleapi"
+)
+
+// retryingFlakyBackend fails the calls to its methods with err, as long as failures is positive
+type retryingFlakyBackend struct {
+	BackendStream
+	err      error
+	failures int
+	calls    map[string]int
+	uploads  []string
+}
+
+func (b *retryingFlakyBackend) call(operation string) error {
+	b.calls[operation]++
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return nil
+}
+
+func (b *retryingFlakyBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if err := b.call("ListObjectsFromDirectory"); err != nil {
+		return nil, err
+	}
+	return b.BackendStream.ListObjectsFromDirectory(prefix, limit)
+}
+
+func (b *retryingFlakyBackend) GetObject(path string) (Object, error) {
+	if err := b.call("GetObject"); err != nil {
+		return Object{}, err
+	}
+	return b.BackendStream.GetObject(path)
+}
+
+func (b *retryingFlakyBackend) RenamePrefixOrObject(path, newPath string) error {
+	if err := b.call("RenamePrefixOrObject"); err != nil {
+		return err
+	}
+	return b.BackendStream.RenamePrefixOrObject(path, newPath)
+}
+
+func (b *retryingFlakyBackend) PutObjectStream(path string, content io.Reader) error {
+	data, _ := ioutil.ReadAll(content)
+	b.uploads = append(b.uploads, string(data))
+	if err := b.call("PutObjectStream"); err != nil {
+		return err
+	}
+	return b.BackendStream.PutObject(path, data)
+}
+
+type RetryingTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Flaky         *retryingFlakyBackend
+	Retrying      *RetryingBackend
+	Events        []RetryEvent
+}
+
+func (suite *RetryingTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-retrying/%s", timestamp)
+	suite.Flaky = &retryingFlakyBackend{
+		BackendStream: NewLocalFilesystemBackend(suite.TempDirectory),
+		err:           awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id"),
+		calls:         map[string]int{},
+	}
+	suite.Retrying = NewRetryingBackend(suite.Flaky, 4)
+	suite.Retrying.BaseDelay = time.Millisecond
+	suite.Retrying.MaxDelay = 2 * time.Millisecond
+	suite.Events = nil
+	suite.Retrying.OnRetry = func(event RetryEvent) {
+		suite.Events = append(suite.Events, event)
+	}
+}
+
+func (suite *RetryingTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *RetryingTestSuite) TestIsRetryableError() {
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{awserr.NewRequestFailure(awserr.New("Throttling", "", nil), 400, ""), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{awserr.New("RequestError", "send request failed", syscall.ECONNRESET), true},
+		{awserr.New("NoSuchKey", "", nil), false},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 404}, false},
+		{microsoft_storage.AzureStorageServiceError{Code: "ServerBusy"}, true},
+		{microsoft_storage.AzureStorageServiceError{StatusCode: 403}, false},
+		{oss.ServiceError{Code: "InternalError", StatusCode: 500}, true},
+		{oss.ServiceError{Code: "NoSuchKey", StatusCode: 404}, false},
+		{&cos.ErrorResponse{Response: &http.Response{StatusCode: 502}}, true},
+		{&cos.ErrorResponse{Code: "NoSuchKey", Response: &http.Response{StatusCode: 404}}, false},
+		{obs.ObsError{BaseModel: obs.BaseModel{StatusCode: 503}}, true},
+		{obs.ObsError{BaseModel: obs.BaseModel{StatusCode: 409}}, false},
+		{timeout, true},
+		{fmt.Errorf("reading: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{ErrObjectNotFound, false},
+		{os.ErrNotExist, false},
+		{errors.New("invalid chart"), false},
+	} {
+		suite.Equal(test.retryable, IsRetryableError(test.err), "%T %v", test.err, test.err)
+	}
+	suite.False(IsRetryableError(nil))
+}
+
+func (suite *RetryingTestSuite) TestIsNotFoundError() {
+	for _, test := range []struct {
+		err      error
+		notFound bool
+	}{
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), true},
+		{awserr.NewRequestFailure(awserr.New("NotFound", "", nil), 404, ""), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{awserr.New("NoSuchKey", "", nil), true},
+		{storage.ErrObjectNotExist, true},
+		{fmt.Errorf("reading: %w", storage.ErrObjectNotExist), true},
+		{&googleapi.Error{Code: 404}, true},
+		{&googleapi.Error{Code: 429}, false},
+		{microsoft_storage.AzureStorageServiceError{Code: "BlobNotFound", StatusCode: 404}, true},
+		{microsoft_storage.AzureStorageServiceError{StatusCode: 403}, false},
+		{oss.ServiceError{Code: "NoSuchKey", StatusCode: 404}, true},
+		{&cos.ErrorResponse{Code: "NoSuchKey", Response: &http.Response{StatusCode: 404}}, true},
+		{&cos.ErrorResponse{Response: &http.Response{StatusCode: 502}}, false},
+		{obs.ObsError{BaseModel: obs.BaseModel{StatusCode: 404}}, true},
+		{ErrObjectNotFound, true},
+		{os.ErrNotExist, true},
+		{syscall.ECONNRESET, false},
+		{errors.New("invalid chart"), false},
+	} {
+		suite.Equal(test.notFound, IsNotFoundError(test.err), "%T %v", test.err, test.err)
+	}
+	suite.False(IsNotFoundError(nil))
+}
+
+func (suite *RetryingTestSuite) TestRetries() {
+	suite.Nil(suite.Flaky.PutObject("retried.txt", []byte("content")))
+
+	suite.Flaky.failures = 2
+	object, err := suite.Retrying.GetObject("retried.txt")
+	suite.Nil(err, "transient errors are retried")
+	suite.Equal([]byte("content"), object.Content)
+	suite.Equal(3, suite.Flaky.calls["GetObject"])
+	suite.Len(suite.Events, 2, "retries are reported")
+	suite.Equal("GetObject", suite.Events[1].Operation)
+	suite.Equal("retried.txt", suite.Events[1].Path)
+	suite.Equal(2, suite.Events[1].Attempt)
+	suite.Equal(suite.Flaky.err, suite.Events[1].Err)
+	suite.True(suite.Events[1].Delay <= suite.Retrying.MaxDelay, "delays are bounded")
+
+	suite.Flaky.failures = 10
+	_, err = suite.Retrying.GetObject("retried.txt")
+	suite.Equal(suite.Flaky.err, err, "the last error is returned once attempts are exhausted")
+	suite.Equal(7, suite.Flaky.calls["GetObject"])
+
+	suite.Flaky.failures = 1
+	output, err := suite.Retrying.ListObjectsFromDirectory("", 0)
+	suite.Equal(io.EOF, err, "the last page is reported")
+	suite.Len(output.GetFiles(), 1)
+	suite.Equal(2, suite.Flaky.calls["ListObjectsFromDirectory"])
+}
+
+func (suite *RetryingTestSuite) TestNoRetries() {
+	suite.Flaky.err = ErrObjectNotFound
+	suite.Flaky.failures = 2
+	_, err := suite.Retrying.GetObject("missing.txt")
+	suite.Equal(ErrObjectNotFound, err)
+	suite.Equal(1, suite.Flaky.calls["GetObject"], "permanent errors are not retried")
+
+	suite.Flaky.err = syscall.ECONNRESET
+	suite.Flaky.failures = 1
+	suite.Equal(syscall.ECONNRESET, suite.Retrying.RenamePrefixOrObject("a.txt", "b.txt"))
+	suite.Equal(1, suite.Flaky.calls["RenamePrefixOrObject"], "renames are not retried")
+	suite.Empty(suite.Events)
+}
+
+func (suite *RetryingTestSuite) TestPutObjectStream() {
+	suite.Flaky.failures = 1
+	content := bytes.NewReader([]byte("seekable"))
+	suite.Nil(suite.Retrying.PutObjectStream("seekable.txt", content), "seekable streams are retried")
+	suite.Equal([]string{"seekable", "seekable"}, suite.Flaky.uploads, "streams are rewound")
+	object, err := suite.Flaky.GetObject("seekable.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("seekable"), object.Content)
+
+	suite.Flaky.uploads = nil
+	suite.Flaky.failures = 1
+	err = suite.Retrying.PutObjectStream("stream.txt", io.MultiReader(bytes.NewReader([]byte("stream"))))
+	suite.Equal(suite.Flaky.err, err, "other streams are not retried")
+	suite.Equal([]string{"stream"}, suite.Flaky.uploads)
+}
+
+func (suite *RetryingTestSuite) TestBudget() {
+	suite.Retrying.MaxAttempts = 10
+	suite.Retrying.BudgetRatio = 0.5
+	suite.Retrying.BudgetBurst = 2
+
+	suite.Flaky.failures = 100
+	_, err := suite.Retrying.GetObject("budget.txt")
+	suite.NotNil(err)
+	suite.Equal(3, suite.Flaky.calls["GetObject"], "retries stop when the budget is spent")
+
+	_, err = suite.Retrying.GetObject("budget.txt")
+	suite.NotNil(err)
+	suite.Equal(4, suite.Flaky.calls["GetObject"], "operations earn a fraction of a retry")
+	_, err = suite.Retrying.GetObject("budget.txt")
+	suite.NotNil(err)
+	suite.Equal(6, suite.Flaky.calls["GetObject"])
+}
+
+func TestRetryingStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryingTestSuite))
+}
@@ -0,0 +1,218 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	pathutil "path"
+	"strings"
+)
+
+// ErrOutsideScope is returned for the paths of a ScopedBackend which would escape its prefix
+var ErrOutsideScope = errors.New("path is outside of the scope")
+
+type (
+	// ScopedBackend is a Backend wrapper confining every path to Prefix in the wrapped backend, e.g. one per tenant of a bucket
+	// Paths are relative to Prefix, in the arguments and in the returned metadata; paths with .. segments are rejected
+	ScopedBackend struct {
+		Backend Backend
+		Prefix  string
+	}
+
+	// scopedListOutput strips the prefix of a ScopedBackend from the paths of a listing
+	scopedListOutput struct {
+		ListObjectsFromDirectoryOutput
+		backend ScopedBackend
+	}
+)
+
+// NewScopedBackend creates a new instance of ScopedBackend, confined to prefix in backend
+func NewScopedBackend(backend Backend, prefix string) *ScopedBackend {
+	prefix = cleanPrefix(prefix)
+	if hasDotDotSegment(prefix) {
+		panic("Invalid scope prefix: " + prefix)
+	}
+	return &ScopedBackend{
+		Backend: backend,
+		Prefix:  prefix,
+	}
+}
+
+func hasDotDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the path in the wrapped backend of a path of the scope
+func (b ScopedBackend) resolve(path string) (string, error) {
+	if hasDotDotSegment(path) {
+		return "", ErrOutsideScope
+	}
+	return pathutil.Join(b.Prefix, cleanPrefix(path)), nil
+}
+
+// strip returns the path in the scope of a path of the wrapped backend
+func (b ScopedBackend) strip(path string) string {
+	if b.Prefix == "" {
+		return path
+	}
+	if path == b.Prefix {
+		return ""
+	}
+	return strings.TrimPrefix(path, b.Prefix+"/")
+}
+
+func (b ScopedBackend) stripAll(metadata []Metadata) []Metadata {
+	if metadata == nil {
+		return nil
+	}
+	stripped := make([]Metadata, len(metadata))
+	for i, m := range metadata {
+		m.Path = b.strip(m.Path)
+		stripped[i] = m
+	}
+	return stripped
+}
+
+func (o scopedListOutput) GetDirectories() []Metadata {
+	return o.backend.stripAll(o.ListObjectsFromDirectoryOutput.GetDirectories())
+}
+
+func (o scopedListOutput) GetFiles() []Metadata {
+	return o.backend.stripAll(o.ListObjectsFromDirectoryOutput.GetFiles())
+}
+
+func (o scopedListOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	output, err := o.ListObjectsFromDirectoryOutput.NextPage()
+	if output == nil {
+		return output, err
+	}
+	return scopedListOutput{ListObjectsFromDirectoryOutput: output, backend: o.backend}, err
+}
+
+// BackendContext returns the context of the requests of the wrapped backend
+func (b ScopedBackend) BackendContext() context.Context {
+	return backendContext(b.Backend)
+}
+
+// WithBackendContext returns a copy of the backend whose wrapped backend makes its requests with ctx
+func (b ScopedBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Backend = withBackendContext(b.Backend, ctx)
+	return &b
+}
+
+// ListObjects lists all objects at prefix in the scope, with their paths relative to prefix
+func (b ScopedBackend) ListObjects(prefix string) ([]Object, error) {
+	resolved, err := b.resolve(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return b.Backend.ListObjects(resolved)
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the scope
+func (b ScopedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	resolved, err := b.resolve(prefix)
+	if err != nil {
+		return nil, err
+	}
+	output, err := b.Backend.ListObjectsFromDirectory(resolved, limit)
+	if output == nil {
+		return output, err
+	}
+	return scopedListOutput{ListObjectsFromDirectoryOutput: output, backend: b}, err
+}
+
+// GetObject retrieves an object in the scope
+func (b ScopedBackend) GetObject(path string) (Object, error) {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return Object{Metadata: Metadata{Path: path}}, err
+	}
+	object, err := b.Backend.GetObject(resolved)
+	object.Path = b.strip(object.Path)
+	return object, err
+}
+
+// PutObject uploads an object in the scope
+func (b ScopedBackend) PutObject(path string, content []byte) error {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return err
+	}
+	return b.Backend.PutObject(resolved, content)
+}
+
+// DeleteObject removes an object in the scope
+func (b ScopedBackend) DeleteObject(path string) error {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return err
+	}
+	return b.Backend.DeleteObject(resolved)
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the scope, both paths being confined to it
+func (b ScopedBackend) RenamePrefixOrObject(path, newPath string) error {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return err
+	}
+	resolvedNewPath, err := b.resolve(newPath)
+	if err != nil {
+		return err
+	}
+	return b.Backend.RenamePrefixOrObject(resolved, resolvedNewPath)
+}
+
+// GetObjectStream retrieves an object stream in the scope
+func (b ScopedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return &ObjectStream{Metadata: Metadata{Path: path}}, err
+	}
+	stream, err := getObjectStream(b.Backend, resolved)
+	if stream != nil {
+		stream.Path = b.strip(stream.Path)
+	}
+	return stream, err
+}
+
+// PutObjectStream uploads an object stream in the scope
+func (b ScopedBackend) PutObjectStream(path string, content io.Reader) error {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		return err
+	}
+	return putObjectStream(b.Backend, resolved, content)
+}
+
+func (b ScopedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	resolved, err := b.resolve(path)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	handleHttpFileDownload(b.Backend, w, r, resolved)
+}
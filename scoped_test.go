@@ -0,0 +1,161 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ScopedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	Scoped        *ScopedBackend
+}
+
+func (suite *ScopedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-scoped/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.Scoped = NewScopedBackend(suite.Local, "/tenants/acme/")
+	suite.Nil(suite.Local.PutObject("tenants/other/index.yaml", []byte("other")))
+}
+
+func (suite *ScopedTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *ScopedTestSuite) TestConfinement() {
+	suite.Equal("tenants/acme", suite.Scoped.Prefix)
+	suite.Nil(suite.Scoped.PutObject("index.yaml", []byte("acme")))
+	stored, err := suite.Local.GetObject("tenants/acme/index.yaml")
+	suite.Nil(err, "paths are confined to the prefix")
+	suite.Equal([]byte("acme"), stored.Content)
+
+	object, err := suite.Scoped.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal("index.yaml", object.Path, "the prefix is stripped from the metadata")
+	suite.Equal([]byte("acme"), object.Content)
+
+	suite.Nil(suite.Scoped.PutObjectStream("charts/mychart-0.1.0.tgz", strings.NewReader("chart")))
+	stream, err := suite.Scoped.GetObjectStream("charts/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Equal("charts/mychart-0.1.0.tgz", stream.Path)
+	content, _ := ioutil.ReadAll(stream.Content)
+	stream.Content.Close()
+	suite.Equal("chart", string(content))
+
+	suite.Nil(suite.Scoped.RenamePrefixOrObject("charts", "archive"))
+	_, err = suite.Local.GetObject("tenants/acme/archive/mychart-0.1.0.tgz")
+	suite.Nil(err, "rename targets are confined to the prefix")
+
+	objects, err := suite.Scoped.ListObjects("archive")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("mychart-0.1.0.tgz", objects[0].Path)
+
+	suite.Nil(suite.Scoped.DeleteObject("index.yaml"))
+	_, err = suite.Local.GetObject("tenants/acme/index.yaml")
+	suite.NotNil(err)
+	_, err = suite.Local.GetObject("tenants/other/index.yaml")
+	suite.Nil(err, "other scopes are untouched")
+}
+
+func (suite *ScopedTestSuite) TestListObjectsFromDirectory() {
+	for _, path := range []string{"a.txt", "b.txt", "c.txt", "sub/d.txt"} {
+		suite.Nil(suite.Scoped.PutObject(path, []byte(path)))
+	}
+
+	var directories, files []string
+	output, err := suite.Scoped.ListObjectsFromDirectory("", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.ElementsMatch([]string{"sub"}, directories, "the prefix is stripped from the listings")
+	suite.ElementsMatch([]string{"a.txt", "b.txt", "c.txt"}, files)
+
+	output, err = suite.Scoped.ListObjectsFromDirectory("sub", 0)
+	for err != io.EOF {
+		suite.Nil(err)
+		suite.Equal("sub/d.txt", output.GetFiles()[0].Path)
+		output, err = output.NextPage()
+	}
+}
+
+func (suite *ScopedTestSuite) TestEscapes() {
+	for _, path := range []string{"..", "../other/index.yaml", "charts/../../other/index.yaml", "/../other"} {
+		_, err := suite.Scoped.GetObject(path)
+		suite.Equal(ErrOutsideScope, err, "%s is rejected", path)
+		suite.Equal(ErrOutsideScope, suite.Scoped.PutObject(path, []byte("x")))
+		suite.Equal(ErrOutsideScope, suite.Scoped.DeleteObject(path))
+		suite.Equal(ErrOutsideScope, suite.Scoped.RenamePrefixOrObject("index.yaml", path), "%s is rejected as rename target", path)
+		suite.Equal(ErrOutsideScope, suite.Scoped.RenamePrefixOrObject(path, "stolen"))
+		_, err = suite.Scoped.ListObjects(path)
+		suite.Equal(ErrOutsideScope, err)
+		_, err = suite.Scoped.ListObjectsFromDirectory(path, 0)
+		suite.Equal(ErrOutsideScope, err)
+		_, err = suite.Scoped.GetObjectStream(path)
+		suite.Equal(ErrOutsideScope, err)
+		suite.Equal(ErrOutsideScope, suite.Scoped.PutObjectStream(path, strings.NewReader("x")))
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	suite.Scoped.HandleHttpFileDownload(w, r, "../other/index.yaml")
+	suite.Equal(http.StatusBadRequest, w.Code)
+
+	object, err := suite.Local.GetObject("tenants/other/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("other"), object.Content, "nothing escaped")
+
+	suite.Panics(func() {
+		NewScopedBackend(suite.Local, "tenants/../..")
+	})
+}
+
+func (suite *ScopedTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.Scoped.PutObject("index.yaml", []byte("acme")))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	suite.Scoped.HandleHttpFileDownload(w, r, "index.yaml")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("acme", w.Body.String())
+}
+
+func TestScopedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(ScopedTestSuite))
+}
@@ -0,0 +1,422 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type sftpListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []os.FileInfo
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &sftpListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the sftp client reads the whole directory at once, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.Name()),
+			LastModified: e.ModTime(),
+		}
+		if e.IsDir() {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *sftpListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// SFTPBackend is a storage backend for SFTP servers
+type SFTPBackend struct {
+	Client        *sftp.Client
+	SSHClient     *ssh.Client
+	RootDirectory string
+}
+
+// NewSFTPBackend creates a new instance of SFTPBackend
+// Authentication is taken from the environment: SFTP_PRIVATE_KEY_FILE (and SFTP_PRIVATE_KEY_PASSPHRASE),
+// SFTP_PASSWORD, or the ssh-agent at SSH_AUTH_SOCK, in that order of preference
+// The server host key is verified against SFTP_KNOWN_HOSTS_FILE, which defaults to ~/.ssh/known_hosts
+func NewSFTPBackend(address string, user string, rootDirectory string) *SFTPBackend {
+	var auths []ssh.AuthMethod
+
+	if keyFile := os.Getenv("SFTP_PRIVATE_KEY_FILE"); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			panic("Failed to read SFTP private key: " + err.Error())
+		}
+		var signer ssh.Signer
+		if passphrase := os.Getenv("SFTP_PRIVATE_KEY_PASSPHRASE"); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			panic("Failed to parse SFTP private key: " + err.Error())
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		auths = append(auths, ssh.Password(password))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			panic("Failed to connect to ssh-agent: " + err.Error())
+		}
+		auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(auths) == 0 {
+		panic("Either the SFTP_PRIVATE_KEY_FILE, SFTP_PASSWORD or SSH_AUTH_SOCK environment variable must be set")
+	}
+
+	knownHostsFile := os.Getenv("SFTP_KNOWN_HOSTS_FILE")
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			panic(err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		panic("Failed to load known_hosts: " + err.Error())
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	return NewSFTPBackendWithConfig(address, config, rootDirectory)
+}
+
+// NewSFTPBackendWithConfig creates a new instance of SFTPBackend with an ssh client configuration
+func NewSFTPBackendWithConfig(address string, config *ssh.ClientConfig, rootDirectory string) *SFTPBackend {
+	conn, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		panic("Failed to connect to SFTP server: " + err.Error())
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		panic("Failed to start SFTP session: " + err.Error())
+	}
+
+	if rootDirectory == "" {
+		rootDirectory = "."
+	}
+
+	b := &SFTPBackend{
+		Client:        client,
+		SSHClient:     conn,
+		RootDirectory: pathutil.Clean(rootDirectory),
+	}
+	return b
+}
+
+// Close ends the SFTP session and the underlying SSH connection
+func (b SFTPBackend) Close() error {
+	err := b.Client.Close()
+	if b.SSHClient != nil {
+		if err2 := b.SSHClient.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// ListObjects lists all objects in root directory (depth 1)
+func (b SFTPBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	files, err := b.Client.ReadDir(pathutil.Join(b.RootDirectory, prefix))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) { // OK if the directory doesnt exist yet
+			err = nil
+		}
+		return objects, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         f.Name(),
+				LastModified: f.ModTime(),
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b SFTPBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	output := &sftpListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+
+	fullPath := pathutil.Join(b.RootDirectory, prefix)
+	fi, err := b.Client.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			output.isEOF = true
+			return output, nil
+		}
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, ErrPrefixIsAnObject
+	}
+
+	output.entries, err = b.Client.ReadDir(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return output.NextPage()
+}
+
+func (b SFTPBackend) RenamePrefixOrObject(path, newPath string) error {
+	fullPath := pathutil.Join(b.RootDirectory, path)
+	fullNewPath := pathutil.Join(b.RootDirectory, newPath)
+
+	// check if newPath is already occupied
+	_, err := b.Client.Stat(fullNewPath)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return ErrNewPathNotEmpty
+	}
+
+	// check if source path exists
+	// ignore if not
+	_, err = b.Client.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// create parent folder if not exists
+	err = b.Client.MkdirAll(pathutil.Dir(fullNewPath))
+	if err != nil {
+		return err
+	}
+
+	return b.Client.Rename(fullPath, fullNewPath)
+}
+
+// GetObject retrieves an object from root directory
+func (b SFTPBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject puts an object in root directory
+func (b SFTPBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from root directory
+func (b SFTPBackend) DeleteObject(path string) error {
+	fullpath := pathutil.Join(b.RootDirectory, path)
+	err := b.Client.Remove(fullpath)
+	parentpath := fullpath
+
+	var err2 error
+	for err2 == nil {
+		// if it succeeded to remove the object, try to remove the parent folder too
+		// same as LocalFilesystemBackend, so empty folders don't linger around on the server
+		// RemoveDirectory errors out if the folder isn't empty, which ends the loop
+
+		parentpath = pathutil.Dir(parentpath)
+
+		// checks if the path isn't one of the paths returned by Dir ('.' or '/')
+		// and if it isn't the root directory
+		if len(parentpath) > 1 && parentpath != b.RootDirectory {
+			err2 = b.Client.RemoveDirectory(parentpath)
+		} else {
+			break
+		}
+	}
+
+	return err
+}
+
+// GetObjectStream retrieves an object stream from root directory
+func (b SFTPBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+	fullpath := pathutil.Join(b.RootDirectory, path)
+	content, err := b.Client.Open(fullpath)
+	if err != nil {
+		return object, err
+	}
+	info, err := content.Stat()
+	if err != nil {
+		content.Close()
+		return object, err
+	}
+	if info.IsDir() {
+		content.Close()
+		return object, errors.New("path must lead to a file, found directory")
+	}
+	object.Content = content
+	object.LastModified = info.ModTime()
+	return object, nil
+}
+
+// PutObjectStream puts an object stream in root directory
+func (b SFTPBackend) PutObjectStream(path string, content io.Reader) error {
+	fullpath := pathutil.Join(b.RootDirectory, path)
+	err := b.Client.MkdirAll(pathutil.Dir(fullpath))
+	if err != nil {
+		return err
+	}
+
+	fp, err := b.Client.Create(fullpath)
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.ReadFrom(content)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
+
+func (b SFTPBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer obj.Content.Close()
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, obj.Content.(io.ReadSeeker))
+}
@@ -0,0 +1,283 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPTestSuite struct {
+	suite.Suite
+	Listener      net.Listener
+	SFTPBackend   *SFTPBackend
+	TempDirectory string
+	HostKey       ssh.Signer
+	UserKey       ssh.Signer
+}
+
+func newTestSigner() ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return signer
+}
+
+// serveSFTP accepts ssh connections and serves the sftp subsystem over them
+func (suite *SFTPTestSuite) serveSFTP() {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "chartmuseum" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("password rejected")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), suite.UserKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("key rejected")
+		},
+	}
+	config.AddHostKey(suite.HostKey)
+
+	for {
+		nConn, err := suite.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func(in <-chan *ssh.Request) {
+					for req := range in {
+						req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+					}
+				}(requests)
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					continue
+				}
+				go func() {
+					server.Serve()
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func (suite *SFTPTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	tempDirectory, err := filepath.Abs(fmt.Sprintf("../../.test/storage-sftp/%s", timestamp))
+	suite.Nil(err)
+	suite.TempDirectory = tempDirectory
+	suite.Nil(os.MkdirAll(filepath.Join(suite.TempDirectory, "root"), 0777))
+
+	suite.HostKey = newTestSigner()
+	suite.UserKey = newTestSigner()
+
+	suite.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	suite.Nil(err)
+	go suite.serveSFTP()
+
+	address := suite.Listener.Addr().String()
+	knownHostsFile := filepath.Join(suite.TempDirectory, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, suite.HostKey.PublicKey())
+	suite.Nil(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	os.Setenv("SFTP_PASSWORD", "secret")
+	os.Setenv("SFTP_KNOWN_HOSTS_FILE", knownHostsFile)
+	os.Unsetenv("SFTP_PRIVATE_KEY_FILE")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Unsetenv("SFTP_PASSWORD")
+	defer os.Unsetenv("SFTP_KNOWN_HOSTS_FILE")
+
+	suite.SFTPBackend = NewSFTPBackend(address, "chartmuseum", filepath.Join(suite.TempDirectory, "root"))
+}
+
+func (suite *SFTPTestSuite) TearDownSuite() {
+	suite.SFTPBackend.Close()
+	suite.Listener.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *SFTPTestSuite) TestUnknownHostKeyIsRejected() {
+	knownHostsFile := filepath.Join(suite.TempDirectory, "other_known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(suite.Listener.Addr().String())}, newTestSigner().PublicKey())
+	suite.Nil(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	os.Setenv("SFTP_PASSWORD", "secret")
+	os.Setenv("SFTP_KNOWN_HOSTS_FILE", knownHostsFile)
+	defer os.Unsetenv("SFTP_PASSWORD")
+	defer os.Unsetenv("SFTP_KNOWN_HOSTS_FILE")
+
+	suite.Panics(func() {
+		NewSFTPBackend(suite.Listener.Addr().String(), "chartmuseum", "")
+	}, "host key mismatch is rejected")
+}
+
+func (suite *SFTPTestSuite) TestPublicKeyAuth() {
+	config := &ssh.ClientConfig{
+		User:            "chartmuseum",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(suite.UserKey)},
+		HostKeyCallback: ssh.FixedHostKey(suite.HostKey.PublicKey()),
+	}
+	backend := NewSFTPBackendWithConfig(suite.Listener.Addr().String(), config, filepath.Join(suite.TempDirectory, "root"))
+	defer backend.Close()
+
+	_, err := backend.ListObjects("")
+	suite.Nil(err, "can list objects with key auth")
+}
+
+func (suite *SFTPTestSuite) TestPutGetDeleteObject() {
+	err := suite.SFTPBackend.PutObject("a/b/c/test.txt", []byte("some content"))
+	suite.Nil(err, "no error putting object in missing directories")
+
+	object, err := suite.SFTPBackend.GetObject("a/b/c/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content)
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	err = suite.SFTPBackend.DeleteObject("a/b/c/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = os.Stat(filepath.Join(suite.TempDirectory, "root", "a"))
+	suite.True(os.IsNotExist(err), "empty parent directories are pruned")
+	_, err = os.Stat(filepath.Join(suite.TempDirectory, "root"))
+	suite.Nil(err, "root directory is kept")
+
+	_, err = suite.SFTPBackend.GetObject("a/b/c/test.txt")
+	suite.NotNil(err, "cannot get deleted object")
+}
+
+func (suite *SFTPTestSuite) TestListObjects() {
+	objects, err := suite.SFTPBackend.ListObjects("does-not-exist")
+	suite.Nil(err, "list objects does not return error if dir does not exist")
+	suite.Empty(objects)
+
+	suite.Nil(suite.SFTPBackend.PutObject("list/a.txt", []byte("a")))
+	suite.Nil(suite.SFTPBackend.PutObject("list/nested/b.txt", []byte("b")))
+
+	objects, err = suite.SFTPBackend.ListObjects("list")
+	suite.Nil(err)
+	suite.Len(objects, 1, "directories are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+
+	suite.Nil(suite.SFTPBackend.DeleteObject("list/a.txt"))
+	suite.Nil(suite.SFTPBackend.DeleteObject("list/nested/b.txt"))
+}
+
+func (suite *SFTPTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/c.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.SFTPBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.SFTPBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject)
+
+	count := 0
+	output, err := suite.SFTPBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		count += len(output.GetDirectories()) + len(output.GetFiles())
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.Equal(3, count, "all entries listed")
+
+	for _, path := range paths {
+		suite.Nil(suite.SFTPBackend.DeleteObject(path))
+	}
+}
+
+func (suite *SFTPTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.SFTPBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.SFTPBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.SFTPBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty)
+
+	err = suite.SFTPBackend.RenamePrefixOrObject("rename", "new/parent/renamed")
+	suite.Nil(err, "no error renaming into missing parents")
+	object, err := suite.SFTPBackend.GetObject("new/parent/renamed/a.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.SFTPBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	suite.Nil(suite.SFTPBackend.DeleteObject("new/parent/renamed/a.txt"))
+	suite.Nil(suite.SFTPBackend.DeleteObject("occupied.txt"))
+}
+
+func (suite *SFTPTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.SFTPBackend.PutObject("download.txt", []byte("downloadable")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	suite.SFTPBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("downloadable", w.Body.String())
+
+	w = httptest.NewRecorder()
+	suite.SFTPBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.SFTPBackend.DeleteObject("download.txt"))
+}
+
+func TestSFTPStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(SFTPTestSuite))
+}
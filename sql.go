@@ -0,0 +1,726 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSQLChunkSize = 1024 * 1024
+
+var sqlTableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlMigrations are applied in order by Migrate, each one exactly once
+// %[1]s is the table name, %[2]s the binary column type and %[3]s the collation clause of the path column
+var sqlMigrations = []string{
+	`CREATE TABLE %[1]s (
+		path TEXT %[3]s NOT NULL PRIMARY KEY,
+		object_id TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		mtime BIGINT NOT NULL,
+		metadata TEXT NOT NULL
+	)`,
+	`CREATE TABLE %[1]s_chunks (
+		object_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		data %[2]s NOT NULL,
+		PRIMARY KEY (object_id, seq)
+	)`,
+}
+
+type sqlListObjectsFromDirectoryOutput struct {
+	backend         *SQLBackend
+	prefix          string
+	limit           int
+	startKey        string
+	startExclusive  bool
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &sqlListObjectsFromDirectoryOutput{
+		backend: l.backend,
+		prefix:  l.prefix,
+		limit:   l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	dirKey := l.backend.key(l.prefix)
+	if dirKey != "" {
+		dirKey += "/"
+	}
+	endKey := sqlPrefixRangeEnd(dirKey)
+	startKey, startExclusive := l.startKey, l.startExclusive
+	if startKey == "" {
+		startKey = dirKey
+	}
+
+	// there is no delimiter in SQL, so directories are found by walking the index
+	// and jumping past every path below a directory once it has been seen
+	for !l.backend.pastRange(startKey, endKey) && (l.limit <= 0 || len(r.directoriesRead)+len(r.filesRead) < l.limit) {
+		batch := 1000
+		if l.limit > 0 && l.limit-len(r.directoriesRead)-len(r.filesRead) < batch {
+			batch = l.limit - len(r.directoriesRead) - len(r.filesRead)
+		}
+
+		query, args := l.backend.rangeQuery("path, mtime", startKey, startExclusive, endKey)
+		rows, err := l.backend.DB.Query(query+" LIMIT "+strconv.Itoa(batch), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		skipped := false
+		for rows.Next() && !skipped {
+			var key string
+			var mtime int64
+			if err := rows.Scan(&key, &mtime); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			n++
+
+			name := strings.TrimPrefix(key, dirKey)
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[:i]
+				r.directoriesRead = append(r.directoriesRead, Metadata{
+					Path: pathutil.Join(l.prefix, name),
+				})
+				startKey, startExclusive = sqlPrefixRangeEnd(dirKey+name+"/"), false
+				// restart the query after the directory
+				skipped = true
+				continue
+			}
+
+			r.filesRead = append(r.filesRead, Metadata{
+				Path:         pathutil.Join(l.prefix, name),
+				LastModified: time.Unix(0, mtime),
+			})
+			startKey, startExclusive = key, true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if !skipped && n < batch {
+			startKey = endKey
+			if endKey == "" {
+				r.isEOF = true
+			}
+			break
+		}
+	}
+
+	r.startKey, r.startExclusive = startKey, startExclusive
+	r.isEOF = r.isEOF || (endKey != "" && startKey >= endKey)
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *sqlListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// sqlObjectReader reads the chunks of an object lazily
+type sqlObjectReader struct {
+	backend   *SQLBackend
+	objectID  string
+	size      int64
+	chunkSize int64
+	offset    int64
+	chunk     []byte
+	index     int64
+}
+
+func (r *sqlObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / r.chunkSize
+	if r.chunk == nil || r.index != index {
+		query := r.backend.rebind(fmt.Sprintf("SELECT data FROM %s_chunks WHERE object_id = ? AND seq = ?", r.backend.Table))
+		err := r.backend.DB.QueryRow(query, r.objectID, index).Scan(&r.chunk)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				err = fmt.Errorf("chunk %d of object %s is missing", index, r.objectID)
+			}
+			return 0, err
+		}
+		r.index = index
+	}
+
+	n := copy(p, r.chunk[r.offset-index*r.chunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *sqlObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = abs
+	return abs, nil
+}
+
+func (r *sqlObjectReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// SQLBackend is a storage backend for SQL databases, through database/sql
+// SQLite and PostgreSQL are supported; objects live in Table and their content, split in chunks, in Table_chunks
+type SQLBackend struct {
+	DB        *sql.DB
+	Table     string
+	Prefix    string
+	Postgres  bool
+	ChunkSize int
+}
+
+// NewSQLBackend creates a new instance of SQLBackend, migrating the schema if needed
+// driverName must be registered by the caller, e.g. by importing modernc.org/sqlite or github.com/lib/pq
+func NewSQLBackend(driverName string, dataSourceName string, table string, prefix string) *SQLBackend {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		panic("Failed to open database: " + err.Error())
+	}
+
+	b := NewSQLBackendWithDB(db, driverName == "postgres" || driverName == "pgx", table, prefix)
+	if err := b.Migrate(); err != nil {
+		panic("Failed to migrate database: " + err.Error())
+	}
+	return b
+}
+
+// NewSQLBackendWithDB creates a new instance of SQLBackend with an existing database handle
+// The schema is not migrated, call Migrate before using it
+func NewSQLBackendWithDB(db *sql.DB, postgres bool, table string, prefix string) *SQLBackend {
+	if table == "" {
+		table = "objects"
+	}
+	if !sqlTableNameRegexp.MatchString(table) {
+		panic("Invalid table name: " + table)
+	}
+
+	b := &SQLBackend{
+		DB:        db,
+		Table:     table,
+		Prefix:    cleanPrefix(prefix),
+		Postgres:  postgres,
+		ChunkSize: defaultSQLChunkSize,
+	}
+	return b
+}
+
+// Migrate brings the schema up to date, recording the applied version in Table_schema
+func (b SQLBackend) Migrate() error {
+	_, err := b.DB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_schema (version INTEGER NOT NULL)", b.Table))
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow(fmt.Sprintf("SELECT version FROM %s_schema", b.Table)).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s_schema (version) VALUES (0)", b.Table))
+	}
+	if err != nil {
+		return err
+	}
+
+	binaryType, collation := "BLOB", ""
+	if b.Postgres {
+		// byte-wise ordering, so that prefix ranges can use the primary key index
+		binaryType, collation = "BYTEA", `COLLATE "C"`
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		_, err = tx.Exec(fmt.Sprintf(sqlMigrations[version], b.Table, binaryType, collation))
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+
+	_, err = tx.Exec(b.rebind(fmt.Sprintf("UPDATE %s_schema SET version = ?", b.Table)), version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind replaces ? placeholders with $n for PostgreSQL
+func (b SQLBackend) rebind(query string) string {
+	if !b.Postgres {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+func (b SQLBackend) key(path string) string {
+	return cleanPrefix(pathutil.Join(b.Prefix, path))
+}
+
+// sqlPrefixRangeEnd returns the smallest key greater than every key starting with prefix
+// an empty result means the range is unbounded
+func sqlPrefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0x7f {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// collate is the collation clause of the comparisons of paths, byte-wise like Go strings and sqlPrefixRangeEnd
+// SQLite compares TEXT byte-wise by default, PostgreSQL is told to whatever the collation of the column
+func (b SQLBackend) collate() string {
+	if b.Postgres {
+		return ` COLLATE "C"`
+	}
+	return ""
+}
+
+func (b SQLBackend) pastRange(key string, end string) bool {
+	return end != "" && key >= end
+}
+
+// rangeQuery selects columns of the objects whose path is in [start, end), or (start, end) if exclusive, in path order
+func (b SQLBackend) rangeQuery(columns string, start string, exclusive bool, end string) (string, []interface{}) {
+	operator := ">="
+	if exclusive {
+		operator = ">"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE path %s ?%s", columns, b.Table, operator, b.collate())
+	args := []interface{}{start}
+	if end != "" {
+		query += " AND path < ?" + b.collate()
+		args = append(args, end)
+	}
+	return b.rebind(query + " ORDER BY path" + b.collate()), args
+}
+
+// ListObjects lists all objects in SQL table, at prefix
+func (b SQLBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	dirKey := b.key(prefix)
+	if dirKey != "" {
+		dirKey += "/"
+	}
+	query, args := b.rangeQuery("path, mtime", dirKey, false, sqlPrefixRangeEnd(dirKey))
+	rows, err := b.DB.Query(query, args...)
+	if err != nil {
+		return objects, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var mtime int64
+		if err := rows.Scan(&key, &mtime); err != nil {
+			return objects, err
+		}
+		path := strings.TrimPrefix(key, dirKey)
+		if objectPathIsInvalid(path) {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         path,
+				LastModified: time.Unix(0, mtime),
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b SQLBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	if key := b.key(prefix); key != "" {
+		var count int
+		err := b.DB.QueryRow(b.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE path = ?", b.Table)), key).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrPrefixIsAnObject
+		}
+	}
+
+	output := &sqlListObjectsFromDirectoryOutput{
+		prefix:  prefix,
+		limit:   limit,
+		backend: &b,
+	}
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves an object, or every object under a prefix, to newPath in a single transaction
+func (b SQLBackend) RenamePrefixOrObject(path, newPath string) error {
+	key, newKey := b.key(path), b.key(newPath)
+
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// check if newPath is already occupied
+	var count int
+	err = tx.QueryRow(b.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE path = ? OR (path >= ?%s AND path < ?%s)", b.Table, b.collate(), b.collate())),
+		newKey, newKey+"/", sqlPrefixRangeEnd(newKey+"/")).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrNewPathNotEmpty
+	}
+
+	// the content is referenced by object id, only the paths have to change
+	result, err := tx.Exec(b.rebind(fmt.Sprintf("UPDATE %s SET path = ? WHERE path = ?", b.Table)), newKey, key)
+	if err != nil {
+		return err
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		// the new paths are computed here rather than with substr, which counts characters and not bytes
+		query, args := b.rangeQuery("path", key+"/", false, sqlPrefixRangeEnd(key+"/"))
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for rows.Next() {
+			var k string
+			if err := rows.Scan(&k); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, k)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			_, err = tx.Exec(b.rebind(fmt.Sprintf("UPDATE %s SET path = ? WHERE path = ?", b.Table)), newKey+strings.TrimPrefix(k, key), k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetObject retrieves an object from SQL table, at prefix
+func (b SQLBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to SQL table, at prefix
+func (b SQLBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from SQL table, at prefix
+func (b SQLBackend) DeleteObject(path string) error {
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var objectID string
+	err = tx.QueryRow(b.rebind(fmt.Sprintf("SELECT object_id FROM %s WHERE path = ?", b.Table)), b.key(path)).Scan(&objectID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(b.rebind(fmt.Sprintf("DELETE FROM %s WHERE path = ?", b.Table)), b.key(path))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(b.rebind(fmt.Sprintf("DELETE FROM %s_chunks WHERE object_id = ?", b.Table)), objectID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetObjectMetadata retrieves the stored metadata of an object (size and content type)
+func (b SQLBackend) GetObjectMetadata(path string) (map[string]string, error) {
+	var size int64
+	var raw string
+	err := b.DB.QueryRow(b.rebind(fmt.Sprintf("SELECT size, metadata FROM %s WHERE path = ?", b.Table)), b.key(path)).Scan(&size, &raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	for key, value := range stored {
+		metadata[key] = fmt.Sprint(value)
+	}
+	metadata["size"] = strconv.FormatInt(size, 10)
+	return metadata, nil
+}
+
+// GetObjectStream retrieves an object stream from SQL table, at prefix
+// The returned content is an io.ReadSeeker that fetches one chunk at a time
+func (b SQLBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	reader := &sqlObjectReader{
+		backend: &b,
+	}
+	var mtime int64
+	var raw string
+	err := b.DB.QueryRow(b.rebind(fmt.Sprintf("SELECT object_id, size, mtime, metadata FROM %s WHERE path = ?", b.Table)), b.key(path)).
+		Scan(&reader.objectID, &reader.size, &mtime, &raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return object, ErrObjectNotFound
+	}
+	if err != nil {
+		return object, err
+	}
+
+	var metadata struct {
+		ChunkSize int64 `json:"chunkSize"`
+	}
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+		return object, err
+	}
+	reader.chunkSize = metadata.ChunkSize
+
+	object.LastModified = time.Unix(0, mtime)
+	object.Content = reader
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to SQL table, at prefix
+// The content is written in chunks inside a single transaction, replacing the previous version atomically
+func (b SQLBackend) PutObjectStream(path string, content io.Reader) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	objectID := hex.EncodeToString(id)
+
+	chunkSize := b.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSQLChunkSize
+	}
+
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertChunk := b.rebind(fmt.Sprintf("INSERT INTO %s_chunks (object_id, seq, data) VALUES (?, ?, ?)", b.Table))
+	// sniff the content type from the head of the stream, independently of the chunk size
+	reader := bufio.NewReaderSize(content, 512)
+	var contentType string
+	if head, _ := reader.Peek(512); len(head) > 0 {
+		contentType = http.DetectContentType(head)
+	}
+
+	buf := make([]byte, chunkSize)
+	var size int64
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if _, err := tx.Exec(insertChunk, objectID, seq, buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	metadata, err := json.Marshal(map[string]interface{}{
+		"chunkSize":   chunkSize,
+		"contentType": contentType,
+	})
+	if err != nil {
+		return err
+	}
+
+	// drop the chunks of the replaced version
+	_, err = tx.Exec(b.rebind(fmt.Sprintf("DELETE FROM %[1]s_chunks WHERE object_id IN (SELECT object_id FROM %[1]s WHERE path = ?)", b.Table)), b.key(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(b.rebind(fmt.Sprintf(`INSERT INTO %s (path, object_id, size, mtime, metadata) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET object_id = excluded.object_id, size = excluded.size, mtime = excluded.mtime, metadata = excluded.metadata`, b.Table)),
+		b.key(path), objectID, size, time.Now().UnixNano(), string(metadata))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b SQLBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	obj, err := b.GetObjectStream(path)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer obj.Content.Close()
+
+	if metadata, err := b.GetObjectMetadata(path); err == nil && metadata["contentType"] != "" {
+		w.Header().Set("Content-Type", metadata["contentType"])
+	}
+
+	name := pathutil.Base(obj.Path)
+	http.ServeContent(w, r, name, obj.LastModified, obj.Content.(io.ReadSeeker))
+}
@@ -0,0 +1,248 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	_ "modernc.org/sqlite"
+)
+
+type SQLTestSuite struct {
+	suite.Suite
+	SQLBackend    *SQLBackend
+	TempDirectory string
+}
+
+func (suite *SQLTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-sql/%s", timestamp)
+	suite.Nil(os.MkdirAll(suite.TempDirectory, 0777))
+
+	dsn := fmt.Sprintf("file:%s/storage.db?_pragma=busy_timeout(5000)", suite.TempDirectory)
+	suite.SQLBackend = NewSQLBackend("sqlite", dsn, "charts", "unittest")
+	// small chunks so that every object spans several rows
+	suite.SQLBackend.ChunkSize = 4
+}
+
+func (suite *SQLTestSuite) TearDownSuite() {
+	suite.SQLBackend.DB.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *SQLTestSuite) TestMigrate() {
+	err := suite.SQLBackend.Migrate()
+	suite.Nil(err, "migrating twice is a no-op")
+
+	var version int
+	err = suite.SQLBackend.DB.QueryRow("SELECT version FROM charts_schema").Scan(&version)
+	suite.Nil(err)
+	suite.Equal(len(sqlMigrations), version, "schema version recorded")
+
+	suite.Panics(func() {
+		NewSQLBackendWithDB(suite.SQLBackend.DB, false, "charts; DROP TABLE charts", "")
+	}, "table name is validated")
+}
+
+func (suite *SQLTestSuite) TestRebind() {
+	b := SQLBackend{Postgres: true}
+	suite.Equal("SELECT a FROM t WHERE b = $1 AND c < $2", b.rebind("SELECT a FROM t WHERE b = ? AND c < ?"))
+	b.Postgres = false
+	suite.Equal("SELECT a FROM t WHERE b = ?", b.rebind("SELECT a FROM t WHERE b = ?"))
+}
+
+func (suite *SQLTestSuite) TestRangeQuery() {
+	b := SQLBackend{Table: "t", Postgres: true}
+	query, args := b.rangeQuery("path", "a/", false, "a0")
+	suite.Equal(`SELECT path FROM t WHERE path >= $1 COLLATE "C" AND path < $2 COLLATE "C" ORDER BY path COLLATE "C"`, query, "ranges are byte-wise whatever the collation")
+	suite.Equal([]interface{}{"a/", "a0"}, args)
+	b.Postgres = false
+	query, _ = b.rangeQuery("path", "a/", true, "")
+	suite.Equal("SELECT path FROM t WHERE path > ? ORDER BY path", query)
+}
+
+func (suite *SQLTestSuite) TestPutGetDeleteObject() {
+	err := suite.SQLBackend.PutObject("putget/test.txt", []byte("some chunked content"))
+	suite.Nil(err, "no error putting object")
+
+	object, err := suite.SQLBackend.GetObject("putget/test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some chunked content"), object.Content, "content matches across chunks")
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	metadata, err := suite.SQLBackend.GetObjectMetadata("putget/test.txt")
+	suite.Nil(err)
+	suite.Equal("20", metadata["size"], "size is stored")
+	suite.Equal("text/plain; charset=utf-8", metadata["contentType"], "content type is stored")
+
+	err = suite.SQLBackend.PutObject("putget/test.txt", []byte("short"))
+	suite.Nil(err, "no error overwriting object")
+	object, err = suite.SQLBackend.GetObject("putget/test.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("short"), object.Content, "content replaced")
+
+	err = suite.SQLBackend.DeleteObject("putget/test.txt")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.SQLBackend.GetObject("putget/test.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "deleted object is not found")
+
+	var count int
+	suite.Nil(suite.SQLBackend.DB.QueryRow("SELECT COUNT(*) FROM charts_chunks").Scan(&count))
+	suite.Zero(count, "no chunks left behind")
+}
+
+func (suite *SQLTestSuite) TestListObjects() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.SQLBackend.PutObject(path, []byte(path)))
+	}
+
+	objects, err := suite.SQLBackend.ListObjects("list")
+	suite.Nil(err, "no error listing objects")
+	suite.Len(objects, 2, "nested and sibling objects are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/nested/c.txt", "list0.txt"} {
+		suite.Nil(suite.SQLBackend.DeleteObject(path))
+	}
+}
+
+func (suite *SQLTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/b/2.txt", "dir/c.txt", "dir/d/1.txt", "dir/e.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.SQLBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.SQLBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject, "cannot list an object")
+
+	output, err := suite.SQLBackend.ListObjectsFromDirectory("dir", 0)
+	suite.ErrorIs(err, io.EOF, "single page listing")
+	suite.Len(output.GetDirectories(), 2, "directories listed")
+	suite.Len(output.GetFiles(), 3, "files listed")
+
+	var files, directories []string
+	output, err = suite.SQLBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err, "no error listing page")
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"dir/b", "dir/d"}, directories, "paged directories")
+	suite.Equal([]string{"dir/a.txt", "dir/c.txt", "dir/e.txt"}, files, "paged files")
+
+	for _, path := range paths {
+		suite.Nil(suite.SQLBackend.DeleteObject(path))
+	}
+}
+
+func (suite *SQLTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.SQLBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.SQLBackend.PutObject("rename/sub/b.txt", []byte("b")))
+	suite.Nil(suite.SQLBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.SQLBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "cannot rename onto an object")
+
+	err = suite.SQLBackend.RenamePrefixOrObject("rename", "renamed")
+	suite.Nil(err, "no error renaming prefix")
+	object, err := suite.SQLBackend.GetObject("renamed/sub/b.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("b"), object.Content, "content follows rename")
+	_, err = suite.SQLBackend.GetObject("rename/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "old path is gone")
+
+	err = suite.SQLBackend.RenamePrefixOrObject("renamed/a.txt", "moved.txt")
+	suite.Nil(err, "no error renaming object")
+	object, err = suite.SQLBackend.GetObject("moved.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.SQLBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	for _, path := range []string{"moved.txt", "renamed/sub/b.txt", "occupied.txt"} {
+		suite.Nil(suite.SQLBackend.DeleteObject(path))
+	}
+}
+
+func (suite *SQLTestSuite) TestRenameNonASCIIPrefix() {
+	suite.Nil(suite.SQLBackend.PutObject("größe/ä.txt", []byte("a")))
+	suite.Nil(suite.SQLBackend.PutObject("größe/ñ/ü.txt", []byte("u")))
+	suite.Nil(suite.SQLBackend.PutObject("größer.txt", []byte("x")))
+
+	suite.Nil(suite.SQLBackend.RenamePrefixOrObject("größe", "тест"))
+	objects, err := suite.SQLBackend.ListObjects("тест")
+	suite.Nil(err)
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.Path)
+	}
+	suite.Equal([]string{"ä.txt"}, paths, "paths are moved byte-wise")
+	object, err := suite.SQLBackend.GetObject("тест/ñ/ü.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("u"), object.Content)
+	object, err = suite.SQLBackend.GetObject("größer.txt")
+	suite.Nil(err, "siblings sharing the prefix are not moved")
+	suite.Equal([]byte("x"), object.Content)
+
+	for _, path := range []string{"тест/ä.txt", "тест/ñ/ü.txt", "größer.txt"} {
+		suite.Nil(suite.SQLBackend.DeleteObject(path))
+	}
+}
+
+func (suite *SQLTestSuite) TestHandleHttpFileDownload() {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	suite.Nil(suite.SQLBackend.PutObject("download.txt", content))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=5-24")
+	suite.SQLBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range requests are served")
+	body, _ := ioutil.ReadAll(w.Body)
+	suite.Equal(content[5:25], body, "range content matches")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.SQLBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.SQLBackend.DeleteObject("download.txt"))
+}
+
+func TestSQLStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(SQLTestSuite))
+}
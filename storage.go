@@ -17,9 +17,15 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"net/http"
+	pathutil "path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -43,6 +49,8 @@ type (
 		Path string
 		// Version      string
 		LastModified time.Time
+		// Size is the size of the content in bytes, set by the backends knowing it when the object is retrieved
+		Size int64
 	}
 
 	ListObjectsFromDirectoryOutput interface {
@@ -80,6 +88,17 @@ type (
 		PutObjectStream(path string, content io.Reader) error
 		HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string)
 	}
+
+	// ContextBackend is implemented by the backends making their requests with a context, which the wrappers
+	// such as TracedBackend extend with their own values, see withContext; the wrappers implement it too,
+	// passing the context on to the backend they wrap
+	ContextBackend interface {
+		Backend
+		// BackendContext returns the context of the requests
+		BackendContext() context.Context
+		// WithBackendContext returns a copy of the backend making its requests with ctx
+		WithBackendContext(ctx context.Context) Backend
+	}
 )
 
 // HasExtension determines whether or not an object contains a file extension
@@ -138,3 +157,135 @@ func removePrefixFromObjectPath(prefix string, path string) string {
 func objectPathIsInvalid(path string) bool {
 	return strings.Contains(path, "/") || path == ""
 }
+
+// isObjectNotFound reports whether err is a missing object, as returned by the backends of this package
+func isObjectNotFound(err error) bool {
+	return errors.Is(err, ErrObjectNotFound) || errors.Is(err, fs.ErrNotExist)
+}
+
+// getObjectStream opens an object of backend as a stream, with GetObject for the backends without streams
+func getObjectStream(backend Backend, path string) (*ObjectStream, error) {
+	if s, ok := backend.(BackendStream); ok {
+		return s.GetObjectStream(path)
+	}
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return &ObjectStream{Metadata: Metadata{Path: path}}, err
+	}
+	return &ObjectStream{
+		Metadata: object.Metadata,
+		Content:  ioutil.NopCloser(bytes.NewReader(object.Content)),
+	}, nil
+}
+
+// putObjectStream uploads a stream to backend, with PutObject for the backends without streams
+func putObjectStream(backend Backend, path string, content io.Reader) error {
+	if s, ok := backend.(BackendStream); ok {
+		return s.PutObjectStream(path, content)
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return backend.PutObject(path, data)
+}
+
+// handleHttpFileDownload serves an object of backend, with GetObject for the backends without streams
+func handleHttpFileDownload(backend Backend, w http.ResponseWriter, r *http.Request, path string) {
+	if s, ok := backend.(BackendStream); ok {
+		s.HandleHttpFileDownload(w, r, path)
+		return
+	}
+	object, err := backend.GetObject(path)
+	if err != nil {
+		if isObjectNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	serveObject(w, r, object, "")
+}
+
+// serveObject writes an object to an HTTP response, http.ServeContent handles the conditional and range requests
+func serveObject(w http.ResponseWriter, r *http.Request, object Object, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, pathutil.Base(object.Path), object.LastModified, bytes.NewReader(object.Content))
+}
+
+// proxyHttpFileDownload serves an object from a server doing the negotiation itself: the conditional and range headers
+// of r are passed to fetch, and its response is copied to w; a not found error answers 404, the others 502
+func proxyHttpFileDownload(w http.ResponseWriter, r *http.Request, fetch func(method string, header http.Header) (*http.Response, error)) {
+	header := http.Header{}
+	for _, k := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if v := r.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+
+	resp, err := fetch(method, header)
+	if err != nil {
+		if isObjectNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, k := range []string{"Accept-Ranges", "Cache-Control", "Content-Length", "Content-Range", "Content-Type", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	case http.StatusNotModified, http.StatusPreconditionFailed, http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable:
+		w.WriteHeader(resp.StatusCode)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// withContext returns a copy of backend making its requests with the context returned by extend from its current one,
+// for the backends implementing ContextBackend, otherwise backend itself
+func withContext(backend Backend, extend func(context.Context) context.Context) Backend {
+	b, ok := backend.(ContextBackend)
+	if !ok {
+		return backend
+	}
+	ctx := b.BackendContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return b.WithBackendContext(extend(ctx))
+}
+
+// withBackendContext returns a copy of backend making its requests with ctx, for the backends implementing
+// ContextBackend, otherwise backend itself
+func withBackendContext(backend Backend, ctx context.Context) Backend {
+	return withContext(backend, func(context.Context) context.Context {
+		return ctx
+	})
+}
+
+// backendContext returns the context of the requests of backend, the background context for the backends
+// not implementing ContextBackend
+func backendContext(backend Backend) context.Context {
+	if b, ok := backend.(ContextBackend); ok && b.BackendContext() != nil {
+		return b.BackendContext()
+	}
+	return context.Background()
+}
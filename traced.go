@@ -0,0 +1,269 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of TracedBackend
+const tracerName = "github.com/chartmuseum/storage"
+
+type (
+	// TracedBackend is a Backend wrapper creating an OpenTelemetry span for every call to the wrapped backend
+	// The spans are children of the span in Context. They are added to the context of the wrapped backend when it is
+	// a ContextBackend, keeping its values such as the actor, so that the requests of its SDK are traced as well
+	TracedBackend struct {
+		Backend Backend
+		// Context holds the parent span of the spans, see WithContext
+		Context context.Context
+		// BackendType is the storage.backend attribute of the spans, the type of the wrapped backend by default
+		BackendType string
+		tracer      trace.Tracer
+	}
+
+	// tracedListOutput traces the pages following the first one
+	tracedListOutput struct {
+		ListObjectsFromDirectoryOutput
+		backend TracedBackend
+		prefix  string
+		page    int
+	}
+
+	// tracedReadCloser ends the span of a stream when it is closed, with the number of bytes read
+	tracedReadCloser struct {
+		io.ReadCloser
+		span  trace.Span
+		bytes int64
+		once  *sync.Once
+	}
+
+	// tracedReader counts the bytes read from a stream
+	tracedReader struct {
+		io.Reader
+		bytes int64
+	}
+)
+
+// NewTracedBackend creates a new instance of TracedBackend, with the tracers of tracerProvider, the global one if nil
+func NewTracedBackend(backend Backend, tracerProvider trace.TracerProvider) *TracedBackend {
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	return &TracedBackend{
+		Backend:     backend,
+		Context:     context.Background(),
+		BackendType: instrumentedBackendType(backend),
+		tracer:      tracerProvider.Tracer(tracerName),
+	}
+}
+
+// WithContext returns a copy of the backend whose spans are children of the span in ctx
+func (b TracedBackend) WithContext(ctx context.Context) *TracedBackend {
+	b.Context = ctx
+	return &b
+}
+
+// start starts the span of an operation, and returns the wrapped backend using its context
+func (b TracedBackend) start(ctx context.Context, operation string, attributes ...attribute.KeyValue) (trace.Span, Backend) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tracer := b.tracer
+	if tracer == nil {
+		tracer = otel.GetTracerProvider().Tracer(tracerName)
+	}
+	_, span := tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attributes, attribute.String("storage.backend", b.BackendType))...))
+	return span, withContext(b.Backend, func(ctx context.Context) context.Context {
+		return trace.ContextWithSpan(ctx, span)
+	})
+}
+
+// endSpan ends a span, marking it as failed with err; io.EOF ends the listings and is not an error
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != io.EOF {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// listed records a page of a listing
+func listed(span trace.Span, output ListObjectsFromDirectoryOutput) {
+	if output == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("storage.directories", len(output.GetDirectories())),
+		attribute.Int("storage.files", len(output.GetFiles())),
+		attribute.Bool("storage.truncated", output.IsTruncated()),
+	)
+}
+
+func (r *tracedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *tracedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.span.RecordError(err)
+		r.span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}
+
+func (r *tracedReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() {
+		r.span.SetAttributes(attribute.Int64("storage.bytes", r.bytes))
+		endSpan(r.span, err)
+	})
+	return err
+}
+
+// BackendContext returns the Context of the backend
+func (b TracedBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+// WithBackendContext is WithContext returning a Backend, see ContextBackend
+func (b TracedBackend) WithBackendContext(ctx context.Context) Backend {
+	return b.WithContext(ctx)
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix
+func (b TracedBackend) ListObjects(prefix string) ([]Object, error) {
+	span, backend := b.start(b.Context, "ListObjects", attribute.String("storage.prefix", prefix))
+	objects, err := backend.ListObjects(prefix)
+	span.SetAttributes(attribute.Int("storage.objects", len(objects)))
+	endSpan(span, err)
+	return objects, err
+}
+
+// ListObjectsFromDirectory lists all objects under prefix in the wrapped backend, with a span for every page
+func (b TracedBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	span, backend := b.start(b.Context, "ListObjectsFromDirectory",
+		attribute.String("storage.prefix", prefix), attribute.Int("storage.limit", limit), attribute.Int("storage.page", 1))
+	output, err := backend.ListObjectsFromDirectory(prefix, limit)
+	listed(span, output)
+	endSpan(span, err)
+	if output == nil {
+		return output, err
+	}
+	return tracedListOutput{ListObjectsFromDirectoryOutput: output, backend: b, prefix: prefix, page: 1}, err
+}
+
+func (o tracedListOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	span, _ := o.backend.start(o.backend.Context, "ListObjectsFromDirectory",
+		attribute.String("storage.prefix", o.prefix), attribute.Int("storage.page", o.page+1))
+	output, err := o.ListObjectsFromDirectoryOutput.NextPage()
+	listed(span, output)
+	endSpan(span, err)
+	if output == nil {
+		return output, err
+	}
+	return tracedListOutput{ListObjectsFromDirectoryOutput: output, backend: o.backend, prefix: o.prefix, page: o.page + 1}, err
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b TracedBackend) GetObject(path string) (Object, error) {
+	span, backend := b.start(b.Context, "GetObject", attribute.String("storage.path", path))
+	object, err := backend.GetObject(path)
+	span.SetAttributes(attribute.Int("storage.bytes", len(object.Content)))
+	endSpan(span, err)
+	return object, err
+}
+
+// PutObject uploads an object to the wrapped backend
+func (b TracedBackend) PutObject(path string, content []byte) error {
+	span, backend := b.start(b.Context, "PutObject", attribute.String("storage.path", path), attribute.Int("storage.bytes", len(content)))
+	err := backend.PutObject(path, content)
+	endSpan(span, err)
+	return err
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b TracedBackend) DeleteObject(path string) error {
+	span, backend := b.start(b.Context, "DeleteObject", attribute.String("storage.path", path))
+	err := backend.DeleteObject(path)
+	endSpan(span, err)
+	return err
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+func (b TracedBackend) RenamePrefixOrObject(path, newPath string) error {
+	span, backend := b.start(b.Context, "RenamePrefixOrObject",
+		attribute.String("storage.path", path), attribute.String("storage.new_path", newPath))
+	err := backend.RenamePrefixOrObject(path, newPath)
+	endSpan(span, err)
+	return err
+}
+
+// GetObjectStream retrieves an object stream from the wrapped backend
+// The span lasts until the stream is closed, with the number of bytes read
+func (b TracedBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	span, backend := b.start(b.Context, "GetObjectStream", attribute.String("storage.path", path))
+	stream, err := getObjectStream(backend, path)
+	if err != nil || stream.Content == nil {
+		endSpan(span, err)
+		return stream, err
+	}
+	stream.Content = &tracedReadCloser{ReadCloser: stream.Content, span: span, once: &sync.Once{}}
+	return stream, nil
+}
+
+// PutObjectStream uploads an object stream to the wrapped backend
+func (b TracedBackend) PutObjectStream(path string, content io.Reader) error {
+	span, backend := b.start(b.Context, "PutObjectStream", attribute.String("storage.path", path))
+	reader := &tracedReader{Reader: content}
+	err := putObjectStream(backend, path, reader)
+	span.SetAttributes(attribute.Int64("storage.bytes", reader.bytes))
+	endSpan(span, err)
+	return err
+}
+
+// HandleHttpFileDownload serves an object of the wrapped backend, in a child span of the span of the request
+func (b TracedBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	span, backend := b.start(r.Context(), "HandleHttpFileDownload", attribute.String("storage.path", path))
+	recorder := &instrumentedResponseWriter{ResponseWriter: w}
+	handleHttpFileDownload(backend, recorder, r.WithContext(trace.ContextWithSpan(r.Context(), span)), path)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", recorder.status),
+		attribute.Int("storage.bytes", recorder.bytes),
+	)
+	if recorder.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(recorder.status))
+	}
+	span.End()
+}
@@ -0,0 +1,291 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedContextBackend records the span and the actor of its context, as the backends making their requests with it
+type tracedContextBackend struct {
+	*LocalFilesystemBackend
+	Context context.Context
+	spans   *[]trace.SpanContext
+	actors  *[]string
+}
+
+func (b tracedContextBackend) BackendContext() context.Context {
+	return b.Context
+}
+
+func (b tracedContextBackend) WithBackendContext(ctx context.Context) Backend {
+	b.Context = ctx
+	return &b
+}
+
+func (b tracedContextBackend) GetObject(path string) (Object, error) {
+	*b.spans = append(*b.spans, trace.SpanContextFromContext(b.Context))
+	actor, _ := ActorFromContext(b.Context)
+	*b.actors = append(*b.actors, actor)
+	return b.LocalFilesystemBackend.GetObject(path)
+}
+
+type TracedTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Local         *LocalFilesystemBackend
+	Exporter      *tracetest.InMemoryExporter
+	Provider      *sdktrace.TracerProvider
+	Traced        *TracedBackend
+}
+
+func (suite *TracedTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-traced/%s", timestamp)
+	suite.Local = NewLocalFilesystemBackend(suite.TempDirectory)
+	suite.Exporter = tracetest.NewInMemoryExporter()
+	suite.Provider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(suite.Exporter))
+	suite.Traced = NewTracedBackend(suite.Local, suite.Provider)
+}
+
+func (suite *TracedTestSuite) TearDownTest() {
+	suite.Provider.Shutdown(context.Background())
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *TracedTestSuite) attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func (suite *TracedTestSuite) TestSpans() {
+	suite.Nil(suite.Traced.PutObject("a.txt", []byte("12345")))
+	_, err := suite.Traced.GetObject("a.txt")
+	suite.Nil(err)
+	_, err = suite.Traced.GetObject("missing.txt")
+	suite.NotNil(err)
+	suite.Nil(suite.Traced.PutObjectStream("b.txt", strings.NewReader("123")))
+	suite.Nil(suite.Traced.RenamePrefixOrObject("b.txt", "c.txt"))
+	suite.Nil(suite.Traced.DeleteObject("c.txt"))
+
+	spans := suite.Exporter.GetSpans()
+	suite.Len(spans, 6)
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+		suite.Equal(trace.SpanKindClient, span.SpanKind)
+		suite.Equal("LocalFilesystemBackend", suite.attributes(span)["storage.backend"].AsString())
+	}
+	suite.Equal([]string{"storage.PutObject", "storage.GetObject", "storage.GetObject", "storage.PutObjectStream",
+		"storage.RenamePrefixOrObject", "storage.DeleteObject"}, names)
+
+	put := suite.attributes(spans[0])
+	suite.Equal("a.txt", put["storage.path"].AsString())
+	suite.Equal(int64(5), put["storage.bytes"].AsInt64())
+	suite.Equal(int64(5), suite.attributes(spans[1])["storage.bytes"].AsInt64())
+	suite.Equal(codes.Unset, spans[1].Status.Code)
+	suite.Equal(codes.Error, spans[2].Status.Code, "errors are marked")
+	suite.Len(spans[2].Events, 1, "errors are recorded")
+	suite.Equal(int64(3), suite.attributes(spans[3])["storage.bytes"].AsInt64())
+	suite.Equal("c.txt", suite.attributes(spans[4])["storage.new_path"].AsString())
+}
+
+func (suite *TracedTestSuite) TestListObjectsFromDirectory() {
+	for i := 0; i < 3; i++ {
+		suite.Nil(suite.Local.PutObject(fmt.Sprintf("list/%d.txt", i), []byte("x")))
+	}
+	objects, err := suite.Traced.ListObjects("list")
+	suite.Nil(err)
+	suite.Len(objects, 3)
+
+	output, err := suite.Traced.ListObjectsFromDirectory("list", 2)
+	for err != io.EOF {
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+
+	spans := suite.Exporter.GetSpans()
+	suite.Equal("list", suite.attributes(spans[0])["storage.prefix"].AsString())
+	suite.Equal(int64(3), suite.attributes(spans[0])["storage.objects"].AsInt64())
+	files := int64(0)
+	for i, span := range spans[1:] {
+		attributes := suite.attributes(span)
+		suite.Equal("storage.ListObjectsFromDirectory", span.Name)
+		suite.Equal(int64(i+1), attributes["storage.page"].AsInt64(), "pages are numbered")
+		suite.Equal(codes.Unset, span.Status.Code, "the end of the listing is not an error")
+		files += attributes["storage.files"].AsInt64()
+	}
+	suite.True(len(spans) > 2)
+	suite.Equal(int64(3), files)
+}
+
+func (suite *TracedTestSuite) TestStreams() {
+	suite.Nil(suite.Local.PutObject("stream.txt", []byte("content")))
+
+	stream, err := suite.Traced.GetObjectStream("stream.txt")
+	suite.Nil(err)
+	suite.Empty(suite.Exporter.GetSpans(), "the span lasts while the stream is open")
+	_, err = ioutil.ReadAll(stream.Content)
+	suite.Nil(err)
+	suite.Nil(stream.Content.Close())
+	stream.Content.Close()
+
+	spans := suite.Exporter.GetSpans()
+	suite.Len(spans, 1, "the span is ended once")
+	suite.Equal(int64(7), suite.attributes(spans[0])["storage.bytes"].AsInt64())
+}
+
+func (suite *TracedTestSuite) TestContextPropagation() {
+	suite.Nil(suite.Local.PutObject("ctx.txt", []byte("ctx")))
+	var seen []trace.SpanContext
+	var actors []string
+	inner := &tracedContextBackend{
+		LocalFilesystemBackend: suite.Local,
+		Context:                WithActor(context.Background(), "alice"),
+		spans:                  &seen,
+		actors:                 &actors,
+	}
+	suite.Traced = NewTracedBackend(inner, suite.Provider)
+	suite.Equal("tracedContextBackend", suite.Traced.BackendType)
+
+	ctx, parent := suite.Provider.Tracer("test").Start(context.Background(), "download")
+	_, err := suite.Traced.WithContext(ctx).GetObject("ctx.txt")
+	suite.Nil(err)
+	parent.End()
+
+	spans := suite.Exporter.GetSpans()
+	suite.Len(spans, 2)
+	suite.Equal(parent.SpanContext().SpanID(), spans[0].Parent.SpanID(), "spans are children of the span of the context")
+	suite.Equal(parent.SpanContext().TraceID(), spans[0].SpanContext.TraceID())
+	suite.Len(seen, 1)
+	suite.Equal(spans[0].SpanContext.SpanID(), seen[0].SpanID(), "the context reaches the wrapped backend")
+	suite.Equal([]string{"alice"}, actors, "the span is added to the context of the wrapped backend")
+	suite.False(trace.SpanContextFromContext(inner.Context).IsValid(), "the wrapped backend is copied, not modified")
+
+	_, err = NewTracedBackend(suite.Local, suite.Provider).GetObject("ctx.txt")
+	suite.Nil(err, "the backends without a context are used as they are")
+}
+
+func (suite *TracedTestSuite) TestPolicyBackend() {
+	suite.Nil(suite.Local.PutObject("charts/a.tgz", []byte("a")))
+	policy, err := LoadPolicy([]byte(`statements: [{effect: allow, principals: [alice], operations: [get], paths: ["charts/**"]}]`))
+	suite.Nil(err)
+	alice := NewPolicyBackend(suite.Local, policy).WithContext(WithActor(context.Background(), "alice"))
+
+	object, err := NewTracedBackend(alice, suite.Provider).GetObject("charts/a.tgz")
+	suite.Nil(err, "the actor of the policy backend is kept")
+	suite.Equal([]byte("a"), object.Content)
+	_, err = NewTracedBackend(NewPolicyBackend(suite.Local, policy), suite.Provider).GetObject("charts/a.tgz")
+	suite.ErrorIs(err, ErrAccessDenied)
+}
+
+func (suite *TracedTestSuite) TestAuditedBackend() {
+	sink := &auditedMemorySink{}
+	alice := NewAuditedBackend(suite.Local, sink, false).WithContext(WithActor(context.Background(), "alice"))
+	traced := NewTracedBackend(alice, suite.Provider)
+
+	ctx, parent := suite.Provider.Tracer("test").Start(context.Background(), "upload")
+	suite.Nil(traced.WithContext(ctx).PutObject("audited.txt", []byte("audited")))
+	parent.End()
+
+	suite.Len(sink.events, 1)
+	suite.Equal("alice", sink.events[0].Actor, "the actor of the audited backend is kept")
+	suite.Len(suite.Exporter.GetSpans(), 2)
+}
+
+func (suite *TracedTestSuite) TestWrappedContextBackend() {
+	suite.Nil(suite.Local.PutObject("wrapped.txt", []byte("wrapped")))
+	policy, err := LoadPolicy([]byte(`statements: [{effect: allow, principals: [alice], operations: [get], paths: ["**"]}]`))
+	suite.Nil(err)
+	alice := WithActor(context.Background(), "alice")
+
+	for name, wrap := range map[string]func(Backend) Backend{
+		"audited": func(b Backend) Backend { return NewAuditedBackend(b, &auditedMemorySink{}, false).WithContext(alice) },
+		"policy":  func(b Backend) Backend { return NewPolicyBackend(b, policy).WithContext(alice) },
+		"scoped":  func(b Backend) Backend { return NewScopedBackend(b, "") },
+		"caching": func(b Backend) Backend { return NewCachingBackend(b, 1024, 0) },
+	} {
+		suite.Exporter.Reset()
+		var seen []trace.SpanContext
+		var actors []string
+		inner := &tracedContextBackend{
+			LocalFilesystemBackend: suite.Local,
+			Context:                context.Background(),
+			spans:                  &seen,
+			actors:                 &actors,
+		}
+		traced := NewTracedBackend(wrap(inner), suite.Provider)
+
+		_, err := traced.GetObject("wrapped.txt")
+		suite.Nil(err, name)
+		spans := suite.Exporter.GetSpans()
+		suite.Len(spans, 1, name)
+		suite.Len(seen, 1, name)
+		suite.Equal(spans[0].SpanContext.SpanID(), seen[0].SpanID(), "%s: the span reaches the backend below the wrapper", name)
+		if name == "audited" || name == "policy" {
+			suite.Equal([]string{"alice"}, actors, "%s: the context of the wrapper reaches the backend below it", name)
+		}
+	}
+}
+
+func (suite *TracedTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.Local.PutObject("download.txt", []byte("0123456789")))
+
+	ctx, parent := suite.Provider.Tracer("test").Start(context.Background(), "GET /download.txt")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil).WithContext(ctx)
+	suite.Traced.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil).WithContext(ctx)
+	suite.Traced.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+	parent.End()
+
+	spans := suite.Exporter.GetSpans()
+	suite.Len(spans, 3)
+	found := suite.attributes(spans[0])
+	suite.Equal(int64(200), found["http.response.status_code"].AsInt64())
+	suite.Equal(int64(10), found["storage.bytes"].AsInt64())
+	suite.Equal(parent.SpanContext().SpanID(), spans[0].Parent.SpanID(), "downloads are children of the span of the request")
+	suite.Equal(int64(404), suite.attributes(spans[1])["http.response.status_code"].AsInt64())
+	suite.Equal(codes.Unset, spans[1].Status.Code, "client errors are not span errors")
+}
+
+func TestTracedStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(TracedTestSuite))
+}
@@ -0,0 +1,478 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	pathutil "path"
+	"strings"
+	"time"
+)
+
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getlastmodified/></d:prop></d:propfind>`
+
+type (
+	webdavMultistatus struct {
+		Responses []webdavResponse `xml:"DAV: response"`
+	}
+	webdavResponse struct {
+		Href     string           `xml:"DAV: href"`
+		Propstat []webdavPropstat `xml:"DAV: propstat"`
+	}
+	webdavPropstat struct {
+		Status string     `xml:"DAV: status"`
+		Prop   webdavProp `xml:"DAV: prop"`
+	}
+	webdavProp struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		LastModified string `xml:"DAV: getlastmodified"`
+	}
+
+	// webdavEntry is a member of a collection, as returned by PROPFIND
+	webdavEntry struct {
+		name         string
+		isCollection bool
+		lastModified time.Time
+	}
+)
+
+type webdavListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []webdavEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &webdavListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// PROPFIND returns the whole collection at once, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isCollection {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *webdavListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+	l.entries = nil
+}
+
+// WebDAVBackend is a storage backend for WebDAV servers (Nextcloud, Apache mod_dav, nginx, ...)
+type WebDAVBackend struct {
+	Endpoint    string
+	Prefix      string
+	Client      *http.Client
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// NewWebDAVBackend creates a new instance of WebDAVBackend
+// endpoint is the base URL of the WebDAV share, e.g. https://cloud.example.com/remote.php/dav/files/user
+// Credentials are taken from WEBDAV_USERNAME and WEBDAV_PASSWORD (basic auth), or WEBDAV_BEARER_TOKEN
+func NewWebDAVBackend(endpoint string, prefix string) *WebDAVBackend {
+	if _, err := url.Parse(endpoint); err != nil {
+		panic("Failed to parse WebDAV endpoint: " + err.Error())
+	}
+
+	b := &WebDAVBackend{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		Prefix:      cleanPrefix(prefix),
+		Client:      http.DefaultClient,
+		Username:    os.Getenv("WEBDAV_USERNAME"),
+		Password:    os.Getenv("WEBDAV_PASSWORD"),
+		BearerToken: os.Getenv("WEBDAV_BEARER_TOKEN"),
+	}
+	return b
+}
+
+// url returns the escaped URL of path, at prefix
+func (b WebDAVBackend) url(path string) string {
+	p := pathutil.Join("/", b.Prefix, path)
+	return b.Endpoint + (&url.URL{Path: p}).EscapedPath()
+}
+
+func (b WebDAVBackend) do(method string, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+b.BearerToken)
+	} else if b.Username != "" || b.Password != "" {
+		req.SetBasicAuth(b.Username, b.Password)
+	}
+	return b.Client.Do(req)
+}
+
+func webdavStatusError(resp *http.Response) error {
+	return fmt.Errorf("webdav: %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// propfind lists the members of the collection at path
+// isCollection is false when path is an object, in which case no entries are returned
+func (b WebDAVBackend) propfind(path string, depth string) (entries []webdavEntry, isCollection bool, err error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := b.do("PROPFIND", path, strings.NewReader(webdavPropfindBody), header)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, ErrObjectNotFound
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, false, webdavStatusError(resp)
+	}
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, false, err
+	}
+
+	self := strings.TrimSuffix(resp.Request.URL.Path, "/")
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, false, err
+		}
+		entry := webdavEntry{
+			name: pathutil.Base(href.Path),
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			entry.isCollection = entry.isCollection || ps.Prop.ResourceType.Collection != nil
+			if ps.Prop.LastModified != "" {
+				entry.lastModified, _ = http.ParseTime(ps.Prop.LastModified)
+			}
+		}
+		if strings.TrimSuffix(href.Path, "/") == self {
+			isCollection = entry.isCollection
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if !isCollection {
+		entries = nil
+	}
+	return entries, isCollection, nil
+}
+
+// mkcol creates the collection at path, along with any missing parents (including the prefix itself)
+func (b WebDAVBackend) mkcol(path string) error {
+	root := b
+	root.Prefix = ""
+	return root.mkcolAll(pathutil.Join(b.Prefix, path))
+}
+
+func (b WebDAVBackend) mkcolAll(path string) error {
+	path = cleanPrefix(path)
+	if path == "" || path == "." {
+		return nil
+	}
+
+	resp, err := b.do("MKCOL", path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		// 405 means the collection already exists
+		return nil
+	case http.StatusConflict:
+		// 409 means a parent is missing
+		if err := b.mkcolAll(pathutil.Dir(path)); err != nil {
+			return err
+		}
+		resp, err = b.do("MKCOL", path, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusMethodNotAllowed {
+			return nil
+		}
+	}
+	return webdavStatusError(resp)
+}
+
+// ListObjects lists all objects in WebDAV collection, at prefix (depth 1)
+func (b WebDAVBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	entries, _, err := b.propfind(prefix, "1")
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) { // OK if the collection doesnt exist yet
+			err = nil
+		}
+		return objects, err
+	}
+	for _, e := range entries {
+		if e.isCollection {
+			continue
+		}
+		object := Object{
+			Metadata: Metadata{
+				Path:         e.name,
+				LastModified: e.lastModified,
+			},
+			Content: []byte{},
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+func (b WebDAVBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	output := &webdavListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+
+	entries, isCollection, err := b.propfind(prefix, "1")
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			output.isEOF = true
+			return output, nil
+		}
+		return nil, err
+	}
+	if !isCollection {
+		return nil, ErrPrefixIsAnObject
+	}
+
+	output.entries = entries
+	return output.NextPage()
+}
+
+// RenamePrefixOrObject moves a collection or an object with MOVE, never overwriting newPath
+func (b WebDAVBackend) RenamePrefixOrObject(path, newPath string) error {
+	header := http.Header{}
+	header.Set("Destination", b.url(newPath))
+	header.Set("Overwrite", "F")
+
+	for retried := false; ; retried = true {
+		resp, err := b.do("MOVE", path, nil, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusCreated, http.StatusNoContent:
+			return nil
+		case http.StatusPreconditionFailed:
+			return ErrNewPathNotEmpty
+		case http.StatusNotFound:
+			// ignore if the source does not exist
+			return nil
+		case http.StatusConflict, http.StatusForbidden:
+			// the parent of newPath is missing (409 per RFC 4918, some servers answer 403)
+			// or, for the latter, the source does not exist
+			if !retried {
+				_, _, err := b.propfind(path, "0")
+				if errors.Is(err, ErrObjectNotFound) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := b.mkcol(pathutil.Dir(newPath)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return webdavStatusError(resp)
+	}
+}
+
+// GetObject retrieves an object from WebDAV collection, at prefix
+func (b WebDAVBackend) GetObject(path string) (Object, error) {
+	var object Object
+
+	result, err := b.GetObjectStream(path)
+	if err != nil {
+		object.Path = path
+		return object, err
+	}
+	defer result.Content.Close()
+
+	object.Metadata = result.Metadata
+
+	var content []byte
+	content, err = ioutil.ReadAll(result.Content)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject uploads an object to WebDAV collection, at prefix
+func (b WebDAVBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject removes an object from WebDAV collection, at prefix
+func (b WebDAVBackend) DeleteObject(path string) error {
+	resp, err := b.do(http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+// GetObjectStream retrieves an object stream from WebDAV collection, at prefix
+func (b WebDAVBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	object := &ObjectStream{}
+	object.Path = path
+
+	resp, err := b.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return object, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return object, ErrObjectNotFound
+		}
+		return object, webdavStatusError(resp)
+	}
+
+	object.Content = resp.Body
+	object.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+// PutObjectStream uploads an object stream to WebDAV collection, at prefix
+// Missing parent collections are created with MKCOL before uploading
+func (b WebDAVBackend) PutObjectStream(path string, content io.Reader) error {
+	if err := b.mkcol(pathutil.Dir(path)); err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodPut, path, content, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+func (b WebDAVBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	proxyHttpFileDownload(w, r, func(method string, header http.Header) (*http.Response, error) {
+		return b.do(method, path, nil, header)
+	})
+}
@@ -0,0 +1,176 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/webdav"
+)
+
+type WebDAVTestSuite struct {
+	suite.Suite
+	Server        *httptest.Server
+	WebDAVBackend *WebDAVBackend
+}
+
+func (suite *WebDAVTestSuite) SetupSuite() {
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !(ok && user == "chartmuseum" && password == "secret") && r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+
+	os.Setenv("WEBDAV_USERNAME", "chartmuseum")
+	os.Setenv("WEBDAV_PASSWORD", "secret")
+	defer os.Unsetenv("WEBDAV_USERNAME")
+	defer os.Unsetenv("WEBDAV_PASSWORD")
+	suite.WebDAVBackend = NewWebDAVBackend(suite.Server.URL+"/dav/", "unittest")
+}
+
+func (suite *WebDAVTestSuite) TearDownSuite() {
+	suite.Server.Close()
+}
+
+func (suite *WebDAVTestSuite) TestAuth() {
+	backend := NewWebDAVBackend(suite.Server.URL+"/dav", "unittest")
+	_, err := backend.ListObjects("")
+	suite.NotNil(err, "cannot list objects without credentials")
+
+	backend.BearerToken = "token"
+	_, err = backend.ListObjects("")
+	suite.Nil(err, "can list objects with a bearer token")
+}
+
+func (suite *WebDAVTestSuite) TestPutGetDeleteObject() {
+	err := suite.WebDAVBackend.PutObject("a/b/test with spaces.txt", []byte("some content"))
+	suite.Nil(err, "no error putting object in missing collections")
+
+	object, err := suite.WebDAVBackend.GetObject("a/b/test with spaces.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal([]byte("some content"), object.Content)
+	suite.False(object.LastModified.IsZero(), "last modified is set")
+
+	err = suite.WebDAVBackend.DeleteObject("a/b/test with spaces.txt")
+	suite.Nil(err, "no error deleting object")
+
+	_, err = suite.WebDAVBackend.GetObject("a/b/test with spaces.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "cannot get deleted object")
+}
+
+func (suite *WebDAVTestSuite) TestListObjects() {
+	objects, err := suite.WebDAVBackend.ListObjects("does-not-exist")
+	suite.Nil(err, "list objects does not return error if collection does not exist")
+	suite.Empty(objects)
+
+	suite.Nil(suite.WebDAVBackend.PutObject("list/a.txt", []byte("a")))
+	suite.Nil(suite.WebDAVBackend.PutObject("list/nested/b.txt", []byte("b")))
+
+	objects, err = suite.WebDAVBackend.ListObjects("list")
+	suite.Nil(err)
+	suite.Len(objects, 1, "collections are skipped")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.False(objects[0].LastModified.IsZero(), "last modified is listed")
+
+	suite.Nil(suite.WebDAVBackend.DeleteObject("list"))
+}
+
+func (suite *WebDAVTestSuite) TestListObjectsFromDirectory() {
+	paths := []string{"dir/a.txt", "dir/b/1.txt", "dir/c.txt"}
+	for _, path := range paths {
+		suite.Nil(suite.WebDAVBackend.PutObject(path, []byte(path)))
+	}
+
+	_, err := suite.WebDAVBackend.ListObjectsFromDirectory("dir/a.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject)
+
+	var files, directories []string
+	output, err := suite.WebDAVBackend.ListObjectsFromDirectory("dir", 2)
+	for {
+		suite.LessOrEqual(len(output.GetDirectories())+len(output.GetFiles()), 2, "page respects limit")
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.ElementsMatch([]string{"dir/b"}, directories)
+	suite.ElementsMatch([]string{"dir/a.txt", "dir/c.txt"}, files)
+
+	suite.Nil(suite.WebDAVBackend.DeleteObject("dir"))
+}
+
+func (suite *WebDAVTestSuite) TestRenamePrefixOrObject() {
+	suite.Nil(suite.WebDAVBackend.PutObject("rename/a.txt", []byte("a")))
+	suite.Nil(suite.WebDAVBackend.PutObject("occupied.txt", []byte("x")))
+
+	err := suite.WebDAVBackend.RenamePrefixOrObject("rename", "occupied.txt")
+	suite.ErrorIs(err, ErrNewPathNotEmpty, "412 is reported as new path not empty")
+
+	err = suite.WebDAVBackend.RenamePrefixOrObject("rename", "new/parent/renamed")
+	suite.Nil(err, "no error renaming into missing collections")
+	object, err := suite.WebDAVBackend.GetObject("new/parent/renamed/a.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	err = suite.WebDAVBackend.RenamePrefixOrObject("does-not-exist", "anywhere")
+	suite.Nil(err, "renaming a missing path is ignored")
+
+	suite.Nil(suite.WebDAVBackend.DeleteObject("new"))
+	suite.Nil(suite.WebDAVBackend.DeleteObject("occupied.txt"))
+}
+
+func (suite *WebDAVTestSuite) TestHandleHttpFileDownload() {
+	suite.Nil(suite.WebDAVBackend.PutObject("download.txt", []byte("downloadable")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/download.txt", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	suite.WebDAVBackend.HandleHttpFileDownload(w, r, "download.txt")
+	suite.Equal(http.StatusPartialContent, w.Code, "range is passed through")
+	suite.Equal("down", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	suite.WebDAVBackend.HandleHttpFileDownload(w, r, "missing.txt")
+	suite.Equal(http.StatusNotFound, w.Code)
+
+	suite.Nil(suite.WebDAVBackend.DeleteObject("download.txt"))
+}
+
+func TestWebDAVStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(WebDAVTestSuite))
+}
@@ -0,0 +1,790 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	writeBackPut    = "put"
+	writeBackDelete = "delete"
+)
+
+type (
+	// WriteBackBackend is a Backend wrapper acknowledging writes once they are in a local journal, and flushing them to the wrapped backend in the background
+	// Reads see the pending writes, the journal is kept across restarts
+	WriteBackBackend struct {
+		Backend Backend
+		// Journal keeps the pending writes, in its queue directory, and their content, in its data directory
+		// The journal is written directly with fsync, and read through the backend
+		Journal *LocalFilesystemBackend
+		// retryInterval is the wait before the first retry of a failed write, doubled at every failure
+		retryInterval time.Duration
+		// maxRetryInterval bounds the wait between the retries of a failed write
+		maxRetryInterval time.Duration
+		state            *writeBackState
+	}
+
+	// WriteBackStats describes the queue of a WriteBackBackend
+	WriteBackStats struct {
+		// Pending is the number of writes waiting to be flushed
+		Pending int
+		// Lag is the age of the oldest pending write, zero when none is pending
+		Lag time.Duration
+		// Flushed is the number of writes flushed to the wrapped backend
+		Flushed uint64
+		// Failures is the number of failed attempts to flush a write
+		Failures uint64
+		// LastError is the error of the last failed attempt, if any
+		LastError error
+	}
+
+	// writeBackOp is a pending write, as recorded in the journal
+	writeBackOp struct {
+		Seq      uint64    `json:"seq"`
+		Op       string    `json:"op"`
+		Path     string    `json:"path"`
+		Time     time.Time `json:"time"`
+		attempts int
+		retryAt  time.Time
+		inFlight bool
+	}
+
+	writeBackState struct {
+		sync.Mutex
+		// flushing serializes the flushes of the worker and of Flush
+		flushing  sync.Mutex
+		queue     []*writeBackOp
+		seq       uint64
+		flushed   uint64
+		failures  uint64
+		lastError error
+		notify    chan struct{}
+		stop      chan struct{}
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+func writeBackName(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func (op *writeBackOp) record() string {
+	return pathutil.Join("queue", writeBackName(op.Seq)+".json")
+}
+
+func (op *writeBackOp) data() string {
+	return pathutil.Join("data", writeBackName(op.Seq))
+}
+
+// NewWriteBackBackend creates a new instance of WriteBackBackend, with its journal in directory
+// The writes left in the journal by a previous instance are flushed by the new one
+func NewWriteBackBackend(backend Backend, directory string) *WriteBackBackend {
+	return NewWriteBackBackendWithRetryInterval(backend, directory, time.Second, 5*time.Minute)
+}
+
+// NewWriteBackBackendWithRetryInterval creates a new instance of WriteBackBackend, retrying a failed write after retryInterval,
+// doubled at every failure up to maxRetryInterval
+func NewWriteBackBackendWithRetryInterval(backend Backend, directory string, retryInterval, maxRetryInterval time.Duration) *WriteBackBackend {
+	b := &WriteBackBackend{
+		Backend:          backend,
+		Journal:          NewLocalFilesystemBackend(directory),
+		retryInterval:    retryInterval,
+		maxRetryInterval: maxRetryInterval,
+		state: &writeBackState{
+			notify: make(chan struct{}, 1),
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		},
+	}
+
+	err := b.createJournal()
+	if err == nil {
+		err = b.load()
+	}
+	if err != nil {
+		panic("Failed to load write-back journal: " + err.Error())
+	}
+
+	go writeBackWorker(b)
+	return b
+}
+
+// createJournal creates the directories of the journal, which are kept even when empty
+func (b WriteBackBackend) createJournal() error {
+	for _, dir := range []string{"queue", "data"} {
+		if err := os.MkdirAll(b.journalPath(dir), 0755); err != nil {
+			return err
+		}
+	}
+	return b.syncJournalDir(".")
+}
+
+// journalPath is the path of a file of the journal on the local filesystem
+func (b WriteBackBackend) journalPath(path string) string {
+	return filepath.Join(b.Journal.RootDirectory, filepath.FromSlash(path))
+}
+
+// writeJournalFile writes a file of the journal and syncs it to the disk
+func (b WriteBackBackend) writeJournalFile(path string, content io.Reader) error {
+	f, err := os.OpenFile(b.journalPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncJournalDir syncs a directory of the journal, so that the files created, renamed or removed in it survive a crash
+func (b WriteBackBackend) syncJournalDir(dir string) error {
+	d, err := os.Open(b.journalPath(dir))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeJournalFile removes a file of the journal, keeping its directory
+func (b WriteBackBackend) removeJournalFile(path string) {
+	os.Remove(b.journalPath(path))
+}
+
+// load reads the queue from the journal, dropping the writes that were not fully recorded
+func (b WriteBackBackend) load() error {
+	records, err := b.Journal.ListObjects("queue")
+	if err != nil {
+		return err
+	}
+	queued := map[string]bool{}
+	for _, record := range records {
+		if !strings.HasSuffix(record.Path, ".json") {
+			b.removeJournalFile(pathutil.Join("queue", record.Path))
+			continue
+		}
+		object, err := b.Journal.GetObject(pathutil.Join("queue", record.Path))
+		if err != nil {
+			return err
+		}
+		op := &writeBackOp{}
+		if err := json.Unmarshal(object.Content, op); err != nil {
+			return fmt.Errorf("%s: %w", record.Path, err)
+		}
+		b.state.queue = append(b.state.queue, op)
+		queued[writeBackName(op.Seq)] = true
+		if op.Seq > b.state.seq {
+			b.state.seq = op.Seq
+		}
+	}
+	sort.Slice(b.state.queue, func(i, j int) bool {
+		return b.state.queue[i].Seq < b.state.queue[j].Seq
+	})
+
+	data, err := b.Journal.ListObjects("data")
+	if err != nil {
+		return err
+	}
+	for _, d := range data {
+		seq, err := strconv.ParseUint(d.Path, 10, 64)
+		if err == nil && seq > b.state.seq {
+			b.state.seq = seq
+		}
+		if !queued[d.Path] {
+			b.removeJournalFile(pathutil.Join("data", d.Path))
+		}
+	}
+	return nil
+}
+
+// Close stops flushing the journal, the pending writes are flushed by the next instance
+func (b WriteBackBackend) Close() {
+	b.state.closeOnce.Do(func() {
+		close(b.state.stop)
+	})
+	<-b.state.done
+}
+
+// Stats returns the state of the queue
+func (b WriteBackBackend) Stats() WriteBackStats {
+	b.state.Lock()
+	defer b.state.Unlock()
+	stats := WriteBackStats{
+		Pending:   len(b.state.queue),
+		Flushed:   b.state.flushed,
+		Failures:  b.state.failures,
+		LastError: b.state.lastError,
+	}
+	if len(b.state.queue) > 0 {
+		stats.Lag = time.Since(b.state.queue[0].Time)
+	}
+	return stats
+}
+
+// Flush tries every pending write once, without waiting for their retry, and returns the first error
+func (b WriteBackBackend) Flush() error {
+	return b.flush(true)
+}
+
+func writeBackWorker(b *WriteBackBackend) {
+	defer close(b.state.done)
+	for {
+		b.flush(false)
+
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if wait, ok := b.nextRetry(); ok {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-b.state.stop:
+			return
+		case <-b.state.notify:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// nextRetry returns the wait until the next retry, if a write is waiting for one
+func (b WriteBackBackend) nextRetry() (time.Duration, bool) {
+	b.state.Lock()
+	defer b.state.Unlock()
+	var next time.Time
+	now := time.Now()
+	for _, op := range b.state.queue {
+		if op.retryAt.After(now) && (next.IsZero() || op.retryAt.Before(next)) {
+			next = op.retryAt
+		}
+	}
+	return next.Sub(now), !next.IsZero()
+}
+
+// flush sends the pending writes in order, a write waiting for a retry holding back the later writes of its path only
+func (b WriteBackBackend) flush(force bool) error {
+	b.state.flushing.Lock()
+	defer b.state.flushing.Unlock()
+
+	var firstErr error
+	blocked := map[string]bool{}
+	for {
+		op := b.next(blocked, force)
+		if op == nil {
+			return firstErr
+		}
+		err := b.apply(op)
+		b.complete(op, err)
+		if err != nil {
+			blocked[op.Path] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
+
+func (b WriteBackBackend) next(blocked map[string]bool, force bool) *writeBackOp {
+	b.state.Lock()
+	defer b.state.Unlock()
+	now := time.Now()
+	for _, op := range b.state.queue {
+		if blocked[op.Path] {
+			continue
+		}
+		if !force && now.Before(op.retryAt) {
+			blocked[op.Path] = true
+			continue
+		}
+		op.inFlight = true
+		return op
+	}
+	return nil
+}
+
+func (b WriteBackBackend) apply(op *writeBackOp) error {
+	switch op.Op {
+	case writeBackPut:
+		stream, err := b.Journal.GetObjectStream(op.data())
+		if isObjectNotFound(err) {
+			// the content is synced before the record, this is a damaged journal and not a write to drop silently
+			return fmt.Errorf("write-back: content of %s is missing from the journal: %w", op.Path, err)
+		}
+		if err != nil {
+			return err
+		}
+		defer stream.Content.Close()
+		return putObjectStream(b.Backend, op.Path, stream.Content)
+	case writeBackDelete:
+		err := b.Backend.DeleteObject(op.Path)
+		if isObjectNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("write-back: unknown operation %q", op.Op)
+}
+
+func (b WriteBackBackend) complete(op *writeBackOp, err error) {
+	b.state.Lock()
+	op.inFlight = false
+	if err != nil {
+		op.attempts++
+		wait := b.retryInterval << uint(op.attempts-1)
+		if wait <= 0 || wait > b.maxRetryInterval {
+			wait = b.maxRetryInterval
+		}
+		op.retryAt = time.Now().Add(wait)
+		b.state.failures++
+		b.state.lastError = err
+		b.state.Unlock()
+		return
+	}
+	b.state.flushed++
+	b.removeLocked(op)
+	b.state.Unlock()
+
+	b.forget(op)
+}
+
+// removeLocked removes an op from the queue, the caller holds the lock
+func (b WriteBackBackend) removeLocked(op *writeBackOp) {
+	for i, queued := range b.state.queue {
+		if queued == op {
+			b.state.queue = append(b.state.queue[:i], b.state.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget removes an op from the journal, the record first and synced so that a crash leaves an orphan content at worst
+func (b WriteBackBackend) forget(op *writeBackOp) {
+	b.removeJournalFile(op.record())
+	if op.Op == writeBackPut {
+		b.syncJournalDir("queue")
+		b.removeJournalFile(op.data())
+	}
+}
+
+// enqueue records a write in the journal, and queues it
+// The content and the record are synced to the disk before the write is acknowledged
+// The pending writes of the same path that are not being flushed are superseded, and dropped
+func (b WriteBackBackend) enqueue(operation string, path string, content io.Reader) error {
+	b.state.Lock()
+	b.state.seq++
+	op := &writeBackOp{
+		Seq:  b.state.seq,
+		Op:   operation,
+		Path: cleanPrefix(path),
+		Time: time.Now(),
+	}
+	b.state.Unlock()
+
+	if operation == writeBackPut {
+		err := b.writeJournalFile(op.data(), content)
+		if err == nil {
+			err = b.syncJournalDir("data")
+		}
+		if err != nil {
+			b.removeJournalFile(op.data())
+			return err
+		}
+	}
+	record, err := json.Marshal(op)
+	if err == nil {
+		// written aside then renamed, so that a crash never leaves a partial record
+		err = b.writeJournalFile(op.record()+".tmp", bytes.NewReader(record))
+	}
+	if err == nil {
+		err = os.Rename(b.journalPath(op.record()+".tmp"), b.journalPath(op.record()))
+	}
+	if err == nil {
+		err = b.syncJournalDir("queue")
+	}
+	if err != nil {
+		b.removeJournalFile(op.record() + ".tmp")
+		b.forget(op)
+		return err
+	}
+
+	var superseded []*writeBackOp
+	b.state.Lock()
+	i := sort.Search(len(b.state.queue), func(i int) bool {
+		return b.state.queue[i].Seq > op.Seq
+	})
+	later := false
+	for _, queued := range b.state.queue[i:] {
+		later = later || queued.Path == op.Path
+	}
+	if later {
+		// a concurrent write of the path was queued first
+		superseded = append(superseded, op)
+	} else {
+		queue := make([]*writeBackOp, 0, len(b.state.queue)+1)
+		for _, queued := range b.state.queue[:i] {
+			if queued.Path == op.Path && !queued.inFlight {
+				superseded = append(superseded, queued)
+				continue
+			}
+			queue = append(queue, queued)
+		}
+		queue = append(queue, op)
+		b.state.queue = append(queue, b.state.queue[i:]...)
+	}
+	b.state.Unlock()
+
+	for _, s := range superseded {
+		b.forget(s)
+	}
+	select {
+	case b.state.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pending returns the last pending write of path, nil if none
+func (b WriteBackBackend) pending(path string) *writeBackOp {
+	path = cleanPrefix(path)
+	b.state.Lock()
+	defer b.state.Unlock()
+	for i := len(b.state.queue) - 1; i >= 0; i-- {
+		if b.state.queue[i].Path == path {
+			op := *b.state.queue[i]
+			return &op
+		}
+	}
+	return nil
+}
+
+// pendingUnder returns the last pending write of every path under prefix, prefix itself excluded
+func (b WriteBackBackend) pendingUnder(prefix string) map[string]*writeBackOp {
+	prefix = cleanPrefix(prefix)
+	ops := map[string]*writeBackOp{}
+	b.state.Lock()
+	defer b.state.Unlock()
+	for _, queued := range b.state.queue {
+		if prefix == "" || strings.HasPrefix(queued.Path, prefix+"/") {
+			op := *queued
+			ops[queued.Path] = &op
+		}
+	}
+	return ops
+}
+
+// ListObjects lists all objects in the wrapped backend, at prefix, with the pending writes applied
+func (b WriteBackBackend) ListObjects(prefix string) ([]Object, error) {
+	objects, err := b.Backend.ListObjects(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	ops := map[string]*writeBackOp{}
+	for path, op := range b.pendingUnder(prefix) {
+		name := removePrefixFromObjectPath(cleanPrefix(prefix), path)
+		if !objectPathIsInvalid(name) {
+			ops[name] = op
+		}
+	}
+	if len(ops) == 0 {
+		return objects, nil
+	}
+
+	listed := objects[:0]
+	for _, object := range objects {
+		if _, ok := ops[object.Path]; !ok {
+			listed = append(listed, object)
+		}
+	}
+	var added []Object
+	for name, op := range ops {
+		if op.Op == writeBackPut {
+			added = append(added, Object{
+				Metadata: Metadata{
+					Path:         name,
+					LastModified: op.Time,
+				},
+				Content: []byte{},
+			})
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].Path < added[j].Path
+	})
+	return append(listed, added...), nil
+}
+
+// writeBackEntry is a member of a directory listing
+type writeBackEntry struct {
+	name         string
+	isDir        bool
+	lastModified time.Time
+}
+
+type writeBackListObjectsFromDirectoryOutput struct {
+	prefix          string
+	limit           int
+	entries         []writeBackEntry
+	filesRead       []Metadata
+	directoriesRead []Metadata
+	nextPageCalled  bool
+	isEOF           bool
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) GetDirectories() []Metadata {
+	return l.directoriesRead
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) GetFiles() []Metadata {
+	return l.filesRead
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) IsTruncated() bool {
+	return !l.isEOF
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) NextPage() (ListObjectsFromDirectoryOutput, error) {
+	if l.nextPageCalled {
+		return nil, errors.New("you cannot call NextPage more than once")
+	}
+
+	r := &writeBackListObjectsFromDirectoryOutput{
+		prefix: l.prefix,
+		limit:  l.limit,
+	}
+
+	if l.isEOF {
+		r.isEOF = true
+		return r, io.EOF
+	}
+
+	r.directoriesRead = make([]Metadata, 0, 5)
+	r.filesRead = make([]Metadata, 0, 5)
+
+	// the merged listing is built at once, pages are sliced from it
+	entries := l.entries
+	if l.limit > 0 && len(entries) > l.limit {
+		r.entries = entries[l.limit:]
+		entries = entries[:l.limit]
+	}
+
+	for _, e := range entries {
+		m := Metadata{
+			Path:         pathutil.Join(l.prefix, e.name),
+			LastModified: e.lastModified,
+		}
+		if e.isDir {
+			r.directoriesRead = append(r.directoriesRead, m)
+		} else {
+			r.filesRead = append(r.filesRead, m)
+		}
+	}
+
+	r.isEOF = len(r.entries) == 0
+
+	var err error
+	if r.isEOF {
+		err = io.EOF
+	}
+
+	l.nextPageCalled = true
+
+	return r, err
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) FreeFromMemory() {
+	l.directoriesRead = nil
+	l.filesRead = nil
+}
+
+func (l *writeBackListObjectsFromDirectoryOutput) Close() {
+	l.FreeFromMemory()
+}
+
+// ListObjectsFromDirectory lists all objects under prefix, always with depth 1, returning at most limit objects (directories + files)
+// It's intent is to abstract a directory listing
+// Make sure prefix is a full path, other cases might give unexpected results
+// If limit <= 0, it will return at most all the objects in 'prefix', limiting only by the backend limits
+// You can know if the response is complete calling output.IsTruncated(), if true then the response isn't complete
+// When writes under prefix are pending, the listing of the wrapped backend is read whole to apply them
+func (b WriteBackBackend) ListObjectsFromDirectory(prefix string, limit int) (ListObjectsFromDirectoryOutput, error) {
+	self := b.pending(prefix)
+	if self != nil && self.Op == writeBackPut && cleanPrefix(prefix) != "" {
+		return nil, ErrPrefixIsAnObject
+	}
+	ops := b.pendingUnder(prefix)
+	if len(ops) == 0 && self == nil {
+		return b.Backend.ListObjectsFromDirectory(prefix, limit)
+	}
+
+	entries := map[string]writeBackEntry{}
+	output, err := b.Backend.ListObjectsFromDirectory(prefix, 0)
+	switch {
+	case err == ErrPrefixIsAnObject && self != nil:
+		// the object is deleted, and the prefix is a directory again
+		output, err = nil, io.EOF
+	case err != nil && err != io.EOF:
+		return nil, err
+	}
+	for output != nil {
+		for _, d := range output.GetDirectories() {
+			name := pathutil.Base(d.Path)
+			entries[name] = writeBackEntry{name: name, isDir: true, lastModified: d.LastModified}
+		}
+		for _, f := range output.GetFiles() {
+			name := pathutil.Base(f.Path)
+			entries[name] = writeBackEntry{name: name, lastModified: f.LastModified}
+		}
+		if err == io.EOF {
+			break
+		}
+		output, err = output.NextPage()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	for path, op := range ops {
+		name := removePrefixFromObjectPath(cleanPrefix(prefix), path)
+		if i := strings.Index(name, "/"); i >= 0 {
+			// a deletion might leave the directory empty, it is listed until flushed
+			if op.Op == writeBackPut {
+				entries[name[:i]] = writeBackEntry{name: name[:i], isDir: true}
+			}
+			continue
+		}
+		if op.Op == writeBackPut {
+			entries[name] = writeBackEntry{name: name, lastModified: op.Time}
+		} else if e, ok := entries[name]; ok && !e.isDir {
+			delete(entries, name)
+		}
+	}
+
+	merged := &writeBackListObjectsFromDirectoryOutput{
+		prefix: prefix,
+		limit:  limit,
+	}
+	for _, e := range entries {
+		merged.entries = append(merged.entries, e)
+	}
+	sort.Slice(merged.entries, func(i, j int) bool {
+		return merged.entries[i].name < merged.entries[j].name
+	})
+	return merged.NextPage()
+}
+
+// RenamePrefixOrObject renames an object or a prefix in the wrapped backend
+// Renames are not queued: the pending writes are flushed first, and the rename fails if some under path or newPath could not be
+func (b WriteBackBackend) RenamePrefixOrObject(path, newPath string) error {
+	err := b.flush(true)
+	for _, p := range []string{path, newPath} {
+		if b.pending(p) != nil || len(b.pendingUnder(p)) > 0 {
+			return fmt.Errorf("write-back: pending writes of %s could not be flushed: %w", p, err)
+		}
+	}
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+// GetObject retrieves an object, from the journal if a write of it is pending, from the wrapped backend otherwise
+func (b WriteBackBackend) GetObject(path string) (Object, error) {
+	if op := b.pending(path); op != nil {
+		if op.Op == writeBackDelete {
+			return Object{Metadata: Metadata{Path: path}}, ErrObjectNotFound
+		}
+		object, err := b.Journal.GetObject(op.data())
+		// the write might have been flushed meanwhile
+		if !isObjectNotFound(err) {
+			object.Path = path
+			object.LastModified = op.Time
+			return object, err
+		}
+	}
+	return b.Backend.GetObject(path)
+}
+
+// PutObject records an object in the journal, it is uploaded to the wrapped backend in the background
+func (b WriteBackBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// DeleteObject records a deletion in the journal, it is applied to the wrapped backend in the background
+func (b WriteBackBackend) DeleteObject(path string) error {
+	return b.enqueue(writeBackDelete, path, nil)
+}
+
+// GetObjectStream retrieves an object stream, from the journal if a write of it is pending, from the wrapped backend otherwise
+func (b WriteBackBackend) GetObjectStream(path string) (*ObjectStream, error) {
+	if op := b.pending(path); op != nil {
+		if op.Op == writeBackDelete {
+			return &ObjectStream{Metadata: Metadata{Path: path}}, ErrObjectNotFound
+		}
+		stream, err := b.Journal.GetObjectStream(op.data())
+		if !isObjectNotFound(err) {
+			stream.Path = path
+			stream.LastModified = op.Time
+			return stream, err
+		}
+	}
+	return getObjectStream(b.Backend, path)
+}
+
+// PutObjectStream records an object stream in the journal, it is uploaded to the wrapped backend in the background
+func (b WriteBackBackend) PutObjectStream(path string, content io.Reader) error {
+	return b.enqueue(writeBackPut, path, content)
+}
+
+func (b WriteBackBackend) HandleHttpFileDownload(w http.ResponseWriter, r *http.Request, path string) {
+	if op := b.pending(path); op != nil {
+		object, err := b.GetObject(path)
+		if err == nil {
+			serveObject(w, r, object, "")
+			return
+		}
+		if err == ErrObjectNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handleHttpFileDownload(b.Backend, w, r, path)
+}
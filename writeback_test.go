@@ -0,0 +1,306 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var errWriteBackOutage = errors.New("outage")
+
+// writeBackFlakyBackend fails the writes of the paths starting with one of its failing prefixes, and records the others
+type writeBackFlakyBackend struct {
+	Backend
+	sync.Mutex
+	failing []string
+	writes  []string
+}
+
+func (b *writeBackFlakyBackend) fail(prefixes ...string) {
+	b.Lock()
+	defer b.Unlock()
+	b.failing = prefixes
+}
+
+func (b *writeBackFlakyBackend) write(op string, path string) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, prefix := range b.failing {
+		if strings.HasPrefix(path, prefix) {
+			return errWriteBackOutage
+		}
+	}
+	b.writes = append(b.writes, op+" "+path)
+	return nil
+}
+
+func (b *writeBackFlakyBackend) PutObject(path string, content []byte) error {
+	if err := b.write("put", path); err != nil {
+		return err
+	}
+	return b.Backend.PutObject(path, content)
+}
+
+func (b *writeBackFlakyBackend) DeleteObject(path string) error {
+	if err := b.write("delete", path); err != nil {
+		return err
+	}
+	return b.Backend.DeleteObject(path)
+}
+
+func (b *writeBackFlakyBackend) RenamePrefixOrObject(path, newPath string) error {
+	if err := b.write("rename", path); err != nil {
+		return err
+	}
+	return b.Backend.RenamePrefixOrObject(path, newPath)
+}
+
+type WriteBackTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Remote        *LocalFilesystemBackend
+	Flaky         *writeBackFlakyBackend
+	WriteBack     *WriteBackBackend
+}
+
+func (suite *WriteBackTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-writeback/%s", timestamp)
+	suite.Remote = NewLocalFilesystemBackend(filepath.Join(suite.TempDirectory, "remote"))
+	suite.Flaky = &writeBackFlakyBackend{Backend: suite.Remote}
+	suite.WriteBack = NewWriteBackBackendWithRetryInterval(suite.Flaky, filepath.Join(suite.TempDirectory, "journal"), 10*time.Millisecond, 20*time.Millisecond)
+}
+
+func (suite *WriteBackTestSuite) TearDownTest() {
+	suite.WriteBack.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *WriteBackTestSuite) remoteContent(path string) string {
+	object, err := suite.Remote.GetObject(path)
+	if err != nil {
+		return ""
+	}
+	return string(object.Content)
+}
+
+func (suite *WriteBackTestSuite) TestWritesAreFlushed() {
+	suite.Nil(suite.WriteBack.PutObject("flushed.txt", []byte("content")), "no error putting object")
+	suite.Eventually(func() bool {
+		return suite.remoteContent("flushed.txt") == "content"
+	}, 5*time.Second, 10*time.Millisecond, "worker uploads the object")
+	suite.Eventually(func() bool {
+		return suite.WriteBack.Stats().Pending == 0
+	}, 5*time.Second, 10*time.Millisecond, "queue is emptied")
+
+	suite.Nil(suite.WriteBack.DeleteObject("flushed.txt"), "no error deleting object")
+	suite.Eventually(func() bool {
+		_, err := suite.Remote.GetObject("flushed.txt")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond, "worker deletes the object")
+
+	records, _ := suite.WriteBack.Journal.ListObjects("queue")
+	suite.Empty(records, "journal is emptied")
+	stats := suite.WriteBack.Stats()
+	suite.Equal(uint64(2), stats.Flushed)
+	suite.Zero(stats.Lag, "no lag when the queue is empty")
+}
+
+func (suite *WriteBackTestSuite) TestOutage() {
+	suite.Flaky.fail("")
+	suite.Nil(suite.WriteBack.PutObject("outage.txt", []byte("v1")), "writes are acknowledged during an outage")
+
+	object, err := suite.WriteBack.GetObject("outage.txt")
+	suite.Nil(err, "pending writes are read from the journal")
+	suite.Equal([]byte("v1"), object.Content)
+	suite.Equal("outage.txt", object.Path)
+	suite.Equal("", suite.remoteContent("outage.txt"))
+
+	suite.Eventually(func() bool {
+		return suite.WriteBack.Stats().Failures >= 2
+	}, 5*time.Second, 10*time.Millisecond, "writes are retried")
+	stats := suite.WriteBack.Stats()
+	suite.Equal(1, stats.Pending)
+	suite.True(stats.Lag > 0, "lag grows")
+	suite.ErrorIs(stats.LastError, errWriteBackOutage)
+	suite.ErrorIs(suite.WriteBack.Flush(), errWriteBackOutage, "flush reports the outage")
+
+	suite.Flaky.fail()
+	suite.Eventually(func() bool {
+		return suite.remoteContent("outage.txt") == "v1"
+	}, 5*time.Second, 10*time.Millisecond, "writes are flushed after the outage")
+}
+
+func (suite *WriteBackTestSuite) TestOrderingPerPath() {
+	suite.Flaky.fail("slow/")
+	suite.Nil(suite.WriteBack.PutObject("slow/a.txt", []byte("v1")))
+	suite.Nil(suite.WriteBack.PutObject("fast.txt", []byte("fast")))
+	suite.ErrorIs(suite.WriteBack.Flush(), errWriteBackOutage)
+	suite.Equal("fast", suite.remoteContent("fast.txt"), "other paths are not held back")
+
+	suite.Nil(suite.WriteBack.PutObject("slow/a.txt", []byte("v2")))
+	suite.Nil(suite.WriteBack.DeleteObject("slow/b.txt"))
+	suite.Nil(suite.WriteBack.PutObject("slow/b.txt", []byte("b")))
+	suite.Equal(2, suite.WriteBack.Stats().Pending, "superseded writes are dropped")
+
+	suite.Flaky.fail()
+	suite.Nil(suite.WriteBack.Flush())
+	suite.Equal("v2", suite.remoteContent("slow/a.txt"), "last write wins")
+	suite.Equal("b", suite.remoteContent("slow/b.txt"))
+	suite.Equal([]string{"put fast.txt", "put slow/a.txt", "put slow/b.txt"}, suite.Flaky.writes)
+}
+
+func (suite *WriteBackTestSuite) TestReadsSeePendingWrites() {
+	for _, path := range []string{"list/a.txt", "list/b.txt", "list/sub/c.txt"} {
+		suite.Nil(suite.Remote.PutObject(path, []byte(path)))
+	}
+	suite.Flaky.fail("")
+	suite.Nil(suite.WriteBack.DeleteObject("list/a.txt"))
+	suite.Nil(suite.WriteBack.PutObject("list/d.txt", []byte("d")))
+	suite.Nil(suite.WriteBack.PutObject("list/new/e.txt", []byte("e")))
+
+	_, err := suite.WriteBack.GetObject("list/a.txt")
+	suite.ErrorIs(err, ErrObjectNotFound, "pending deletes are seen")
+	stream, err := suite.WriteBack.GetObjectStream("list/d.txt")
+	suite.Nil(err)
+	content, _ := ioutil.ReadAll(stream.Content)
+	stream.Content.Close()
+	suite.Equal("d", string(content), "pending puts are streamed")
+
+	objects, err := suite.WriteBack.ListObjects("list")
+	suite.Nil(err)
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Path)
+	}
+	suite.Equal([]string{"b.txt", "d.txt"}, names, "listing applies pending writes")
+
+	output, err := suite.WriteBack.ListObjectsFromDirectory("list", 2)
+	var files, directories []string
+	for {
+		for _, d := range output.GetDirectories() {
+			directories = append(directories, d.Path)
+		}
+		for _, f := range output.GetFiles() {
+			files = append(files, f.Path)
+		}
+		if err == io.EOF {
+			break
+		}
+		suite.Nil(err)
+		output, err = output.NextPage()
+	}
+	suite.Equal([]string{"list/new", "list/sub"}, directories, "directories of pending writes are listed")
+	suite.Equal([]string{"list/b.txt", "list/d.txt"}, files)
+
+	_, err = suite.WriteBack.ListObjectsFromDirectory("list/d.txt", 0)
+	suite.ErrorIs(err, ErrPrefixIsAnObject)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/list/d.txt", nil)
+	suite.WriteBack.HandleHttpFileDownload(w, r, "list/d.txt")
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal("d", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/list/a.txt", nil)
+	suite.WriteBack.HandleHttpFileDownload(w, r, "list/a.txt")
+	suite.Equal(http.StatusNotFound, w.Code, "pending deletes are not served")
+}
+
+func (suite *WriteBackTestSuite) TestJournalSurvivesRestart() {
+	suite.Flaky.fail("")
+	suite.Nil(suite.WriteBack.PutObject("restart/a.txt", []byte("a")))
+	suite.Nil(suite.WriteBack.DeleteObject("restart/b.txt"))
+	suite.WriteBack.Close()
+
+	// leftovers of a crash in the middle of a write
+	suite.Nil(suite.WriteBack.Journal.PutObject("queue/00000000000000000099.json.tmp", []byte("{")))
+	suite.Nil(suite.WriteBack.Journal.PutObject("data/00000000000000000099", []byte("orphan")))
+
+	suite.WriteBack = NewWriteBackBackendWithRetryInterval(suite.Flaky, suite.WriteBack.Journal.RootDirectory, 10*time.Millisecond, 20*time.Millisecond)
+	suite.Equal(2, suite.WriteBack.Stats().Pending, "queue is reloaded")
+	_, err := suite.WriteBack.Journal.GetObject("data/00000000000000000099")
+	suite.NotNil(err, "orphan content is removed")
+	object, err := suite.WriteBack.GetObject("restart/a.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("a"), object.Content)
+
+	suite.Nil(suite.WriteBack.PutObject("restart/c.txt", []byte("c")))
+	suite.Flaky.fail()
+	suite.Nil(suite.WriteBack.Flush())
+	suite.Equal("a", suite.remoteContent("restart/a.txt"))
+	suite.Equal("c", suite.remoteContent("restart/c.txt"), "sequence continues after the orphans")
+	suite.Equal([]string{"put restart/a.txt", "delete restart/b.txt", "put restart/c.txt"}, suite.Flaky.writes, "order is kept across restarts")
+}
+
+func (suite *WriteBackTestSuite) TestMissingContent() {
+	suite.Flaky.fail("")
+	suite.Nil(suite.WriteBack.PutObject("missing/a.txt", []byte("a")))
+	suite.WriteBack.Close()
+	suite.Nil(os.Remove(filepath.Join(suite.WriteBack.Journal.RootDirectory, "data", writeBackName(1))))
+
+	suite.WriteBack = NewWriteBackBackendWithRetryInterval(suite.Flaky, suite.WriteBack.Journal.RootDirectory, 10*time.Millisecond, 20*time.Millisecond)
+	suite.Flaky.fail()
+	suite.NotNil(suite.WriteBack.Flush(), "a write missing its content is an error")
+	stats := suite.WriteBack.Stats()
+	suite.Equal(uint64(0), stats.Flushed, "a write missing its content is not flushed")
+	suite.Equal(1, stats.Pending)
+	suite.NotNil(stats.LastError)
+	suite.Empty(suite.Flaky.writes)
+}
+
+func (suite *WriteBackTestSuite) TestJournalDirectoriesAreKept() {
+	suite.Nil(suite.WriteBack.PutObject("kept/a.txt", []byte("a")))
+	suite.Nil(suite.WriteBack.Flush())
+	suite.Equal(0, suite.WriteBack.Stats().Pending)
+	for _, dir := range []string{"queue", "data"} {
+		info, err := os.Stat(filepath.Join(suite.WriteBack.Journal.RootDirectory, dir))
+		suite.Nil(err, "the %s directory is kept when empty", dir)
+		suite.True(info.IsDir())
+	}
+}
+
+func (suite *WriteBackTestSuite) TestRenamePrefixOrObject() {
+	suite.Flaky.fail("")
+	suite.Nil(suite.WriteBack.PutObject("rename/a.txt", []byte("a")))
+	err := suite.WriteBack.RenamePrefixOrObject("rename", "renamed")
+	suite.ErrorIs(err, errWriteBackOutage, "renames fail while pending writes cannot be flushed")
+
+	suite.Flaky.fail()
+	suite.Nil(suite.WriteBack.RenamePrefixOrObject("rename", "renamed"), "no error renaming prefix")
+	suite.Equal("a", suite.remoteContent("renamed/a.txt"), "pending writes are flushed before renaming")
+	_, err = suite.WriteBack.GetObject("rename/a.txt")
+	suite.NotNil(err)
+}
+
+func TestWriteBackStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(WriteBackTestSuite))
+}